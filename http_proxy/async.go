@@ -0,0 +1,50 @@
+package http_proxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+var ErrSendCanceled = errors.New("send canceled")
+
+// The handle of a send started with SendAsync
+type Future struct {
+	done     chan struct{}
+	cancel   context.CancelCauseFunc
+	response *http.Response
+	err      error
+}
+
+func (requestIntent *proxiedRequestImpl) SendAsync() *Future {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	future := &Future{done: make(chan struct{}), cancel: cancel}
+	go func() {
+		defer close(future.done)
+		defer cancel(nil)
+		future.response, future.err = requestIntent.sendWithParent(ctx)
+	}()
+	return future
+}
+
+// Returns a channel closed when the send completes
+func (future *Future) Done() <-chan struct{} {
+	return future.done
+}
+
+// Waits for the send to complete and returns its outcome. If ctx is done
+// first its error is returned and the send keeps running
+func (future *Future) Wait(ctx context.Context) (*http.Response, error) {
+	select {
+	case <-future.done:
+		return future.response, future.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Aborts the send if it is still running. The outcome of the send reports
+// ErrSendCanceled. It has no effect on completed sends
+func (future *Future) Cancel() {
+	future.cancel(ErrSendCanceled)
+}
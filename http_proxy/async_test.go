@@ -0,0 +1,109 @@
+package http_proxy_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	http_proxy "github.com/AndreaCostanzo1/http-proxy/http_proxy"
+)
+
+func TestSendAsync(t *testing.T) {
+	t.Run("SendAsync completes in the background", func(t *testing.T) {
+		server := slowServer(20 * time.Millisecond)
+		defer server.Close()
+
+		var interceptorCalls int32
+		futures := []*http_proxy.Future{}
+		for i := 0; i < 3; i++ {
+			futures = append(futures, http_proxy.NewRequest("GET", server.URL).
+				WithGenericInterceptor(func(body map[string]interface{}, response *http.Response) error {
+					atomic.AddInt32(&interceptorCalls, 1)
+					return nil
+				}).
+				SendAsync())
+		}
+		for _, future := range futures {
+			resp, err := future.Wait(context.Background())
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("expected status code 200, got %d", resp.StatusCode)
+			}
+			select {
+			case <-future.Done():
+			default:
+				t.Errorf("expected Done to be closed after Wait returned")
+			}
+		}
+		if calls := atomic.LoadInt32(&interceptorCalls); calls != 3 {
+			t.Errorf("expected interceptors to run once per response, got %d", calls)
+		}
+	})
+
+	t.Run("Cancel aborts the underlying request", func(t *testing.T) {
+		server := slowServer(time.Second)
+		defer server.Close()
+
+		interceptorCalled := false
+		start := time.Now()
+		future := http_proxy.NewRequest("GET", server.URL).
+			WithGenericInterceptor(func(body map[string]interface{}, response *http.Response) error {
+				interceptorCalled = true
+				return nil
+			}).
+			SendAsync()
+		time.Sleep(20 * time.Millisecond)
+		future.Cancel()
+		resp, err := future.Wait(context.Background())
+
+		if !errors.Is(err, http_proxy.ErrSendCanceled) {
+			t.Errorf("expected ErrSendCanceled, got %v", err)
+		}
+		if resp != nil {
+			t.Errorf("expected no response, got %v", resp)
+		}
+		if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+			t.Errorf("expected send to be aborted early, took %s", elapsed)
+		}
+		if interceptorCalled {
+			t.Errorf("expected interceptors not to run on canceled sends")
+		}
+	})
+
+	t.Run("Wait returns when its context is done", func(t *testing.T) {
+		server := slowServer(200 * time.Millisecond)
+		defer server.Close()
+
+		future := http_proxy.NewRequest("GET", server.URL).SendAsync()
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		_, waitErr := future.Wait(ctx)
+		resp, err := future.Wait(context.Background())
+
+		if !errors.Is(waitErr, context.DeadlineExceeded) {
+			t.Errorf("expected context.DeadlineExceeded, got %v", waitErr)
+		}
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Errorf("expected the send to complete after the first Wait, got %v", err)
+		}
+	})
+
+	t.Run("Cancel after completion keeps the response", func(t *testing.T) {
+		server := slowServer(0)
+		defer server.Close()
+
+		future := http_proxy.NewRequest("GET", server.URL).SendAsync()
+		<-future.Done()
+		future.Cancel()
+		resp, err := future.Wait(context.Background())
+
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Errorf("expected completed send to be unaffected, got %v", err)
+		}
+	})
+}
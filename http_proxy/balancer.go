@@ -0,0 +1,347 @@
+package http_proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNoTargets           = errors.New("no targets available")
+	ErrUnknownBalancing    = errors.New("unknown balancing strategy")
+	ErrInvalidTargetWeight = errors.New("invalid target weight")
+)
+
+// How a Balancer selects the target of each send
+type BalancingStrategy string
+
+const (
+	// Targets are selected in turn
+	ROUND_ROBIN BalancingStrategy = "RoundRobin"
+	// Targets are selected in turn, proportionally to their weight
+	WEIGHTED_ROUND_ROBIN BalancingStrategy = "WeightedRoundRobin"
+	// The target with the fewest sends in flight is selected
+	LEAST_OUTSTANDING BalancingStrategy = "LeastOutstanding"
+	// Of two random targets, the one with fewer sends in flight is selected
+	RANDOM_TWO_CHOICES BalancingStrategy = "RandomTwoChoices"
+	// Requests with the same key are sent to the same target, and only a
+	// small share of the keys moves when the targets change
+	CONSISTENT_HASH BalancingStrategy = "ConsistentHash"
+)
+
+// Number of points each unit of weight places on the consistent hashing ring
+const CONSISTENT_HASH_REPLICAS = 100
+
+// A base URL a Balancer sends requests to
+type Target struct {
+	URL string
+	// Relative share of the sends for WEIGHTED_ROUND_ROBIN and of the keys
+	// for CONSISTENT_HASH. It defaults to 1
+	Weight int
+}
+
+// Computes the key of a request for CONSISTENT_HASH
+type BalancingKeyFunc = func(request *http.Request) string
+
+// Returns a key function using the values of the provided headers.
+// Without headers the path and query of the request are used
+func BalancingKey(headers ...string) BalancingKeyFunc {
+	return func(request *http.Request) string {
+		if len(headers) == 0 {
+			return request.URL.RequestURI()
+		}
+		values := make([]string, 0, len(headers))
+		for _, name := range headers {
+			values = append(values, strings.Join(request.Header.Values(name), ","))
+		}
+		return strings.Join(values, "\n")
+	}
+}
+
+// Spreads the requests addressed to a logical service name over several
+// base URLs. A request whose host is the service name, e.g. http://users/v1/items
+// for the service users, is sent to the selected target with the target path
+// prepended to its own. It can be shared between requests and reverse proxies
+type Balancer struct {
+	service          string
+	strategy         BalancingStrategy
+	keyFunc          BalancingKeyFunc
+	mutex            sync.Mutex
+	targets          []*balancedTarget
+	next             int
+	ring             []ringPoint
+	outlierDetection *OutlierDetection
+}
+
+type balancedTarget struct {
+	url                 *url.URL
+	weight              int
+	currentWeight       int
+	outstanding         int
+	healthy             bool
+	checkSuccesses      int
+	checkFailures       int
+	lastCheck           time.Time
+	lastCheckErr        error
+	consecutiveFailures int
+	ejections           int
+	ejectedUntil        time.Time
+}
+
+// The target selected for an attempt of a send
+type balancedSend struct {
+	balancer *Balancer
+	target   *balancedTarget
+	once     sync.Once
+}
+
+// Targets selected by the attempts of a send, avoided by its hedged attempts
+type balancedTargets struct {
+	selected []*balancedTarget
+}
+
+type balancedTargetsKey struct{}
+
+type ringPoint struct {
+	hash   uint64
+	target *balancedTarget
+}
+
+// Creates a balancer for the service selecting its targets with strategy
+func NewBalancer(service string, strategy BalancingStrategy, targets ...Target) (*Balancer, error) {
+	switch strategy {
+	case ROUND_ROBIN, WEIGHTED_ROUND_ROBIN, LEAST_OUTSTANDING, RANDOM_TWO_CHOICES, CONSISTENT_HASH:
+	default:
+		return nil, fmt.Errorf("%w %q", ErrUnknownBalancing, strategy)
+	}
+	if len(targets) == 0 {
+		return nil, ErrNoTargets
+	}
+	balancer := &Balancer{service: service, strategy: strategy, keyFunc: BalancingKey()}
+	for _, target := range targets {
+		if urlErr := validateURL(target.URL); urlErr != nil {
+			return nil, urlErr
+		}
+		if target.Weight < 0 {
+			return nil, fmt.Errorf("%w %d for %s", ErrInvalidTargetWeight, target.Weight, target.URL)
+		}
+		targetURL, _ := url.Parse(target.URL)
+		balancer.targets = append(balancer.targets, &balancedTarget{url: targetURL, weight: max(target.Weight, 1), healthy: true})
+	}
+	balancer.ring = hashRing(balancer.targets)
+	return balancer, nil
+}
+
+// Set the function computing the key of the requests for CONSISTENT_HASH.
+// It defaults to BalancingKey()
+func (balancer *Balancer) WithHashKey(keyFunc BalancingKeyFunc) *Balancer {
+	balancer.keyFunc = keyFunc
+	return balancer
+}
+
+func (requestIntent *proxiedRequestImpl) WithBalancer(balancer *Balancer) ProxiedRequest {
+	requestIntent.mutex.Lock()
+	defer requestIntent.mutex.Unlock()
+	requestIntent.options.balancer = balancer
+	return requestIntent
+}
+
+// Marks the context of a send so that its hedged attempts are sent to
+// targets not selected by the previous attempts
+func (balancer *Balancer) sendContext(ctx context.Context) context.Context {
+	if balancer == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, balancedTargetsKey{}, &balancedTargets{})
+}
+
+func (balancer *Balancer) transport(next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &balancingTransport{balancer: balancer, next: next}
+}
+
+// Selects a target for each round trip, so that every hedged attempt of a
+// send is balanced on its own
+type balancingTransport struct {
+	balancer *Balancer
+	next     http.RoundTripper
+}
+
+func (transport *balancingTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	routedRequest, balanced, routeErr := transport.balancer.route(request)
+	if routeErr != nil {
+		return nil, routeErr
+	}
+	if balanced == nil {
+		return transport.next.RoundTrip(request)
+	}
+	response, err := transport.next.RoundTrip(routedRequest)
+	balanced.report(routedRequest.Context(), response, err)
+	if err != nil {
+		balanced.release()
+		return nil, err
+	}
+	response.Body = &countingBody{ReadCloser: response.Body, onDone: func(int64) { balanced.release() }}
+	return response, nil
+}
+
+// Returns a copy of the request addressed to the selected target when it is
+// addressed to the service. It fails with ErrNoTargets when every target is
+// unhealthy or ejected
+func (balancer *Balancer) route(request *http.Request) (*http.Request, *balancedSend, error) {
+	if balancer == nil || !strings.EqualFold(request.URL.Hostname(), balancer.service) {
+		return request, nil, nil
+	}
+	key := ""
+	if balancer.strategy == CONSISTENT_HASH {
+		key = balancer.keyFunc(request)
+	}
+	selected, _ := request.Context().Value(balancedTargetsKey{}).(*balancedTargets)
+	balancer.mutex.Lock()
+	target := balancer.pick(key, time.Now(), selected)
+	if target == nil {
+		balancer.mutex.Unlock()
+		return nil, nil, fmt.Errorf("%w for service %q", ErrNoTargets, balancer.service)
+	}
+	target.outstanding++
+	if selected != nil {
+		selected.selected = append(selected.selected, target)
+	}
+	balancer.mutex.Unlock()
+
+	routedURL, _ := url.Parse(upstreamURL(target.url.String(), request.URL))
+	routedRequest := request.Clone(request.Context())
+	routedRequest.URL = routedURL
+	routedRequest.Host = routedURL.Host
+	return routedRequest, &balancedSend{balancer: balancer, target: target}, nil
+}
+
+// Reports the outcome of the attempt to the outlier detection. Attempts
+// abandoned by the caller or canceled because another hedged attempt won
+// are not held against the target, unlike the ones exceeding the timeouts
+func (send *balancedSend) report(ctx context.Context, response *http.Response, err error) {
+	if ctx.Err() != nil && !errors.Is(context.Cause(ctx), ErrTimeout) {
+		return
+	}
+	send.balancer.recordOutcome(send.target, err != nil || response.StatusCode >= http.StatusInternalServerError)
+}
+
+// Marks the attempt as no longer outstanding
+func (send *balancedSend) release() {
+	send.once.Do(func() {
+		send.balancer.mutex.Lock()
+		defer send.balancer.mutex.Unlock()
+		send.target.outstanding--
+	})
+}
+
+// Selects one of the available targets, or nil if none is available. The
+// targets already selected by the send are chosen only when no other is available
+func (balancer *Balancer) pick(key string, now time.Time, selected *balancedTargets) *balancedTarget {
+	isNotSelected := func(target *balancedTarget) bool {
+		return target.isAvailable(now) && (selected == nil || !slices.Contains(selected.selected, target))
+	}
+	isCandidate := isNotSelected
+	if !slices.ContainsFunc(balancer.targets, isNotSelected) {
+		isCandidate = func(target *balancedTarget) bool { return target.isAvailable(now) }
+	}
+	targets := []*balancedTarget{}
+	for _, target := range balancer.targets {
+		if isCandidate(target) {
+			targets = append(targets, target)
+		}
+	}
+	if len(targets) == 0 {
+		return nil
+	}
+	switch balancer.strategy {
+	case WEIGHTED_ROUND_ROBIN:
+		// Smooth weighted round-robin, which interleaves the targets
+		totalWeight := 0
+		var selected *balancedTarget
+		for _, target := range targets {
+			target.currentWeight += target.weight
+			totalWeight += target.weight
+			if selected == nil || target.currentWeight > selected.currentWeight {
+				selected = target
+			}
+		}
+		selected.currentWeight -= totalWeight
+		return selected
+	case LEAST_OUTSTANDING:
+		// Ties are broken in turn, so that idle targets share the load
+		start := balancer.next % len(targets)
+		balancer.next++
+		selected := targets[start]
+		for offset := 1; offset < len(targets); offset++ {
+			if candidate := targets[(start+offset)%len(targets)]; candidate.outstanding < selected.outstanding {
+				selected = candidate
+			}
+		}
+		return selected
+	case RANDOM_TWO_CHOICES:
+		if len(targets) == 1 {
+			return targets[0]
+		}
+		first := rand.IntN(len(targets))
+		second := rand.IntN(len(targets) - 1)
+		if second >= first {
+			second++
+		}
+		if targets[second].outstanding < targets[first].outstanding {
+			return targets[second]
+		}
+		return targets[first]
+	case CONSISTENT_HASH:
+		// Keys of unavailable targets move to the next available point of the ring
+		hash := hashKey(key)
+		index := sort.Search(len(balancer.ring), func(i int) bool { return balancer.ring[i].hash >= hash })
+		for offset := 0; offset < len(balancer.ring); offset++ {
+			if target := balancer.ring[(index+offset)%len(balancer.ring)].target; isCandidate(target) {
+				return target
+			}
+		}
+		return nil
+	default:
+		selected := targets[balancer.next%len(targets)]
+		balancer.next++
+		return selected
+	}
+}
+
+// Places CONSISTENT_HASH_REPLICAS points per unit of weight of each target on the ring
+func hashRing(targets []*balancedTarget) []ringPoint {
+	ring := []ringPoint{}
+	for _, target := range targets {
+		for replica := 0; replica < target.weight*CONSISTENT_HASH_REPLICAS; replica++ {
+			ring = append(ring, ringPoint{hash: hashKey(fmt.Sprintf("%s#%d", target.url, replica)), target: target})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+	return ring
+}
+
+// Hashes the key with FNV-1a followed by a finalizer spreading similar keys,
+// like the replicas of a target, over the whole ring
+func hashKey(key string) uint64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(key))
+	mixed := hash.Sum64()
+	mixed ^= mixed >> 33
+	mixed *= 0xff51afd7ed558ccd
+	mixed ^= mixed >> 33
+	mixed *= 0xc4ceb9fe1a85ec53
+	mixed ^= mixed >> 33
+	return mixed
+}
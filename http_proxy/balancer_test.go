@@ -0,0 +1,244 @@
+package http_proxy_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	http_proxy "github.com/AndreaCostanzo1/http-proxy/http_proxy"
+)
+
+// Starts servers answering with their name and the path they received
+func namedServers(t *testing.T, names ...string) ([]http_proxy.Target, func()) {
+	targets := []http_proxy.Target{}
+	servers := []*httptest.Server{}
+	for _, name := range names {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name + " " + r.URL.RequestURI()))
+		}))
+		servers = append(servers, server)
+		targets = append(targets, http_proxy.Target{URL: server.URL + "/" + name})
+	}
+	return targets, func() {
+		for _, server := range servers {
+			server.Close()
+		}
+	}
+}
+
+func newBalancer(t *testing.T, strategy http_proxy.BalancingStrategy, targets ...http_proxy.Target) *http_proxy.Balancer {
+	t.Helper()
+	balancer, err := http_proxy.NewBalancer("users", strategy, targets...)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	return balancer
+}
+
+func TestBalancer(t *testing.T) {
+	t.Run("Round robin selects the targets in turn", func(t *testing.T) {
+		targets, closeAll := namedServers(t, "a", "b", "c")
+		defer closeAll()
+		balancer := newBalancer(t, http_proxy.ROUND_ROBIN, targets...)
+
+		received := []string{}
+		for i := 0; i < 4; i++ {
+			_, body := sendAndRead(t, http_proxy.NewRequest("GET", "http://users/items?page=1").WithBalancer(balancer))
+			received = append(received, body)
+		}
+
+		expected := []string{"a /a/items?page=1", "b /b/items?page=1", "c /c/items?page=1", "a /a/items?page=1"}
+		if fmt.Sprint(received) != fmt.Sprint(expected) {
+			t.Errorf("expected %v, got %v", expected, received)
+		}
+	})
+
+	t.Run("Weighted round robin follows the weights", func(t *testing.T) {
+		targets, closeAll := namedServers(t, "a", "b")
+		defer closeAll()
+		targets[0].Weight = 3
+		balancer := newBalancer(t, http_proxy.WEIGHTED_ROUND_ROBIN, targets...)
+
+		received := []string{}
+		for i := 0; i < 8; i++ {
+			_, body := sendAndRead(t, http_proxy.NewRequest("GET", "http://users").WithBalancer(balancer))
+			received = append(received, body[:1])
+		}
+
+		expected := []string{"a", "a", "b", "a", "a", "a", "b", "a"}
+		if fmt.Sprint(received) != fmt.Sprint(expected) {
+			t.Errorf("expected %v, got %v", expected, received)
+		}
+	})
+
+	for _, strategy := range []http_proxy.BalancingStrategy{http_proxy.LEAST_OUTSTANDING, http_proxy.RANDOM_TWO_CHOICES} {
+		t.Run(string(strategy)+" avoids busy targets", func(t *testing.T) {
+			release := make(chan struct{})
+			arrived := make(chan struct{}, 1)
+			busy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				arrived <- struct{}{}
+				<-release
+				w.Write([]byte("busy"))
+			}))
+			defer busy.Close()
+			defer close(release)
+			idle := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("idle"))
+			}))
+			defer idle.Close()
+			balancer := newBalancer(t, strategy, http_proxy.Target{URL: busy.URL}, http_proxy.Target{URL: idle.URL})
+
+			// Keep sending until a send is held by the busy target
+			for isBusy := false; !isBusy; {
+				future := http_proxy.NewRequest("GET", "http://users").WithBalancer(balancer).SendAsync()
+				select {
+				case <-arrived:
+					isBusy = true
+				case <-future.Done():
+					resp, _ := future.Wait(context.Background())
+					resp.Body.Close()
+				}
+			}
+
+			for i := 0; i < 5; i++ {
+				if _, body := sendAndRead(t, http_proxy.NewRequest("GET", "http://users").WithBalancer(balancer)); body != "idle" {
+					t.Errorf("expected the idle target, got %q", body)
+				}
+			}
+		})
+	}
+
+	t.Run("Sends with interceptors are no longer outstanding once their body is closed", func(t *testing.T) {
+		// Bodies longer than what the interceptors parse are left to the caller
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(strings.Repeat("not json ", 1000)))
+		}))
+		defer server.Close()
+		balancer := newBalancer(t, http_proxy.LEAST_OUTSTANDING, http_proxy.Target{URL: server.URL})
+
+		for i := 0; i < 3; i++ {
+			sendAndRead(t, http_proxy.NewRequest("GET", "http://users").
+				WithBalancer(balancer).
+				WithGenericInterceptor(func(parsedBody map[string]interface{}, response *http.Response) error {
+					return nil
+				}))
+		}
+
+		for _, health := range balancer.Health() {
+			if health.Outstanding != 0 {
+				t.Errorf("expected no outstanding sends, got %+v", health)
+			}
+		}
+	})
+
+	t.Run("Consistent hashing keeps keys on the same target", func(t *testing.T) {
+		targets, closeAll := namedServers(t, "a", "b", "c")
+		defer closeAll()
+		balancer := newBalancer(t, http_proxy.CONSISTENT_HASH, targets...).WithHashKey(http_proxy.BalancingKey("X-User"))
+
+		assigned := map[string]string{}
+		used := map[string]bool{}
+		for round := 0; round < 2; round++ {
+			for user := 0; user < 30; user++ {
+				key := fmt.Sprint("user-", user)
+				_, body := sendAndRead(t, http_proxy.NewRequest("GET", "http://users").WithBalancer(balancer).SetHeader("X-User", key))
+				if previous, isFound := assigned[key]; isFound && previous != body {
+					t.Errorf("expected %s to stay on %q, got %q", key, previous, body)
+				}
+				assigned[key] = body
+				used[body] = true
+			}
+		}
+		if len(used) != 3 {
+			t.Errorf("expected the keys to be spread over 3 targets, got %v", used)
+		}
+	})
+
+	for _, strategy := range []http_proxy.BalancingStrategy{http_proxy.ROUND_ROBIN, http_proxy.LEAST_OUTSTANDING, http_proxy.CONSISTENT_HASH} {
+		t.Run(string(strategy)+" sends hedged attempts to other targets", func(t *testing.T) {
+			slow := slowServer(time.Second)
+			defer slow.Close()
+			targets, closeAll := namedServers(t, "fast")
+			defer closeAll()
+			balancer := newBalancer(t, strategy, http_proxy.Target{URL: slow.URL}, targets[0])
+
+			for i := 0; i < 4; i++ {
+				start := time.Now()
+				_, body := sendAndRead(t, http_proxy.NewRequest("GET", fmt.Sprintf("http://users/items/%d", i)).
+					WithBalancer(balancer).
+					WithHedging(http_proxy.HedgingPolicy{Delay: 20 * time.Millisecond}))
+
+				if expected := fmt.Sprintf("fast /fast/items/%d", i); body != expected {
+					t.Errorf("expected body %q, got %q", expected, body)
+				}
+				if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+					t.Errorf("expected the hedged attempt to answer quickly, got %s", elapsed)
+				}
+			}
+		})
+	}
+
+	t.Run("Requests to other hosts are not balanced", func(t *testing.T) {
+		targets, closeAll := namedServers(t, "a")
+		defer closeAll()
+		direct := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("direct"))
+		}))
+		defer direct.Close()
+		balancer := newBalancer(t, http_proxy.ROUND_ROBIN, targets...)
+
+		if _, body := sendAndRead(t, http_proxy.NewRequest("GET", direct.URL).WithBalancer(balancer)); body != "direct" {
+			t.Errorf("expected body %q, got %q", "direct", body)
+		}
+	})
+
+	t.Run("Reverse proxies balance the forwarded requests", func(t *testing.T) {
+		targets, closeAll := namedServers(t, "a", "b")
+		defer closeAll()
+		balancer := newBalancer(t, http_proxy.ROUND_ROBIN, targets...)
+		proxy := proxyServer(http_proxy.NewRequest("GET", "http://users/api").WithBalancer(balancer))
+		defer proxy.Close()
+
+		received := []string{}
+		for i := 0; i < 2; i++ {
+			resp, err := http.Get(proxy.URL + "/items")
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			received = append(received, string(body))
+		}
+
+		expected := []string{"a /a/api/items", "b /b/api/items"}
+		if fmt.Sprint(received) != fmt.Sprint(expected) {
+			t.Errorf("expected %v, got %v", expected, received)
+		}
+	})
+
+	t.Run("Invalid configurations are rejected", func(t *testing.T) {
+		cases := map[string]struct {
+			strategy http_proxy.BalancingStrategy
+			targets  []http_proxy.Target
+			expected error
+		}{
+			"no targets":       {http_proxy.ROUND_ROBIN, nil, http_proxy.ErrNoTargets},
+			"unknown strategy": {"Fastest", []http_proxy.Target{{URL: "http://a"}}, http_proxy.ErrUnknownBalancing},
+			"invalid url":      {http_proxy.ROUND_ROBIN, []http_proxy.Target{{URL: "/relative"}}, http_proxy.ErrInvalidURL},
+			"negative weight":  {http_proxy.ROUND_ROBIN, []http_proxy.Target{{URL: "http://a", Weight: -1}}, http_proxy.ErrInvalidTargetWeight},
+		}
+		for name, testCase := range cases {
+			t.Run(name, func(t *testing.T) {
+				if _, err := http_proxy.NewBalancer("users", testCase.strategy, testCase.targets...); !errors.Is(err, testCase.expected) {
+					t.Errorf("expected error %v, got %v", testCase.expected, err)
+				}
+			})
+		}
+	})
+}
@@ -0,0 +1,166 @@
+package http_proxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+// Default number of requests sent at the same time by SendAll
+const DEFAULT_BATCH_CONCURRENCY = 10
+
+var ErrBatchAborted = errors.New("batch aborted before the request was sent")
+
+type BatchOptions struct {
+	// Maximum number of requests in flight. It defaults to DEFAULT_BATCH_CONCURRENCY
+	Concurrency int
+	// Maximum number of requests in flight towards the same host. Zero means no limit
+	PerHostConcurrency int
+	// Stops the batch at the first failed request, canceling the ones in flight
+	FailFast bool
+	// Invoked after each request completes. Calls are never concurrent
+	OnProgress func(progress BatchProgress)
+}
+
+// The outcome of a request sent by SendAll
+type BatchResult struct {
+	Index    int
+	Request  ProxiedRequest
+	Response *http.Response
+	Err      error
+}
+
+type BatchProgress struct {
+	Completed int
+	Total     int
+	Result    BatchResult
+}
+
+// Sends the requests in parallel with bounded concurrency. Results are
+// returned in the same order as the requests, and the returned error joins
+// the errors of the failed requests. With FailFast only the first error is
+// returned and the requests not yet completed fail with ErrBatchAborted or
+// with the cancellation error
+func SendAll(ctx context.Context, requests []ProxiedRequest, options BatchOptions) ([]BatchResult, error) {
+	batchCtx, abort := context.WithCancelCause(ctx)
+	defer abort(nil)
+	concurrency := options.Concurrency
+	if concurrency < 1 {
+		concurrency = DEFAULT_BATCH_CONCURRENCY
+	}
+	slots := make(chan struct{}, concurrency)
+	hostSlots := newHostSemaphores(options.PerHostConcurrency)
+
+	results := make([]BatchResult, len(requests))
+	var progressMutex sync.Mutex
+	completed := 0
+	var firstErr error
+	var wg sync.WaitGroup
+	for index, request := range requests {
+		wg.Add(1)
+		go func(index int, request ProxiedRequest) {
+			defer wg.Done()
+			result := BatchResult{Index: index, Request: request}
+			result.Response, result.Err = sendInBatch(batchCtx, request, slots, hostSlots)
+
+			progressMutex.Lock()
+			defer progressMutex.Unlock()
+			results[index] = result
+			completed++
+			if result.Err != nil && options.FailFast && firstErr == nil {
+				firstErr = result.Err
+				abort(ErrBatchAborted)
+			}
+			if options.OnProgress != nil {
+				options.OnProgress(BatchProgress{Completed: completed, Total: len(requests), Result: result})
+			}
+		}(index, request)
+	}
+	wg.Wait()
+
+	if options.FailFast {
+		return results, firstErr
+	}
+	errs := []error{}
+	for _, result := range results {
+		if result.Err != nil {
+			errs = append(errs, result.Err)
+		}
+	}
+	return results, errors.Join(errs...)
+}
+
+func sendInBatch(ctx context.Context, request ProxiedRequest, slots chan struct{}, hostSlots *hostSemaphores) (*http.Response, error) {
+	releaseHost, acquireErr := hostSlots.acquire(ctx, batchHost(request))
+	if acquireErr != nil {
+		return nil, acquireErr
+	}
+	defer releaseHost()
+	select {
+	case slots <- struct{}{}:
+		defer func() { <-slots }()
+	case <-ctx.Done():
+		return nil, context.Cause(ctx)
+	}
+	if ctx.Err() != nil {
+		return nil, context.Cause(ctx)
+	}
+	requestIntent, isProxiedRequest := request.(*proxiedRequestImpl)
+	if !isProxiedRequest {
+		// Other implementations can't be aborted once they are sent
+		return request.Send()
+	}
+	return requestIntent.sendWithParent(ctx)
+}
+
+// Returns the host the request is sent to, used for PerHostConcurrency
+func batchHost(request ProxiedRequest) string {
+	if requestIntent, isProxiedRequest := request.(*proxiedRequestImpl); isProxiedRequest {
+		return requestIntent.host()
+	}
+	if underlyingRequest, requestErr := request.UnderlyingRequest(); requestErr == nil {
+		return underlyingRequest.URL.Host
+	}
+	return ""
+}
+
+func (requestIntent *proxiedRequestImpl) host() string {
+	requestIntent.mutex.Lock()
+	defer requestIntent.mutex.Unlock()
+	if parsedURL, parseErr := url.Parse(requestIntent.url); parseErr == nil {
+		return parsedURL.Host
+	}
+	return ""
+}
+
+// Limits the number of concurrent requests per host
+type hostSemaphores struct {
+	limit int
+	mutex sync.Mutex
+	slots map[string]chan struct{}
+}
+
+func newHostSemaphores(limit int) *hostSemaphores {
+	return &hostSemaphores{limit: limit, slots: map[string]chan struct{}{}}
+}
+
+func (semaphores *hostSemaphores) acquire(ctx context.Context, host string) (func(), error) {
+	if semaphores.limit < 1 {
+		return func() {}, nil
+	}
+	semaphores.mutex.Lock()
+	slots, isFound := semaphores.slots[host]
+	if !isFound {
+		slots = make(chan struct{}, semaphores.limit)
+		semaphores.slots[host] = slots
+	}
+	semaphores.mutex.Unlock()
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, nil
+	case <-ctx.Done():
+		return nil, context.Cause(ctx)
+	}
+}
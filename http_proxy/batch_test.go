@@ -0,0 +1,211 @@
+package http_proxy_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	http_proxy "github.com/AndreaCostanzo1/http-proxy/http_proxy"
+)
+
+// Tracks the maximum number of requests served at the same time
+func concurrencyTrackingServer(inFlight *int32, maxInFlight *int32, delay time.Duration) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current := atomic.AddInt32(inFlight, 1)
+		defer atomic.AddInt32(inFlight, -1)
+		for {
+			observed := atomic.LoadInt32(maxInFlight)
+			if current <= observed || atomic.CompareAndSwapInt32(maxInFlight, observed, current) {
+				break
+			}
+		}
+		time.Sleep(delay)
+		if r.URL.Query().Get("fail") != "" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("X-Echo-Query", r.URL.RawQuery)
+		w.WriteHeader(http.StatusOK)
+	}))
+}
+
+// A ProxiedRequest implemented outside of the package
+type wrappedRequest struct {
+	http_proxy.ProxiedRequest
+}
+
+func failOn500(body map[string]interface{}, response *http.Response) error {
+	return errors.New(response.Status)
+}
+
+func TestSendAll(t *testing.T) {
+	t.Run("SendAll returns ordered results with bounded concurrency", func(t *testing.T) {
+		var inFlight, maxInFlight int32
+		server := concurrencyTrackingServer(&inFlight, &maxInFlight, 20*time.Millisecond)
+		defer server.Close()
+
+		requests := []http_proxy.ProxiedRequest{}
+		for i := 0; i < 12; i++ {
+			requests = append(requests, http_proxy.NewRequest("GET", fmt.Sprintf("%s?index=%d", server.URL, i)))
+		}
+		progressCalls := 0
+		results, err := http_proxy.SendAll(context.Background(), requests, http_proxy.BatchOptions{
+			Concurrency: 3,
+			OnProgress: func(progress http_proxy.BatchProgress) {
+				progressCalls++
+				if progress.Completed != progressCalls || progress.Total != len(requests) {
+					t.Errorf("expected progress %d/%d, got %d/%d", progressCalls, len(requests), progress.Completed, progress.Total)
+				}
+			},
+		})
+
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		for i, result := range results {
+			if result.Index != i || result.Request != requests[i] {
+				t.Errorf("expected result %d to be paired with its request", i)
+			}
+			if query := result.Response.Header.Get("X-Echo-Query"); query != fmt.Sprintf("index=%d", i) {
+				t.Errorf("expected response for index=%d, got %s", i, query)
+			}
+		}
+		if max := atomic.LoadInt32(&maxInFlight); max > 3 {
+			t.Errorf("expected at most 3 requests in flight, got %d", max)
+		}
+		if progressCalls != len(requests) {
+			t.Errorf("expected %d progress calls, got %d", len(requests), progressCalls)
+		}
+	})
+
+	t.Run("SendAll limits the requests in flight per host", func(t *testing.T) {
+		var inFlight, maxInFlight, otherInFlight, otherMaxInFlight int32
+		server := concurrencyTrackingServer(&inFlight, &maxInFlight, 20*time.Millisecond)
+		defer server.Close()
+		otherServer := concurrencyTrackingServer(&otherInFlight, &otherMaxInFlight, 20*time.Millisecond)
+		defer otherServer.Close()
+
+		requests := []http_proxy.ProxiedRequest{}
+		for i := 0; i < 6; i++ {
+			requests = append(requests, http_proxy.NewRequest("GET", server.URL), http_proxy.NewRequest("GET", otherServer.URL))
+		}
+		_, err := http_proxy.SendAll(context.Background(), requests, http_proxy.BatchOptions{Concurrency: 10, PerHostConcurrency: 2})
+
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if max := atomic.LoadInt32(&maxInFlight); max > 2 {
+			t.Errorf("expected at most 2 requests in flight per host, got %d", max)
+		}
+		if max := atomic.LoadInt32(&otherMaxInFlight); max > 2 {
+			t.Errorf("expected at most 2 requests in flight per host, got %d", max)
+		}
+	})
+
+	t.Run("SendAll collects all the errors", func(t *testing.T) {
+		var inFlight, maxInFlight int32
+		server := concurrencyTrackingServer(&inFlight, &maxInFlight, 0)
+		defer server.Close()
+
+		requests := []http_proxy.ProxiedRequest{
+			http_proxy.NewRequest("GET", server.URL+"?fail=1").WithStatusCodeInterceptor(http.StatusInternalServerError, failOn500),
+			http_proxy.NewRequest("GET", server.URL),
+			http_proxy.NewRequest("GET", server.URL+"?fail=2").WithStatusCodeInterceptor(http.StatusInternalServerError, failOn500),
+		}
+		results, err := http_proxy.SendAll(context.Background(), requests, http_proxy.BatchOptions{})
+
+		if err == nil {
+			t.Fatalf("expected an error, got none")
+		}
+		if results[0].Err == nil || results[1].Err != nil || results[2].Err == nil {
+			t.Errorf("expected only the failing requests to report errors, got %v", results)
+		}
+	})
+
+	t.Run("SendAll fails fast", func(t *testing.T) {
+		// Healthy requests are held until they are canceled, so the failing
+		// one always completes first whatever the order the requests start in
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Query().Get("fail") != "" {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			select {
+			case <-r.Context().Done():
+			case <-time.After(time.Second):
+			}
+		}))
+		defer server.Close()
+
+		requests := []http_proxy.ProxiedRequest{
+			http_proxy.NewRequest("GET", server.URL+"?fail=1").WithStatusCodeInterceptor(http.StatusInternalServerError, failOn500),
+		}
+		for i := 0; i < 5; i++ {
+			requests = append(requests, http_proxy.NewRequest("GET", server.URL))
+		}
+		start := time.Now()
+		results, err := http_proxy.SendAll(context.Background(), requests, http_proxy.BatchOptions{Concurrency: len(requests), FailFast: true})
+
+		if err == nil || err.Error() != "500 Internal Server Error" {
+			t.Errorf("expected first error '500 Internal Server Error', got %v", err)
+		}
+		if results[0].Err == nil || errors.Is(results[0].Err, http_proxy.ErrBatchAborted) {
+			t.Errorf("expected the failing request to report its own error, got %v", results[0].Err)
+		}
+		for _, result := range results[1:] {
+			if !errors.Is(result.Err, http_proxy.ErrBatchAborted) {
+				t.Errorf("expected the healthy requests to be aborted, got %v", result.Err)
+			}
+		}
+		if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+			t.Errorf("expected the batch to stop at the first error, took %s", elapsed)
+		}
+	})
+
+	t.Run("SendAll honors the context cancellation", func(t *testing.T) {
+		var inFlight, maxInFlight int32
+		server := concurrencyTrackingServer(&inFlight, &maxInFlight, time.Second)
+		defer server.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		results, err := http_proxy.SendAll(ctx, []http_proxy.ProxiedRequest{http_proxy.NewRequest("GET", server.URL)}, http_proxy.BatchOptions{})
+
+		if !errors.Is(err, context.DeadlineExceeded) || !errors.Is(results[0].Err, context.DeadlineExceeded) {
+			t.Errorf("expected context.DeadlineExceeded, got %v", err)
+		}
+		if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+			t.Errorf("expected batch to stop early, took %s", elapsed)
+		}
+	})
+
+	t.Run("SendAll bounds and aborts other implementations of ProxiedRequest", func(t *testing.T) {
+		var inFlight, maxInFlight int32
+		server := concurrencyTrackingServer(&inFlight, &maxInFlight, 20*time.Millisecond)
+		defer server.Close()
+
+		requests := []http_proxy.ProxiedRequest{}
+		for i := 0; i < 4; i++ {
+			requests = append(requests, wrappedRequest{http_proxy.NewRequest("GET", server.URL)})
+		}
+		if _, err := http_proxy.SendAll(context.Background(), requests, http_proxy.BatchOptions{PerHostConcurrency: 1}); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if max := atomic.LoadInt32(&maxInFlight); max != 1 {
+			t.Errorf("expected 1 request in flight per host, got %d", max)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		results, _ := http_proxy.SendAll(ctx, []http_proxy.ProxiedRequest{wrappedRequest{http_proxy.NewRequest("GET", server.URL)}}, http_proxy.BatchOptions{})
+		if !errors.Is(results[0].Err, context.Canceled) || results[0].Response != nil {
+			t.Errorf("expected the request not to be sent, got %v", results[0].Err)
+		}
+	})
+}
@@ -3,21 +3,250 @@ package http_proxy
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"net/http"
+	"sync"
 )
 
+// Maximum number of bytes buffered in memory to make a non-seekable body replayable
+const DEFAULT_BODY_BUFFER_LIMIT int64 = 10 << 20
+
+var ErrBodyNotReplayable = errors.New("request body can't be replayed")
+
+type bodyFactory = func() (io.Reader, error)
+
 func (requestIntent *proxiedRequestImpl) SetBody(body io.Reader) ProxiedRequest {
-	requestIntent.verifyUnderlyingRequestNotGenerated()
+	requestIntent.mutex.Lock()
+	defer requestIntent.mutex.Unlock()
+	requestIntent.setBody("SetBody", body)
+	return requestIntent
+}
+
+func (requestIntent *proxiedRequestImpl) setBody(call string, body io.Reader) {
+	requestIntent.verifyUnderlyingRequestNotGenerated(call)
 	requestIntent.body = body
+	requestIntent.bodyFactory = nil
+	requestIntent.replayableBody = nil
+}
+
+func (requestIntent *proxiedRequestImpl) SetBodyFactory(factory func() (io.Reader, error)) ProxiedRequest {
+	requestIntent.mutex.Lock()
+	defer requestIntent.mutex.Unlock()
+	requestIntent.verifyUnderlyingRequestNotGenerated("SetBodyFactory")
+	requestIntent.body = nil
+	requestIntent.bodyFactory = factory
+	requestIntent.replayableBody = nil
 	return requestIntent
 }
 
 func (requestIntent *proxiedRequestImpl) SetJSONBody(body any) ProxiedRequest {
-	requestIntent.verifyUnderlyingRequestNotGenerated()
+	requestIntent.mutex.Lock()
+	defer requestIntent.mutex.Unlock()
+	requestIntent.verifyUnderlyingRequestNotGenerated("SetJSONBody")
 	payload, marshalErr := json.Marshal(body)
-	requestIntent.requestError = marshalErr
 	if marshalErr != nil {
+		requestIntent.recordError("SetJSONBody", marshalErr)
 		return requestIntent
 	}
-	return requestIntent.SetBody(bytes.NewBuffer(payload)).SetHeader("Content-Type", "application/json")
+	requestIntent.setBody("SetJSONBody", bytes.NewBuffer(payload))
+	requestIntent.setHeader("SetJSONBody", "Content-Type", "application/json")
+	return requestIntent
+}
+
+func (requestIntent *proxiedRequestImpl) WithBodyBufferLimit(limit int64) ProxiedRequest {
+	requestIntent.mutex.Lock()
+	defer requestIntent.mutex.Unlock()
+	requestIntent.verifyUnderlyingRequestNotGenerated("WithBodyBufferLimit")
+	requestIntent.bodyBufferLimit = limit
+	requestIntent.replayableBody = nil
+	return requestIntent
+}
+
+// A body that can be opened once per send. When replayable is false
+// only the first call to open succeeds
+type replayableBody struct {
+	open          func() (io.ReadCloser, error)
+	contentLength int64
+	replayable    bool
+}
+
+func newReplayableBody(body io.Reader, factory bodyFactory, bufferLimit int64) (*replayableBody, error) {
+	if factory != nil {
+		return &replayableBody{open: openFromFactory(factory), contentLength: -1, replayable: true}, nil
+	}
+	switch typedBody := body.(type) {
+	case nil:
+		return emptyBody(), nil
+	case *bytes.Buffer:
+		return bytesBody(typedBody.Bytes()), nil
+	case readSeekerAt:
+		return sectionBody(typedBody)
+	case io.ReadSeeker:
+		return seekerBody(typedBody, bufferLimit)
+	}
+	if body == http.NoBody {
+		return emptyBody(), nil
+	}
+	buffered, readErr := io.ReadAll(io.LimitReader(body, bufferLimit+1))
+	if readErr != nil {
+		return nil, readErr
+	}
+	if int64(len(buffered)) <= bufferLimit {
+		return bytesBody(buffered), nil
+	}
+	return oneShotBody(io.MultiReader(bytes.NewReader(buffered), body)), nil
+}
+
+type readSeekerAt interface {
+	io.ReaderAt
+	io.ReadSeeker
+}
+
+func emptyBody() *replayableBody {
+	return &replayableBody{
+		open:       func() (io.ReadCloser, error) { return http.NoBody, nil },
+		replayable: true,
+	}
+}
+
+func bytesBody(payload []byte) *replayableBody {
+	if len(payload) == 0 {
+		return emptyBody()
+	}
+	return &replayableBody{
+		open:          func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(payload)), nil },
+		contentLength: int64(len(payload)),
+		replayable:    true,
+	}
+}
+
+func sectionBody(body readSeekerAt) (*replayableBody, error) {
+	start, end, seekErr := seekBounds(body)
+	if seekErr != nil {
+		return nil, seekErr
+	}
+	if start >= end {
+		return emptyBody(), nil
+	}
+	return &replayableBody{
+		open: func() (io.ReadCloser, error) {
+			return io.NopCloser(io.NewSectionReader(body, start, end-start)), nil
+		},
+		contentLength: end - start,
+		replayable:    true,
+	}, nil
+}
+
+// Buffers the body when it fits in bufferLimit. Bigger bodies share the
+// cursor of the seeker, so they can be read by one send at a time
+func seekerBody(body io.ReadSeeker, bufferLimit int64) (*replayableBody, error) {
+	start, end, seekErr := seekBounds(body)
+	if seekErr != nil {
+		return nil, seekErr
+	}
+	if end-start <= bufferLimit {
+		buffered := make([]byte, end-start)
+		if _, readErr := io.ReadFull(body, buffered); readErr != nil {
+			return nil, readErr
+		}
+		if _, seekErr := body.Seek(start, io.SeekStart); seekErr != nil {
+			return nil, seekErr
+		}
+		return bytesBody(buffered), nil
+	}
+	var mutex sync.Mutex
+	isOpen := false
+	release := func() {
+		mutex.Lock()
+		defer mutex.Unlock()
+		isOpen = false
+	}
+	return &replayableBody{
+		open: func() (io.ReadCloser, error) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			if isOpen {
+				return nil, fmt.Errorf("%w: it is being read by another send", ErrBodyNotReplayable)
+			}
+			if _, seekErr := body.Seek(start, io.SeekStart); seekErr != nil {
+				return nil, seekErr
+			}
+			isOpen = true
+			return &releasingBody{Reader: io.LimitReader(body, end-start), release: release}, nil
+		},
+		contentLength: end - start,
+		replayable:    true,
+	}, nil
+}
+
+// Releases the seeker shared by the sends when it is closed
+type releasingBody struct {
+	io.Reader
+	once    sync.Once
+	release func()
+}
+
+func (body *releasingBody) Close() error {
+	body.once.Do(body.release)
+	return nil
+}
+
+func seekBounds(body io.Seeker) (int64, int64, error) {
+	start, seekErr := body.Seek(0, io.SeekCurrent)
+	if seekErr != nil {
+		return 0, 0, seekErr
+	}
+	end, seekErr := body.Seek(0, io.SeekEnd)
+	if seekErr != nil {
+		return 0, 0, seekErr
+	}
+	_, seekErr = body.Seek(start, io.SeekStart)
+	return start, end, seekErr
+}
+
+func oneShotBody(body io.Reader) *replayableBody {
+	var once sync.Once
+	return &replayableBody{
+		open: func() (io.ReadCloser, error) {
+			var readCloser io.ReadCloser
+			once.Do(func() { readCloser = io.NopCloser(body) })
+			if readCloser == nil {
+				return nil, ErrBodyNotReplayable
+			}
+			return readCloser, nil
+		},
+		contentLength: -1,
+	}
+}
+
+func openFromFactory(factory bodyFactory) func() (io.ReadCloser, error) {
+	return func() (io.ReadCloser, error) {
+		body, factoryErr := factory()
+		if factoryErr != nil {
+			return nil, factoryErr
+		}
+		if readCloser, isReadCloser := body.(io.ReadCloser); isReadCloser {
+			return readCloser, nil
+		}
+		return io.NopCloser(body), nil
+	}
+}
+
+// Attaches the body to the request, setting GetBody only if the body can be replayed
+func (body *replayableBody) applyTo(request *http.Request) error {
+	readCloser, openErr := body.open()
+	if openErr != nil {
+		return openErr
+	}
+	request.Body = readCloser
+	request.GetBody = nil
+	if body.replayable {
+		request.GetBody = body.open
+	}
+	if body.contentLength >= 0 {
+		request.ContentLength = body.contentLength
+	}
+	return nil
 }
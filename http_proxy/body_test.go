@@ -3,9 +3,11 @@ package http_proxy_test
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
 	http_proxy "github.com/AndreaCostanzo1/http-proxy/http_proxy"
@@ -131,3 +133,194 @@ func TestSetJSONBody(t *testing.T) {
 		}
 	})
 }
+
+type nonSeekableReader struct {
+	reader io.Reader
+}
+
+func (body *nonSeekableReader) Read(p []byte) (int, error) {
+	return body.reader.Read(p)
+}
+
+// Implements io.ReadSeeker but not io.ReaderAt
+type seekOnlyReader struct {
+	reader io.ReadSeeker
+}
+
+func (body *seekOnlyReader) Read(p []byte) (int, error) {
+	return body.reader.Read(p)
+}
+
+func (body *seekOnlyReader) Seek(offset int64, whence int) (int64, error) {
+	return body.reader.Seek(offset, whence)
+}
+
+func echoBodyServer(received chan<- string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- string(body)
+		w.WriteHeader(http.StatusOK)
+	}))
+}
+
+func TestReplayableBody(t *testing.T) {
+	bodies := map[string]func() io.Reader{
+		"bytes.Buffer":        func() io.Reader { return bytes.NewBufferString("test body") },
+		"strings.Reader":      func() io.Reader { return strings.NewReader("test body") },
+		"non-seekable reader": func() io.Reader { return &nonSeekableReader{strings.NewReader("test body")} },
+		"seek-only reader":    func() io.Reader { return &seekOnlyReader{strings.NewReader("test body")} },
+	}
+	for name, newBody := range bodies {
+		t.Run("Send replays body from "+name, func(t *testing.T) {
+			received := make(chan string, 2)
+			server := echoBodyServer(received)
+			defer server.Close()
+
+			req := http_proxy.NewRequest("POST", server.URL)
+			req.SetBody(newBody())
+			for i := 0; i < 2; i++ {
+				if _, err := req.Send(); err != nil {
+					t.Fatalf("expected no error on send %d, got %v", i+1, err)
+				}
+				if body := <-received; body != "test body" {
+					t.Errorf("expected body to be 'test body' on send %d, got '%s'", i+1, body)
+				}
+			}
+		})
+	}
+
+	t.Run("Send replays seekable body from its current offset", func(t *testing.T) {
+		received := make(chan string, 2)
+		server := echoBodyServer(received)
+		defer server.Close()
+
+		body := strings.NewReader("skip:test body")
+		body.Seek(5, io.SeekStart)
+		req := http_proxy.NewRequest("POST", server.URL)
+		req.SetBody(body)
+		for i := 0; i < 2; i++ {
+			req.Send()
+			if received := <-received; received != "test body" {
+				t.Errorf("expected body to be 'test body', got '%s'", received)
+			}
+		}
+	})
+
+	t.Run("SetBodyFactory invokes the factory on every send", func(t *testing.T) {
+		received := make(chan string, 2)
+		server := echoBodyServer(received)
+		defer server.Close()
+
+		calls := 0
+		req := http_proxy.NewRequest("POST", server.URL)
+		req.SetBodyFactory(func() (io.Reader, error) {
+			calls++
+			return strings.NewReader("test body"), nil
+		})
+		req.Send()
+		req.Send()
+		<-received
+		if body := <-received; body != "test body" {
+			t.Errorf("expected body to be 'test body', got '%s'", body)
+		}
+		if calls != 2 {
+			t.Errorf("expected factory to be called twice, got %d", calls)
+		}
+	})
+
+	t.Run("SetBodyFactory error is returned", func(t *testing.T) {
+		factoryErr := errors.New("factory failure")
+		req := http_proxy.NewRequest("POST", "http://localhost")
+		req.SetBodyFactory(func() (io.Reader, error) {
+			return nil, factoryErr
+		})
+		resp, err := req.Send()
+
+		if !errors.Is(err, factoryErr) {
+			t.Errorf("expected factory error, got %v", err)
+		}
+		if resp != nil {
+			t.Errorf("expected no response, got %v", resp)
+		}
+	})
+
+	t.Run("Body bigger than the buffer limit is sent only once", func(t *testing.T) {
+		received := make(chan string, 1)
+		server := echoBodyServer(received)
+		defer server.Close()
+
+		req := http_proxy.NewRequest("POST", server.URL)
+		req.WithBodyBufferLimit(4)
+		req.SetBody(&nonSeekableReader{strings.NewReader("test body")})
+		if _, err := req.Send(); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if body := <-received; body != "test body" {
+			t.Errorf("expected body to be 'test body', got '%s'", body)
+		}
+		if _, err := req.Send(); !errors.Is(err, http_proxy.ErrBodyNotReplayable) {
+			t.Errorf("expected ErrBodyNotReplayable, got %v", err)
+		}
+	})
+
+	t.Run("Seekable body bigger than the buffer limit is read by one send at a time", func(t *testing.T) {
+		req := http_proxy.NewRequest("POST", "http://localhost")
+		req.WithBodyBufferLimit(4)
+		req.SetBody(&seekOnlyReader{strings.NewReader("test body")})
+		underlyingRequest, _ := req.UnderlyingRequest()
+
+		if _, err := underlyingRequest.GetBody(); !errors.Is(err, http_proxy.ErrBodyNotReplayable) {
+			t.Errorf("expected ErrBodyNotReplayable while the body is being read, got %v", err)
+		}
+		underlyingRequest.Body.Close()
+		body, err := underlyingRequest.GetBody()
+		if err != nil {
+			t.Fatalf("expected no error once the body is closed, got %v", err)
+		}
+		if payload, _ := io.ReadAll(body); string(payload) != "test body" {
+			t.Errorf("expected body to be 'test body', got '%s'", payload)
+		}
+	})
+
+	t.Run("UnderlyingRequest populates GetBody", func(t *testing.T) {
+		req := http_proxy.NewRequest("POST", "http://localhost")
+		req.SetBody(&nonSeekableReader{strings.NewReader("test body")})
+		underlyingRequest, _ := req.UnderlyingRequest()
+
+		if underlyingRequest.GetBody == nil {
+			t.Fatalf("expected GetBody to be populated")
+		}
+		body, _ := underlyingRequest.GetBody()
+		if payload, _ := io.ReadAll(body); string(payload) != "test body" {
+			t.Errorf("expected body to be 'test body', got '%s'", payload)
+		}
+		if underlyingRequest.ContentLength != int64(len("test body")) {
+			t.Errorf("expected content length %d, got %d", len("test body"), underlyingRequest.ContentLength)
+		}
+	})
+
+	t.Run("Body is resent on 307 redirects", func(t *testing.T) {
+		received := make(chan string, 1)
+		target := echoBodyServer(received)
+		defer target.Close()
+		redirect := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.ReadAll(r.Body)
+			http.Redirect(w, r, target.URL, http.StatusTemporaryRedirect)
+		}))
+		defer redirect.Close()
+
+		req := http_proxy.NewRequest("POST", redirect.URL)
+		req.SetBody(&nonSeekableReader{strings.NewReader("test body")})
+		resp, err := req.Send()
+
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("expected status code 200, got %d", resp.StatusCode)
+		}
+		if body := <-received; body != "test body" {
+			t.Errorf("expected redirected body to be 'test body', got '%s'", body)
+		}
+	})
+}
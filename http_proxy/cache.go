@@ -0,0 +1,546 @@
+package http_proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Header added to responses handled by a ResponseCache, see IsFromCache
+const CACHE_STATUS_HEADER = "X-Http-Proxy-Cache"
+
+const (
+	// Fresh response served from the cache
+	CACHE_HIT = "HIT"
+	// Stale response confirmed by the server with 304 Not Modified
+	CACHE_REVALIDATED = "REVALIDATED"
+	// Stale response served because of stale-while-revalidate or stale-if-error
+	CACHE_STALE = "STALE"
+	// Response received from the server
+	CACHE_MISS = "MISS"
+)
+
+// Upper bound of the heuristic freshness lifetime
+const MAX_HEURISTIC_FRESHNESS = 24 * time.Hour
+
+// Responses bigger than this are not stored unless the cache is configured otherwise
+const DEFAULT_MAX_CACHE_ENTRY_SIZE int64 = 1 << 20
+
+// Background revalidations taking longer than this are abandoned unless the
+// cache is configured otherwise
+const DEFAULT_REVALIDATION_TIMEOUT = 30 * time.Second
+
+// Status codes whose responses can be reused using heuristic freshness (RFC 9110 section 15.1).
+// Apart from the partial 206, they are also the only status codes whose responses are stored
+var heuristicallyCacheableStatusCodes = map[int]bool{
+	200: true, 203: true, 204: true, 206: true, 300: true, 301: true, 308: true,
+	404: true, 405: true, 410: true, 414: true, 501: true,
+}
+
+// A stored response
+type CacheEntry struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+	// Values of the request headers listed in the Vary response header
+	VaryHeader   http.Header
+	RequestTime  time.Time
+	ResponseTime time.Time
+}
+
+// Where a ResponseCache keeps its entries. Implementations must be safe for concurrent use
+type CacheStorage interface {
+	Get(key string) (*CacheEntry, bool)
+	Set(key string, entry *CacheEntry)
+	Delete(key string)
+}
+
+// A client-side HTTP cache following the RFC 9111 rules of shared caches,
+// so that it can be shared by many requests. s-maxage takes precedence over
+// max-age and proxy-revalidate forbids serving stale responses like must-revalidate
+type ResponseCache struct {
+	storage             CacheStorage
+	maxEntrySize        int64
+	revalidationTimeout time.Duration
+	now                 func() time.Time
+	revalidating        sync.Map
+}
+
+// Creates a cache keeping its entries in the storage
+func NewResponseCache(storage CacheStorage) *ResponseCache {
+	return &ResponseCache{
+		storage:             storage,
+		maxEntrySize:        DEFAULT_MAX_CACHE_ENTRY_SIZE,
+		revalidationTimeout: DEFAULT_REVALIDATION_TIMEOUT,
+		now:                 time.Now,
+	}
+}
+
+// Set the size of the biggest response body that is stored
+func (cache *ResponseCache) WithMaxEntrySize(size int64) *ResponseCache {
+	cache.maxEntrySize = size
+	return cache
+}
+
+// Set how long a background revalidation can take before it is abandoned
+func (cache *ResponseCache) WithRevalidationTimeout(timeout time.Duration) *ResponseCache {
+	cache.revalidationTimeout = timeout
+	return cache
+}
+
+// Reports whether the response was served by a ResponseCache, either
+// because it was fresh, revalidated or allowed to be served stale
+func IsFromCache(response *http.Response) bool {
+	if response == nil {
+		return false
+	}
+	switch response.Header.Get(CACHE_STATUS_HEADER) {
+	case CACHE_HIT, CACHE_REVALIDATED, CACHE_STALE:
+		return true
+	default:
+		return false
+	}
+}
+
+func (requestIntent *proxiedRequestImpl) WithCache(cache *ResponseCache) ProxiedRequest {
+	requestIntent.mutex.Lock()
+	defer requestIntent.mutex.Unlock()
+	requestIntent.options.cache = cache
+	return requestIntent
+}
+
+func (cache *ResponseCache) transport(next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &cachingTransport{cache: cache, next: next}
+}
+
+type cachingTransport struct {
+	cache *ResponseCache
+	next  http.RoundTripper
+}
+
+func (transport *cachingTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	cache := transport.cache
+	key := cacheKey(request)
+	if request.Method != http.MethodGet {
+		response, err := transport.next.RoundTrip(request)
+		if err == nil && isUnsafeMethod(request.Method) && response.StatusCode < http.StatusBadRequest {
+			cache.storage.Delete(key)
+		}
+		return response, err
+	}
+
+	requestDirectives := parseCacheControl(request.Header)
+	// Partial responses are not stored, so range requests bypass the cache
+	if _, noStore := requestDirectives["no-store"]; noStore || request.Header.Get("Range") != "" {
+		return transport.next.RoundTrip(request)
+	}
+	entry, isFound := cache.lookup(key, request)
+	if !isFound || hasConditionalHeaders(request) {
+		requestTime := cache.now()
+		response, err := transport.next.RoundTrip(request)
+		if err != nil {
+			return response, err
+		}
+		// A 304 answers the validators of the caller, so it is passed through
+		// and only refreshes the stored response it confirms
+		if response.StatusCode == http.StatusNotModified {
+			if isFound && confirmsEntry(response, entry) {
+				cache.storage.Set(key, cache.refresh(entry, response, requestTime))
+			}
+			response.Header.Set(CACHE_STATUS_HEADER, CACHE_MISS)
+			return response, nil
+		}
+		return cache.handleNetworkResponse(key, request, response, requestTime), nil
+	}
+	if cache.isFresh(entry, requestDirectives) {
+		closeRequestBody(request)
+		return cache.responseFromEntry(entry, request, CACHE_HIT), nil
+	}
+	if cache.canServeWhileRevalidating(entry, requestDirectives) {
+		transport.revalidateInBackground(key, entry, request)
+		closeRequestBody(request)
+		return cache.responseFromEntry(entry, request, CACHE_STALE), nil
+	}
+	return transport.revalidate(key, entry, request, requestDirectives)
+}
+
+// Sends a conditional request built from the validators of the entry.
+// A 304 response is turned into the updated stored response, while errors
+// are replaced by the stale response when stale-if-error allows it
+func (transport *cachingTransport) revalidate(key string, entry *CacheEntry, request *http.Request, requestDirectives map[string]string) (*http.Response, error) {
+	cache := transport.cache
+	conditionalRequest := request.Clone(request.Context())
+	if etag := entry.Header.Get("Etag"); etag != "" {
+		conditionalRequest.Header.Set("If-None-Match", etag)
+	}
+	if lastModified := entry.Header.Get("Last-Modified"); lastModified != "" {
+		conditionalRequest.Header.Set("If-Modified-Since", lastModified)
+	}
+
+	requestTime := cache.now()
+	response, err := transport.next.RoundTrip(conditionalRequest)
+	if err != nil || response.StatusCode >= http.StatusInternalServerError {
+		if cache.canServeOnError(entry, requestDirectives) {
+			if response != nil {
+				response.Body.Close()
+			}
+			return cache.responseFromEntry(entry, request, CACHE_STALE), nil
+		}
+		if err != nil {
+			return response, err
+		}
+	}
+	if response.StatusCode == http.StatusNotModified {
+		io.Copy(io.Discard, response.Body)
+		response.Body.Close()
+		refreshedEntry := cache.refresh(entry, response, requestTime)
+		cache.storage.Set(key, refreshedEntry)
+		return cache.responseFromEntry(refreshedEntry, request, CACHE_REVALIDATED), nil
+	}
+	return cache.handleNetworkResponse(key, request, response, requestTime), nil
+}
+
+// Revalidates the entry without blocking the caller. At most one
+// background revalidation per key runs at the same time, and it is bounded
+// by the revalidation timeout instead of the context of the caller, whose
+// timings and spans belong to the stale response already returned
+func (transport *cachingTransport) revalidateInBackground(key string, entry *CacheEntry, request *http.Request) {
+	if _, isRunning := transport.cache.revalidating.LoadOrStore(key, struct{}{}); isRunning {
+		return
+	}
+	ctx, cancel := context.WithTimeout(detachedContext(request.Context()), transport.cache.revalidationTimeout)
+	// The body of the caller is closed when the stale response is returned
+	backgroundRequest := request.Clone(ctx)
+	backgroundRequest.Body = http.NoBody
+	backgroundRequest.ContentLength = 0
+	go func() {
+		defer transport.cache.revalidating.Delete(key)
+		defer cancel()
+		response, err := transport.revalidate(key, entry, backgroundRequest, map[string]string{})
+		if err == nil {
+			io.Copy(io.Discard, response.Body)
+			response.Body.Close()
+		}
+	}()
+}
+
+func (cache *ResponseCache) handleNetworkResponse(key string, request *http.Request, response *http.Response, requestTime time.Time) *http.Response {
+	response.Header.Set(CACHE_STATUS_HEADER, CACHE_MISS)
+	if cache.isStorable(request, response) {
+		cache.storeOnEOF(key, request, response, requestTime)
+	}
+	return response
+}
+
+// Creates a copy of the entry updated with the headers of a 304 response
+func (cache *ResponseCache) refresh(entry *CacheEntry, notModified *http.Response, requestTime time.Time) *CacheEntry {
+	refreshedEntry := *entry
+	refreshedEntry.Header = entry.Header.Clone()
+	for name, values := range notModified.Header {
+		if name != "Content-Length" && name != CACHE_STATUS_HEADER {
+			refreshedEntry.Header[name] = values
+		}
+	}
+	refreshedEntry.RequestTime = requestTime
+	refreshedEntry.ResponseTime = cache.now()
+	return &refreshedEntry
+}
+
+// Closes the body of a request answered from the cache, as http.RoundTripper
+// requires also when the request is not forwarded
+func closeRequestBody(request *http.Request) {
+	if request.Body != nil {
+		request.Body.Close()
+	}
+}
+
+// Reports whether a 304 response refers to the stored entry, comparing the
+// ETag when the 304 has one (RFC 9111 section 4.3.4)
+func confirmsEntry(notModified *http.Response, entry *CacheEntry) bool {
+	etag := notModified.Header.Get("Etag")
+	return etag == "" || etag == entry.Header.Get("Etag")
+}
+
+func hasConditionalHeaders(request *http.Request) bool {
+	return request.Header.Get("If-None-Match") != "" || request.Header.Get("If-Modified-Since") != ""
+}
+
+func hasCredentials(request *http.Request) bool {
+	return request.Header.Get("Authorization") != "" || request.Header.Get("Cookie") != ""
+}
+
+func cacheKey(request *http.Request) string {
+	return http.MethodGet + " " + request.URL.String()
+}
+
+func isUnsafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return false
+	default:
+		return true
+	}
+}
+
+// Returns the stored entry if it was produced for a request with the same varying headers
+func (cache *ResponseCache) lookup(key string, request *http.Request) (*CacheEntry, bool) {
+	entry, isFound := cache.storage.Get(key)
+	if !isFound {
+		return nil, false
+	}
+	for _, name := range varyHeaderNames(entry.Header) {
+		if name == "*" || request.Header.Get(name) != entry.VaryHeader.Get(name) {
+			return nil, false
+		}
+	}
+	return entry, true
+}
+
+func (cache *ResponseCache) isFresh(entry *CacheEntry, requestDirectives map[string]string) bool {
+	if _, noCache := requestDirectives["no-cache"]; noCache {
+		return false
+	}
+	responseDirectives := parseCacheControl(entry.Header)
+	if _, noCache := responseDirectives["no-cache"]; noCache {
+		return false
+	}
+	lifetime := freshnessLifetime(entry.StatusCode, entry.Header, entry.ResponseTime)
+	age := currentAge(entry, cache.now())
+	if maxAge, isSet := directiveSeconds(requestDirectives, "max-age"); isSet {
+		lifetime = min(lifetime, maxAge)
+	}
+	if minFresh, isSet := directiveSeconds(requestDirectives, "min-fresh"); isSet {
+		age += minFresh
+	}
+	if maxStale, isSet := requestDirectives["max-stale"]; isSet {
+		if !mustRevalidate(responseDirectives) {
+			if maxStale == "" {
+				return true
+			}
+			if seconds, isValid := directiveSeconds(requestDirectives, "max-stale"); isValid {
+				lifetime += seconds
+			}
+		}
+	}
+	return lifetime > age
+}
+
+// Returns how long ago the entry stopped being fresh
+func (cache *ResponseCache) staleness(entry *CacheEntry) time.Duration {
+	return currentAge(entry, cache.now()) - freshnessLifetime(entry.StatusCode, entry.Header, entry.ResponseTime)
+}
+
+func (cache *ResponseCache) canServeWhileRevalidating(entry *CacheEntry, requestDirectives map[string]string) bool {
+	if _, noCache := requestDirectives["no-cache"]; noCache {
+		return false
+	}
+	responseDirectives := parseCacheControl(entry.Header)
+	window, isSet := directiveSeconds(responseDirectives, "stale-while-revalidate")
+	return isSet && !mustRevalidate(responseDirectives) && cache.staleness(entry) <= window
+}
+
+func (cache *ResponseCache) canServeOnError(entry *CacheEntry, requestDirectives map[string]string) bool {
+	responseDirectives := parseCacheControl(entry.Header)
+	window, isSet := directiveSeconds(requestDirectives, "stale-if-error")
+	if !isSet {
+		window, isSet = directiveSeconds(responseDirectives, "stale-if-error")
+	}
+	return isSet && !mustRevalidate(responseDirectives) && cache.staleness(entry) <= window
+}
+
+// Reports whether a shared cache must not serve the response once stale.
+// s-maxage implies proxy-revalidate (RFC 9111 section 5.2.2.10)
+func mustRevalidate(responseDirectives map[string]string) bool {
+	for _, name := range []string{"must-revalidate", "proxy-revalidate", "s-maxage"} {
+		if _, isSet := responseDirectives[name]; isSet {
+			return true
+		}
+	}
+	return false
+}
+
+// Reports whether the response can be stored. Only final responses with a
+// cacheable status code are stored. As the cache can be shared by requests sent
+// on behalf of different users, private responses are never stored and responses
+// to requests carrying credentials only when marked public or with s-maxage
+func (cache *ResponseCache) isStorable(request *http.Request, response *http.Response) bool {
+	if !heuristicallyCacheableStatusCodes[response.StatusCode] || response.StatusCode == http.StatusPartialContent {
+		return false
+	}
+	responseDirectives := parseCacheControl(response.Header)
+	if _, noStore := responseDirectives["no-store"]; noStore {
+		return false
+	}
+	if _, isPrivate := responseDirectives["private"]; isPrivate {
+		return false
+	}
+	_, isPublic := responseDirectives["public"]
+	_, hasSharedMaxAge := responseDirectives["s-maxage"]
+	if !isPublic && !hasSharedMaxAge && hasCredentials(request) {
+		return false
+	}
+	if response.ContentLength > cache.maxEntrySize || strings.Contains(response.Header.Get("Vary"), "*") {
+		return false
+	}
+	hasValidators := response.Header.Get("Etag") != "" || response.Header.Get("Last-Modified") != ""
+	return hasValidators || freshnessLifetime(response.StatusCode, response.Header, cache.now()) > 0
+}
+
+// Stores the response once its body has been completely read. The response
+// time is the one of the headers, as RFC 9111 section 4.2.3 requires, so that
+// the time spent reading the body counts in the age of the entry
+func (cache *ResponseCache) storeOnEOF(key string, request *http.Request, response *http.Response, requestTime time.Time) {
+	entry := &CacheEntry{
+		StatusCode:   response.StatusCode,
+		Header:       response.Header.Clone(),
+		VaryHeader:   http.Header{},
+		RequestTime:  requestTime,
+		ResponseTime: cache.now(),
+	}
+	entry.Header.Del(CACHE_STATUS_HEADER)
+	for _, name := range varyHeaderNames(response.Header) {
+		if values := request.Header.Values(name); len(values) > 0 {
+			entry.VaryHeader[http.CanonicalHeaderKey(name)] = values
+		}
+	}
+	response.Body = &teeOnEOFBody{
+		ReadCloser: response.Body,
+		limit:      cache.maxEntrySize,
+		onEOF: func(body []byte) {
+			entry.Body = body
+			cache.storage.Set(key, entry)
+		},
+	}
+}
+
+func (cache *ResponseCache) responseFromEntry(entry *CacheEntry, request *http.Request, cacheStatus string) *http.Response {
+	header := entry.Header.Clone()
+	header.Set("Age", strconv.FormatInt(int64(currentAge(entry, cache.now())/time.Second), 10))
+	header.Set(CACHE_STATUS_HEADER, cacheStatus)
+	return &http.Response{
+		Status:        strconv.Itoa(entry.StatusCode) + " " + http.StatusText(entry.StatusCode),
+		StatusCode:    entry.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(entry.Body)),
+		ContentLength: int64(len(entry.Body)),
+		Request:       request,
+	}
+}
+
+// Computes the freshness lifetime of a response for a shared cache as defined
+// by RFC 9111 section 4.2.1
+func freshnessLifetime(statusCode int, header http.Header, responseTime time.Time) time.Duration {
+	directives := parseCacheControl(header)
+	if sharedMaxAge, isSet := directiveSeconds(directives, "s-maxage"); isSet {
+		return sharedMaxAge
+	}
+	if maxAge, isSet := directiveSeconds(directives, "max-age"); isSet {
+		return maxAge
+	}
+	date := headerTime(header, "Date", responseTime)
+	if expires := header.Get("Expires"); expires != "" {
+		expiresAt, parseErr := http.ParseTime(expires)
+		if parseErr != nil {
+			return 0
+		}
+		return max(0, expiresAt.Sub(date))
+	}
+	if lastModified := header.Get("Last-Modified"); lastModified != "" && heuristicallyCacheableStatusCodes[statusCode] {
+		if modifiedAt, parseErr := http.ParseTime(lastModified); parseErr == nil && date.After(modifiedAt) {
+			return min(date.Sub(modifiedAt)/10, MAX_HEURISTIC_FRESHNESS)
+		}
+	}
+	return 0
+}
+
+// Computes the current age of an entry as defined by RFC 9111 section 4.2.3
+func currentAge(entry *CacheEntry, now time.Time) time.Duration {
+	date := headerTime(entry.Header, "Date", entry.ResponseTime)
+	apparentAge := max(0, entry.ResponseTime.Sub(date))
+	ageValue := time.Duration(0)
+	if seconds, parseErr := strconv.ParseInt(entry.Header.Get("Age"), 10, 64); parseErr == nil {
+		ageValue = time.Duration(seconds) * time.Second
+	}
+	correctedAgeValue := ageValue + entry.ResponseTime.Sub(entry.RequestTime)
+	return max(apparentAge, correctedAgeValue) + now.Sub(entry.ResponseTime)
+}
+
+func headerTime(header http.Header, name string, fallback time.Time) time.Time {
+	if parsed, parseErr := http.ParseTime(header.Get(name)); parseErr == nil {
+		return parsed
+	}
+	return fallback
+}
+
+// Parses the Cache-Control header into a map of lowercase directives to their values
+func parseCacheControl(header http.Header) map[string]string {
+	directives := map[string]string{}
+	for _, value := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			name, argument, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			if name != "" {
+				directives[strings.ToLower(name)] = strings.Trim(argument, `"`)
+			}
+		}
+	}
+	return directives
+}
+
+func directiveSeconds(directives map[string]string, name string) (time.Duration, bool) {
+	value, isSet := directives[name]
+	if !isSet {
+		return 0, false
+	}
+	seconds, parseErr := strconv.ParseInt(value, 10, 64)
+	if parseErr != nil || seconds < 0 {
+		return 0, false
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+func varyHeaderNames(header http.Header) []string {
+	names := []string{}
+	for _, value := range header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+// Copies what is read from the body and hands it to onEOF once the
+// whole body has been read, unless it is bigger than limit
+type teeOnEOFBody struct {
+	io.ReadCloser
+	limit    int64
+	buffer   bytes.Buffer
+	overflow bool
+	done     bool
+	onEOF    func(body []byte)
+}
+
+func (body *teeOnEOFBody) Read(p []byte) (int, error) {
+	n, err := body.ReadCloser.Read(p)
+	if !body.overflow {
+		body.buffer.Write(p[:n])
+		body.overflow = int64(body.buffer.Len()) > body.limit
+	}
+	if err == io.EOF && !body.overflow && !body.done {
+		body.done = true
+		body.onEOF(body.buffer.Bytes())
+	}
+	return n, err
+}
@@ -0,0 +1,150 @@
+package http_proxy
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// An in-memory CacheStorage evicting the least recently used entries
+// when the stored bodies and headers exceed a size limit
+type MemoryCacheStorage struct {
+	mutex    sync.Mutex
+	maxBytes int64
+	size     int64
+	order    *list.List
+	entries  map[string]*list.Element
+}
+
+type memoryCacheItem struct {
+	key   string
+	entry *CacheEntry
+	size  int64
+}
+
+// Creates a memory storage holding up to maxBytes of responses
+func NewMemoryCacheStorage(maxBytes int64) *MemoryCacheStorage {
+	return &MemoryCacheStorage{maxBytes: maxBytes, order: list.New(), entries: map[string]*list.Element{}}
+}
+
+func (storage *MemoryCacheStorage) Get(key string) (*CacheEntry, bool) {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	element, isFound := storage.entries[key]
+	if !isFound {
+		return nil, false
+	}
+	storage.order.MoveToFront(element)
+	return element.Value.(*memoryCacheItem).entry, true
+}
+
+func (storage *MemoryCacheStorage) Set(key string, entry *CacheEntry) {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	storage.remove(key)
+	item := &memoryCacheItem{key: key, entry: entry, size: entrySize(key, entry)}
+	if item.size > storage.maxBytes {
+		return
+	}
+	storage.entries[key] = storage.order.PushFront(item)
+	storage.size += item.size
+	for storage.size > storage.maxBytes {
+		storage.remove(storage.order.Back().Value.(*memoryCacheItem).key)
+	}
+}
+
+func (storage *MemoryCacheStorage) Delete(key string) {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	storage.remove(key)
+}
+
+// Returns the number of bytes currently used by the stored entries
+func (storage *MemoryCacheStorage) Size() int64 {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	return storage.size
+}
+
+func (storage *MemoryCacheStorage) remove(key string) {
+	if element, isFound := storage.entries[key]; isFound {
+		storage.order.Remove(element)
+		delete(storage.entries, key)
+		storage.size -= element.Value.(*memoryCacheItem).size
+	}
+}
+
+func entrySize(key string, entry *CacheEntry) int64 {
+	size := int64(len(key) + len(entry.Body))
+	for _, header := range []map[string][]string{entry.Header, entry.VaryHeader} {
+		for name, values := range header {
+			for _, value := range values {
+				size += int64(len(name) + len(value))
+			}
+		}
+	}
+	return size
+}
+
+// A CacheStorage keeping one JSON file per entry in a directory
+type FileCacheStorage struct {
+	directory string
+	mutex     sync.RWMutex
+}
+
+// Creates a file storage in directory, creating it if missing
+func NewFileCacheStorage(directory string) (*FileCacheStorage, error) {
+	if mkdirErr := os.MkdirAll(directory, 0o700); mkdirErr != nil {
+		return nil, mkdirErr
+	}
+	return &FileCacheStorage{directory: directory}, nil
+}
+
+func (storage *FileCacheStorage) Get(key string) (*CacheEntry, bool) {
+	storage.mutex.RLock()
+	defer storage.mutex.RUnlock()
+	payload, readErr := os.ReadFile(storage.path(key))
+	if readErr != nil {
+		return nil, false
+	}
+	var entry CacheEntry
+	if unmarshalErr := json.Unmarshal(payload, &entry); unmarshalErr != nil {
+		return nil, false
+	}
+	return &entry, true
+}
+
+// Writes the entry to disk. Entries that can't be written are skipped,
+// a cache miss being the only consequence
+func (storage *FileCacheStorage) Set(key string, entry *CacheEntry) {
+	payload, marshalErr := json.Marshal(entry)
+	if marshalErr != nil {
+		return
+	}
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	temporaryFile, createErr := os.CreateTemp(storage.directory, "entry-*.tmp")
+	if createErr != nil {
+		return
+	}
+	_, writeErr := temporaryFile.Write(payload)
+	closeErr := temporaryFile.Close()
+	if writeErr != nil || closeErr != nil || os.Rename(temporaryFile.Name(), storage.path(key)) != nil {
+		os.Remove(temporaryFile.Name())
+	}
+}
+
+func (storage *FileCacheStorage) Delete(key string) {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	os.Remove(storage.path(key))
+}
+
+func (storage *FileCacheStorage) path(key string) string {
+	digest := sha256.Sum256([]byte(key))
+	return filepath.Join(storage.directory, hex.EncodeToString(digest[:])+".json")
+}
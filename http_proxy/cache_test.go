@@ -0,0 +1,672 @@
+package http_proxy_test
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	http_proxy "github.com/AndreaCostanzo1/http-proxy/http_proxy"
+)
+
+// Serves a body counting the calls, with the headers returned by headers
+func cacheableServer(calls *int32, headers func(r *http.Request) map[string]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		call := atomic.AddInt32(calls, 1)
+		for name, value := range headers(r) {
+			w.Header().Set(name, value)
+		}
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, `{"call":%d}`, call)
+	}))
+}
+
+func sendAndRead(t *testing.T, req http_proxy.ProxiedRequest) (*http.Response, string) {
+	resp, err := req.Send()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	return resp, string(body)
+}
+
+func TestResponseCache(t *testing.T) {
+	staticHeaders := func(headers map[string]string) func(r *http.Request) map[string]string {
+		return func(r *http.Request) map[string]string { return headers }
+	}
+	cases := []struct {
+		name           string
+		headers        map[string]string
+		expectedCached bool
+	}{
+		{"max-age", map[string]string{"Cache-Control": "max-age=60"}, true},
+		{"s-maxage over max-age=0", map[string]string{"Cache-Control": "max-age=0, s-maxage=60"}, true},
+		{"s-maxage=0 over max-age", map[string]string{"Cache-Control": "max-age=60, s-maxage=0"}, false},
+		{"private max-age", map[string]string{"Cache-Control": "private, max-age=60"}, false},
+		{"future Expires", map[string]string{"Expires": time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)}, true},
+		{"heuristic freshness", map[string]string{"Last-Modified": time.Now().Add(-24 * time.Hour).UTC().Format(http.TimeFormat)}, true},
+		{"no-store", map[string]string{"Cache-Control": "no-store, max-age=60"}, false},
+		{"no-cache", map[string]string{"Cache-Control": "no-cache, max-age=60"}, false},
+		{"past Expires", map[string]string{"Expires": time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)}, false},
+		{"invalid Expires", map[string]string{"Expires": "0"}, false},
+		{"max-age=0", map[string]string{"Cache-Control": "max-age=0"}, false},
+		{"Vary *", map[string]string{"Cache-Control": "max-age=60", "Vary": "*"}, false},
+		{"no freshness information", map[string]string{}, false},
+	}
+	for _, testCase := range cases {
+		t.Run("Cache with "+testCase.name, func(t *testing.T) {
+			var calls int32
+			server := cacheableServer(&calls, staticHeaders(testCase.headers))
+			defer server.Close()
+
+			cache := http_proxy.NewResponseCache(http_proxy.NewMemoryCacheStorage(1 << 20))
+			_, firstBody := sendAndRead(t, http_proxy.NewRequest("GET", server.URL).WithCache(cache))
+			secondResp, secondBody := sendAndRead(t, http_proxy.NewRequest("GET", server.URL).WithCache(cache))
+
+			if http_proxy.IsFromCache(secondResp) != testCase.expectedCached {
+				t.Errorf("expected IsFromCache to be %v", testCase.expectedCached)
+			}
+			if testCase.expectedCached && (calls != 1 || secondBody != firstBody) {
+				t.Errorf("expected cached body '%s' after 1 call, got '%s' after %d calls", firstBody, secondBody, calls)
+			}
+			if !testCase.expectedCached && calls != 2 {
+				t.Errorf("expected 2 calls, got %d", calls)
+			}
+		})
+	}
+
+	t.Run("Cache adds the Age header to cached responses", func(t *testing.T) {
+		var calls int32
+		server := cacheableServer(&calls, staticHeaders(map[string]string{"Cache-Control": "max-age=60", "Age": "10"}))
+		defer server.Close()
+
+		cache := http_proxy.NewResponseCache(http_proxy.NewMemoryCacheStorage(1 << 20))
+		sendAndRead(t, http_proxy.NewRequest("GET", server.URL).WithCache(cache))
+		resp, _ := sendAndRead(t, http_proxy.NewRequest("GET", server.URL).WithCache(cache))
+
+		if age := resp.Header.Get("Age"); age != "10" && age != "11" {
+			t.Errorf("expected Age around 10, got '%s'", age)
+		}
+	})
+
+	t.Run("Cache honors the Vary header", func(t *testing.T) {
+		var calls int32
+		server := cacheableServer(&calls, staticHeaders(map[string]string{"Cache-Control": "max-age=60", "Vary": "Accept-Language"}))
+		defer server.Close()
+
+		cache := http_proxy.NewResponseCache(http_proxy.NewMemoryCacheStorage(1 << 20))
+		sendAndRead(t, http_proxy.NewRequest("GET", server.URL).WithCache(cache).SetHeader("Accept-Language", "en"))
+		sameResp, _ := sendAndRead(t, http_proxy.NewRequest("GET", server.URL).WithCache(cache).SetHeader("Accept-Language", "en"))
+		otherResp, _ := sendAndRead(t, http_proxy.NewRequest("GET", server.URL).WithCache(cache).SetHeader("Accept-Language", "it"))
+
+		if !http_proxy.IsFromCache(sameResp) {
+			t.Errorf("expected same language to be served from cache")
+		}
+		if http_proxy.IsFromCache(otherResp) {
+			t.Errorf("expected different language not to be served from cache")
+		}
+	})
+
+	t.Run("Cache honors request directives", func(t *testing.T) {
+		var calls int32
+		server := cacheableServer(&calls, staticHeaders(map[string]string{"Cache-Control": "max-age=60"}))
+		defer server.Close()
+
+		cache := http_proxy.NewResponseCache(http_proxy.NewMemoryCacheStorage(1 << 20))
+		sendAndRead(t, http_proxy.NewRequest("GET", server.URL).WithCache(cache))
+		for _, directive := range []string{"no-cache", "no-store", "max-age=0", "min-fresh=120"} {
+			resp, _ := sendAndRead(t, http_proxy.NewRequest("GET", server.URL).WithCache(cache).SetHeader("Cache-Control", directive))
+			if http_proxy.IsFromCache(resp) {
+				t.Errorf("expected request with '%s' not to be served from cache", directive)
+			}
+		}
+		resp, _ := sendAndRead(t, http_proxy.NewRequest("GET", server.URL).WithCache(cache).SetHeader("Cache-Control", "max-stale"))
+		if !http_proxy.IsFromCache(resp) {
+			t.Errorf("expected request with 'max-stale' to be served from cache")
+		}
+	})
+
+	t.Run("Unsafe methods invalidate the cached response", func(t *testing.T) {
+		var calls int32
+		server := cacheableServer(&calls, staticHeaders(map[string]string{"Cache-Control": "max-age=60"}))
+		defer server.Close()
+
+		cache := http_proxy.NewResponseCache(http_proxy.NewMemoryCacheStorage(1 << 20))
+		sendAndRead(t, http_proxy.NewRequest("GET", server.URL).WithCache(cache))
+		sendAndRead(t, http_proxy.NewRequest("POST", server.URL).WithCache(cache))
+		resp, _ := sendAndRead(t, http_proxy.NewRequest("GET", server.URL).WithCache(cache))
+
+		if http_proxy.IsFromCache(resp) {
+			t.Errorf("expected response to be invalidated by POST")
+		}
+	})
+
+	t.Run("Cache doesn't share responses to requests with credentials", func(t *testing.T) {
+		for _, credential := range []string{"Authorization", "Cookie"} {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Cache-Control", "max-age=60")
+				fmt.Fprintf(w, "data for %s", r.Header.Get(credential))
+			}))
+			defer server.Close()
+
+			cache := http_proxy.NewResponseCache(http_proxy.NewMemoryCacheStorage(1 << 20))
+			sendAndRead(t, http_proxy.NewRequest("GET", server.URL).SetHeader(credential, "alice").WithCache(cache))
+			resp, body := sendAndRead(t, http_proxy.NewRequest("GET", server.URL).SetHeader(credential, "bob").WithCache(cache))
+
+			if http_proxy.IsFromCache(resp) || body != "data for bob" {
+				t.Errorf("expected the response for bob with %s, got '%s'", credential, body)
+			}
+		}
+	})
+
+	t.Run("Cache stores public responses to requests with credentials", func(t *testing.T) {
+		var calls int32
+		server := cacheableServer(&calls, staticHeaders(map[string]string{"Cache-Control": "public, max-age=60"}))
+		defer server.Close()
+
+		cache := http_proxy.NewResponseCache(http_proxy.NewMemoryCacheStorage(1 << 20))
+		sendAndRead(t, http_proxy.NewRequest("GET", server.URL).SetHeader("Authorization", "Bearer alice").WithCache(cache))
+		resp, _ := sendAndRead(t, http_proxy.NewRequest("GET", server.URL).SetHeader("Authorization", "Bearer bob").WithCache(cache))
+
+		if !http_proxy.IsFromCache(resp) || calls != 1 {
+			t.Errorf("expected the public response to be cached, got %d calls", calls)
+		}
+	})
+
+	t.Run("Cache ignores range requests and partial responses", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Cache-Control", "max-age=60")
+			if r.Header.Get("Range") != "" {
+				w.Header().Set("Content-Range", "bytes 0-2/4")
+				w.WriteHeader(http.StatusPartialContent)
+				w.Write([]byte("par"))
+				return
+			}
+			w.Write([]byte("full"))
+		}))
+		defer server.Close()
+
+		cache := http_proxy.NewResponseCache(http_proxy.NewMemoryCacheStorage(1 << 20))
+		sendAndRead(t, http_proxy.NewRequest("GET", server.URL).SetHeader("Range", "bytes=0-2").WithCache(cache))
+		resp, body := sendAndRead(t, http_proxy.NewRequest("GET", server.URL).WithCache(cache))
+		if http_proxy.IsFromCache(resp) || body != "full" {
+			t.Errorf("expected the full body from the server, got '%s'", body)
+		}
+		resp, body = sendAndRead(t, http_proxy.NewRequest("GET", server.URL).SetHeader("Range", "bytes=0-2").WithCache(cache))
+		if http_proxy.IsFromCache(resp) || body != "par" {
+			t.Errorf("expected the partial body from the server, got '%s'", body)
+		}
+	})
+
+	t.Run("Cache stores only cacheable status codes", func(t *testing.T) {
+		cases := map[int]bool{
+			http.StatusOK:                  true,
+			http.StatusNotFound:            true,
+			http.StatusFound:               false,
+			http.StatusInternalServerError: false,
+		}
+		for statusCode, expectedCached := range cases {
+			var calls int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&calls, 1)
+				w.Header().Set("Cache-Control", "max-age=60")
+				w.Header().Set("ETag", `"v1"`)
+				w.WriteHeader(statusCode)
+			}))
+
+			cache := http_proxy.NewResponseCache(http_proxy.NewMemoryCacheStorage(1 << 20))
+			client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+			sendAndRead(t, http_proxy.NewRequest("GET", server.URL).WithHTTPClient(client).WithCache(cache))
+			resp, _ := sendAndRead(t, http_proxy.NewRequest("GET", server.URL).WithHTTPClient(client).WithCache(cache))
+
+			if http_proxy.IsFromCache(resp) != expectedCached {
+				t.Errorf("expected IsFromCache to be %v for status code %d, got %d calls", expectedCached, statusCode, calls)
+			}
+			server.Close()
+		}
+	})
+
+	t.Run("Cache closes the request body of responses it serves", func(t *testing.T) {
+		var calls int32
+		server := cacheableServer(&calls, staticHeaders(map[string]string{"Cache-Control": "max-age=60"}))
+		defer server.Close()
+
+		var opened, closed int32
+		cache := http_proxy.NewResponseCache(http_proxy.NewMemoryCacheStorage(1 << 20))
+		req := http_proxy.NewRequest("GET", server.URL).WithCache(cache).SetBodyFactory(func() (io.Reader, error) {
+			atomic.AddInt32(&opened, 1)
+			return &closeCountingBody{Reader: strings.NewReader("query"), closed: &closed}, nil
+		})
+		sendAndRead(t, req)
+		resp, _ := sendAndRead(t, req)
+
+		if !http_proxy.IsFromCache(resp) {
+			t.Errorf("expected the second response to be served from cache")
+		}
+		if opened != 2 || closed != opened {
+			t.Errorf("expected the 2 opened bodies to be closed, got %d closed", closed)
+		}
+	})
+
+	t.Run("Cache doesn't store bodies bigger than the entry size", func(t *testing.T) {
+		var calls int32
+		server := cacheableServer(&calls, staticHeaders(map[string]string{"Cache-Control": "max-age=60"}))
+		defer server.Close()
+
+		cache := http_proxy.NewResponseCache(http_proxy.NewMemoryCacheStorage(1 << 20)).WithMaxEntrySize(4)
+		sendAndRead(t, http_proxy.NewRequest("GET", server.URL).WithCache(cache))
+		resp, _ := sendAndRead(t, http_proxy.NewRequest("GET", server.URL).WithCache(cache))
+
+		if http_proxy.IsFromCache(resp) {
+			t.Errorf("expected big response not to be cached")
+		}
+	})
+}
+
+func TestMemoryCacheStorage(t *testing.T) {
+	entry := func(body string) *http_proxy.CacheEntry {
+		return &http_proxy.CacheEntry{StatusCode: http.StatusOK, Header: http.Header{}, Body: []byte(body)}
+	}
+
+	t.Run("Memory storage evicts the least recently used entries", func(t *testing.T) {
+		storage := http_proxy.NewMemoryCacheStorage(25)
+		storage.Set("a", entry(strings.Repeat("a", 9)))
+		storage.Set("b", entry(strings.Repeat("b", 9)))
+		storage.Get("a")
+		storage.Set("c", entry(strings.Repeat("c", 9)))
+
+		if _, isFound := storage.Get("b"); isFound {
+			t.Errorf("expected least recently used entry to be evicted")
+		}
+		for _, key := range []string{"a", "c"} {
+			if _, isFound := storage.Get(key); !isFound {
+				t.Errorf("expected entry '%s' to be kept", key)
+			}
+		}
+		if size := storage.Size(); size != 20 {
+			t.Errorf("expected size 20, got %d", size)
+		}
+	})
+
+	t.Run("Memory storage skips entries bigger than its limit", func(t *testing.T) {
+		storage := http_proxy.NewMemoryCacheStorage(5)
+		storage.Set("a", entry("too big"))
+
+		if _, isFound := storage.Get("a"); isFound {
+			t.Errorf("expected entry bigger than the limit not to be stored")
+		}
+	})
+
+	t.Run("Memory storage deletes entries", func(t *testing.T) {
+		storage := http_proxy.NewMemoryCacheStorage(100)
+		storage.Set("a", entry("a"))
+		storage.Delete("a")
+
+		if _, isFound := storage.Get("a"); isFound || storage.Size() != 0 {
+			t.Errorf("expected entry to be deleted")
+		}
+	})
+}
+
+func TestFileCacheStorage(t *testing.T) {
+	t.Run("File storage serves cached responses", func(t *testing.T) {
+		var calls int32
+		server := cacheableServer(&calls, func(r *http.Request) map[string]string {
+			return map[string]string{"Cache-Control": "max-age=60"}
+		})
+		defer server.Close()
+
+		storage, err := http_proxy.NewFileCacheStorage(t.TempDir())
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		_, firstBody := sendAndRead(t, http_proxy.NewRequest("GET", server.URL).WithCache(http_proxy.NewResponseCache(storage)))
+		resp, secondBody := sendAndRead(t, http_proxy.NewRequest("GET", server.URL).WithCache(http_proxy.NewResponseCache(storage)))
+
+		if !http_proxy.IsFromCache(resp) || firstBody != secondBody {
+			t.Errorf("expected body '%s' from cache, got '%s'", firstBody, secondBody)
+		}
+	})
+
+	t.Run("File storage deletes entries", func(t *testing.T) {
+		storage, _ := http_proxy.NewFileCacheStorage(t.TempDir())
+		storage.Set("a", &http_proxy.CacheEntry{StatusCode: http.StatusOK, Body: []byte("a")})
+		if _, isFound := storage.Get("a"); !isFound {
+			t.Errorf("expected entry to be stored")
+		}
+		storage.Delete("a")
+
+		if _, isFound := storage.Get("a"); isFound {
+			t.Errorf("expected entry to be deleted")
+		}
+	})
+}
+
+func TestCacheRevalidation(t *testing.T) {
+	t.Run("Stale responses are revalidated with ETag", func(t *testing.T) {
+		var calls int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&calls, 1)
+			w.Header().Set("Cache-Control", "no-cache")
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("ETag", `"v1"`)
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`{"version":1}`))
+		}))
+		defer server.Close()
+
+		cache := http_proxy.NewResponseCache(http_proxy.NewMemoryCacheStorage(1 << 20))
+		sendAndRead(t, http_proxy.NewRequest("GET", server.URL).WithCache(cache))
+		notModifiedInterceptorCalled := false
+		resp, body := sendAndRead(t, http_proxy.NewRequest("GET", server.URL).
+			WithCache(cache).
+			WithStatusCodeInterceptor(http.StatusNotModified, func(body map[string]interface{}, response *http.Response) error {
+				notModifiedInterceptorCalled = true
+				return nil
+			}))
+
+		if resp.StatusCode != http.StatusOK || body != `{"version":1}` {
+			t.Errorf("expected cached 200 response, got %d '%s'", resp.StatusCode, body)
+		}
+		if status := resp.Header.Get(http_proxy.CACHE_STATUS_HEADER); status != http_proxy.CACHE_REVALIDATED {
+			t.Errorf("expected cache status '%s', got '%s'", http_proxy.CACHE_REVALIDATED, status)
+		}
+		if calls != 2 {
+			t.Errorf("expected 2 calls, got %d", calls)
+		}
+		if notModifiedInterceptorCalled {
+			t.Errorf("expected interceptors not to see the 304 response")
+		}
+	})
+
+	t.Run("Stale responses are revalidated with Last-Modified", func(t *testing.T) {
+		lastModified := time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Cache-Control", "max-age=0")
+			if r.Header.Get("If-Modified-Since") == lastModified {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("Last-Modified", lastModified)
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("content"))
+		}))
+		defer server.Close()
+
+		cache := http_proxy.NewResponseCache(http_proxy.NewMemoryCacheStorage(1 << 20))
+		sendAndRead(t, http_proxy.NewRequest("GET", server.URL).WithCache(cache))
+		resp, body := sendAndRead(t, http_proxy.NewRequest("GET", server.URL).WithCache(cache))
+
+		if status := resp.Header.Get(http_proxy.CACHE_STATUS_HEADER); status != http_proxy.CACHE_REVALIDATED || body != "content" {
+			t.Errorf("expected revalidated 'content', got %s '%s'", status, body)
+		}
+	})
+
+	t.Run("Changed responses replace the stored ones", func(t *testing.T) {
+		var calls int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			call := atomic.AddInt32(&calls, 1)
+			w.Header().Set("Cache-Control", "max-age=0")
+			w.Header().Set("ETag", fmt.Sprintf(`"v%d"`, call))
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprintf(w, "version %d", call)
+		}))
+		defer server.Close()
+
+		cache := http_proxy.NewResponseCache(http_proxy.NewMemoryCacheStorage(1 << 20))
+		sendAndRead(t, http_proxy.NewRequest("GET", server.URL).WithCache(cache))
+		resp, body := sendAndRead(t, http_proxy.NewRequest("GET", server.URL).WithCache(cache))
+
+		if http_proxy.IsFromCache(resp) || body != "version 2" {
+			t.Errorf("expected new version from the network, got '%s'", body)
+		}
+	})
+
+	t.Run("304 responses to conditional requests of the caller are not stored", func(t *testing.T) {
+		var calls int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&calls, 1)
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("ETag", `"v1"`)
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("content"))
+		}))
+		defer server.Close()
+
+		cache := http_proxy.NewResponseCache(http_proxy.NewMemoryCacheStorage(1 << 20))
+		conditionalResp, _ := sendAndRead(t, http_proxy.NewRequest("GET", server.URL).SetHeader("If-None-Match", `"v1"`).WithCache(cache))
+		resp, body := sendAndRead(t, http_proxy.NewRequest("GET", server.URL).WithCache(cache))
+
+		if conditionalResp.StatusCode != http.StatusNotModified {
+			t.Errorf("expected the 304 to be passed to the caller, got %d", conditionalResp.StatusCode)
+		}
+		if resp.StatusCode != http.StatusOK || body != "content" || http_proxy.IsFromCache(resp) {
+			t.Errorf("expected 'content' from the server, got %d '%s'", resp.StatusCode, body)
+		}
+		if calls != 2 {
+			t.Errorf("expected 2 calls, got %d", calls)
+		}
+	})
+
+	t.Run("304 responses to conditional requests of the caller refresh the stored response", func(t *testing.T) {
+		var calls int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&calls, 1)
+			w.Header().Set("ETag", `"v1"`)
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				w.Header().Set("Cache-Control", "max-age=60")
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("Cache-Control", "max-age=0")
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("content"))
+		}))
+		defer server.Close()
+
+		cache := http_proxy.NewResponseCache(http_proxy.NewMemoryCacheStorage(1 << 20))
+		sendAndRead(t, http_proxy.NewRequest("GET", server.URL).WithCache(cache))
+		sendAndRead(t, http_proxy.NewRequest("GET", server.URL).SetHeader("If-None-Match", `"v1"`).WithCache(cache))
+		resp, body := sendAndRead(t, http_proxy.NewRequest("GET", server.URL).WithCache(cache))
+
+		if resp.StatusCode != http.StatusOK || body != "content" || !http_proxy.IsFromCache(resp) {
+			t.Errorf("expected the refreshed 200 'content' from cache, got %d '%s'", resp.StatusCode, body)
+		}
+		if calls != 2 {
+			t.Errorf("expected 2 calls, got %d", calls)
+		}
+	})
+
+	t.Run("stale-while-revalidate serves stale responses and revalidates in background", func(t *testing.T) {
+		revalidations := make(chan string, 1)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if etag := r.Header.Get("If-None-Match"); etag != "" {
+				revalidations <- etag
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("Cache-Control", "max-age=0, stale-while-revalidate=60")
+			w.Header().Set("ETag", `"v1"`)
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("content"))
+		}))
+		defer server.Close()
+
+		cache := http_proxy.NewResponseCache(http_proxy.NewMemoryCacheStorage(1 << 20))
+		sendAndRead(t, http_proxy.NewRequest("GET", server.URL).WithCache(cache))
+		resp, body := sendAndRead(t, http_proxy.NewRequest("GET", server.URL).WithCache(cache))
+
+		if status := resp.Header.Get(http_proxy.CACHE_STATUS_HEADER); status != http_proxy.CACHE_STALE || body != "content" {
+			t.Errorf("expected stale 'content', got %s '%s'", status, body)
+		}
+		select {
+		case etag := <-revalidations:
+			if etag != `"v1"` {
+				t.Errorf("expected revalidation with '\"v1\"', got '%s'", etag)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("expected a background revalidation")
+		}
+	})
+
+	t.Run("Background revalidations don't record the timings of the stale response", func(t *testing.T) {
+		revalidated := make(chan struct{}, 1)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("If-None-Match") != "" {
+				w.WriteHeader(http.StatusNotModified)
+				revalidated <- struct{}{}
+				return
+			}
+			w.Header().Set("Cache-Control", "max-age=0, stale-while-revalidate=60")
+			w.Header().Set("ETag", `"v1"`)
+			w.Write([]byte("content"))
+		}))
+		defer server.Close()
+
+		cache := http_proxy.NewResponseCache(http_proxy.NewMemoryCacheStorage(1 << 20))
+		sendAndRead(t, http_proxy.NewRequest("GET", server.URL).WithCache(cache))
+		resp, _ := sendAndRead(t, http_proxy.NewRequest("GET", server.URL).WithCache(cache).WithTimings())
+		select {
+		case <-revalidated:
+		case <-time.After(time.Second):
+			t.Fatalf("expected a background revalidation")
+		}
+		time.Sleep(50 * time.Millisecond)
+
+		if timings, _ := http_proxy.TimingsFromResponse(resp); timings.TimeToFirstByte != 0 || timings.RemoteAddress != "" {
+			t.Errorf("expected no network timings for the stale response, got %+v", timings)
+		}
+	})
+
+	t.Run("Hung background revalidations are abandoned after the timeout", func(t *testing.T) {
+		var revalidations int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("If-None-Match") != "" {
+				if atomic.AddInt32(&revalidations, 1) == 1 {
+					select {
+					case <-r.Context().Done():
+					case <-time.After(time.Second):
+					}
+					return
+				}
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("Cache-Control", "max-age=0, stale-while-revalidate=60")
+			w.Header().Set("ETag", `"v1"`)
+			w.Write([]byte("content"))
+		}))
+		defer server.Close()
+
+		cache := http_proxy.NewResponseCache(http_proxy.NewMemoryCacheStorage(1 << 20)).WithRevalidationTimeout(50 * time.Millisecond)
+		sendAndRead(t, http_proxy.NewRequest("GET", server.URL).WithCache(cache))
+		sendAndRead(t, http_proxy.NewRequest("GET", server.URL).WithCache(cache))
+		time.Sleep(150 * time.Millisecond)
+		sendAndRead(t, http_proxy.NewRequest("GET", server.URL).WithCache(cache))
+		time.Sleep(50 * time.Millisecond)
+
+		if revalidations := atomic.LoadInt32(&revalidations); revalidations != 2 {
+			t.Errorf("expected 2 revalidations, got %d", revalidations)
+		}
+	})
+
+	t.Run("stale-if-error serves stale responses when the server fails", func(t *testing.T) {
+		for _, source := range []string{"response", "request"} {
+			var calls int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if atomic.AddInt32(&calls, 1) > 1 {
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+				if source == "response" {
+					w.Header().Set("Cache-Control", "max-age=0, stale-if-error=60")
+				} else {
+					w.Header().Set("Cache-Control", "max-age=0")
+				}
+				w.Header().Set("ETag", `"v1"`)
+				w.WriteHeader(http.StatusOK)
+				w.Write([]byte("content"))
+			}))
+
+			cache := http_proxy.NewResponseCache(http_proxy.NewMemoryCacheStorage(1 << 20))
+			sendAndRead(t, http_proxy.NewRequest("GET", server.URL).WithCache(cache))
+			req := http_proxy.NewRequest("GET", server.URL).WithCache(cache)
+			if source == "request" {
+				req.SetHeader("Cache-Control", "stale-if-error=60")
+			}
+			resp, body := sendAndRead(t, req)
+
+			if resp.StatusCode != http.StatusOK || body != "content" {
+				t.Errorf("expected stale-if-error from %s to serve 'content', got %d '%s'", source, resp.StatusCode, body)
+			}
+			server.Close()
+		}
+	})
+
+	t.Run("proxy-revalidate forbids serving stale responses on errors", func(t *testing.T) {
+		var calls int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if atomic.AddInt32(&calls, 1) > 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.Header().Set("Cache-Control", "max-age=0, proxy-revalidate, stale-if-error=60")
+			w.Header().Set("ETag", `"v1"`)
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer server.Close()
+
+		cache := http_proxy.NewResponseCache(http_proxy.NewMemoryCacheStorage(1 << 20))
+		sendAndRead(t, http_proxy.NewRequest("GET", server.URL).WithCache(cache))
+		resp, _ := sendAndRead(t, http_proxy.NewRequest("GET", server.URL).WithCache(cache))
+
+		if resp.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("expected status code 503, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("Server errors are returned without stale-if-error", func(t *testing.T) {
+		var calls int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if atomic.AddInt32(&calls, 1) > 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.Header().Set("Cache-Control", "max-age=0")
+			w.Header().Set("ETag", `"v1"`)
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer server.Close()
+
+		cache := http_proxy.NewResponseCache(http_proxy.NewMemoryCacheStorage(1 << 20))
+		sendAndRead(t, http_proxy.NewRequest("GET", server.URL).WithCache(cache))
+		resp, _ := sendAndRead(t, http_proxy.NewRequest("GET", server.URL).WithCache(cache))
+
+		if resp.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("expected status code 503, got %d", resp.StatusCode)
+		}
+	})
+}
+
+// Counts how many times it is closed
+type closeCountingBody struct {
+	io.Reader
+	closed *int32
+}
+
+func (body *closeCountingBody) Close() error {
+	atomic.AddInt32(body.closed, 1)
+	return nil
+}
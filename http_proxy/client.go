@@ -0,0 +1,171 @@
+package http_proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// Settings applied to every send of a request. They are copied when the
+// request is sent, so a send is not affected by later changes
+type sendOptions struct {
+	httpClient *http.Client
+	timeouts   Timeouts
+	budget     *Budget
+	hedging    *HedgingPolicy
+	cache      *ResponseCache
+	dedup      *DedupGroup
+	recorder   *HARRecorder
+	logger     *RequestLogger
+	route      string
+	tracer     Tracer
+	metrics    *Metrics
+	balancer   *Balancer
+	// Whether the timings of the phases of the send are captured
+	captureTimings bool
+	// Number of the send, starting from 1. It is set for each send
+	attempt int
+}
+
+func (requestIntent *proxiedRequestImpl) WithHTTPClient(client *http.Client) ProxiedRequest {
+	requestIntent.mutex.Lock()
+	defer requestIntent.mutex.Unlock()
+	requestIntent.options.httpClient = client
+	return requestIntent
+}
+
+// Performs the request, hedging it when the policy applies. The cancel
+// function of the hedged attempt is chained to the one pointed by cancel
+func (options sendOptions) do(request *http.Request, cancel *context.CancelFunc) (*http.Response, error) {
+	if !options.hedging.appliesTo(request) {
+		return options.client().Do(request)
+	}
+	response, cancelAttempt, err := options.hedging.do(options.client(), request)
+	cancelSend := *cancel
+	*cancel = func() {
+		cancelAttempt()
+		cancelSend()
+	}
+	return response, err
+}
+
+// Returns the client used to send the request, with the transport
+// adjusted to honor the configured timeouts and wrapped by the recorder, the
+// balancer, the deduplication group and the cache, so that only cache misses
+// are deduplicated and balanced and only the calls reaching the network are recorded
+func (options sendOptions) client() *http.Client {
+	baseClient := options.httpClient
+	if baseClient == nil {
+		baseClient = http.DefaultClient
+	}
+	if !options.timeouts.hasTransportTimeouts() && options.cache == nil && options.dedup == nil && options.recorder == nil && options.balancer == nil {
+		return baseClient
+	}
+	client := *baseClient
+	if options.timeouts.hasTransportTimeouts() {
+		client.Transport = transportWithTimeouts(client.Transport)
+	}
+	if options.recorder != nil {
+		client.Transport = options.recorder.Transport(client.Transport)
+	}
+	if options.balancer != nil {
+		client.Transport = options.balancer.transport(client.Transport)
+	}
+	if options.dedup != nil {
+		client.Transport = options.dedup.transport(client.Transport)
+	}
+	if options.cache != nil {
+		client.Transport = options.cache.transport(client.Transport)
+	}
+	return &client
+}
+
+type transportTimeoutsKey struct{}
+
+// Wraps the transport so that each round trip honors the timeouts carried by
+// its context. The transport itself is not copied, so that sends with
+// different timeouts share its connection pool
+func transportWithTimeouts(roundTripper http.RoundTripper) http.RoundTripper {
+	if roundTripper == nil {
+		roundTripper = http.DefaultTransport
+	}
+	if _, isTransport := roundTripper.(*http.Transport); !isTransport {
+		return roundTripper
+	}
+	return &timeoutTransport{transport: roundTripper}
+}
+
+// Bounds the time to get a connection, the TLS handshake and the wait for the
+// response headers of each round trip, redirects and hedged attempts included,
+// with the timeouts carried by the context of the request
+type timeoutTransport struct {
+	transport http.RoundTripper
+}
+
+func (roundTripper *timeoutTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	timeouts, _ := request.Context().Value(transportTimeoutsKey{}).(Timeouts)
+	if !timeouts.hasTransportTimeouts() {
+		return roundTripper.transport.RoundTrip(request)
+	}
+	ctx, cancel := context.WithCancelCause(request.Context())
+	var mutex sync.Mutex
+	timers := map[string]*time.Timer{}
+	isDone := false
+	startTimer := func(phase string, timeout time.Duration) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		// Dials outlive the round trip that started them
+		if _, isRunning := timers[phase]; timeout > 0 && !isRunning && !isDone {
+			timers[phase] = time.AfterFunc(timeout, func() {
+				cancel(fmt.Errorf("%w: %s exceeded %s", ErrTimeout, phase, timeout))
+			})
+		}
+	}
+	stopTimer := func(phase string) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if timer, isRunning := timers[phase]; isRunning {
+			timer.Stop()
+			delete(timers, phase)
+		}
+	}
+	// The connection is established once dialed, which custom dialers don't
+	// report, or at the latest when the TLS handshake starts or it is handed out
+	trace := &httptrace.ClientTrace{
+		GetConn: func(string) { startTimer("connect", timeouts.Connect) },
+		ConnectDone: func(network string, address string, err error) {
+			if err == nil {
+				stopTimer("connect")
+			}
+		},
+		GotConn: func(httptrace.GotConnInfo) { stopTimer("connect") },
+		TLSHandshakeStart: func() {
+			stopTimer("connect")
+			startTimer("TLS handshake", timeouts.TLSHandshake)
+		},
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { stopTimer("TLS handshake") },
+		WroteRequest:         func(httptrace.WroteRequestInfo) { startTimer("response header", timeouts.ResponseHeader) },
+		GotFirstResponseByte: func() { stopTimer("response header") },
+	}
+	response, err := roundTripper.transport.RoundTrip(request.WithContext(httptrace.WithClientTrace(ctx, trace)))
+	mutex.Lock()
+	isDone = true
+	for _, timer := range timers {
+		timer.Stop()
+	}
+	mutex.Unlock()
+	if err != nil {
+		if cause := context.Cause(ctx); request.Context().Err() == nil && errors.Is(cause, ErrTimeout) {
+			err = fmt.Errorf("%w: %w", cause, err)
+		}
+		cancel(nil)
+		return nil, err
+	}
+	response.Body = &cancelOnCloseBody{ReadCloser: response.Body, cancel: func() { cancel(nil) }}
+	return response, nil
+}
@@ -0,0 +1,87 @@
+package http_proxy_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	http_proxy "github.com/AndreaCostanzo1/http-proxy/http_proxy"
+)
+
+const parallelSends = 20
+
+func TestConcurrentSend(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("X-Echo-Body", string(body))
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"status":"ok"}`))
+	}))
+	defer server.Close()
+
+	sendInParallel := func(t *testing.T, send func(int) (*http.Response, error)) {
+		var wg sync.WaitGroup
+		for i := 0; i < parallelSends; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				resp, err := send(i)
+				if err != nil {
+					t.Errorf("expected no error, got %v", err)
+					return
+				}
+				if body := resp.Header.Get("X-Echo-Body"); body != "test body" {
+					t.Errorf("expected body 'test body', got '%s'", body)
+				}
+			}(i)
+		}
+		wg.Wait()
+	}
+
+	t.Run("Parallel sends of the same request", func(t *testing.T) {
+		req := http_proxy.NewRequest("POST", server.URL).
+			SetBody(&nonSeekableReader{strings.NewReader("test body")}).
+			WithGenericInterceptor(func(body map[string]interface{}, response *http.Response) error {
+				return nil
+			})
+
+		sendInParallel(t, func(int) (*http.Response, error) {
+			return req.Send()
+		})
+	})
+
+	t.Run("Parallel sends of a request with a seekable body", func(t *testing.T) {
+		req := http_proxy.NewRequest("POST", server.URL).SetBody(&seekOnlyReader{strings.NewReader("test body")})
+
+		sendInParallel(t, func(int) (*http.Response, error) {
+			return req.Send()
+		})
+	})
+
+	t.Run("Parallel sends of requests derived from one template", func(t *testing.T) {
+		template := http_proxy.NewTemplate(http_proxy.NewRequest("POST", server.URL).
+			SetJWTAuthToken("token").
+			SetBody(strings.NewReader("test body")))
+
+		sendInParallel(t, func(i int) (*http.Response, error) {
+			return template.DerivePath("POST", "/items").
+				SetHeader("X-Index", strings.Repeat("i", i+1)).
+				Send()
+		})
+	})
+
+	t.Run("Parallel configuration and sends of the same request", func(t *testing.T) {
+		req := http_proxy.NewRequest("POST", server.URL).SetBody(strings.NewReader("test body"))
+
+		sendInParallel(t, func(i int) (*http.Response, error) {
+			req.WithStatusCodeInterceptor(http.StatusOK, func(body map[string]interface{}, response *http.Response) error {
+				return nil
+			})
+			req.Clone().AddHeader("X-Index", "value")
+			return req.Send()
+		})
+	})
+}
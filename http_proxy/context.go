@@ -5,6 +5,19 @@ import (
 )
 
 func (requestIntent *proxiedRequestImpl) WithContext(ctx context.Context) ProxiedRequest {
+	requestIntent.mutex.Lock()
+	defer requestIntent.mutex.Unlock()
 	requestIntent.context = ctx
 	return requestIntent
 }
+
+// Returns a context for a call outliving the send that started it. It carries
+// none of the values of ctx, like its spans and httptrace hooks, except for
+// the transport timeouts, which bound the connection setup
+func detachedContext(ctx context.Context) context.Context {
+	detached := context.Background()
+	if timeouts, isSet := ctx.Value(transportTimeoutsKey{}).(Timeouts); isSet {
+		detached = context.WithValue(detached, transportTimeoutsKey{}, timeouts)
+	}
+	return detached
+}
@@ -2,9 +2,11 @@ package http_proxy_test
 
 import (
 	"context"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	http_proxy "github.com/AndreaCostanzo1/http-proxy/http_proxy"
 )
@@ -49,4 +51,25 @@ func TestWithContext(t *testing.T) {
 			t.Errorf("expected no response due to canceled context, got %v", resp)
 		}
 	})
+	t.Run("WithContext applies to the sends after the first one", func(t *testing.T) {
+		server := slowServer(300 * time.Millisecond)
+		defer server.Close()
+
+		req := http_proxy.NewRequest("GET", server.URL)
+		if _, err := req.Send(); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		req.WithContext(ctx)
+		start := time.Now()
+		_, err := req.Send()
+
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expected context.DeadlineExceeded, got %v", err)
+		}
+		if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+			t.Errorf("expected the send to stop after about 50ms, got %s", elapsed)
+		}
+	})
 }
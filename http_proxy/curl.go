@@ -0,0 +1,163 @@
+package http_proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+func (requestIntent *proxiedRequestImpl) ToCurl(redactHeaders ...string) (string, error) {
+	requestIntent.mutex.Lock()
+	defer requestIntent.mutex.Unlock()
+	if buildErr := requestIntent.buildError(); buildErr != nil {
+		return "", buildErr
+	}
+	header := http.Header{}
+	for key, values := range requestIntent.headers {
+		for _, value := range values {
+			header.Add(key, value)
+		}
+	}
+	// Rendering a command must not cause token requests, so the token is not resolved
+	if requestIntent.tokenSource != nil {
+		if token, isCached := requestIntent.tokenSource.cachedToken(); isCached {
+			header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+		}
+	}
+	body, bodyErr := requestIntent.peekBody()
+	if bodyErr != nil {
+		return "", bodyErr
+	}
+
+	command := []string{"curl"}
+	switch {
+	case requestIntent.method == http.MethodHead:
+		command = append(command, "--head")
+	case requestIntent.method != http.MethodGet || len(body) > 0:
+		command = append(command, "-X", shellQuote(requestIntent.method))
+	}
+	command = append(command, shellQuote(requestIntent.url))
+	redacted := RedactHeader(header, redactHeaders)
+	names := make([]string, 0, len(redacted))
+	for name := range redacted {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range redacted[name] {
+			command = append(command, "-H", shellQuote(name+": "+value))
+		}
+	}
+	switch {
+	case bytes.IndexByte(body, 0) >= 0:
+		// Arguments can't contain NUL bytes, so the body is piped by printf
+		command = append([]string{"printf", shellQuote(printfFormat(body)), "|"}, command...)
+		command = append(command, "--data-binary", "@-")
+	case len(body) > 0:
+		// Unlike --data-binary, --data-raw doesn't read a file when the body starts with @
+		command = append(command, "--data-raw", shellQuote(string(body)))
+	}
+	return strings.Join(command, " "), nil
+}
+
+// Reads the body without consuming it. If the underlying request was
+// generated but not sent yet, its body is closed and reopened so that the
+// first send doesn't find a reader that was already read
+func (requestIntent *proxiedRequestImpl) peekBody() ([]byte, error) {
+	body, bodyErr := requestIntent.resolveBody()
+	if bodyErr != nil {
+		return nil, bodyErr
+	}
+	if !body.replayable {
+		return nil, ErrBodyNotReplayable
+	}
+	isUnsent := requestIntent.underlyingRequest != nil && requestIntent.attempts == 0
+	// Seekers over the buffer limit can't be opened while the request holds them
+	if isUnsent && requestIntent.underlyingRequest.Body != nil {
+		requestIntent.underlyingRequest.Body.Close()
+	}
+	reader, openErr := body.open()
+	if openErr != nil {
+		return nil, openErr
+	}
+	payload, readErr := io.ReadAll(reader)
+	reader.Close()
+	if readErr != nil {
+		return nil, readErr
+	}
+	if isUnsent {
+		if applyErr := body.applyTo(requestIntent.underlyingRequest); applyErr != nil {
+			return nil, applyErr
+		}
+	}
+	return payload, nil
+}
+
+// Quotes value for POSIX shells. Values with control characters or invalid
+// UTF-8 use ANSI-C quoting, supported by bash and zsh, since single quotes
+// can't represent them
+func shellQuote(value string) string {
+	if value != "" && strings.IndexFunc(value, needsQuoting) < 0 {
+		return value
+	}
+	if !utf8.ValidString(value) || strings.IndexFunc(value, isControl) >= 0 {
+		var quoted strings.Builder
+		quoted.WriteString("$'")
+		for index := 0; index < len(value); {
+			character, size := utf8.DecodeRuneInString(value[index:])
+			switch {
+			case character == utf8.RuneError && size <= 1:
+				fmt.Fprintf(&quoted, "\\x%02x", value[index])
+			case character == '\\' || character == '\'':
+				quoted.WriteString("\\" + string(character))
+			case character == '\n':
+				quoted.WriteString("\\n")
+			case character == '\t':
+				quoted.WriteString("\\t")
+			case character == '\r':
+				quoted.WriteString("\\r")
+			case isControl(character):
+				fmt.Fprintf(&quoted, "\\x%02x", character)
+			default:
+				quoted.WriteString(value[index : index+size])
+			}
+			index += size
+		}
+		quoted.WriteString("'")
+		return quoted.String()
+	}
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
+
+// Escapes body as a printf format string producing it
+func printfFormat(body []byte) string {
+	var format strings.Builder
+	for _, character := range body {
+		switch {
+		case character == '%':
+			format.WriteString("%%")
+		case character == '\\':
+			format.WriteString(`\\`)
+		case character >= 0x20 && character < 0x7f:
+			format.WriteByte(character)
+		default:
+			fmt.Fprintf(&format, "\\%03o", character)
+		}
+	}
+	return format.String()
+}
+
+// Reports whether the character needs quoting
+func needsQuoting(character rune) bool {
+	isPlain := character < utf8.RuneSelf && (unicode.IsLetter(character) || unicode.IsDigit(character) || strings.ContainsRune("-_./:=@%+,", character))
+	return !isPlain
+}
+
+func isControl(character rune) bool {
+	return character < 0x20 || character == 0x7f
+}
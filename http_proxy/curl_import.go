@@ -0,0 +1,624 @@
+package http_proxy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidCurlCommand = errors.New("invalid curl command")
+	ErrCurlFileNotAllowed = errors.New("curl command reads a file that is not allowed")
+)
+
+// Options of FromCurlWithOptions
+type CurlImportOptions struct {
+	// Directory the files referenced with @ and < are read from. Paths are
+	// relative to it and can't point outside of it. When empty, commands
+	// referencing files fail with ErrCurlFileNotAllowed
+	FileDir string
+}
+
+// Flags that don't change the request, with whether they take an argument
+var ignoredCurlFlags = map[string]bool{
+	"-s": false, "--silent": false, "-S": false, "--show-error": false,
+	"-v": false, "--verbose": false, "-i": false, "--include": false,
+	"-L": false, "--location": false, "-k": false, "--insecure": false,
+	"-f": false, "--fail": false, "--fail-with-body": false, "-#": false, "--progress-bar": false,
+	"--compressed": false, "-o": true, "--output": true, "-w": true, "--write-out": true,
+}
+
+// Maps the long names of the flags to their short form
+var curlFlagAliases = map[string]string{
+	"--request": "-X", "--header": "-H", "--data": "-d", "--data-ascii": "-d",
+	"--form": "-F", "--user": "-u", "--get": "-G", "--head": "-I",
+	"--user-agent": "-A", "--referer": "-e", "--cookie": "-b", "--max-time": "-m",
+}
+
+// Flags taking an argument, in their short form
+var curlFlagsWithArgument = map[string]bool{
+	"-X": true, "-H": true, "-d": true, "-F": true, "-u": true, "-A": true, "-e": true, "-b": true, "-m": true,
+	"--data-raw": true, "--data-binary": true, "--data-urlencode": true, "--json": true,
+	"--url": true, "--connect-timeout": true,
+}
+
+// Parses a curl command line into an equivalent request. It understands
+// POSIX shell quoting, ANSI-C quoting and line continuations, the flags
+// -X, -H, -d, --data-raw, --data-binary, --data-urlencode, --json, -F, -u,
+// -G, -I, -A, -e, -b, -m and --connect-timeout, and ignores the flags that
+// only affect the output of curl. Commands referencing files with @ or < fail
+// with ErrCurlFileNotAllowed, see FromCurlWithOptions to read them. The only
+// pipeline accepted is a printf format piped into the @- data of the command,
+// which is how ToCurl renders bodies with NUL bytes. --compressed needs no
+// translation since the default transport already asks for compressed
+// responses and decodes them
+func FromCurl(command string) (ProxiedRequest, error) {
+	return FromCurlWithOptions(command, CurlImportOptions{})
+}
+
+// Parses a curl command line like FromCurl. Files referenced with @ or <
+// are read from options.FileDir when the command is parsed
+func FromCurlWithOptions(command string, options CurlImportOptions) (ProxiedRequest, error) {
+	pipeline, splitErr := splitShellWords(command)
+	if splitErr != nil {
+		return nil, splitErr
+	}
+	var stdin []byte
+	switch len(pipeline) {
+	case 1:
+	case 2:
+		output, printfErr := printfOutput(pipeline[0])
+		if printfErr != nil {
+			return nil, printfErr
+		}
+		stdin = output
+	default:
+		return nil, fmt.Errorf("%w: only printf can be piped into curl", ErrInvalidCurlCommand)
+	}
+	words := pipeline[len(pipeline)-1]
+	if len(words) == 0 || words[0] != "curl" {
+		return nil, fmt.Errorf("%w: it must start with curl", ErrInvalidCurlCommand)
+	}
+	parsed, parseErr := parseCurlFlags(words[1:], options, stdin)
+	if parseErr != nil {
+		return nil, parseErr
+	}
+	return parsed.toRequest()
+}
+
+type curlCommand struct {
+	options CurlImportOptions
+	// Output of the printf piped into the command, nil if nothing is piped
+	stdin          []byte
+	method         string
+	url            string
+	headers        [][2]string
+	data           []string
+	isJSON         bool
+	formParts      []string
+	user           string
+	isGet          bool
+	isHead         bool
+	timeout        time.Duration
+	connectTimeout time.Duration
+}
+
+func parseCurlFlags(words []string, options CurlImportOptions, stdin []byte) (*curlCommand, error) {
+	parsed := &curlCommand{options: options, stdin: stdin}
+	for index := 0; index < len(words); index++ {
+		word := words[index]
+		if !strings.HasPrefix(word, "-") || word == "-" {
+			if parsed.url != "" {
+				return nil, fmt.Errorf("%w: unexpected argument %q", ErrInvalidCurlCommand, word)
+			}
+			parsed.url = word
+			continue
+		}
+		for _, flag := range expandCurlFlag(word) {
+			name, argument := flag[0], flag[1]
+			if takesArgument, isIgnored := ignoredCurlFlags[name]; isIgnored {
+				if takesArgument && argument == "" {
+					index++
+				}
+				continue
+			}
+			if alias, isAlias := curlFlagAliases[name]; isAlias {
+				name = alias
+			}
+			if curlFlagsWithArgument[name] && argument == "" {
+				index++
+				if index >= len(words) {
+					return nil, fmt.Errorf("%w: %s requires an argument", ErrInvalidCurlCommand, word)
+				}
+				argument = words[index]
+			}
+			if applyErr := parsed.apply(name, argument); applyErr != nil {
+				return nil, applyErr
+			}
+		}
+	}
+	if parsed.url == "" {
+		return nil, fmt.Errorf("%w: missing url", ErrInvalidCurlCommand)
+	}
+	return parsed, nil
+}
+
+// Splits a word into flags and their attached arguments, so that
+// -sSXPOST becomes -s, -S and -X with argument POST
+func expandCurlFlag(word string) [][2]string {
+	if strings.HasPrefix(word, "--") {
+		return [][2]string{{word, ""}}
+	}
+	flags := [][2]string{}
+	for index := 1; index < len(word); index++ {
+		name := "-" + string(word[index])
+		if (curlFlagsWithArgument[name] || ignoredCurlFlags[name]) && index+1 < len(word) {
+			return append(flags, [2]string{name, word[index+1:]})
+		}
+		flags = append(flags, [2]string{name, ""})
+	}
+	return flags
+}
+
+func (parsed *curlCommand) apply(name string, argument string) error {
+	switch name {
+	case "-X":
+		parsed.method = argument
+	case "-H":
+		key, value, isFound := strings.Cut(argument, ":")
+		if !isFound {
+			// "Name;" sends the header with an empty value
+			if key, isEmpty := strings.CutSuffix(argument, ";"); isEmpty {
+				parsed.headers = append(parsed.headers, [2]string{strings.TrimSpace(key), ""})
+				return nil
+			}
+			return fmt.Errorf("%w: invalid header %q", ErrInvalidCurlCommand, argument)
+		}
+		parsed.headers = append(parsed.headers, [2]string{strings.TrimSpace(key), strings.TrimSpace(value)})
+	case "-d":
+		data, readErr := parsed.readData(argument, true)
+		if readErr != nil {
+			return readErr
+		}
+		parsed.data = append(parsed.data, data)
+	case "--data-binary":
+		data, readErr := parsed.readData(argument, false)
+		if readErr != nil {
+			return readErr
+		}
+		parsed.data = append(parsed.data, data)
+	case "--data-raw":
+		parsed.data = append(parsed.data, argument)
+	case "--json":
+		data, readErr := parsed.readData(argument, false)
+		if readErr != nil {
+			return readErr
+		}
+		parsed.data = append(parsed.data, data)
+		parsed.isJSON = true
+	case "--data-urlencode":
+		data, encodeErr := parsed.urlencodeData(argument)
+		if encodeErr != nil {
+			return encodeErr
+		}
+		parsed.data = append(parsed.data, data)
+	case "-F":
+		parsed.formParts = append(parsed.formParts, argument)
+	case "-u":
+		parsed.user = argument
+	case "-G":
+		parsed.isGet = true
+	case "-I":
+		parsed.isHead = true
+	case "-A":
+		parsed.headers = append(parsed.headers, [2]string{"User-Agent", argument})
+	case "-e":
+		parsed.headers = append(parsed.headers, [2]string{"Referer", argument})
+	case "-b":
+		if !strings.Contains(argument, "=") {
+			return fmt.Errorf("%w: cookie files are not supported", ErrInvalidCurlCommand)
+		}
+		parsed.headers = append(parsed.headers, [2]string{"Cookie", argument})
+	case "-m", "--connect-timeout":
+		seconds, parseErr := strconv.ParseFloat(argument, 64)
+		if parseErr != nil {
+			return fmt.Errorf("%w: invalid timeout %q", ErrInvalidCurlCommand, argument)
+		}
+		if name == "-m" {
+			parsed.timeout = time.Duration(seconds * float64(time.Second))
+		} else {
+			parsed.connectTimeout = time.Duration(seconds * float64(time.Second))
+		}
+	case "--url":
+		parsed.url = argument
+	default:
+		return fmt.Errorf("%w: unsupported flag %s", ErrInvalidCurlCommand, name)
+	}
+	return nil
+}
+
+func (parsed *curlCommand) toRequest() (ProxiedRequest, error) {
+	requestURL := parsed.url
+	if !strings.Contains(requestURL, "://") {
+		requestURL = "http://" + requestURL
+	}
+	data := strings.Join(parsed.data, "&")
+	method := "GET"
+	switch {
+	case parsed.isHead:
+		method = "HEAD"
+	case parsed.isGet:
+		if len(parsed.data) > 0 {
+			separator := "?"
+			if strings.Contains(requestURL, "?") {
+				separator = "&"
+			}
+			requestURL += separator + data
+		}
+	case len(parsed.data) > 0 || len(parsed.formParts) > 0:
+		method = "POST"
+	}
+	if parsed.method != "" {
+		method = parsed.method
+	}
+	if len(parsed.data) > 0 && len(parsed.formParts) > 0 && !parsed.isGet {
+		return nil, fmt.Errorf("%w: -d and -F can't be used together", ErrInvalidCurlCommand)
+	}
+
+	request := NewRequest(method, requestURL)
+	hasContentType, hasAccept := false, false
+	for _, header := range parsed.headers {
+		hasContentType = hasContentType || strings.EqualFold(header[0], "Content-Type")
+		hasAccept = hasAccept || strings.EqualFold(header[0], "Accept")
+		request.AddHeader(header[0], header[1])
+	}
+	if parsed.user != "" {
+		request.SetHeader("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(parsed.user)))
+	}
+	switch {
+	case len(parsed.formParts) > 0:
+		body, contentType, formErr := parsed.buildForm()
+		if formErr != nil {
+			return nil, formErr
+		}
+		request.SetBody(body)
+		if !hasContentType {
+			request.SetHeader("Content-Type", contentType)
+		}
+	case len(parsed.data) > 0 && !parsed.isGet:
+		request.SetBody(strings.NewReader(data))
+		if parsed.isJSON && !hasAccept {
+			request.SetHeader("Accept", "application/json")
+		}
+		if !hasContentType && parsed.isJSON {
+			request.SetHeader("Content-Type", "application/json")
+		} else if !hasContentType {
+			request.SetHeader("Content-Type", "application/x-www-form-urlencoded")
+		}
+	}
+	if parsed.timeout > 0 || parsed.connectTimeout > 0 {
+		request.WithTimeouts(Timeouts{Total: parsed.timeout, Connect: parsed.connectTimeout})
+	}
+	request.mutex.Lock()
+	defer request.mutex.Unlock()
+	if buildErr := request.buildError(); buildErr != nil {
+		return nil, buildErr
+	}
+	return request, nil
+}
+
+// Returns the data of -d, --data-binary and --json, reading it from a file when
+// it starts with @. Like curl, -d strips carriage returns and newlines from files
+func (parsed *curlCommand) readData(argument string, stripNewlines bool) (string, error) {
+	fileName, isFile := strings.CutPrefix(argument, "@")
+	if !isFile {
+		return argument, nil
+	}
+	content, readErr := parsed.readFile(fileName)
+	if readErr != nil {
+		return "", readErr
+	}
+	if stripNewlines {
+		content = bytes.ReplaceAll(bytes.ReplaceAll(content, []byte("\r"), nil), []byte("\n"), nil)
+	}
+	return string(content), nil
+}
+
+// Encodes the argument of --data-urlencode, which has one of the forms
+// content, =content, name=content, @file and name@file
+func (parsed *curlCommand) urlencodeData(argument string) (string, error) {
+	if equalIndex := strings.Index(argument, "="); equalIndex >= 0 && !strings.Contains(argument[:equalIndex], "@") {
+		name, content := argument[:equalIndex], argument[equalIndex+1:]
+		if name == "" {
+			return url.QueryEscape(content), nil
+		}
+		return name + "=" + url.QueryEscape(content), nil
+	}
+	if name, fileName, isFile := strings.Cut(argument, "@"); isFile {
+		content, readErr := parsed.readFile(fileName)
+		if readErr != nil {
+			return "", readErr
+		}
+		if name == "" {
+			return url.QueryEscape(string(content)), nil
+		}
+		return name + "=" + url.QueryEscape(string(content)), nil
+	}
+	return url.QueryEscape(argument), nil
+}
+
+// Builds a multipart body from the arguments of -F: name=value, name=@file
+// to upload a file and name=<file to send the content of a file as value.
+// A ;type= suffix sets the content type of the part
+func (parsed *curlCommand) buildForm() (io.Reader, string, error) {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	for _, part := range parsed.formParts {
+		name, value, isFound := strings.Cut(part, "=")
+		if !isFound {
+			return nil, "", fmt.Errorf("%w: invalid form part %q", ErrInvalidCurlCommand, part)
+		}
+		contentType := ""
+		if before, partType, hasType := strings.Cut(value, ";type="); hasType {
+			value, contentType = before, partType
+		}
+		header := textproto.MIMEHeader{}
+		var content []byte
+		switch {
+		case strings.HasPrefix(value, "@"):
+			fileContent, readErr := parsed.readFile(value[1:])
+			if readErr != nil {
+				return nil, "", readErr
+			}
+			content = fileContent
+			header.Set("Content-Disposition", fmt.Sprintf(`form-data; name=%q; filename=%q`, name, filepath.Base(value[1:])))
+			if contentType == "" {
+				contentType = "application/octet-stream"
+			}
+		case strings.HasPrefix(value, "<"):
+			fileContent, readErr := parsed.readFile(value[1:])
+			if readErr != nil {
+				return nil, "", readErr
+			}
+			content = fileContent
+			header.Set("Content-Disposition", fmt.Sprintf(`form-data; name=%q`, name))
+		default:
+			content = []byte(value)
+			header.Set("Content-Disposition", fmt.Sprintf(`form-data; name=%q`, name))
+		}
+		if contentType != "" {
+			header.Set("Content-Type", contentType)
+		}
+		partWriter, createErr := writer.CreatePart(header)
+		if createErr != nil {
+			return nil, "", createErr
+		}
+		partWriter.Write(content)
+	}
+	if closeErr := writer.Close(); closeErr != nil {
+		return nil, "", closeErr
+	}
+	return &body, writer.FormDataContentType(), nil
+}
+
+// Reads a file referenced by the command, which must be inside options.FileDir
+func (parsed *curlCommand) readFile(fileName string) ([]byte, error) {
+	if fileName == "-" {
+		if parsed.stdin == nil {
+			return nil, fmt.Errorf("%w: reading from stdin is not supported", ErrInvalidCurlCommand)
+		}
+		return parsed.stdin, nil
+	}
+	if parsed.options.FileDir == "" {
+		return nil, fmt.Errorf("%w: %s", ErrCurlFileNotAllowed, fileName)
+	}
+	if !filepath.IsLocal(fileName) {
+		return nil, fmt.Errorf("%w: %s is outside of %s", ErrCurlFileNotAllowed, fileName, parsed.options.FileDir)
+	}
+	// Symbolic links are resolved so that they can't point outside of the directory
+	resolvedDir, dirErr := filepath.EvalSymlinks(parsed.options.FileDir)
+	if dirErr != nil {
+		return nil, dirErr
+	}
+	resolvedFile, fileErr := filepath.EvalSymlinks(filepath.Join(resolvedDir, fileName))
+	if fileErr != nil {
+		return nil, fileErr
+	}
+	if relative, relErr := filepath.Rel(resolvedDir, resolvedFile); relErr != nil || !filepath.IsLocal(relative) {
+		return nil, fmt.Errorf("%w: %s is outside of %s", ErrCurlFileNotAllowed, fileName, parsed.options.FileDir)
+	}
+	return os.ReadFile(resolvedFile)
+}
+
+// Splits a command line into the words of the commands of its pipeline
+// following the POSIX shell quoting rules, plus the ANSI-C $'...' quoting of
+// bash. Variables and command substitutions are kept verbatim, while
+// operators other than pipes, like redirections, are rejected
+func splitShellWords(command string) ([][]string, error) {
+	pipeline := [][]string{}
+	words := []string{}
+	var word strings.Builder
+	isInWord := false
+	for index := 0; index < len(command); index++ {
+		character := command[index]
+		switch {
+		case character == '\\':
+			if index+1 < len(command) {
+				index++
+				if command[index] != '\n' {
+					word.WriteByte(command[index])
+					isInWord = true
+				}
+			}
+		case character == '\'':
+			end := strings.IndexByte(command[index+1:], '\'')
+			if end < 0 {
+				return nil, fmt.Errorf("%w: unterminated single quote", ErrInvalidCurlCommand)
+			}
+			word.WriteString(command[index+1 : index+1+end])
+			index += end + 1
+			isInWord = true
+		case character == '"':
+			end, quoteErr := readDoubleQuoted(command, index+1, &word)
+			if quoteErr != nil {
+				return nil, quoteErr
+			}
+			index = end
+			isInWord = true
+		case character == '$' && index+1 < len(command) && command[index+1] == '\'':
+			end, quoteErr := readANSIQuoted(command, index+2, &word)
+			if quoteErr != nil {
+				return nil, quoteErr
+			}
+			index = end
+			isInWord = true
+		case character == ' ' || character == '\t' || character == '\n' || character == '\r':
+			if isInWord {
+				words = append(words, word.String())
+				word.Reset()
+				isInWord = false
+			}
+		case character == '|':
+			if isInWord {
+				words = append(words, word.String())
+				word.Reset()
+				isInWord = false
+			}
+			if len(words) == 0 {
+				return nil, fmt.Errorf("%w: empty command in pipeline", ErrInvalidCurlCommand)
+			}
+			pipeline = append(pipeline, words)
+			words = []string{}
+		case strings.IndexByte("&;<>()`", character) >= 0:
+			return nil, fmt.Errorf("%w: unsupported shell operator %q", ErrInvalidCurlCommand, character)
+		default:
+			word.WriteByte(character)
+			isInWord = true
+		}
+	}
+	if isInWord {
+		words = append(words, word.String())
+	}
+	if len(pipeline) > 0 && len(words) == 0 {
+		return nil, fmt.Errorf("%w: empty command in pipeline", ErrInvalidCurlCommand)
+	}
+	return append(pipeline, words), nil
+}
+
+// Returns the output of a printf command with a single format argument,
+// which can contain %% and the backslash escapes of printf
+func printfOutput(words []string) ([]byte, error) {
+	if len(words) != 2 || words[0] != "printf" {
+		return nil, fmt.Errorf("%w: only printf can be piped into curl", ErrInvalidCurlCommand)
+	}
+	escapes := map[byte]byte{'n': '\n', 't': '\t', 'r': '\r', 'a': '\a', 'b': '\b', 'f': '\f', 'v': '\v', '\\': '\\', '"': '"'}
+	format := words[1]
+	var output bytes.Buffer
+	for index := 0; index < len(format); index++ {
+		character := format[index]
+		switch {
+		case character == '%':
+			if index+1 >= len(format) || format[index+1] != '%' {
+				return nil, fmt.Errorf("%w: printf conversions are not supported", ErrInvalidCurlCommand)
+			}
+			output.WriteByte('%')
+			index++
+		case character == '\\' && index+1 < len(format):
+			index++
+			if replacement, isFound := escapes[format[index]]; isFound {
+				output.WriteByte(replacement)
+				continue
+			}
+			end := index
+			for end < len(format) && end-index < 3 && isDigitInBase(format[end], 8) {
+				end++
+			}
+			if end == index {
+				output.WriteByte('\\')
+				output.WriteByte(format[index])
+				continue
+			}
+			value, _ := strconv.ParseUint(format[index:end], 8, 8)
+			output.WriteByte(byte(value))
+			index = end - 1
+		default:
+			output.WriteByte(character)
+		}
+	}
+	return output.Bytes(), nil
+}
+
+// Reads a double quoted string starting at start, where a backslash escapes
+// only $, `, ", \ and newline. It returns the index of the closing quote
+func readDoubleQuoted(command string, start int, word *strings.Builder) (int, error) {
+	for index := start; index < len(command); index++ {
+		switch character := command[index]; {
+		case character == '"':
+			return index, nil
+		case character == '\\' && index+1 < len(command) && strings.IndexByte("$`\"\\\n", command[index+1]) >= 0:
+			index++
+			if command[index] != '\n' {
+				word.WriteByte(command[index])
+			}
+		default:
+			word.WriteByte(character)
+		}
+	}
+	return 0, fmt.Errorf("%w: unterminated double quote", ErrInvalidCurlCommand)
+}
+
+// Reads an ANSI-C quoted string starting at start. It returns the index of the closing quote
+func readANSIQuoted(command string, start int, word *strings.Builder) (int, error) {
+	escapes := map[byte]byte{'n': '\n', 't': '\t', 'r': '\r', 'a': '\a', 'b': '\b', 'e': 0x1b, 'E': 0x1b, 'f': '\f', 'v': '\v', '\\': '\\', '\'': '\'', '"': '"', '?': '?'}
+	for index := start; index < len(command); index++ {
+		character := command[index]
+		if character == '\'' {
+			return index, nil
+		}
+		if character != '\\' || index+1 >= len(command) {
+			word.WriteByte(character)
+			continue
+		}
+		index++
+		escape := command[index]
+		if replacement, isFound := escapes[escape]; isFound {
+			word.WriteByte(replacement)
+			continue
+		}
+		base, digits, maxDigits := 8, index, 3
+		if escape == 'x' {
+			base, digits, maxDigits = 16, index+1, 2
+		} else if escape < '0' || escape > '7' {
+			word.WriteByte('\\')
+			word.WriteByte(escape)
+			continue
+		}
+		end := digits
+		for end < len(command) && end-digits < maxDigits && isDigitInBase(command[end], base) {
+			end++
+		}
+		if end == digits {
+			word.WriteString("\\x")
+			continue
+		}
+		value, _ := strconv.ParseUint(command[digits:end], base, 8)
+		word.WriteByte(byte(value))
+		index = end - 1
+	}
+	return 0, fmt.Errorf("%w: unterminated ANSI-C quote", ErrInvalidCurlCommand)
+}
+
+func isDigitInBase(character byte, base int) bool {
+	_, parseErr := strconv.ParseUint(string(character), base, 8)
+	return parseErr == nil
+}
@@ -0,0 +1,418 @@
+package http_proxy_test
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	http_proxy "github.com/AndreaCostanzo1/http-proxy/http_proxy"
+)
+
+func TestToCurl(t *testing.T) {
+	t.Run("ToCurl renders method, URL, headers and body", func(t *testing.T) {
+		command, err := http_proxy.NewRequest("POST", "https://api.example.com/items?page=1&sort=name").
+			SetHeader("X-Custom-Header", "it's").
+			SetJSONBody(map[string]string{"name": "item"}).
+			ToCurl()
+
+		expected := `curl -X POST 'https://api.example.com/items?page=1&sort=name' -H 'Content-Type: application/json' -H 'X-Custom-Header: it'\''s' --data-raw '{"name":"item"}'`
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if command != expected {
+			t.Errorf("expected command %s, got %s", expected, command)
+		}
+	})
+
+	t.Run("ToCurl redacts the listed headers", func(t *testing.T) {
+		command, _ := http_proxy.NewRequest("GET", "https://api.example.com").
+			SetJWTAuthToken("secret-token").
+			ToCurl(http_proxy.DefaultRedactedHeaders...)
+
+		if strings.Contains(command, "secret-token") || !strings.Contains(command, "'Authorization: "+http_proxy.REDACTED+"'") {
+			t.Errorf("expected the Authorization header to be redacted, got %s", command)
+		}
+	})
+
+	t.Run("ToCurl doesn't refresh or mint JWTs", func(t *testing.T) {
+		expiredToken := unsignedToken(map[string]interface{}{"exp": time.Now().Add(-time.Hour).Unix()})
+		refreshes := 0
+		command, err := http_proxy.NewRequest("GET", "https://api.example.com").
+			SetValidatedJWTAuthToken(expiredToken, http_proxy.JWTValidation{Refresh: func(string) (string, error) {
+				refreshes++
+				return unsignedToken(map[string]interface{}{"exp": time.Now().Add(time.Hour).Unix()}), nil
+			}}).
+			ToCurl()
+
+		if err != nil || refreshes != 0 {
+			t.Errorf("expected no refresh and no error, got %d refreshes and %v", refreshes, err)
+		}
+		if !strings.Contains(command, "'Authorization: Bearer "+expiredToken+"'") {
+			t.Errorf("expected the token currently held, got %s", command)
+		}
+
+		tokens := make(chan string, 1)
+		server := bearerServer(tokens)
+		defer server.Close()
+		signer := http_proxy.NewHS256Signer([]byte("secret"), time.Hour)
+		req := http_proxy.NewRequest("GET", server.URL).WithJWTSigner(signer)
+		command, _ = req.ToCurl()
+		if strings.Contains(command, "Authorization") {
+			t.Errorf("expected no token before the signer mints one, got %s", command)
+		}
+		if _, err := req.Send(); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		mintedToken := <-tokens
+		command, _ = req.ToCurl()
+		if !strings.Contains(command, "'Authorization: Bearer "+mintedToken+"'") {
+			t.Errorf("expected the minted token %s, got %s", mintedToken, command)
+		}
+	})
+
+	t.Run("ToCurl doesn't consume the body", func(t *testing.T) {
+		received := make(chan string, 1)
+		server := echoBodyServer(received)
+		defer server.Close()
+
+		for _, body := range []io.Reader{strings.NewReader("seekable"), &nonSeekableReader{reader: strings.NewReader("buffered")}} {
+			req := http_proxy.NewRequest("PUT", server.URL).SetBody(body)
+			req.UnderlyingRequest()
+			command, err := req.ToCurl()
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if _, err := req.Send(); err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if sent := <-received; !strings.HasSuffix(command, "--data-raw "+sent) {
+				t.Errorf("expected body '%s' to be sent and rendered, got %s", sent, command)
+			}
+		}
+	})
+
+	t.Run("ToCurl closes the body of the generated request it replaces", func(t *testing.T) {
+		received := make(chan string, 1)
+		server := echoBodyServer(received)
+		defer server.Close()
+
+		var opened, closed atomic.Int32
+		req := http_proxy.NewRequest("PUT", server.URL).SetBodyFactory(func() (io.Reader, error) {
+			opened.Add(1)
+			return &closeCountingReader{Reader: strings.NewReader("payload"), closed: &closed}, nil
+		})
+		req.UnderlyingRequest()
+		if _, err := req.ToCurl(); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if _, err := req.Send(); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		<-received
+
+		if closed.Load() != opened.Load() {
+			t.Errorf("expected the %d opened bodies to be closed, got %d", opened.Load(), closed.Load())
+		}
+	})
+
+	t.Run("ToCurl reads seekable bodies over the buffer limit of a generated request", func(t *testing.T) {
+		received := make(chan string, 1)
+		server := echoBodyServer(received)
+		defer server.Close()
+
+		req := http_proxy.NewRequest("PUT", server.URL).WithBodyBufferLimit(4).SetBody(&seekOnlyReader{reader: strings.NewReader("payload")})
+		req.UnderlyingRequest()
+		command, err := req.ToCurl()
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if _, err := req.Send(); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if sent := <-received; sent != "payload" || !strings.HasSuffix(command, "--data-raw payload") {
+			t.Errorf("expected body 'payload' to be sent and rendered, got '%s' and %s", sent, command)
+		}
+	})
+
+	t.Run("ToCurl renders bodies starting with @ as data", func(t *testing.T) {
+		command, _ := http_proxy.NewRequest("POST", "https://api.example.com").SetBody(strings.NewReader("@/etc/passwd")).ToCurl()
+
+		if expected := "curl -X POST https://api.example.com --data-raw @/etc/passwd"; command != expected {
+			t.Errorf("expected command %s, got %s", expected, command)
+		}
+	})
+
+	t.Run("ToCurl reports request errors", func(t *testing.T) {
+		if _, err := http_proxy.NewRequest("BAD METHOD", "https://api.example.com").ToCurl(); err == nil {
+			t.Errorf("expected an error due to the invalid method, got none")
+		}
+	})
+
+	t.Run("The command reproduces the request", func(t *testing.T) {
+		if _, lookErr := exec.LookPath("curl"); lookErr != nil {
+			t.Skip("curl is not installed")
+		}
+		if _, lookErr := exec.LookPath("bash"); lookErr != nil {
+			t.Skip("bash is not installed")
+		}
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			w.Write([]byte(r.Method + " " + r.URL.RequestURI() + " " + r.Header.Get("X-Quote") + " "))
+			w.Write(body)
+		}))
+		defer server.Close()
+		secretFile := filepath.Join(t.TempDir(), "secret")
+		os.WriteFile(secretFile, []byte("secret"), 0o600)
+		for _, body := range []string{"line one\nit's\t$HOME `id` \\ \xff", "binary \x00\x01%s\\0", "@" + secretFile} {
+			command, _ := http_proxy.NewRequest("PATCH", server.URL+"/path?q=a%20b&x=$y").
+				SetHeader("X-Quote", `"double" 'single' $(id)`).
+				SetBody(strings.NewReader(body)).
+				ToCurl()
+			output, err := exec.Command("bash", "-c", command+" --silent").Output()
+
+			expected := "PATCH /path?q=a%20b&x=$y \"double\" 'single' $(id) " + body
+			if err != nil {
+				t.Fatalf("expected curl to succeed, got %v", err)
+			}
+			if string(output) != expected {
+				t.Errorf("expected output %q, got %q", expected, output)
+			}
+		}
+	})
+}
+
+// Echoes the method, URL, headers and body of the received request
+func requestEchoServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("X-Echo-Method", r.Method)
+		w.Header().Set("X-Echo-URL", r.URL.RequestURI())
+		w.Header().Set("X-Echo-Host", r.Host)
+		w.Header().Set("X-Echo-Content-Type", r.Header.Get("Content-Type"))
+		w.Header().Set("X-Echo-Authorization", r.Header.Get("Authorization"))
+		w.Header().Set("X-Echo-Accept", r.Header.Get("Accept"))
+		w.Header()["X-Echo-Custom"] = r.Header.Values("X-Custom-Header")
+		w.Write(body)
+	}))
+}
+
+func TestFromCurl(t *testing.T) {
+	server := requestEchoServer()
+	defer server.Close()
+
+	testCases := []struct {
+		name                string
+		command             string
+		expectedMethod      string
+		expectedURL         string
+		expectedContentType string
+		expectedBody        string
+	}{
+		{"GET with headers", `curl -H 'X-Custom-Header: a' --header "X-Custom-Header: b" URL/items`, "GET", "/items", "", ""},
+		{"Data implies POST", `curl URL -d 'name=item' -d "quantity=2"`, "POST", "/", "application/x-www-form-urlencoded", "name=item&quantity=2"},
+		{"Explicit method and raw data", `curl -sS -XPUT URL --data-raw '@not-a-file' -H 'Content-Type: text/plain'`, "PUT", "/", "text/plain", "@not-a-file"},
+		{"URL encoded data", `curl URL --data-urlencode 'q=a b&c' --data-urlencode '=x/y'`, "POST", "/", "application/x-www-form-urlencoded", "q=a+b%26c&x%2Fy"},
+		{"GET with data in the query", `curl -G URL/search -d q=go --data-urlencode 'tag=a b'`, "GET", "/search?q=go&tag=a+b", "", ""},
+		{"JSON with line continuations", "curl URL \\\n  --json '{\"name\": \"item\"}' \\\n  --compressed -L", "POST", "/", "application/json", `{"name": "item"}`},
+		{"ANSI-C quoting", `curl URL --data-binary $'line\none\x21'`, "POST", "/", "application/x-www-form-urlencoded", "line\none!"},
+		{"HEAD", `curl -I URL`, "HEAD", "/", "", ""},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			req, err := http_proxy.FromCurl(strings.ReplaceAll(testCase.command, "URL", server.URL))
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			resp, body := sendAndRead(t, req)
+
+			if value := resp.Header.Get("X-Echo-Method"); value != testCase.expectedMethod {
+				t.Errorf("expected method '%s', got '%s'", testCase.expectedMethod, value)
+			}
+			if value := resp.Header.Get("X-Echo-URL"); value != testCase.expectedURL {
+				t.Errorf("expected URL '%s', got '%s'", testCase.expectedURL, value)
+			}
+			if value := resp.Header.Get("X-Echo-Content-Type"); value != testCase.expectedContentType {
+				t.Errorf("expected Content-Type '%s', got '%s'", testCase.expectedContentType, value)
+			}
+			if body != testCase.expectedBody {
+				t.Errorf("expected body '%s', got '%s'", testCase.expectedBody, body)
+			}
+		})
+	}
+
+	t.Run("Repeated headers are all sent", func(t *testing.T) {
+		req, _ := http_proxy.FromCurl(`curl -H 'X-Custom-Header: a' -H 'X-Custom-Header: b' ` + server.URL)
+		resp, _ := sendAndRead(t, req)
+
+		if values := resp.Header.Values("X-Echo-Custom"); strings.Join(values, ",") != "a,b" {
+			t.Errorf("expected header values [a b], got %v", values)
+		}
+	})
+
+	t.Run("The Host header sets the host of the request", func(t *testing.T) {
+		req, _ := http_proxy.FromCurl(`curl -H 'Host: api.example.com' ` + server.URL)
+		resp, _ := sendAndRead(t, req)
+
+		if host := resp.Header.Get("X-Echo-Host"); host != "api.example.com" {
+			t.Errorf("expected host 'api.example.com', got '%s'", host)
+		}
+	})
+
+	t.Run("Basic authentication", func(t *testing.T) {
+		req, _ := http_proxy.FromCurl(`curl -u 'user:pa ss' ` + server.URL)
+		resp, _ := sendAndRead(t, req)
+
+		if value := resp.Header.Get("X-Echo-Authorization"); value != "Basic dXNlcjpwYSBzcw==" {
+			t.Errorf("expected basic credentials, got '%s'", value)
+		}
+	})
+
+	t.Run("Multipart forms", func(t *testing.T) {
+		directory := t.TempDir()
+		os.WriteFile(filepath.Join(directory, "report.csv"), []byte("a,b\n1,2\n"), 0o600)
+		options := http_proxy.CurlImportOptions{FileDir: directory}
+		req, err := http_proxy.FromCurlWithOptions(`curl -F 'title=Report' -F "file=@report.csv;type=text/csv" `+server.URL, options)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		resp, body := sendAndRead(t, req)
+
+		_, params, _ := mime.ParseMediaType(resp.Header.Get("X-Echo-Content-Type"))
+		form, err := multipart.NewReader(strings.NewReader(body), params["boundary"]).ReadForm(1 << 20)
+		if err != nil {
+			t.Fatalf("expected a multipart body, got %v", err)
+		}
+		if value := form.Value["title"]; len(value) != 1 || value[0] != "Report" {
+			t.Errorf("expected field title 'Report', got %v", value)
+		}
+		files := form.File["file"]
+		if len(files) != 1 || files[0].Filename != "report.csv" || files[0].Header.Get("Content-Type") != "text/csv" {
+			t.Fatalf("expected file report.csv of type text/csv, got %v", files)
+		}
+	})
+
+	t.Run("Files are read from the configured directory only", func(t *testing.T) {
+		parent := t.TempDir()
+		directory := filepath.Join(parent, "snippets")
+		os.Mkdir(directory, 0o700)
+		os.WriteFile(filepath.Join(directory, "body.txt"), []byte("from file\n"), 0o600)
+		os.WriteFile(filepath.Join(parent, "secret"), []byte("secret"), 0o600)
+		os.Symlink(filepath.Join(parent, "secret"), filepath.Join(directory, "link"))
+		options := http_proxy.CurlImportOptions{FileDir: directory}
+
+		req, err := http_proxy.FromCurlWithOptions(`curl -d @body.txt `+server.URL, options)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if _, body := sendAndRead(t, req); body != "from file" {
+			t.Errorf("expected body 'from file', got '%s'", body)
+		}
+		for _, command := range []string{
+			`curl -d @../secret ` + server.URL,
+			`curl -d @` + filepath.Join(parent, "secret") + ` ` + server.URL,
+			`curl --data-urlencode name@link ` + server.URL,
+			`curl -F 'file=<../secret' ` + server.URL,
+		} {
+			if _, err := http_proxy.FromCurlWithOptions(command, options); !errors.Is(err, http_proxy.ErrCurlFileNotAllowed) {
+				t.Errorf("expected ErrCurlFileNotAllowed for %s, got %v", command, err)
+			}
+		}
+	})
+
+	t.Run("Files are not read by default", func(t *testing.T) {
+		fileName := filepath.Join(t.TempDir(), "secret")
+		os.WriteFile(fileName, []byte("secret"), 0o600)
+		for _, command := range []string{
+			`curl -d @` + fileName + ` ` + server.URL,
+			`curl --json @` + fileName + ` ` + server.URL,
+			`curl -F file=@` + fileName + ` ` + server.URL,
+		} {
+			if _, err := http_proxy.FromCurl(command); !errors.Is(err, http_proxy.ErrCurlFileNotAllowed) {
+				t.Errorf("expected ErrCurlFileNotAllowed for %s, got %v", command, err)
+			}
+		}
+	})
+
+	t.Run("JSON keeps the Accept header of the command", func(t *testing.T) {
+		req, _ := http_proxy.FromCurl(`curl -H 'Accept: application/vnd.api+json' --json '{}' ` + server.URL)
+		resp, _ := sendAndRead(t, req)
+
+		if value := resp.Header.Get("X-Echo-Accept"); value != "application/vnd.api+json" {
+			t.Errorf("expected Accept 'application/vnd.api+json', got '%s'", value)
+		}
+	})
+
+	t.Run("ToCurl output can be imported", func(t *testing.T) {
+		original := http_proxy.NewRequest("PATCH", server.URL+"/items?id=1").
+			SetHeader("X-Custom-Header", `it's "quoted"`).
+			SetJSONBody(map[string]string{"name": "new\tname"})
+		command, _ := original.ToCurl()
+		imported, err := http_proxy.FromCurl(command)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		importedCommand, _ := imported.ToCurl()
+
+		if importedCommand != command {
+			t.Errorf("expected the imported request to render as %s, got %s", command, importedCommand)
+		}
+	})
+
+	t.Run("ToCurl output with binary bodies can be imported", func(t *testing.T) {
+		body := "binary \x00\x01\xff%s\\0 it's\n"
+		command, _ := http_proxy.NewRequest("PUT", server.URL).SetBody(strings.NewReader(body)).ToCurl()
+		imported, err := http_proxy.FromCurl(command)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		resp, importedBody := sendAndRead(t, imported)
+
+		if method := resp.Header.Get("X-Echo-Method"); method != "PUT" || importedBody != body {
+			t.Errorf("expected PUT with body %q, got %s with %q", body, method, importedBody)
+		}
+	})
+
+	invalidCommands := []string{
+		`wget http://example.com`,
+		`curl`,
+		`curl 'http://example.com`,
+		`curl http://example.com | jq .`,
+		`printf '%s' body | curl -d @- http://example.com`,
+		`cat body | curl -d @- http://example.com`,
+		`printf body | | curl -d @- http://example.com`,
+		`curl -d @- http://example.com`,
+		`curl --unknown-flag http://example.com`,
+		`curl -H 'no separator' http://example.com`,
+		`curl -X 'BAD METHOD' http://example.com`,
+		`curl -d @/does/not/exist http://example.com`,
+	}
+	for _, command := range invalidCommands {
+		t.Run("Invalid command "+command, func(t *testing.T) {
+			if _, err := http_proxy.FromCurl(command); err == nil {
+				t.Errorf("expected an error, got none")
+			}
+		})
+	}
+}
+
+// Counts the calls to Close
+type closeCountingReader struct {
+	io.Reader
+	closed *atomic.Int32
+}
+
+func (reader *closeCountingReader) Close() error {
+	reader.closed.Add(1)
+	return nil
+}
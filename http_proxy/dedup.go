@@ -0,0 +1,239 @@
+package http_proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+)
+
+// Responses bigger than this are not shared unless the group is configured otherwise
+const DEFAULT_DEDUP_BODY_LIMIT int64 = 1 << 20
+
+// Computes the key identifying identical requests
+type DedupKeyFunc = func(request *http.Request) string
+
+// Returns a key function matching requests with the same method, URL,
+// credentials and values of the provided headers. The Authorization and
+// Cookie headers are always part of the key, so that requests sent on
+// behalf of different users are never shared
+func DedupKey(headers ...string) DedupKeyFunc {
+	headers = append([]string{"Authorization", "Cookie"}, headers...)
+	return func(request *http.Request) string {
+		var key strings.Builder
+		key.WriteString(request.Method + " " + request.URL.String())
+		for _, name := range headers {
+			key.WriteString("\n" + http.CanonicalHeaderKey(name) + ": " + strings.Join(request.Header.Values(name), ","))
+		}
+		return key.String()
+	}
+}
+
+// Shares a single upstream call between identical GET and HEAD requests in
+// flight at the same time. Every caller receives its own copy of the response.
+// When the body exceeds the limit it is streamed to one of the callers instead,
+// and the others send their own request. The shared call carries none of the
+// context values of the callers and is canceled only once every caller has
+// gone, so trace context headers and httptrace timings are only recorded for
+// the caller that started it
+type DedupGroup struct {
+	keyFunc   DedupKeyFunc
+	bodyLimit int64
+	mutex     sync.Mutex
+	calls     map[string]*dedupCall
+}
+
+type dedupCall struct {
+	key     string
+	done    chan struct{}
+	cancel  context.CancelFunc
+	waiters int
+	status  string
+	code    int
+	header  http.Header
+	body    []byte
+	// Set when the body exceeds the limit. The response is kept in stream
+	// until a caller takes it
+	isStreamed bool
+	stream     *http.Response
+	err        error
+}
+
+// Creates a group using keyFunc to identify identical requests.
+// When keyFunc is nil DedupKey() is used
+func NewDedupGroup(keyFunc DedupKeyFunc) *DedupGroup {
+	if keyFunc == nil {
+		keyFunc = DedupKey()
+	}
+	return &DedupGroup{keyFunc: keyFunc, bodyLimit: DEFAULT_DEDUP_BODY_LIMIT, calls: map[string]*dedupCall{}}
+}
+
+// Set the size of the biggest response body that is shared
+func (group *DedupGroup) WithBodyLimit(limit int64) *DedupGroup {
+	group.bodyLimit = limit
+	return group
+}
+
+func (requestIntent *proxiedRequestImpl) WithDeduplication(group *DedupGroup) ProxiedRequest {
+	requestIntent.mutex.Lock()
+	defer requestIntent.mutex.Unlock()
+	requestIntent.options.dedup = group
+	return requestIntent
+}
+
+func (group *DedupGroup) transport(next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &dedupTransport{group: group, next: next}
+}
+
+type dedupTransport struct {
+	group *DedupGroup
+	next  http.RoundTripper
+}
+
+func (transport *dedupTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	if request.Method != http.MethodGet && request.Method != http.MethodHead {
+		return transport.next.RoundTrip(request)
+	}
+	call := transport.group.join(transport.group.keyFunc(request), request, transport.next)
+	select {
+	case <-call.done:
+	case <-request.Context().Done():
+		transport.group.leave(call)
+		return nil, context.Cause(request.Context())
+	}
+	if call.err != nil {
+		return nil, call.err
+	}
+	if call.isStreamed {
+		return transport.takeStream(call, request)
+	}
+	return &http.Response{
+		Status:        call.status,
+		StatusCode:    call.code,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        call.header.Clone(),
+		Body:          io.NopCloser(bytes.NewReader(call.body)),
+		ContentLength: int64(len(call.body)),
+		Request:       request,
+	}, nil
+}
+
+// Returns the response streamed by the call to the first caller asking for it.
+// The other callers send their own request, as the body was too big to share
+func (transport *dedupTransport) takeStream(call *dedupCall, request *http.Request) (*http.Response, error) {
+	transport.group.mutex.Lock()
+	call.waiters--
+	stream := call.stream
+	call.stream = nil
+	transport.group.mutex.Unlock()
+	if stream == nil {
+		return transport.next.RoundTrip(request)
+	}
+	// The call is detached from the caller, which can still abort it
+	stop := context.AfterFunc(request.Context(), call.cancel)
+	stream.Body = &cancelOnCloseBody{ReadCloser: stream.Body, cancel: func() {
+		stop()
+		call.cancel()
+	}}
+	stream.Request = request
+	return stream, nil
+}
+
+// Joins the call in flight for the key, starting it if there is none
+func (group *DedupGroup) join(key string, request *http.Request, next http.RoundTripper) *dedupCall {
+	group.mutex.Lock()
+	defer group.mutex.Unlock()
+	if call, isFound := group.calls[key]; isFound {
+		call.waiters++
+		return call
+	}
+	ctx, cancel := sharedContext(request.Context())
+	call := &dedupCall{key: key, done: make(chan struct{}), cancel: cancel, waiters: 1}
+	group.calls[key] = call
+	sharedRequest := request.Clone(ctx)
+	go func() {
+		stream := call.execute(next, sharedRequest, group.bodyLimit)
+		group.mutex.Lock()
+		group.forget(call)
+		call.isStreamed = stream != nil
+		if stream != nil && call.waiters > 0 {
+			// The call is canceled once the caller taking the stream closes it
+			call.stream = stream
+		} else {
+			if stream != nil {
+				stream.Body.Close()
+			}
+			cancel()
+		}
+		group.mutex.Unlock()
+		close(call.done)
+	}()
+	return call
+}
+
+// Returns the context of a shared call. Spans, baggage, deadlines and the other
+// values of the caller starting the call don't belong to the callers joining it,
+// so only its httptrace hooks, which capture its timings, are kept on top of
+// the detached context
+func sharedContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	shared, cancel := context.WithCancel(detachedContext(ctx))
+	if trace := httptrace.ContextClientTrace(ctx); trace != nil {
+		shared = httptrace.WithClientTrace(shared, trace)
+	}
+	return shared, cancel
+}
+
+// Removes a waiter that gave up, canceling the call if nobody else waits for
+// it. A canceled call is forgotten right away so that new callers start a new one
+func (group *DedupGroup) leave(call *dedupCall) {
+	group.mutex.Lock()
+	defer group.mutex.Unlock()
+	call.waiters--
+	if call.waiters == 0 {
+		group.forget(call)
+		call.cancel()
+		if call.stream != nil {
+			call.stream.Body.Close()
+			call.stream = nil
+		}
+	}
+}
+
+// Removes the call from the calls in flight, unless it was already replaced
+func (group *DedupGroup) forget(call *dedupCall) {
+	if group.calls[call.key] == call {
+		delete(group.calls, call.key)
+	}
+}
+
+// Sends the request and reads the body to share it. A response whose body
+// exceeds the limit is returned with its body still to be read instead
+func (call *dedupCall) execute(next http.RoundTripper, request *http.Request, bodyLimit int64) *http.Response {
+	response, err := next.RoundTrip(request)
+	if err != nil {
+		call.err = err
+		return nil
+	}
+	body, readErr := io.ReadAll(io.LimitReader(response.Body, bodyLimit+1))
+	if readErr == nil && int64(len(body)) > bodyLimit {
+		response.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), response.Body), response.Body}
+		return response
+	}
+	response.Body.Close()
+	call.status = response.Status
+	call.code = response.StatusCode
+	call.header = response.Header
+	call.body, call.err = body, readErr
+	return nil
+}
@@ -0,0 +1,278 @@
+package http_proxy_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	http_proxy "github.com/AndreaCostanzo1/http-proxy/http_proxy"
+)
+
+// Holds every request until release is closed
+func gatedServer(calls *int32, release <-chan struct{}) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(calls, 1)
+		<-release
+		w.Header().Set("X-Language", r.Header.Get("Accept-Language"))
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("shared body"))
+	}))
+}
+
+func sendConcurrently(requests []http_proxy.ProxiedRequest) ([]string, []error) {
+	bodies := make([]string, len(requests))
+	errs := make([]error, len(requests))
+	var wg sync.WaitGroup
+	for i, request := range requests {
+		wg.Add(1)
+		go func(i int, request http_proxy.ProxiedRequest) {
+			defer wg.Done()
+			resp, err := request.Send()
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			body, _ := io.ReadAll(resp.Body)
+			bodies[i] = string(body)
+		}(i, request)
+	}
+	wg.Wait()
+	return bodies, errs
+}
+
+func TestWithDeduplication(t *testing.T) {
+	t.Run("Identical requests in flight share one call", func(t *testing.T) {
+		var calls int32
+		release := make(chan struct{})
+		server := gatedServer(&calls, release)
+		defer server.Close()
+
+		group := http_proxy.NewDedupGroup(nil)
+		requests := []http_proxy.ProxiedRequest{}
+		for i := 0; i < 10; i++ {
+			requests = append(requests, http_proxy.NewRequest("GET", server.URL).WithDeduplication(group))
+		}
+		time.AfterFunc(50*time.Millisecond, func() { close(release) })
+		bodies, errs := sendConcurrently(requests)
+
+		for i := range requests {
+			if errs[i] != nil || bodies[i] != "shared body" {
+				t.Errorf("expected 'shared body', got '%s' and %v", bodies[i], errs[i])
+			}
+		}
+		if calls := atomic.LoadInt32(&calls); calls != 1 {
+			t.Errorf("expected 1 upstream call, got %d", calls)
+		}
+	})
+
+	t.Run("Requests differing in key headers are not shared", func(t *testing.T) {
+		var calls int32
+		release := make(chan struct{})
+		server := gatedServer(&calls, release)
+		defer server.Close()
+
+		group := http_proxy.NewDedupGroup(http_proxy.DedupKey("Accept-Language"))
+		requests := []http_proxy.ProxiedRequest{
+			http_proxy.NewRequest("GET", server.URL).WithDeduplication(group).SetHeader("Accept-Language", "en"),
+			http_proxy.NewRequest("GET", server.URL).WithDeduplication(group).SetHeader("Accept-Language", "it"),
+			http_proxy.NewRequest("POST", server.URL).WithDeduplication(group).SetHeader("Accept-Language", "en"),
+		}
+		time.AfterFunc(50*time.Millisecond, func() { close(release) })
+		sendConcurrently(requests)
+
+		if calls := atomic.LoadInt32(&calls); calls != 3 {
+			t.Errorf("expected 3 upstream calls, got %d", calls)
+		}
+	})
+
+	t.Run("Custom key functions select the shared requests", func(t *testing.T) {
+		var calls int32
+		release := make(chan struct{})
+		server := gatedServer(&calls, release)
+		defer server.Close()
+
+		group := http_proxy.NewDedupGroup(func(request *http.Request) string { return request.URL.Path })
+		requests := []http_proxy.ProxiedRequest{
+			http_proxy.NewRequest("GET", server.URL+"/items?page=1").WithDeduplication(group),
+			http_proxy.NewRequest("GET", server.URL+"/items?page=2").WithDeduplication(group),
+		}
+		time.AfterFunc(50*time.Millisecond, func() { close(release) })
+		sendConcurrently(requests)
+
+		if calls := atomic.LoadInt32(&calls); calls != 1 {
+			t.Errorf("expected 1 upstream call, got %d", calls)
+		}
+	})
+
+	t.Run("A caller giving up doesn't cancel the shared call", func(t *testing.T) {
+		var calls int32
+		release := make(chan struct{})
+		server := gatedServer(&calls, release)
+		defer server.Close()
+
+		group := http_proxy.NewDedupGroup(nil)
+		ctx, cancel := context.WithCancel(context.Background())
+		impatient := http_proxy.NewRequest("GET", server.URL).WithDeduplication(group).WithContext(ctx).SendAsync()
+		time.Sleep(20 * time.Millisecond)
+		patient := http_proxy.NewRequest("GET", server.URL).WithDeduplication(group).SendAsync()
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+		_, impatientErr := impatient.Wait(context.Background())
+		close(release)
+		resp, err := patient.Wait(context.Background())
+
+		if !errors.Is(impatientErr, context.Canceled) {
+			t.Errorf("expected context.Canceled, got %v", impatientErr)
+		}
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if body, _ := io.ReadAll(resp.Body); string(body) != "shared body" {
+			t.Errorf("expected 'shared body', got '%s'", body)
+		}
+	})
+
+	t.Run("The shared call doesn't carry the context values of the caller", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("shared body"))
+		}))
+		defer server.Close()
+
+		type callerKey struct{}
+		var sharedValue interface{}
+		var hasDeadline bool
+		client := &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+			sharedValue = r.Context().Value(callerKey{})
+			_, hasDeadline = r.Context().Deadline()
+			return http.DefaultTransport.RoundTrip(r)
+		})}
+		ctx := context.WithValue(context.Background(), callerKey{}, "first caller")
+		resp, _ := sendAndRead(t, http_proxy.NewRequest("GET", server.URL).
+			WithHTTPClient(client).
+			WithContext(ctx).
+			WithTimeout(time.Minute).
+			WithTimings().
+			WithDeduplication(http_proxy.NewDedupGroup(nil)))
+
+		if sharedValue != nil || hasDeadline {
+			t.Errorf("expected no value and no deadline of the caller, got %v and deadline %v", sharedValue, hasDeadline)
+		}
+		if timings, isFound := http_proxy.TimingsFromResponse(resp); !isFound || timings.TimeToFirstByte <= 0 {
+			t.Errorf("expected the timings of the caller starting the call, got %+v", timings)
+		}
+	})
+
+	t.Run("Requests of different users are not shared", func(t *testing.T) {
+		var calls int32
+		release := make(chan struct{})
+		server := gatedServer(&calls, release)
+		defer server.Close()
+
+		group := http_proxy.NewDedupGroup(nil)
+		requests := []http_proxy.ProxiedRequest{
+			http_proxy.NewRequest("GET", server.URL).WithDeduplication(group).SetHeader("Authorization", "Bearer alice"),
+			http_proxy.NewRequest("GET", server.URL).WithDeduplication(group).SetHeader("Authorization", "Bearer bob"),
+			http_proxy.NewRequest("GET", server.URL).WithDeduplication(group).SetHeader("Cookie", "session=alice"),
+			http_proxy.NewRequest("GET", server.URL).WithDeduplication(group).SetHeader("Cookie", "session=bob"),
+		}
+		time.AfterFunc(50*time.Millisecond, func() { close(release) })
+		sendConcurrently(requests)
+
+		if calls := atomic.LoadInt32(&calls); calls != 4 {
+			t.Errorf("expected 4 upstream calls, got %d", calls)
+		}
+	})
+
+	t.Run("Callers arriving after a call is canceled start a new one", func(t *testing.T) {
+		var calls int32
+		release := make(chan struct{})
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&calls, 1)
+			select {
+			case <-release:
+				w.Write([]byte("shared body"))
+			case <-r.Context().Done():
+			}
+		}))
+		defer server.Close()
+
+		group := http_proxy.NewDedupGroup(nil)
+		ctx, cancel := context.WithCancel(context.Background())
+		abandoned := http_proxy.NewRequest("GET", server.URL).WithDeduplication(group).WithContext(ctx).SendAsync()
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+		abandoned.Wait(context.Background())
+		fresh := http_proxy.NewRequest("GET", server.URL).WithDeduplication(group).SendAsync()
+		time.Sleep(20 * time.Millisecond)
+		close(release)
+		resp, err := fresh.Wait(context.Background())
+
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if body, _ := io.ReadAll(resp.Body); string(body) != "shared body" {
+			t.Errorf("expected 'shared body', got '%s'", body)
+		}
+		if calls := atomic.LoadInt32(&calls); calls != 2 {
+			t.Errorf("expected 2 upstream calls, got %d", calls)
+		}
+	})
+
+	t.Run("Bodies over the limit are streamed to one caller and sent again for the others", func(t *testing.T) {
+		var calls int32
+		release := make(chan struct{})
+		expectedBody := strings.Repeat("large body ", 100)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&calls, 1)
+			<-release
+			w.Write([]byte(expectedBody))
+		}))
+		defer server.Close()
+
+		group := http_proxy.NewDedupGroup(nil).WithBodyLimit(64)
+		requests := []http_proxy.ProxiedRequest{}
+		for i := 0; i < 3; i++ {
+			requests = append(requests, http_proxy.NewRequest("GET", server.URL).WithDeduplication(group))
+		}
+		time.AfterFunc(50*time.Millisecond, func() { close(release) })
+		bodies, errs := sendConcurrently(requests)
+
+		for i := range requests {
+			if errs[i] != nil || bodies[i] != expectedBody {
+				t.Errorf("expected a body of %d bytes, got %d bytes and %v", len(expectedBody), len(bodies[i]), errs[i])
+			}
+		}
+		if calls := atomic.LoadInt32(&calls); calls != 3 {
+			t.Errorf("expected 3 upstream calls, got %d", calls)
+		}
+	})
+
+	t.Run("Endless bodies are streamed", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			chunk := []byte(strings.Repeat("x", 1024))
+			for r.Context().Err() == nil {
+				if _, writeErr := w.Write(chunk); writeErr != nil {
+					return
+				}
+			}
+		}))
+		defer server.Close()
+
+		group := http_proxy.NewDedupGroup(nil)
+		resp, err := http_proxy.NewRequest("GET", server.URL).WithDeduplication(group).Send()
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		defer resp.Body.Close()
+		if read, _ := io.CopyN(io.Discard, resp.Body, 2*http_proxy.DEFAULT_DEDUP_BODY_LIMIT); read != 2*http_proxy.DEFAULT_DEDUP_BODY_LIMIT {
+			t.Errorf("expected to read %d bytes, got %d", 2*http_proxy.DEFAULT_DEDUP_BODY_LIMIT, read)
+		}
+	})
+}
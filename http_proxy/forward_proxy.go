@@ -0,0 +1,348 @@
+package http_proxy
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var ErrDestinationDenied = errors.New("destination denied by the proxy rules")
+
+// Realm announced in the Proxy-Authenticate header when credentials are missing
+const PROXY_AUTH_REALM = "http_proxy"
+
+type ForwardProxyOptions struct {
+	// Credentials required in the Proxy-Authorization header with the Basic
+	// scheme. Authentication is disabled when both are empty
+	Username string
+	Password string
+	// Destinations the proxy connects to. When empty every destination not
+	// denied is allowed. Patterns are a host name, a host name with a leading
+	// "*." matching its subdomains, an IP address or a CIDR range, each
+	// optionally followed by ":port", or "*" matching every destination
+	Allow []string
+	// Destinations the proxy refuses to connect to, even if allowed. Patterns
+	// with an IP address or a CIDR range are also checked against the address
+	// host names resolve to when connecting
+	Deny []string
+	// Tunnels are closed when no data flows in either direction for this long.
+	// Zero disables the idle timeout
+	IdleTimeout time.Duration
+	// Tunnels are closed this long after being established, even if active.
+	// Zero disables the total timeout
+	TunnelTimeout time.Duration
+	// Client sending plain HTTP requests. It defaults to a client connecting
+	// directly to the destinations. Redirects are never followed. Deny rules
+	// are enforced on the connections only when its transport is an *http.Transport
+	Client *http.Client
+	// Opens the connections of the tunnels and of the plain HTTP requests, unless
+	// the transport of Client has its own dialer. It defaults to a net.Dialer.
+	// Deny rules are checked against the remote address of the connections
+	Dial func(ctx context.Context, network string, address string) (net.Conn, error)
+}
+
+// An http.Handler acting as a forward proxy. Requests in absolute form are
+// sent to their destination, CONNECT requests open a TCP tunnel to it
+type ForwardProxy struct {
+	options ForwardProxyOptions
+	client  *http.Client
+	dial    func(ctx context.Context, network string, address string) (net.Conn, error)
+}
+
+// Creates a forward proxy applying the authentication, destination rules
+// and tunnel timeouts of options
+func NewForwardProxy(options ForwardProxyOptions) *ForwardProxy {
+	proxy := &ForwardProxy{options: options}
+	if options.Dial != nil {
+		proxy.dial = proxy.checkedDial(options.Dial)
+	} else {
+		// Addresses are checked before connecting, once host names are resolved
+		dialer := &net.Dialer{Control: func(network string, address string, _ syscall.RawConn) error {
+			return proxy.checkAddress(address)
+		}}
+		proxy.dial = dialer.DialContext
+	}
+
+	client := http.Client{}
+	if options.Client != nil {
+		client = *options.Client
+	}
+	transport, isTransport := client.Transport.(*http.Transport)
+	dial := proxy.dial
+	if isTransport && transport.DialContext != nil {
+		dial = proxy.checkedDial(transport.DialContext)
+	}
+	if client.Transport == nil {
+		transport, isTransport = http.DefaultTransport.(*http.Transport), true
+	}
+	if isTransport {
+		transport = transport.Clone()
+		if options.Client == nil {
+			transport.Proxy = nil
+		}
+		transport.DialContext = dial
+		client.Transport = transport
+	}
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	proxy.client = &client
+	return proxy
+}
+
+func (proxy *ForwardProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !proxy.isAuthorized(r) {
+		w.Header().Set("Proxy-Authenticate", `Basic realm="`+PROXY_AUTH_REALM+`"`)
+		http.Error(w, http.StatusText(http.StatusProxyAuthRequired), http.StatusProxyAuthRequired)
+		return
+	}
+	destination := r.Host
+	if r.Method != http.MethodConnect {
+		if !r.URL.IsAbs() || r.URL.Host == "" {
+			http.Error(w, "proxy requests must use an absolute URL", http.StatusBadRequest)
+			return
+		}
+		destination = r.URL.Host
+	}
+	host, port := splitDestination(destination, r.URL.Scheme)
+	if !proxy.isAllowed(host, port) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	if r.Method == http.MethodConnect {
+		proxy.tunnel(w, r, net.JoinHostPort(host, port))
+		return
+	}
+
+	forwarded := NewRequest(r.Method, r.URL.String())
+	forwarded.options.httpClient = proxy.client
+	response, err := sendIncoming(forwarded, r)
+	if err != nil {
+		if response != nil {
+			response.Body.Close()
+		}
+		if errors.Is(err, ErrDestinationDenied) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		defaultProxyErrorHandler(w, r, err)
+		return
+	}
+	defer response.Body.Close()
+	writeResponse(w, response)
+}
+
+func (proxy *ForwardProxy) isAuthorized(r *http.Request) bool {
+	if proxy.options.Username == "" && proxy.options.Password == "" {
+		return true
+	}
+	scheme, encoded, isFound := strings.Cut(r.Header.Get("Proxy-Authorization"), " ")
+	if !isFound || !strings.EqualFold(scheme, "Basic") {
+		return false
+	}
+	decoded, decodeErr := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if decodeErr != nil {
+		return false
+	}
+	username, password, _ := strings.Cut(string(decoded), ":")
+	usernameMatches := subtle.ConstantTimeCompare([]byte(username), []byte(proxy.options.Username)) == 1
+	passwordMatches := subtle.ConstantTimeCompare([]byte(password), []byte(proxy.options.Password)) == 1
+	return usernameMatches && passwordMatches
+}
+
+func (proxy *ForwardProxy) isAllowed(host string, port string) bool {
+	for _, pattern := range proxy.options.Deny {
+		if matchesDestination(pattern, host, port) {
+			return false
+		}
+	}
+	if len(proxy.options.Allow) == 0 {
+		return true
+	}
+	for _, pattern := range proxy.options.Allow {
+		if matchesDestination(pattern, host, port) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns ErrDestinationDenied if the address the proxy connects to matches a deny rule
+func (proxy *ForwardProxy) checkAddress(address string) error {
+	host, port, splitErr := net.SplitHostPort(address)
+	if splitErr != nil {
+		return fmt.Errorf("%w: %s", ErrDestinationDenied, address)
+	}
+	for _, pattern := range proxy.options.Deny {
+		if matchesDestination(pattern, host, port) {
+			return fmt.Errorf("%w: %s", ErrDestinationDenied, address)
+		}
+	}
+	return nil
+}
+
+// Wraps dial so that connections to denied addresses are closed before being used
+func (proxy *ForwardProxy) checkedDial(
+	dial func(ctx context.Context, network string, address string) (net.Conn, error),
+) func(ctx context.Context, network string, address string) (net.Conn, error) {
+	return func(ctx context.Context, network string, address string) (net.Conn, error) {
+		connection, dialErr := dial(ctx, network, address)
+		if dialErr != nil {
+			return nil, dialErr
+		}
+		// Connections not made over TCP, like in-memory pipes, have no address to check
+		if remote, isTCP := connection.RemoteAddr().(*net.TCPAddr); isTCP {
+			if checkErr := proxy.checkAddress(remote.String()); checkErr != nil {
+				connection.Close()
+				return nil, checkErr
+			}
+		}
+		return connection, nil
+	}
+}
+
+// Splits the destination in host and port, using the default port of the scheme when missing
+func splitDestination(destination string, scheme string) (string, string) {
+	if host, port, splitErr := net.SplitHostPort(destination); splitErr == nil {
+		return host, port
+	}
+	port := "80"
+	if scheme == "https" {
+		port = "443"
+	}
+	return strings.Trim(destination, "[]"), port
+}
+
+func matchesDestination(pattern string, host string, port string) bool {
+	if pattern == "*" {
+		return true
+	}
+	hostPattern, portPattern := pattern, ""
+	if patternHost, patternPort, splitErr := net.SplitHostPort(pattern); splitErr == nil {
+		hostPattern, portPattern = patternHost, patternPort
+	}
+	if portPattern != "" && portPattern != port {
+		return false
+	}
+	// Names differing only in case or in the trailing dot of the root are the same
+	hostPattern = normalizeHost(strings.Trim(hostPattern, "[]"))
+	host = normalizeHost(host)
+	if _, network, parseErr := net.ParseCIDR(hostPattern); parseErr == nil {
+		ip := net.ParseIP(host)
+		return ip != nil && network.Contains(ip)
+	}
+	if patternIP := net.ParseIP(hostPattern); patternIP != nil {
+		return patternIP.Equal(net.ParseIP(host))
+	}
+	if domain, isWildcard := strings.CutPrefix(hostPattern, "*."); isWildcard {
+		return strings.HasSuffix(host, "."+domain)
+	}
+	return hostPattern == host
+}
+
+func normalizeHost(host string) string {
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// Connects the caller to the destination and copies the data in both
+// directions until both of them end or a timeout expires
+func (proxy *ForwardProxy) tunnel(w http.ResponseWriter, r *http.Request, destination string) {
+	target, dialErr := proxy.dial(r.Context(), "tcp", destination)
+	if errors.Is(dialErr, ErrDestinationDenied) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	if dialErr != nil {
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+	client, buffered, hijackErr := http.NewResponseController(w).Hijack()
+	if hijackErr != nil {
+		target.Close()
+		http.Error(w, "tunneling not supported", http.StatusInternalServerError)
+		return
+	}
+	defer client.Close()
+	defer target.Close()
+	if _, writeErr := client.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); writeErr != nil {
+		return
+	}
+	// The server may have set deadlines on the hijacked connection
+	deadline := time.Time{}
+	if proxy.options.TunnelTimeout > 0 {
+		deadline = time.Now().Add(proxy.options.TunnelTimeout)
+	}
+	client.SetDeadline(deadline)
+	target.SetDeadline(deadline)
+
+	var lastActivity atomic.Int64
+	lastActivity.Store(time.Now().UnixNano())
+	var waitGroup sync.WaitGroup
+	waitGroup.Add(2)
+	go func() {
+		defer waitGroup.Done()
+		// Bytes sent by the caller after the request are already buffered
+		copyTunnel(target, io.MultiReader(io.LimitReader(buffered, int64(buffered.Reader.Buffered())), client), &lastActivity)
+	}()
+	go func() {
+		defer waitGroup.Done()
+		copyTunnel(client, target, &lastActivity)
+	}()
+	if proxy.options.IdleTimeout > 0 {
+		stop := make(chan struct{})
+		defer close(stop)
+		go closeWhenIdle(proxy.options.IdleTimeout, &lastActivity, stop, client, target)
+	}
+	waitGroup.Wait()
+}
+
+// Copies source to destination recording the time of each transfer. When
+// source ends the write side of destination is closed, so that the peer
+// sees the end of the stream while the other direction keeps flowing
+func copyTunnel(destination net.Conn, source io.Reader, lastActivity *atomic.Int64) {
+	buffer := make([]byte, 32<<10)
+	for {
+		n, readErr := source.Read(buffer)
+		if n > 0 {
+			lastActivity.Store(time.Now().UnixNano())
+			if _, writeErr := destination.Write(buffer[:n]); writeErr != nil {
+				destination.Close()
+				return
+			}
+		}
+		if readErr != nil {
+			if halfCloser, canHalfClose := destination.(interface{ CloseWrite() error }); canHalfClose && readErr == io.EOF {
+				halfCloser.CloseWrite()
+			} else {
+				destination.Close()
+			}
+			return
+		}
+	}
+}
+
+func closeWhenIdle(idleTimeout time.Duration, lastActivity *atomic.Int64, stop chan struct{}, connections ...net.Conn) {
+	ticker := time.NewTicker(max(idleTimeout/4, time.Millisecond))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if time.Since(time.Unix(0, lastActivity.Load())) >= idleTimeout {
+				for _, connection := range connections {
+					connection.Close()
+				}
+				return
+			}
+		}
+	}
+}
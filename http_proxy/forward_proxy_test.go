@@ -0,0 +1,396 @@
+package http_proxy_test
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	http_proxy "github.com/AndreaCostanzo1/http-proxy/http_proxy"
+)
+
+// Returns a client sending its requests through the proxy
+func proxiedClient(proxy *httptest.Server, userinfo *url.Userinfo, base *http.Client) *http.Client {
+	proxyURL, _ := url.Parse(proxy.URL)
+	proxyURL.User = userinfo
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if base != nil {
+		transport = base.Transport.(*http.Transport).Clone()
+	}
+	transport.Proxy = http.ProxyURL(proxyURL)
+	return &http.Client{Transport: transport}
+}
+
+// Starts a TCP server echoing what it receives
+func echoListener(t *testing.T) net.Listener {
+	listener, listenErr := net.Listen("tcp", "127.0.0.1:0")
+	if listenErr != nil {
+		t.Fatalf("expected no error, got %v", listenErr)
+	}
+	go func() {
+		for {
+			connection, acceptErr := listener.Accept()
+			if acceptErr != nil {
+				return
+			}
+			go func() {
+				defer connection.Close()
+				io.Copy(connection, connection)
+			}()
+		}
+	}()
+	return listener
+}
+
+// Opens a tunnel through the proxy and returns the connection once established
+func connectThrough(t *testing.T, proxy *httptest.Server, destination string) (net.Conn, *bufio.Reader) {
+	connection, dialErr := net.Dial("tcp", strings.TrimPrefix(proxy.URL, "http://"))
+	if dialErr != nil {
+		t.Fatalf("expected no error, got %v", dialErr)
+	}
+	connection.Write([]byte("CONNECT " + destination + " HTTP/1.1\r\nHost: " + destination + "\r\n\r\n"))
+	reader := bufio.NewReader(connection)
+	resp, readErr := http.ReadResponse(reader, nil)
+	if readErr != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the tunnel to be established, got %v %v", resp, readErr)
+	}
+	return connection, reader
+}
+
+// Sets a deadline on the hijacked connections, as servers with timeouts may do
+type deadlineHijacker struct {
+	http.ResponseWriter
+	timeout time.Duration
+}
+
+func (w deadlineHijacker) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	connection, buffered, hijackErr := http.NewResponseController(w.ResponseWriter).Hijack()
+	if hijackErr == nil {
+		connection.SetDeadline(time.Now().Add(w.timeout))
+	}
+	return connection, buffered, hijackErr
+}
+
+func TestForwardProxy(t *testing.T) {
+	t.Run("Plain HTTP requests are forwarded to their destination", func(t *testing.T) {
+		var received *http.Request
+		destination := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			received = r
+			w.Write([]byte("hello from " + r.URL.Path))
+		}))
+		defer destination.Close()
+		proxy := httptest.NewServer(http_proxy.NewForwardProxy(http_proxy.ForwardProxyOptions{Username: "user", Password: "secret"}))
+		defer proxy.Close()
+
+		resp, err := proxiedClient(proxy, url.UserPassword("user", "secret"), nil).Get(destination.URL + "/path?query=1")
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK || string(body) != "hello from /path" {
+			t.Errorf("expected the destination response, got %d %q", resp.StatusCode, body)
+		}
+		if received.URL.RawQuery != "query=1" || received.Header.Get("Proxy-Authorization") != "" || received.Header.Get("X-Forwarded-For") != "127.0.0.1" {
+			t.Errorf("expected the query, no proxy credentials and a forwarding header, got %s %v", received.URL, received.Header)
+		}
+	})
+
+	t.Run("CONNECT tunnels carry HTTPS traffic", func(t *testing.T) {
+		destination := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("secure"))
+		}))
+		defer destination.Close()
+		proxy := httptest.NewServer(http_proxy.NewForwardProxy(http_proxy.ForwardProxyOptions{Username: "user", Password: "secret"}))
+		defer proxy.Close()
+
+		client := proxiedClient(proxy, url.UserPassword("user", "secret"), destination.Client())
+		for i := 0; i < 2; i++ {
+			resp, err := client.Get(destination.URL)
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if string(body) != "secure" {
+				t.Errorf("expected body %q, got %q", "secure", body)
+			}
+		}
+	})
+
+	t.Run("Missing or wrong credentials are rejected", func(t *testing.T) {
+		destination := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		defer destination.Close()
+		proxy := httptest.NewServer(http_proxy.NewForwardProxy(http_proxy.ForwardProxyOptions{Username: "user", Password: "secret"}))
+		defer proxy.Close()
+
+		for _, userinfo := range []*url.Userinfo{nil, url.UserPassword("user", "wrong")} {
+			resp, err := proxiedClient(proxy, userinfo, nil).Get(destination.URL)
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusProxyAuthRequired || resp.Header.Get("Proxy-Authenticate") != `Basic realm="http_proxy"` {
+				t.Errorf("expected status %d with a challenge, got %d %v", http.StatusProxyAuthRequired, resp.StatusCode, resp.Header)
+			}
+		}
+	})
+
+	t.Run("Destinations are checked against the rules", func(t *testing.T) {
+		destination := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		defer destination.Close()
+		port := destination.URL[strings.LastIndex(destination.URL, ":")+1:]
+		cases := []struct {
+			name     string
+			options  http_proxy.ForwardProxyOptions
+			expected int
+		}{
+			{"no rules", http_proxy.ForwardProxyOptions{}, http.StatusOK},
+			{"allowed range", http_proxy.ForwardProxyOptions{Allow: []string{"127.0.0.0/8"}}, http.StatusOK},
+			{"allowed address and port", http_proxy.ForwardProxyOptions{Allow: []string{"127.0.0.1:" + port}}, http.StatusOK},
+			{"other port", http_proxy.ForwardProxyOptions{Allow: []string{"127.0.0.1:1"}}, http.StatusForbidden},
+			{"not allowed", http_proxy.ForwardProxyOptions{Allow: []string{"*.example.com"}}, http.StatusForbidden},
+			{"denied", http_proxy.ForwardProxyOptions{Allow: []string{"*"}, Deny: []string{"127.0.0.1"}}, http.StatusForbidden},
+		}
+		for _, testCase := range cases {
+			t.Run(testCase.name, func(t *testing.T) {
+				proxy := httptest.NewServer(http_proxy.NewForwardProxy(testCase.options))
+				defer proxy.Close()
+
+				resp, err := proxiedClient(proxy, nil, nil).Get(destination.URL)
+				if err != nil {
+					t.Fatalf("expected no error, got %v", err)
+				}
+				resp.Body.Close()
+				if resp.StatusCode != testCase.expected {
+					t.Errorf("expected status %d, got %d", testCase.expected, resp.StatusCode)
+				}
+			})
+		}
+	})
+
+	t.Run("Host name rules match subdomains", func(t *testing.T) {
+		dialed := make(chan string, 1)
+		proxy := httptest.NewServer(http_proxy.NewForwardProxy(http_proxy.ForwardProxyOptions{
+			Allow: []string{"*.example.com:443"},
+			Dial: func(ctx context.Context, network string, address string) (net.Conn, error) {
+				dialed <- address
+				client, server := net.Pipe()
+				go server.Close()
+				return client, nil
+			},
+		}))
+		defer proxy.Close()
+
+		connection, _ := connectThrough(t, proxy, "api.EXAMPLE.com:443")
+		connection.Close()
+		if address := <-dialed; address != "api.EXAMPLE.com:443" {
+			t.Errorf("expected to dial api.EXAMPLE.com:443, got %s", address)
+		}
+		resp, _ := proxiedClient(proxy, nil, nil).Get("http://example.com/")
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("expected status %d for the parent domain, got %d", http.StatusForbidden, resp.StatusCode)
+		}
+	})
+
+	t.Run("Deny rules ignore the case and the trailing dot of host names", func(t *testing.T) {
+		dialed := make(chan string, 10)
+		proxy := httptest.NewServer(http_proxy.NewForwardProxy(http_proxy.ForwardProxyOptions{
+			Deny: []string{"localhost", "blocked.com", "*.internal.example."},
+			Dial: func(ctx context.Context, network string, address string) (net.Conn, error) {
+				dialed <- address
+				return nil, errors.New("unexpected dial")
+			},
+		}))
+		defer proxy.Close()
+
+		for _, destination := range []string{"LOCALHOST:443", "localhost.:443", "blocked.com.:443", "api.internal.example:443", "api.Internal.Example.:443"} {
+			connection, _ := net.Dial("tcp", strings.TrimPrefix(proxy.URL, "http://"))
+			connection.Write([]byte("CONNECT " + destination + " HTTP/1.1\r\nHost: " + destination + "\r\n\r\n"))
+			tunnelResp, _ := http.ReadResponse(bufio.NewReader(connection), nil)
+			connection.Close()
+			if tunnelResp.StatusCode != http.StatusForbidden {
+				t.Errorf("expected status %d for %s, got %d", http.StatusForbidden, destination, tunnelResp.StatusCode)
+			}
+		}
+		resp, _ := proxiedClient(proxy, nil, nil).Get("http://localhost./")
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("expected status %d for plain HTTP, got %d", http.StatusForbidden, resp.StatusCode)
+		}
+		if len(dialed) > 0 {
+			t.Errorf("expected no destination to be dialed, got %s", <-dialed)
+		}
+	})
+
+	t.Run("Host names resolving to denied addresses are refused", func(t *testing.T) {
+		destination := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		defer destination.Close()
+		port := destination.URL[strings.LastIndex(destination.URL, ":")+1:]
+		redirectingDial := func(ctx context.Context, network string, address string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, destination.Listener.Addr().String())
+		}
+		for _, options := range []http_proxy.ForwardProxyOptions{
+			{Deny: []string{"127.0.0.0/8", "::1"}},
+			{Deny: []string{"127.0.0.0/8"}, Dial: redirectingDial},
+		} {
+			proxy := httptest.NewServer(http_proxy.NewForwardProxy(options))
+			defer proxy.Close()
+
+			resp, err := proxiedClient(proxy, nil, nil).Get("http://localhost:" + port)
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusForbidden {
+				t.Errorf("expected status %d for plain HTTP, got %d", http.StatusForbidden, resp.StatusCode)
+			}
+			connection, _ := net.Dial("tcp", strings.TrimPrefix(proxy.URL, "http://"))
+			defer connection.Close()
+			connection.Write([]byte("CONNECT localhost:" + port + " HTTP/1.1\r\nHost: localhost:" + port + "\r\n\r\n"))
+			if tunnelResp, _ := http.ReadResponse(bufio.NewReader(connection), nil); tunnelResp.StatusCode != http.StatusForbidden {
+				t.Errorf("expected status %d for CONNECT, got %d", http.StatusForbidden, tunnelResp.StatusCode)
+			}
+		}
+	})
+
+	t.Run("Plain HTTP requests use the dialer", func(t *testing.T) {
+		destination := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("hello from " + r.Host))
+		}))
+		defer destination.Close()
+		dialed := make(chan string, 1)
+		proxy := httptest.NewServer(http_proxy.NewForwardProxy(http_proxy.ForwardProxyOptions{
+			Dial: func(ctx context.Context, network string, address string) (net.Conn, error) {
+				dialed <- address
+				return (&net.Dialer{}).DialContext(ctx, network, destination.Listener.Addr().String())
+			},
+		}))
+		defer proxy.Close()
+
+		resp, err := proxiedClient(proxy, nil, nil).Get("http://api.example.com/")
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || string(body) != "hello from api.example.com" {
+			t.Errorf("expected the destination response, got %d %q", resp.StatusCode, body)
+		}
+		select {
+		case address := <-dialed:
+			if address != "api.example.com:80" {
+				t.Errorf("expected to dial api.example.com:80, got %s", address)
+			}
+		default:
+			t.Errorf("expected the request to use the dialer")
+		}
+	})
+
+	t.Run("Tunnels clear the deadlines of hijacked connections", func(t *testing.T) {
+		listener := echoListener(t)
+		defer listener.Close()
+		forwardProxy := http_proxy.NewForwardProxy(http_proxy.ForwardProxyOptions{})
+		proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			forwardProxy.ServeHTTP(deadlineHijacker{w, 100 * time.Millisecond}, r)
+		}))
+		defer proxy.Close()
+
+		connection, reader := connectThrough(t, proxy, listener.Addr().String())
+		defer connection.Close()
+		connection.SetDeadline(time.Now().Add(time.Second))
+		for i := 0; i < 4; i++ {
+			time.Sleep(50 * time.Millisecond)
+			connection.Write([]byte("ping\n"))
+			if line, readErr := reader.ReadString('\n'); line != "ping\n" {
+				t.Fatalf("expected the echo after %d pings, got %q %v", i, line, readErr)
+			}
+		}
+	})
+
+	t.Run("Requests not in absolute form are rejected", func(t *testing.T) {
+		proxy := httptest.NewServer(http_proxy.NewForwardProxy(http_proxy.ForwardProxyOptions{}))
+		defer proxy.Close()
+
+		resp, err := http.Get(proxy.URL + "/path")
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected status %d, got %d", http.StatusBadRequest, resp.StatusCode)
+		}
+	})
+
+	t.Run("Idle tunnels are closed", func(t *testing.T) {
+		listener := echoListener(t)
+		defer listener.Close()
+		proxy := httptest.NewServer(http_proxy.NewForwardProxy(http_proxy.ForwardProxyOptions{IdleTimeout: 100 * time.Millisecond}))
+		defer proxy.Close()
+
+		connection, reader := connectThrough(t, proxy, listener.Addr().String())
+		defer connection.Close()
+		for i := 0; i < 4; i++ {
+			connection.Write([]byte("ping\n"))
+			if line, _ := reader.ReadString('\n'); line != "ping\n" {
+				t.Fatalf("expected the echo, got %q", line)
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+
+		connection.SetReadDeadline(time.Now().Add(time.Second))
+		if _, readErr := reader.ReadByte(); readErr != io.EOF {
+			t.Errorf("expected the idle tunnel to be closed, got %v", readErr)
+		}
+	})
+
+	t.Run("Tunnels are closed after the total timeout", func(t *testing.T) {
+		listener := echoListener(t)
+		defer listener.Close()
+		proxy := httptest.NewServer(http_proxy.NewForwardProxy(http_proxy.ForwardProxyOptions{TunnelTimeout: 150 * time.Millisecond}))
+		defer proxy.Close()
+
+		connection, reader := connectThrough(t, proxy, listener.Addr().String())
+		defer connection.Close()
+		start := time.Now()
+		connection.SetDeadline(time.Now().Add(time.Second))
+		for {
+			connection.Write([]byte("ping\n"))
+			if _, readErr := reader.ReadString('\n'); readErr != nil {
+				break
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		if elapsed := time.Since(start); elapsed < 100*time.Millisecond || elapsed > 500*time.Millisecond {
+			t.Errorf("expected the tunnel to be closed after about 150ms, got %s", elapsed)
+		}
+	})
+
+	t.Run("Unreachable destinations fail with a gateway error", func(t *testing.T) {
+		listener := echoListener(t)
+		listener.Close()
+		proxy := httptest.NewServer(http_proxy.NewForwardProxy(http_proxy.ForwardProxyOptions{}))
+		defer proxy.Close()
+
+		resp, _ := proxiedClient(proxy, nil, nil).Get("http://" + listener.Addr().String())
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadGateway {
+			t.Errorf("expected status %d, got %d", http.StatusBadGateway, resp.StatusCode)
+		}
+		connection, _ := net.Dial("tcp", strings.TrimPrefix(proxy.URL, "http://"))
+		defer connection.Close()
+		connection.Write([]byte("CONNECT " + listener.Addr().String() + " HTTP/1.1\r\nHost: " + listener.Addr().String() + "\r\n\r\n"))
+		if tunnelResp, _ := http.ReadResponse(bufio.NewReader(connection), nil); tunnelResp.StatusCode != http.StatusBadGateway {
+			t.Errorf("expected status %d, got %d", http.StatusBadGateway, tunnelResp.StatusCode)
+		}
+	})
+}
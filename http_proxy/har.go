@@ -0,0 +1,524 @@
+package http_proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Number of entries kept by a HARRecorder unless configured otherwise
+const DEFAULT_HAR_MAX_ENTRIES = 1000
+
+// Bytes of each request and response body kept by a HARRecorder unless configured otherwise
+const DEFAULT_HAR_MAX_BODY_SIZE int64 = 64 << 10
+
+type HAROptions struct {
+	// Maximum number of entries kept, the oldest are dropped first.
+	// It defaults to DEFAULT_HAR_MAX_ENTRIES
+	MaxEntries int
+	// Maximum number of bytes kept for each body, bigger bodies are truncated.
+	// It defaults to DEFAULT_HAR_MAX_BODY_SIZE, a negative value disables body capture
+	MaxBodySize int64
+	// Request and response headers whose values are replaced by REDACTED.
+	// They default to DefaultRedactedHeaders
+	RedactHeaders []string
+	// Query parameters whose values are replaced by REDACTED
+	RedactQuery []string
+	// Applied to the captured request and response bodies before they are exported
+	RedactBody func(body []byte) []byte
+}
+
+// Captures the traffic of the requests it is attached to and exports it in
+// the HTTP Archive 1.2 format, which can be imported by browser devtools.
+// Each attempt reaching the transport is an entry, so hedged attempts are
+// listed separately while cache hits and deduplicated calls are not.
+// It is safe for concurrent use
+type HARRecorder struct {
+	options HAROptions
+	mutex   sync.Mutex
+	entries []*harRecord
+}
+
+// Creates a recorder with the provided options
+func NewHARRecorder(options HAROptions) *HARRecorder {
+	if options.MaxEntries <= 0 {
+		options.MaxEntries = DEFAULT_HAR_MAX_ENTRIES
+	}
+	if options.MaxBodySize == 0 {
+		options.MaxBodySize = DEFAULT_HAR_MAX_BODY_SIZE
+	}
+	if options.RedactHeaders == nil {
+		options.RedactHeaders = DefaultRedactedHeaders
+	}
+	return &HARRecorder{options: options}
+}
+
+func (requestIntent *proxiedRequestImpl) WithHARRecorder(recorder *HARRecorder) ProxiedRequest {
+	requestIntent.mutex.Lock()
+	defer requestIntent.mutex.Unlock()
+	requestIntent.options.recorder = recorder
+	return requestIntent
+}
+
+// Wraps next so that the traffic going through it is recorded. It is meant
+// for clients used without ProxiedRequest, prefer WithHARRecorder otherwise
+// since transport timeouts can't be applied to the wrapped transport
+func (recorder *HARRecorder) Transport(next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &harTransport{recorder: recorder, next: next}
+}
+
+// Returns the number of recorded entries
+func (recorder *HARRecorder) Len() int {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	return len(recorder.entries)
+}
+
+// Drops the recorded entries
+func (recorder *HARRecorder) Reset() {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	recorder.entries = nil
+}
+
+// Writes the recorded entries as a HAR document. Entries whose response body
+// is still being read are exported with the content received so far
+func (recorder *HARRecorder) WriteTo(writer io.Writer) (int64, error) {
+	recorder.mutex.Lock()
+	records := append([]*harRecord{}, recorder.entries...)
+	recorder.mutex.Unlock()
+	sort.SliceStable(records, func(i, j int) bool { return records[i].start.Before(records[j].start) })
+
+	document := harDocument{Log: harLog{
+		Version: "1.2",
+		Creator: harCreator{Name: "http-proxy", Version: "1.0"},
+		Entries: make([]harEntry, 0, len(records)),
+	}}
+	for _, record := range records {
+		document.Log.Entries = append(document.Log.Entries, record.export(recorder.options))
+	}
+	payload, marshalErr := json.MarshalIndent(document, "", "  ")
+	if marshalErr != nil {
+		return 0, marshalErr
+	}
+	written, writeErr := writer.Write(payload)
+	return int64(written), writeErr
+}
+
+func (recorder *HARRecorder) add(record *harRecord) {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	recorder.entries = append(recorder.entries, record)
+	if overflow := len(recorder.entries) - recorder.options.MaxEntries; overflow > 0 {
+		recorder.entries = append([]*harRecord{}, recorder.entries[overflow:]...)
+	}
+}
+
+type harTransport struct {
+	recorder *HARRecorder
+	next     http.RoundTripper
+}
+
+func (transport *harTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	limit := transport.recorder.options.MaxBodySize
+	record := &harRecord{
+		start:       time.Now(),
+		request:     request,
+		requestBody: &harCapture{limit: limit},
+		timings:     &harTimings{},
+	}
+	tracedRequest := request.Clone(httptrace.WithClientTrace(request.Context(), record.timings.trace()))
+	if request.Body != nil && request.Body != http.NoBody {
+		tracedRequest.Body = &harCaptureBody{ReadCloser: request.Body, capture: record.requestBody}
+	}
+	record.timings.start = record.start
+
+	response, err := transport.next.RoundTrip(tracedRequest)
+	if err != nil {
+		record.err = err
+		record.timings.finish()
+		transport.recorder.add(record)
+		return nil, err
+	}
+	record.response = response
+	record.responseHeader = response.Header.Clone()
+	record.responseBody = &harCapture{limit: limit}
+	transport.recorder.add(record)
+	response.Body = &harCaptureBody{ReadCloser: response.Body, capture: record.responseBody, onDone: record.timings.finish}
+	response.Request = request
+	return response, nil
+}
+
+// A request/response exchange seen by the transport
+type harRecord struct {
+	start          time.Time
+	request        *http.Request
+	requestBody    *harCapture
+	response       *http.Response
+	responseHeader http.Header
+	responseBody   *harCapture
+	timings        *harTimings
+	err            error
+}
+
+func (record *harRecord) export(options HAROptions) harEntry {
+	request := record.request
+	requestHeader := RedactHeader(request.Header, options.RedactHeaders)
+	if request.Host != "" && request.Host != request.URL.Host {
+		requestHeader.Set("Host", request.Host)
+	}
+	requestURL, _ := url.Parse(redactURL(request.URL, options.RedactQuery))
+	entry := harEntry{
+		StartedDateTime: record.start.Format(time.RFC3339Nano),
+		Request: harRequest{
+			Method:      request.Method,
+			URL:         requestURL.String(),
+			HTTPVersion: request.Proto,
+			Cookies:     harCookies(request.Cookies(), containsHeader(options.RedactHeaders, "Cookie")),
+			Headers:     harNameValues(requestHeader),
+			QueryString: harNameValues(requestURL.Query()),
+			HeadersSize: -1,
+			BodySize:    record.requestBody.size(),
+		},
+		Response: harResponse{
+			Cookies:     []harCookie{},
+			Headers:     []harNameValue{},
+			HeadersSize: -1,
+			BodySize:    -1,
+		},
+		Cache: struct{}{},
+	}
+	if entry.Request.HTTPVersion == "" {
+		entry.Request.HTTPVersion = "HTTP/1.1"
+	}
+	if text, _, isCaptured := record.requestBody.export(options); isCaptured {
+		entry.Request.PostData = &harPostData{MimeType: request.Header.Get("Content-Type"), Text: text}
+	}
+
+	if record.err != nil {
+		entry.Response.HTTPVersion = entry.Request.HTTPVersion
+		entry.Response.Content = harContent{Size: 0}
+		entry.Comment = record.err.Error()
+	} else {
+		response := record.response
+		entry.Response.Status = response.StatusCode
+		entry.Response.StatusText = http.StatusText(response.StatusCode)
+		entry.Response.HTTPVersion = response.Proto
+		entry.Response.Cookies = harCookies((&http.Response{Header: record.responseHeader}).Cookies(), containsHeader(options.RedactHeaders, "Set-Cookie"))
+		entry.Response.Headers = harNameValues(RedactHeader(record.responseHeader, options.RedactHeaders))
+		entry.Response.RedirectURL = record.responseHeader.Get("Location")
+		entry.Response.BodySize = record.responseBody.size()
+		entry.Response.Content = harContent{Size: record.responseBody.size(), MimeType: record.responseHeader.Get("Content-Type")}
+		if text, encoding, isCaptured := record.responseBody.export(options); isCaptured {
+			entry.Response.Content.Text = text
+			entry.Response.Content.Encoding = encoding
+			if record.responseBody.isTruncated() {
+				entry.Response.Content.Comment = "truncated"
+			}
+		}
+	}
+	entry.Timings, entry.Time, entry.ServerIPAddress = record.timings.export()
+	return entry
+}
+
+// Keeps up to limit bytes of a body while counting its total size
+type harCapture struct {
+	mutex  sync.Mutex
+	limit  int64
+	buffer bytes.Buffer
+	total  int64
+}
+
+func (capture *harCapture) Write(p []byte) {
+	capture.mutex.Lock()
+	defer capture.mutex.Unlock()
+	capture.total += int64(len(p))
+	if room := capture.limit - int64(capture.buffer.Len()); room > 0 {
+		capture.buffer.Write(p[:min(int64(len(p)), room)])
+	}
+}
+
+func (capture *harCapture) size() int64 {
+	capture.mutex.Lock()
+	defer capture.mutex.Unlock()
+	return capture.total
+}
+
+func (capture *harCapture) isTruncated() bool {
+	capture.mutex.Lock()
+	defer capture.mutex.Unlock()
+	return capture.total > int64(capture.buffer.Len())
+}
+
+// Returns the redacted body as text, base64 encoded when it isn't valid UTF-8
+func (capture *harCapture) export(options HAROptions) (string, string, bool) {
+	capture.mutex.Lock()
+	defer capture.mutex.Unlock()
+	if capture.total == 0 || capture.limit < 0 {
+		return "", "", false
+	}
+	body := append([]byte{}, capture.buffer.Bytes()...)
+	if options.RedactBody != nil {
+		body = options.RedactBody(body)
+	}
+	if utf8.Valid(body) {
+		return string(body), "", true
+	}
+	return base64.StdEncoding.EncodeToString(body), "base64", true
+}
+
+type harCaptureBody struct {
+	io.ReadCloser
+	capture *harCapture
+	onDone  func()
+	once    sync.Once
+}
+
+func (body *harCaptureBody) Read(p []byte) (int, error) {
+	n, err := body.ReadCloser.Read(p)
+	body.capture.Write(p[:n])
+	if err != nil && body.onDone != nil {
+		body.once.Do(body.onDone)
+	}
+	return n, err
+}
+
+func (body *harCaptureBody) Close() error {
+	if body.onDone != nil {
+		body.once.Do(body.onDone)
+	}
+	return body.ReadCloser.Close()
+}
+
+// Instants of the phases of an exchange, collected with httptrace
+type harTimings struct {
+	mutex         sync.Mutex
+	start         time.Time
+	dnsStart      time.Time
+	dnsDone       time.Time
+	connectStart  time.Time
+	connectDone   time.Time
+	tlsStart      time.Time
+	tlsDone       time.Time
+	gotConn       time.Time
+	wroteRequest  time.Time
+	firstByte     time.Time
+	end           time.Time
+	remoteAddress string
+}
+
+func (timings *harTimings) trace() *httptrace.ClientTrace {
+	set := func(instant *time.Time) {
+		timings.mutex.Lock()
+		defer timings.mutex.Unlock()
+		if instant.IsZero() {
+			*instant = time.Now()
+		}
+	}
+	return &httptrace.ClientTrace{
+		DNSStart:             func(httptrace.DNSStartInfo) { set(&timings.dnsStart) },
+		DNSDone:              func(httptrace.DNSDoneInfo) { set(&timings.dnsDone) },
+		ConnectStart:         func(string, string) { set(&timings.connectStart) },
+		ConnectDone:          func(string, string, error) { set(&timings.connectDone) },
+		TLSHandshakeStart:    func() { set(&timings.tlsStart) },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { set(&timings.tlsDone) },
+		WroteRequest:         func(httptrace.WroteRequestInfo) { set(&timings.wroteRequest) },
+		GotFirstResponseByte: func() { set(&timings.firstByte) },
+		GotConn: func(info httptrace.GotConnInfo) {
+			set(&timings.gotConn)
+			timings.mutex.Lock()
+			defer timings.mutex.Unlock()
+			if host, _, splitErr := net.SplitHostPort(info.Conn.RemoteAddr().String()); splitErr == nil {
+				timings.remoteAddress = host
+			}
+		},
+	}
+}
+
+func (timings *harTimings) finish() {
+	timings.mutex.Lock()
+	defer timings.mutex.Unlock()
+	if timings.end.IsZero() {
+		timings.end = time.Now()
+	}
+}
+
+// Returns the HAR timings, the total time in milliseconds and the server address.
+// Phases that didn't happen, like DNS resolution on a reused connection, are -1
+func (timings *harTimings) export() (harTimingsJSON, float64, string) {
+	timings.mutex.Lock()
+	defer timings.mutex.Unlock()
+	end := timings.end
+	if end.IsZero() {
+		end = time.Now()
+	}
+	result := harTimingsJSON{
+		Blocked: -1,
+		DNS:     span(timings.dnsStart, timings.dnsDone),
+		Connect: span(timings.connectStart, timings.connectDone),
+		SSL:     span(timings.tlsStart, timings.tlsDone),
+		Send:    span(timings.gotConn, timings.wroteRequest),
+		Wait:    span(timings.wroteRequest, timings.firstByte),
+		Receive: span(timings.firstByte, end),
+	}
+	if result.SSL >= 0 {
+		result.Connect = span(timings.connectStart, timings.tlsDone)
+	}
+	if !timings.gotConn.IsZero() {
+		result.Blocked = milliseconds(timings.gotConn.Sub(timings.start))
+		for _, phase := range []float64{result.DNS, result.Connect} {
+			if phase > 0 {
+				result.Blocked -= phase
+			}
+		}
+		result.Blocked = max(result.Blocked, 0)
+	}
+	if result.Send < 0 {
+		result.Send = 0
+	}
+	if result.Wait < 0 {
+		result.Wait = 0
+	}
+	if result.Receive < 0 {
+		result.Receive = 0
+	}
+	return result, milliseconds(end.Sub(timings.start)), timings.remoteAddress
+}
+
+func span(from time.Time, to time.Time) float64 {
+	if from.IsZero() || to.IsZero() {
+		return -1
+	}
+	return milliseconds(to.Sub(from))
+}
+
+func milliseconds(duration time.Duration) float64 {
+	return float64(duration.Microseconds()) / 1000
+}
+
+func harNameValues[T ~map[string][]string](values T) []harNameValue {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pairs := []harNameValue{}
+	for _, name := range names {
+		for _, value := range values[name] {
+			pairs = append(pairs, harNameValue{Name: name, Value: value})
+		}
+	}
+	return pairs
+}
+
+func harCookies(cookies []*http.Cookie, isRedacted bool) []harCookie {
+	exported := []harCookie{}
+	for _, cookie := range cookies {
+		value := cookie.Value
+		if isRedacted {
+			value = REDACTED
+		}
+		exported = append(exported, harCookie{Name: cookie.Name, Value: value, Path: cookie.Path, Domain: cookie.Domain, HTTPOnly: cookie.HttpOnly, Secure: cookie.Secure})
+	}
+	return exported
+}
+
+type harDocument struct {
+	Log harLog `json:"log"`
+}
+
+type harLog struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime string         `json:"startedDateTime"`
+	Time            float64        `json:"time"`
+	Request         harRequest     `json:"request"`
+	Response        harResponse    `json:"response"`
+	Cache           struct{}       `json:"cache"`
+	Timings         harTimingsJSON `json:"timings"`
+	ServerIPAddress string         `json:"serverIPAddress,omitempty"`
+	Comment         string         `json:"comment,omitempty"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harCookie    `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int64          `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harCookie    `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int64          `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harCookie struct {
+	Name     string `json:"name"`
+	Value    string `json:"value"`
+	Path     string `json:"path,omitempty"`
+	Domain   string `json:"domain,omitempty"`
+	HTTPOnly bool   `json:"httpOnly,omitempty"`
+	Secure   bool   `json:"secure,omitempty"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type harContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type harTimingsJSON struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+	SSL     float64 `json:"ssl"`
+}
@@ -0,0 +1,191 @@
+package http_proxy_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	http_proxy "github.com/AndreaCostanzo1/http-proxy/http_proxy"
+)
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harDocument struct {
+	Log struct {
+		Version string `json:"version"`
+		Entries []struct {
+			Time    float64 `json:"time"`
+			Comment string  `json:"comment"`
+			Request struct {
+				Method      string         `json:"method"`
+				URL         string         `json:"url"`
+				Headers     []harNameValue `json:"headers"`
+				QueryString []harNameValue `json:"queryString"`
+				PostData    *struct {
+					MimeType string `json:"mimeType"`
+					Text     string `json:"text"`
+				} `json:"postData"`
+			} `json:"request"`
+			Response struct {
+				Status  int            `json:"status"`
+				Headers []harNameValue `json:"headers"`
+				Content struct {
+					Size    int64  `json:"size"`
+					Text    string `json:"text"`
+					Comment string `json:"comment"`
+				} `json:"content"`
+			} `json:"response"`
+			Timings map[string]float64 `json:"timings"`
+		} `json:"entries"`
+	} `json:"log"`
+}
+
+func exportHAR(t *testing.T, recorder *http_proxy.HARRecorder) (harDocument, string) {
+	var buffer bytes.Buffer
+	if _, err := recorder.WriteTo(&buffer); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	var document harDocument
+	if err := json.Unmarshal(buffer.Bytes(), &document); err != nil {
+		t.Fatalf("expected a valid HAR document, got %v", err)
+	}
+	return document, buffer.String()
+}
+
+func harValue(pairs []harNameValue, name string) string {
+	for _, pair := range pairs {
+		if strings.EqualFold(pair.Name, name) {
+			return pair.Value
+		}
+	}
+	return ""
+}
+
+func TestHARRecorder(t *testing.T) {
+	t.Run("Exchanges are exported with headers, query, post data and content", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Set-Cookie", "session=secret-session")
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"id":1}`))
+		}))
+		defer server.Close()
+		recorder := http_proxy.NewHARRecorder(http_proxy.HAROptions{RedactQuery: []string{"api_key"}})
+
+		_, body := sendAndRead(t, http_proxy.NewRequest("POST", server.URL+"/items?page=2&api_key=secret-key").
+			WithHARRecorder(recorder).
+			SetJWTAuthToken("secret-token").
+			SetHeader("X-Custom-Header", "value").
+			SetJSONBody(map[string]string{"name": "item"}))
+		document, raw := exportHAR(t, recorder)
+
+		if body != `{"id":1}` {
+			t.Errorf("expected the caller to read the body, got '%s'", body)
+		}
+		if document.Log.Version != "1.2" || len(document.Log.Entries) != 1 {
+			t.Fatalf("expected a HAR 1.2 document with 1 entry, got %s", raw)
+		}
+		entry := document.Log.Entries[0]
+		if entry.Request.Method != "POST" || !strings.Contains(entry.Request.URL, "/items?") {
+			t.Errorf("expected POST on /items, got %s %s", entry.Request.Method, entry.Request.URL)
+		}
+		if value := harValue(entry.Request.Headers, "X-Custom-Header"); value != "value" {
+			t.Errorf("expected header X-Custom-Header 'value', got '%s'", value)
+		}
+		if value := harValue(entry.Request.QueryString, "page"); value != "2" {
+			t.Errorf("expected query parameter page '2', got '%s'", value)
+		}
+		if entry.Request.PostData == nil || entry.Request.PostData.Text != `{"name":"item"}` {
+			t.Errorf("expected post data with the JSON body, got %+v", entry.Request.PostData)
+		}
+		if entry.Response.Status != http.StatusCreated || entry.Response.Content.Text != `{"id":1}` || entry.Response.Content.Size != 8 {
+			t.Errorf("expected response 201 with the content, got %d '%s'", entry.Response.Status, entry.Response.Content.Text)
+		}
+		for _, phase := range []string{"blocked", "dns", "connect", "send", "wait", "receive", "ssl"} {
+			if _, isFound := entry.Timings[phase]; !isFound {
+				t.Errorf("expected timing '%s', got %v", phase, entry.Timings)
+			}
+		}
+		if entry.Timings["wait"] < 0 || entry.Time <= 0 {
+			t.Errorf("expected positive timings, got %v and time %f", entry.Timings, entry.Time)
+		}
+		if strings.Contains(raw, "secret") {
+			t.Errorf("expected credentials to be redacted, got %s", raw)
+		}
+	})
+
+	t.Run("Bodies are truncated and entries capped", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(strings.Repeat("a", 100)))
+		}))
+		defer server.Close()
+		recorder := http_proxy.NewHARRecorder(http_proxy.HAROptions{MaxEntries: 2, MaxBodySize: 10})
+
+		for _, path := range []string{"/first", "/second", "/third"} {
+			sendAndRead(t, http_proxy.NewRequest("GET", server.URL+path).WithHARRecorder(recorder))
+		}
+		document, _ := exportHAR(t, recorder)
+
+		if len(document.Log.Entries) != 2 {
+			t.Fatalf("expected 2 entries, got %d", len(document.Log.Entries))
+		}
+		if !strings.HasSuffix(document.Log.Entries[0].Request.URL, "/second") {
+			t.Errorf("expected the oldest entry to be dropped, got %s", document.Log.Entries[0].Request.URL)
+		}
+		content := document.Log.Entries[1].Response.Content
+		if content.Text != strings.Repeat("a", 10) || content.Size != 100 || content.Comment != "truncated" {
+			t.Errorf("expected content truncated to 10 of 100 bytes, got %+v", content)
+		}
+	})
+
+	t.Run("Transport errors and custom redaction", func(t *testing.T) {
+		recorder := http_proxy.NewHARRecorder(http_proxy.HAROptions{
+			RedactHeaders: []string{"X-Api-Key"},
+			RedactBody: func(body []byte) []byte {
+				return bytes.ReplaceAll(body, []byte("hunter2"), []byte(http_proxy.REDACTED))
+			},
+		})
+		failing := &http.Client{Transport: recorder.Transport(roundTripFunc(func(r *http.Request) (*http.Response, error) {
+			io.ReadAll(r.Body)
+			return nil, errors.New("connection refused")
+		}))}
+
+		_, err := http_proxy.NewRequest("PUT", "http://unreachable.test").
+			WithHTTPClient(failing).
+			SetHeader("X-Api-Key", "key").
+			SetBody(strings.NewReader("password=hunter2")).
+			Send()
+		document, raw := exportHAR(t, recorder)
+
+		if err == nil {
+			t.Errorf("expected an error, got none")
+		}
+		if recorder.Len() != 1 || document.Log.Entries[0].Response.Status != 0 {
+			t.Fatalf("expected 1 entry without response, got %s", raw)
+		}
+		if !strings.Contains(document.Log.Entries[0].Comment, "connection refused") {
+			t.Errorf("expected the error as comment, got '%s'", document.Log.Entries[0].Comment)
+		}
+		if strings.Contains(raw, "hunter2") || strings.Contains(raw, `"key"`) {
+			t.Errorf("expected body and header to be redacted, got %s", raw)
+		}
+		recorder.Reset()
+		if recorder.Len() != 0 {
+			t.Errorf("expected no entries after Reset, got %d", recorder.Len())
+		}
+	})
+}
+
+type roundTripFunc func(r *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
@@ -3,7 +3,13 @@ package http_proxy
 import "fmt"
 
 func (requestIntent *proxiedRequestImpl) AddHeader(key string, value string) ProxiedRequest {
-	requestIntent.verifyUnderlyingRequestNotGenerated()
+	requestIntent.mutex.Lock()
+	defer requestIntent.mutex.Unlock()
+	requestIntent.verifyUnderlyingRequestNotGenerated("AddHeader")
+	if headerErr := validateHeader(key, value); headerErr != nil {
+		requestIntent.recordError("AddHeader", headerErr)
+		return requestIntent
+	}
 	if _, isFound := requestIntent.headers[key]; !isFound {
 		requestIntent.headers[key] = []string{}
 	}
@@ -12,27 +18,53 @@ func (requestIntent *proxiedRequestImpl) AddHeader(key string, value string) Pro
 }
 
 func (requestIntent *proxiedRequestImpl) SetHeader(key string, value string) ProxiedRequest {
-	requestIntent.verifyUnderlyingRequestNotGenerated()
-	requestIntent.headers[key] = []string{value}
+	requestIntent.mutex.Lock()
+	defer requestIntent.mutex.Unlock()
+	requestIntent.setHeader("SetHeader", key, value)
 	return requestIntent
 }
 
+func (requestIntent *proxiedRequestImpl) setHeader(call string, key string, value string) {
+	requestIntent.verifyUnderlyingRequestNotGenerated(call)
+	if headerErr := validateHeader(key, value); headerErr != nil {
+		requestIntent.recordError(call, headerErr)
+		return
+	}
+	requestIntent.headers[key] = []string{value}
+}
+
 func (requestIntent *proxiedRequestImpl) SetHeaders(headers map[string]string) ProxiedRequest {
-	requestIntent.verifyUnderlyingRequestNotGenerated()
+	requestIntent.mutex.Lock()
+	defer requestIntent.mutex.Unlock()
+	requestIntent.verifyUnderlyingRequestNotGenerated("SetHeaders")
 	for key, value := range headers {
+		if headerErr := validateHeader(key, value); headerErr != nil {
+			requestIntent.recordError("SetHeaders", headerErr)
+			continue
+		}
 		requestIntent.headers[key] = []string{value}
 	}
 	return requestIntent
 }
 
 func (requestIntent *proxiedRequestImpl) SetMultiValueHeaders(headers map[string][]string) ProxiedRequest {
-	requestIntent.verifyUnderlyingRequestNotGenerated()
+	requestIntent.mutex.Lock()
+	defer requestIntent.mutex.Unlock()
+	requestIntent.verifyUnderlyingRequestNotGenerated("SetMultiValueHeaders")
 	for key, values := range headers {
-		requestIntent.headers[key] = values
+		if headerErr := validateHeader(key, values...); headerErr != nil {
+			requestIntent.recordError("SetMultiValueHeaders", headerErr)
+			continue
+		}
+		requestIntent.headers[key] = append([]string{}, values...)
 	}
 	return requestIntent
 }
 
 func (requestIntent *proxiedRequestImpl) SetJWTAuthToken(token string) ProxiedRequest {
-	return requestIntent.SetHeader("Authorization", fmt.Sprintf("Bearer %s", token))
+	requestIntent.mutex.Lock()
+	defer requestIntent.mutex.Unlock()
+	requestIntent.setHeader("SetJWTAuthToken", "Authorization", fmt.Sprintf("Bearer %s", token))
+	requestIntent.tokenSource = nil
+	return requestIntent
 }
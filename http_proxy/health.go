@@ -0,0 +1,276 @@
+package http_proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var ErrHealthCheckFailed = errors.New("health check failed")
+
+const (
+	DEFAULT_HEALTH_CHECK_INTERVAL        = 10 * time.Second
+	DEFAULT_HEALTH_CHECK_TIMEOUT         = 2 * time.Second
+	DEFAULT_HEALTHY_THRESHOLD            = 2
+	DEFAULT_UNHEALTHY_THRESHOLD          = 3
+	DEFAULT_OUTLIER_CONSECUTIVE_FAILURES = 5
+	DEFAULT_BASE_EJECTION_DURATION       = 30 * time.Second
+	DEFAULT_MAX_EJECTION_DURATION        = 5 * time.Minute
+	DEFAULT_MAX_EJECTION_PERCENT         = 50
+)
+
+// Maximum number of bytes of the probe responses searched for the expected body
+const HEALTH_CHECK_MAX_BODY_SIZE = 64 << 10
+
+// Periodic probes marking the targets of a Balancer healthy or unhealthy.
+// Zero values are replaced by the defaults
+type HealthCheck struct {
+	// Path probed on each target, appended to the target URL. It defaults to /
+	Path string
+	// Method of the probes. It defaults to GET
+	Method string
+	// Time between the probes of a target. It defaults to DEFAULT_HEALTH_CHECK_INTERVAL
+	Interval time.Duration
+	// Bounds each probe. It defaults to DEFAULT_HEALTH_CHECK_TIMEOUT
+	Timeout time.Duration
+	// Status code of a successful probe. Any 2xx status succeeds when zero
+	ExpectedStatus int
+	// Text the body of a successful probe contains, if not empty
+	ExpectedBody string
+	// Consecutive successful probes marking an unhealthy target healthy.
+	// It defaults to DEFAULT_HEALTHY_THRESHOLD
+	HealthyThreshold int
+	// Consecutive failed probes marking a healthy target unhealthy.
+	// It defaults to DEFAULT_UNHEALTHY_THRESHOLD
+	UnhealthyThreshold int
+	// Builds the probe for the URL, e.g. to add headers or a client.
+	// It defaults to NewRequest with Method
+	Probe func(url string) ProxiedRequest
+}
+
+// Passive detection ejecting the targets of a Balancer that fail consecutive
+// sends with a 5xx status or a transport error. Zero values are replaced by the defaults.
+// The outcome is recorded by the balancer transport as soon as each round trip
+// returns, before the response is validated: every hedged attempt and redirect
+// goes to its own target while only the winning response is validated, so
+// errors returned by interceptors are not held against the targets
+type OutlierDetection struct {
+	// Consecutive failed sends ejecting a target.
+	// It defaults to DEFAULT_OUTLIER_CONSECUTIVE_FAILURES
+	ConsecutiveFailures int
+	// Duration of the first ejection of a target. Each following ejection
+	// without a successful send in between lasts one more base duration.
+	// It defaults to DEFAULT_BASE_EJECTION_DURATION
+	BaseEjectionDuration time.Duration
+	// Upper bound of the ejection duration. It defaults to DEFAULT_MAX_EJECTION_DURATION
+	MaxEjectionDuration time.Duration
+	// Maximum percentage of the targets ejected at the same time, rounded down.
+	// Failing targets over the limit keep receiving sends, so that an outage of
+	// every target doesn't leave the balancer without targets. With the default
+	// DEFAULT_MAX_EJECTION_PERCENT a balancer with a single target never ejects
+	// it and one with two targets ejects at most one; set 100 to lift the limit
+	MaxEjectionPercent int
+}
+
+// Health of a target of a Balancer. Only targets that are healthy and not
+// ejected receive sends
+type TargetHealth struct {
+	URL string
+	// Result of the active health checks, true until a check fails
+	Healthy bool
+	// Error of the last failed probe, if the last probe failed
+	LastCheckError error
+	LastCheck      time.Time
+	// Whether the target is ejected by the outlier detection
+	Ejected      bool
+	EjectedUntil time.Time
+	// Ejections since the last successful send
+	Ejections int
+	// Consecutive sends failed with a 5xx status or a transport error
+	ConsecutiveFailures int
+	// Sends whose response body has not been consumed yet
+	Outstanding int
+}
+
+// Enables the passive outlier detection on the outcome of the sends
+func (balancer *Balancer) WithOutlierDetection(detection OutlierDetection) *Balancer {
+	if detection.ConsecutiveFailures <= 0 {
+		detection.ConsecutiveFailures = DEFAULT_OUTLIER_CONSECUTIVE_FAILURES
+	}
+	if detection.BaseEjectionDuration <= 0 {
+		detection.BaseEjectionDuration = DEFAULT_BASE_EJECTION_DURATION
+	}
+	if detection.MaxEjectionDuration <= 0 {
+		detection.MaxEjectionDuration = DEFAULT_MAX_EJECTION_DURATION
+	}
+	if detection.MaxEjectionPercent <= 0 {
+		detection.MaxEjectionPercent = DEFAULT_MAX_EJECTION_PERCENT
+	}
+	balancer.mutex.Lock()
+	defer balancer.mutex.Unlock()
+	balancer.outlierDetection = &detection
+	return balancer
+}
+
+// Probes every target right away and then once per interval, until ctx is done
+func (balancer *Balancer) StartHealthChecks(ctx context.Context, check HealthCheck) {
+	if check.Method == "" {
+		check.Method = http.MethodGet
+	}
+	if check.Interval <= 0 {
+		check.Interval = DEFAULT_HEALTH_CHECK_INTERVAL
+	}
+	if check.Timeout <= 0 {
+		check.Timeout = DEFAULT_HEALTH_CHECK_TIMEOUT
+	}
+	if check.HealthyThreshold <= 0 {
+		check.HealthyThreshold = DEFAULT_HEALTHY_THRESHOLD
+	}
+	if check.UnhealthyThreshold <= 0 {
+		check.UnhealthyThreshold = DEFAULT_UNHEALTHY_THRESHOLD
+	}
+	if check.Probe == nil {
+		check.Probe = func(url string) ProxiedRequest { return NewRequest(check.Method, url) }
+	}
+	for _, target := range balancer.targets {
+		go balancer.probePeriodically(ctx, target, check)
+	}
+}
+
+// Returns the health of the targets, in the order they were provided
+func (balancer *Balancer) Health() []TargetHealth {
+	balancer.mutex.Lock()
+	defer balancer.mutex.Unlock()
+	now := time.Now()
+	health := make([]TargetHealth, 0, len(balancer.targets))
+	for _, target := range balancer.targets {
+		targetHealth := TargetHealth{
+			URL:                 target.url.String(),
+			Healthy:             target.healthy,
+			LastCheckError:      target.lastCheckErr,
+			LastCheck:           target.lastCheck,
+			Ejected:             now.Before(target.ejectedUntil),
+			Ejections:           target.ejections,
+			ConsecutiveFailures: target.consecutiveFailures,
+			Outstanding:         target.outstanding,
+		}
+		if targetHealth.Ejected {
+			targetHealth.EjectedUntil = target.ejectedUntil
+		}
+		health = append(health, targetHealth)
+	}
+	return health
+}
+
+func (balancer *Balancer) probePeriodically(ctx context.Context, target *balancedTarget, check HealthCheck) {
+	ticker := time.NewTicker(check.Interval)
+	defer ticker.Stop()
+	for {
+		probeErr := probe(ctx, target, check)
+		if ctx.Err() != nil {
+			return
+		}
+		balancer.recordCheck(target, check, probeErr)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func probe(ctx context.Context, target *balancedTarget, check HealthCheck) error {
+	probeCtx, cancel := context.WithTimeout(ctx, check.Timeout)
+	defer cancel()
+	probePath, parseErr := url.Parse(check.Path)
+	if parseErr != nil {
+		return fmt.Errorf("%w: %w", ErrHealthCheckFailed, parseErr)
+	}
+	response, sendErr := check.Probe(upstreamURL(target.url.String(), probePath)).WithContext(probeCtx).Send()
+	if sendErr != nil {
+		return fmt.Errorf("%w: %w", ErrHealthCheckFailed, sendErr)
+	}
+	defer response.Body.Close()
+	isExpectedStatus := response.StatusCode == check.ExpectedStatus ||
+		check.ExpectedStatus == 0 && response.StatusCode >= 200 && response.StatusCode < 300
+	if !isExpectedStatus {
+		return fmt.Errorf("%w: unexpected status %d", ErrHealthCheckFailed, response.StatusCode)
+	}
+	if check.ExpectedBody != "" {
+		body, readErr := io.ReadAll(io.LimitReader(response.Body, HEALTH_CHECK_MAX_BODY_SIZE))
+		if readErr != nil {
+			return fmt.Errorf("%w: %w", ErrHealthCheckFailed, readErr)
+		}
+		if !strings.Contains(string(body), check.ExpectedBody) {
+			return fmt.Errorf("%w: body doesn't contain %q", ErrHealthCheckFailed, check.ExpectedBody)
+		}
+	}
+	return nil
+}
+
+func (balancer *Balancer) recordCheck(target *balancedTarget, check HealthCheck, probeErr error) {
+	balancer.mutex.Lock()
+	defer balancer.mutex.Unlock()
+	target.lastCheck = time.Now()
+	target.lastCheckErr = probeErr
+	if probeErr != nil {
+		target.checkSuccesses = 0
+		target.checkFailures++
+		if target.checkFailures >= check.UnhealthyThreshold {
+			target.healthy = false
+		}
+		return
+	}
+	target.checkFailures = 0
+	target.checkSuccesses++
+	if target.checkSuccesses >= check.HealthyThreshold {
+		target.healthy = true
+	}
+}
+
+// Records the outcome of a send to the target for the outlier detection
+func (balancer *Balancer) recordOutcome(target *balancedTarget, isFailure bool) {
+	balancer.mutex.Lock()
+	defer balancer.mutex.Unlock()
+	detection := balancer.outlierDetection
+	if detection == nil {
+		return
+	}
+	if !isFailure {
+		target.consecutiveFailures = 0
+		target.ejections = 0
+		return
+	}
+	target.consecutiveFailures++
+	if target.consecutiveFailures >= detection.ConsecutiveFailures {
+		target.consecutiveFailures = 0
+		if !balancer.canEject(detection) {
+			return
+		}
+		target.ejections++
+		ejection := min(detection.BaseEjectionDuration*time.Duration(target.ejections), detection.MaxEjectionDuration)
+		target.ejectedUntil = time.Now().Add(ejection)
+	}
+}
+
+// Reports whether one more target can be ejected without exceeding the
+// maximum ejection percentage. The caller holds the mutex
+func (balancer *Balancer) canEject(detection *OutlierDetection) bool {
+	now := time.Now()
+	ejected := 1
+	for _, target := range balancer.targets {
+		if now.Before(target.ejectedUntil) {
+			ejected++
+		}
+	}
+	return ejected*100 <= len(balancer.targets)*detection.MaxEjectionPercent
+}
+
+func (target *balancedTarget) isAvailable(now time.Time) bool {
+	return target.healthy && !now.Before(target.ejectedUntil)
+}
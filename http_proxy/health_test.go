@@ -0,0 +1,275 @@
+package http_proxy_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	http_proxy "github.com/AndreaCostanzo1/http-proxy/http_proxy"
+)
+
+// Starts a server answering with its name, or with a 500 while it is broken
+func toggledServer(name string, isBroken *atomic.Bool) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isBroken.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("broken"))
+			return
+		}
+		w.Write([]byte(name))
+	}))
+}
+
+// Polls condition until it holds or a second has passed
+func eventually(t *testing.T, description string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %s", description)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func sendToService(balancer *http_proxy.Balancer) string {
+	resp, err := http_proxy.NewRequest("GET", "http://users").WithBalancer(balancer).Send()
+	if err != nil {
+		return err.Error()
+	}
+	defer resp.Body.Close()
+	body := make([]byte, 16)
+	n, _ := resp.Body.Read(body)
+	return string(body[:n])
+}
+
+func TestOutlierDetection(t *testing.T) {
+	t.Run("Failing targets are ejected and recover", func(t *testing.T) {
+		var isBroken, isNeverBroken atomic.Bool
+		isBroken.Store(true)
+		broken := toggledServer("a", &isBroken)
+		defer broken.Close()
+		healthy := toggledServer("b", &isNeverBroken)
+		defer healthy.Close()
+		balancer := newBalancer(t, http_proxy.ROUND_ROBIN, http_proxy.Target{URL: broken.URL}, http_proxy.Target{URL: healthy.URL}).
+			WithOutlierDetection(http_proxy.OutlierDetection{ConsecutiveFailures: 2, BaseEjectionDuration: 100 * time.Millisecond})
+
+		for i := 0; i < 4; i++ {
+			sendToService(balancer)
+		}
+		health := balancer.Health()
+		if !health[0].Ejected || health[0].Ejections != 1 || health[1].Ejected {
+			t.Fatalf("expected only the failing target to be ejected, got %+v", health)
+		}
+		for i := 0; i < 4; i++ {
+			if body := sendToService(balancer); body != "b" {
+				t.Errorf("expected the ejected target to be skipped, got %q", body)
+			}
+		}
+
+		isBroken.Store(false)
+		time.Sleep(100 * time.Millisecond)
+		received := map[string]bool{}
+		for i := 0; i < 4; i++ {
+			received[sendToService(balancer)] = true
+		}
+		if !received["a"] || !received["b"] {
+			t.Errorf("expected the recovered target to receive sends, got %v", received)
+		}
+		if health := balancer.Health(); health[0].Ejected || health[0].Ejections != 0 || health[0].ConsecutiveFailures != 0 {
+			t.Errorf("expected a recovered target, got %+v", health[0])
+		}
+	})
+
+	t.Run("Repeated ejections last longer", func(t *testing.T) {
+		var isBroken atomic.Bool
+		isBroken.Store(true)
+		broken := toggledServer("a", &isBroken)
+		defer broken.Close()
+		balancer := newBalancer(t, http_proxy.ROUND_ROBIN, http_proxy.Target{URL: broken.URL}).
+			WithOutlierDetection(http_proxy.OutlierDetection{ConsecutiveFailures: 1, BaseEjectionDuration: 50 * time.Millisecond, MaxEjectionDuration: 80 * time.Millisecond, MaxEjectionPercent: 100})
+
+		sendToService(balancer)
+		firstEjection := time.Until(balancer.Health()[0].EjectedUntil)
+		time.Sleep(firstEjection)
+		sendToService(balancer)
+		secondEjection := time.Until(balancer.Health()[0].EjectedUntil)
+
+		if firstEjection > 50*time.Millisecond || secondEjection <= 50*time.Millisecond || secondEjection > 80*time.Millisecond {
+			t.Errorf("expected ejections of 50ms and 80ms, got %s and %s", firstEjection, secondEjection)
+		}
+	})
+
+	t.Run("Transport errors count as failures", func(t *testing.T) {
+		unreachable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		unreachable.Close()
+		balancer := newBalancer(t, http_proxy.ROUND_ROBIN, http_proxy.Target{URL: unreachable.URL}).
+			WithOutlierDetection(http_proxy.OutlierDetection{ConsecutiveFailures: 2, MaxEjectionPercent: 100})
+
+		sendToService(balancer)
+		sendToService(balancer)
+
+		_, err := http_proxy.NewRequest("GET", "http://users").WithBalancer(balancer).Send()
+		if !errors.Is(err, http_proxy.ErrNoTargets) {
+			t.Errorf("expected error %v, got %v", http_proxy.ErrNoTargets, err)
+		}
+	})
+
+	t.Run("Ejections are limited to the maximum percentage of the targets", func(t *testing.T) {
+		var isBroken atomic.Bool
+		isBroken.Store(true)
+		first := toggledServer("a", &isBroken)
+		defer first.Close()
+		second := toggledServer("b", &isBroken)
+		defer second.Close()
+		balancer := newBalancer(t, http_proxy.ROUND_ROBIN, http_proxy.Target{URL: first.URL}, http_proxy.Target{URL: second.URL}).
+			WithOutlierDetection(http_proxy.OutlierDetection{ConsecutiveFailures: 1, BaseEjectionDuration: time.Minute})
+
+		for i := 0; i < 4; i++ {
+			sendToService(balancer)
+		}
+		ejected := 0
+		for _, health := range balancer.Health() {
+			if health.Ejected {
+				ejected++
+			}
+		}
+		if ejected != 1 {
+			t.Fatalf("expected 1 ejected target, got %+v", balancer.Health())
+		}
+
+		isBroken.Store(false)
+		if body := sendToService(balancer); body != "a" && body != "b" {
+			t.Errorf("expected the target over the limit to keep receiving sends, got %q", body)
+		}
+	})
+
+	t.Run("A single target is never ejected with the default maximum percentage", func(t *testing.T) {
+		var isBroken atomic.Bool
+		isBroken.Store(true)
+		broken := toggledServer("a", &isBroken)
+		defer broken.Close()
+		balancer := newBalancer(t, http_proxy.ROUND_ROBIN, http_proxy.Target{URL: broken.URL}).
+			WithOutlierDetection(http_proxy.OutlierDetection{ConsecutiveFailures: 1, BaseEjectionDuration: time.Minute})
+
+		for i := 0; i < 3; i++ {
+			sendToService(balancer)
+		}
+
+		if health := balancer.Health()[0]; health.Ejected {
+			t.Errorf("expected the only target not to be ejected, got %+v", health)
+		}
+		isBroken.Store(false)
+		if body := sendToService(balancer); body != "a" {
+			t.Errorf("expected the only target to keep receiving sends, got %q", body)
+		}
+	})
+
+	t.Run("Sends canceled by the caller don't count", func(t *testing.T) {
+		server := slowServer(time.Second)
+		defer server.Close()
+		balancer := newBalancer(t, http_proxy.ROUND_ROBIN, http_proxy.Target{URL: server.URL}).
+			WithOutlierDetection(http_proxy.OutlierDetection{ConsecutiveFailures: 1})
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		http_proxy.NewRequest("GET", "http://users").WithBalancer(balancer).WithContext(ctx).Send()
+
+		if health := balancer.Health(); health[0].Ejected || health[0].ConsecutiveFailures != 0 || health[0].Outstanding != 0 {
+			t.Errorf("expected the target to be unaffected, got %+v", health[0])
+		}
+	})
+}
+
+func TestHealthChecks(t *testing.T) {
+	t.Run("Probes mark targets unhealthy and healthy", func(t *testing.T) {
+		var isBroken atomic.Bool
+		var probes atomic.Int32
+		flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/base/health" {
+				probes.Add(1)
+				if r.Header.Get("X-Probe") != "yes" {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				if isBroken.Load() {
+					w.Write([]byte("status: degraded"))
+					return
+				}
+				w.Write([]byte("status: ok"))
+				return
+			}
+			w.Write([]byte("a"))
+		}))
+		defer flaky.Close()
+		stable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/health" {
+				w.Write([]byte("status: ok"))
+				return
+			}
+			w.Write([]byte("b"))
+		}))
+		defer stable.Close()
+		balancer := newBalancer(t, http_proxy.ROUND_ROBIN, http_proxy.Target{URL: flaky.URL + "/base"}, http_proxy.Target{URL: stable.URL})
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		balancer.StartHealthChecks(ctx, http_proxy.HealthCheck{
+			Path:               "/health",
+			Interval:           10 * time.Millisecond,
+			ExpectedBody:       "ok",
+			HealthyThreshold:   1,
+			UnhealthyThreshold: 2,
+			Probe: func(url string) http_proxy.ProxiedRequest {
+				return http_proxy.NewRequest("GET", url).SetHeader("X-Probe", "yes")
+			},
+		})
+		eventually(t, "a successful probe", func() bool { return !balancer.Health()[0].LastCheck.IsZero() })
+		if health := balancer.Health()[0]; !health.Healthy || health.LastCheckError != nil {
+			t.Fatalf("expected a healthy target, got %+v", health)
+		}
+
+		isBroken.Store(true)
+		eventually(t, "the target to become unhealthy", func() bool { return !balancer.Health()[0].Healthy })
+		if err := balancer.Health()[0].LastCheckError; !errors.Is(err, http_proxy.ErrHealthCheckFailed) {
+			t.Errorf("expected error %v, got %v", http_proxy.ErrHealthCheckFailed, err)
+		}
+		for i := 0; i < 4; i++ {
+			if body := sendToService(balancer); body != "b" {
+				t.Errorf("expected the unhealthy target to be skipped, got %q", body)
+			}
+		}
+
+		isBroken.Store(false)
+		eventually(t, "the target to become healthy", func() bool { return balancer.Health()[0].Healthy })
+
+		cancel()
+		time.Sleep(20 * time.Millisecond)
+		probesAfterCancel := probes.Load()
+		time.Sleep(50 * time.Millisecond)
+		if probes.Load() != probesAfterCancel {
+			t.Errorf("expected no probes after the context is canceled")
+		}
+	})
+
+	t.Run("Probes expect the configured status", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		}))
+		defer server.Close()
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		balancer := newBalancer(t, http_proxy.ROUND_ROBIN, http_proxy.Target{URL: server.URL})
+
+		balancer.StartHealthChecks(ctx, http_proxy.HealthCheck{Interval: 10 * time.Millisecond, ExpectedStatus: http.StatusOK, UnhealthyThreshold: 1})
+
+		eventually(t, "the target to become unhealthy", func() bool { return !balancer.Health()[0].Healthy })
+		if _, err := http_proxy.NewRequest("GET", "http://users").WithBalancer(balancer).Send(); !errors.Is(err, http_proxy.ErrNoTargets) {
+			t.Errorf("expected error %v, got %v", http_proxy.ErrNoTargets, err)
+		}
+	})
+}
@@ -0,0 +1,208 @@
+package http_proxy
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Number of observations a LatencyTracker needs before its percentiles are used
+const MIN_LATENCY_SAMPLES = 20
+
+// Configures hedged sends: after Delay without a successful response a
+// duplicate request is fired, up to MaxAttempts requests in flight, and the
+// first successful response wins. Failed attempts are not retried: once the
+// attempts in flight have all failed, the last failure is returned. Hedging
+// applies only to GET, HEAD and OPTIONS requests, other methods are always sent once.
+// Requests are not hedged until a positive delay is known, so a policy with only
+// a Latency tracker sends each request once while the tracker is warming up
+type HedgingPolicy struct {
+	// Time to wait for a response before firing the next attempt.
+	// Zero or negative values disable hedging until Latency provides a delay
+	Delay time.Duration
+	// Maximum number of attempts, the first one included. It defaults to 2
+	MaxAttempts int
+	// When set, the observed p95 latency replaces Delay once enough samples are collected
+	Latency *LatencyTracker
+}
+
+// Keeps the latencies of the last sends to compute percentiles.
+// It is safe for concurrent use and can be shared between requests
+type LatencyTracker struct {
+	mutex   sync.Mutex
+	samples []time.Duration
+	next    int
+	count   int
+}
+
+// Creates a tracker remembering the last size latencies
+func NewLatencyTracker(size int) *LatencyTracker {
+	return &LatencyTracker{samples: make([]time.Duration, size)}
+}
+
+// Records the latency of a send
+func (tracker *LatencyTracker) Observe(latency time.Duration) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	if len(tracker.samples) == 0 {
+		return
+	}
+	tracker.samples[tracker.next] = latency
+	tracker.next = (tracker.next + 1) % len(tracker.samples)
+	tracker.count = min(tracker.count+1, len(tracker.samples))
+}
+
+// Returns the requested percentile, between 0 and 100, of the recorded latencies.
+// It reports false while fewer than MIN_LATENCY_SAMPLES latencies are recorded
+func (tracker *LatencyTracker) Percentile(percentile float64) (time.Duration, bool) {
+	tracker.mutex.Lock()
+	sorted := append([]time.Duration{}, tracker.samples[:tracker.count]...)
+	tracker.mutex.Unlock()
+	if len(sorted) < MIN_LATENCY_SAMPLES {
+		return 0, false
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	index := int(float64(len(sorted)-1) * percentile / 100)
+	return sorted[max(0, min(index, len(sorted)-1))], true
+}
+
+func (requestIntent *proxiedRequestImpl) WithHedging(policy HedgingPolicy) ProxiedRequest {
+	requestIntent.mutex.Lock()
+	defer requestIntent.mutex.Unlock()
+	requestIntent.options.hedging = &policy
+	return requestIntent
+}
+
+func (policy *HedgingPolicy) appliesTo(request *http.Request) bool {
+	if policy == nil || (request.GetBody == nil && request.Body != nil && request.Body != http.NoBody) {
+		return false
+	}
+	switch request.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	default:
+		return false
+	}
+}
+
+// Returns the time to wait before the next attempt. It reports false when
+// no positive delay is known and the request must not be hedged
+func (policy *HedgingPolicy) delay() (time.Duration, bool) {
+	delay := policy.Delay
+	if policy.Latency != nil {
+		if p95, isKnown := policy.Latency.Percentile(95); isKnown {
+			delay = p95
+		}
+	}
+	return delay, delay > 0
+}
+
+func (policy *HedgingPolicy) maxAttempts() int {
+	if policy.MaxAttempts < 1 {
+		return 2
+	}
+	return policy.MaxAttempts
+}
+
+type hedgedAttempt struct {
+	index    int
+	response *http.Response
+	err      error
+	latency  time.Duration
+}
+
+func (attempt hedgedAttempt) succeeded() bool {
+	return attempt.err == nil && attempt.response.StatusCode < http.StatusInternalServerError
+}
+
+// Sends the request hedging it according to the policy. The returned cancel
+// function releases the context of the winning attempt and must be called
+// once its response is no longer needed
+func (policy *HedgingPolicy) do(client *http.Client, request *http.Request) (*http.Response, context.CancelFunc, error) {
+	maxAttempts := policy.maxAttempts()
+	attempts := make(chan hedgedAttempt, maxAttempts)
+	cancels := []context.CancelFunc{}
+	launch := func() {
+		attemptCtx, cancel := context.WithCancel(request.Context())
+		attemptRequest := request.Clone(attemptCtx)
+		cancels = append(cancels, cancel)
+		index := len(cancels) - 1
+		// An attempt whose body can't be opened fails without being sent
+		if index > 0 && request.GetBody != nil {
+			body, bodyErr := request.GetBody()
+			if bodyErr != nil {
+				attempts <- hedgedAttempt{index: index, err: bodyErr}
+				return
+			}
+			attemptRequest.Body = body
+		}
+		go func() {
+			start := time.Now()
+			response, err := client.Do(attemptRequest)
+			attempts <- hedgedAttempt{index: index, response: response, err: err, latency: time.Since(start)}
+		}()
+	}
+	cancelAllExcept := func(winner int) {
+		for index, cancel := range cancels {
+			if index != winner {
+				cancel()
+			}
+		}
+	}
+
+	// The hedge channel stays nil, so it never fires, while no delay is known
+	var timer *time.Timer
+	var hedge <-chan time.Time
+	scheduleHedge := func() {
+		hedge = nil
+		if delay, isKnown := policy.delay(); isKnown && len(cancels) < maxAttempts {
+			timer = time.NewTimer(delay)
+			hedge = timer.C
+		}
+	}
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+
+	launch()
+	pending := 1
+	scheduleHedge()
+	var fallback *hedgedAttempt
+	for pending > 0 {
+		select {
+		case <-hedge:
+			launch()
+			pending++
+			scheduleHedge()
+		case attempt := <-attempts:
+			pending--
+			if attempt.succeeded() {
+				if policy.Latency != nil {
+					policy.Latency.Observe(attempt.latency)
+				}
+				cancelAllExcept(attempt.index)
+				go discardAttempts(attempts, pending)
+				return attempt.response, cancels[attempt.index], nil
+			}
+			if fallback != nil && fallback.response != nil {
+				fallback.response.Body.Close()
+			}
+			fallback = &attempt
+		}
+	}
+	cancelAllExcept(fallback.index)
+	return fallback.response, cancels[fallback.index], fallback.err
+}
+
+// Closes the responses of the attempts that lost the race
+func discardAttempts(attempts <-chan hedgedAttempt, pending int) {
+	for ; pending > 0; pending-- {
+		if attempt := <-attempts; attempt.response != nil {
+			attempt.response.Body.Close()
+		}
+	}
+}
@@ -0,0 +1,242 @@
+package http_proxy_test
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	http_proxy "github.com/AndreaCostanzo1/http-proxy/http_proxy"
+)
+
+// Serves the first call slowly and the following ones immediately
+func firstCallSlowServer(calls *int32, canceled chan<- struct{}) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(calls, 1) == 1 {
+			select {
+			case <-time.After(time.Second):
+			case <-r.Context().Done():
+				canceled <- struct{}{}
+				return
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"status":"ok"}`))
+	}))
+}
+
+func TestWithHedging(t *testing.T) {
+	t.Run("WithHedging returns the first successful response", func(t *testing.T) {
+		var calls int32
+		canceled := make(chan struct{}, 1)
+		server := firstCallSlowServer(&calls, canceled)
+		defer server.Close()
+
+		var interceptorCalls int32
+		start := time.Now()
+		resp, err := http_proxy.NewRequest("GET", server.URL).
+			WithHedging(http_proxy.HedgingPolicy{Delay: 20 * time.Millisecond}).
+			WithGenericInterceptor(func(body map[string]interface{}, response *http.Response) error {
+				atomic.AddInt32(&interceptorCalls, 1)
+				return nil
+			}).
+			Send()
+
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		resp.Body.Close()
+		if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+			t.Errorf("expected hedged response before the slow one, took %s", elapsed)
+		}
+		if calls := atomic.LoadInt32(&calls); calls != 2 {
+			t.Errorf("expected 2 attempts, got %d", calls)
+		}
+		if calls := atomic.LoadInt32(&interceptorCalls); calls != 1 {
+			t.Errorf("expected interceptor to run once, got %d", calls)
+		}
+		select {
+		case <-canceled:
+		case <-time.After(time.Second):
+			t.Errorf("expected the slow attempt to be canceled")
+		}
+	})
+
+	t.Run("WithHedging doesn't duplicate non idempotent requests", func(t *testing.T) {
+		var calls int32
+		canceled := make(chan struct{}, 1)
+		server := firstCallSlowServer(&calls, canceled)
+		defer server.Close()
+
+		_, err := http_proxy.NewRequest("POST", server.URL).
+			WithHedging(http_proxy.HedgingPolicy{Delay: 20 * time.Millisecond}).
+			WithTimeout(100 * time.Millisecond).
+			Send()
+
+		if err == nil {
+			t.Errorf("expected an error due to timeout, got none")
+		}
+		if calls := atomic.LoadInt32(&calls); calls != 1 {
+			t.Errorf("expected 1 attempt, got %d", calls)
+		}
+	})
+
+	t.Run("WithHedging returns the last failure when every attempt fails", func(t *testing.T) {
+		var calls int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&calls, 1)
+			time.Sleep(100 * time.Millisecond)
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		defer server.Close()
+
+		resp, err := http_proxy.NewRequest("GET", server.URL).
+			WithHedging(http_proxy.HedgingPolicy{Delay: 20 * time.Millisecond, MaxAttempts: 3}).
+			Send()
+
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if resp.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("expected status code 503, got %d", resp.StatusCode)
+		}
+		if calls := atomic.LoadInt32(&calls); calls != 3 {
+			t.Errorf("expected 3 attempts, got %d", calls)
+		}
+	})
+
+	t.Run("WithHedging doesn't send attempts whose body can't be opened", func(t *testing.T) {
+		var calls int32
+		canceled := make(chan struct{}, 1)
+		server := firstCallSlowServer(&calls, canceled)
+		defer server.Close()
+
+		var opened int32
+		resp, err := http_proxy.NewRequest("GET", server.URL).
+			WithHedging(http_proxy.HedgingPolicy{Delay: 20 * time.Millisecond}).
+			SetBodyFactory(func() (io.Reader, error) {
+				if atomic.AddInt32(&opened, 1) > 1 {
+					return nil, errors.New("body unavailable")
+				}
+				return strings.NewReader("query"), nil
+			}).
+			Send()
+
+		if err != nil {
+			t.Fatalf("expected the first attempt to succeed, got %v", err)
+		}
+		resp.Body.Close()
+		if calls := atomic.LoadInt32(&calls); calls != 1 {
+			t.Errorf("expected 1 upstream call, got %d", calls)
+		}
+	})
+
+	t.Run("WithHedging doesn't hedge until a positive delay is known", func(t *testing.T) {
+		policies := map[string]http_proxy.HedgingPolicy{
+			"zero delay":         {},
+			"warming up tracker": {Latency: http_proxy.NewLatencyTracker(100)},
+			"negative delay":     {Delay: -time.Second, MaxAttempts: 3},
+		}
+		for name, policy := range policies {
+			var calls int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&calls, 1)
+				time.Sleep(20 * time.Millisecond)
+				w.WriteHeader(http.StatusOK)
+			}))
+
+			resp, err := http_proxy.NewRequest("GET", server.URL).WithHedging(policy).Send()
+
+			if err != nil {
+				t.Fatalf("expected no error with %s, got %v", name, err)
+			}
+			resp.Body.Close()
+			server.Close()
+			if calls := atomic.LoadInt32(&calls); calls != 1 {
+				t.Errorf("expected 1 upstream call with %s, got %d", name, calls)
+			}
+		}
+	})
+
+	t.Run("WithHedging doesn't retry failures before the delay", func(t *testing.T) {
+		var calls int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&calls, 1)
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		defer server.Close()
+
+		start := time.Now()
+		resp, err := http_proxy.NewRequest("GET", server.URL).
+			WithHedging(http_proxy.HedgingPolicy{Delay: time.Second, MaxAttempts: 3}).
+			Send()
+
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("expected status code 503, got %d", resp.StatusCode)
+		}
+		if calls := atomic.LoadInt32(&calls); calls != 1 {
+			t.Errorf("expected 1 attempt, got %d", calls)
+		}
+		if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+			t.Errorf("expected the failure to be returned without waiting for the delay, took %s", elapsed)
+		}
+	})
+}
+
+func TestLatencyTracker(t *testing.T) {
+	t.Run("Percentile requires enough samples", func(t *testing.T) {
+		tracker := http_proxy.NewLatencyTracker(100)
+		tracker.Observe(time.Millisecond)
+
+		if _, isKnown := tracker.Percentile(95); isKnown {
+			t.Errorf("expected percentile to be unknown with a single sample")
+		}
+	})
+
+	t.Run("Percentile over the last samples", func(t *testing.T) {
+		tracker := http_proxy.NewLatencyTracker(100)
+		for i := 1; i <= 200; i++ {
+			tracker.Observe(time.Duration(i) * time.Millisecond)
+		}
+		p95, isKnown := tracker.Percentile(95)
+
+		if !isKnown {
+			t.Fatalf("expected percentile to be known")
+		}
+		if p95 < 190*time.Millisecond || p95 > 196*time.Millisecond {
+			t.Errorf("expected p95 around 195ms, got %s", p95)
+		}
+	})
+
+	t.Run("Hedging delay follows the observed p95", func(t *testing.T) {
+		var calls int32
+		canceled := make(chan struct{}, 1)
+		server := firstCallSlowServer(&calls, canceled)
+		defer server.Close()
+
+		tracker := http_proxy.NewLatencyTracker(100)
+		for i := 0; i < http_proxy.MIN_LATENCY_SAMPLES; i++ {
+			tracker.Observe(10 * time.Millisecond)
+		}
+		start := time.Now()
+		resp, err := http_proxy.NewRequest("GET", server.URL).
+			WithHedging(http_proxy.HedgingPolicy{Delay: time.Hour, Latency: tracker}).
+			Send()
+
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		resp.Body.Close()
+		if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+			t.Errorf("expected hedge to fire after the observed p95, took %s", elapsed)
+		}
+	})
+}
@@ -19,11 +19,15 @@ const (
 type errorHandler = func(parsedBody map[string]interface{}, response *http.Response) error
 
 func (requestIntent *proxiedRequestImpl) WithGenericInterceptor(handlers ...errorHandler) ProxiedRequest {
+	requestIntent.mutex.Lock()
+	defer requestIntent.mutex.Unlock()
 	requestIntent.genericInterceptors = append(requestIntent.genericInterceptors, handlers...)
 	return requestIntent
 }
 
 func (requestIntent *proxiedRequestImpl) WithStatusCodeInterceptor(statusCode int, handlers ...errorHandler) ProxiedRequest {
+	requestIntent.mutex.Lock()
+	defer requestIntent.mutex.Unlock()
 	existingHandlers, isFound := requestIntent.statusCodeInterceptors[statusCode]
 	if !isFound {
 		existingHandlers = []errorHandler{}
@@ -34,16 +38,19 @@ func (requestIntent *proxiedRequestImpl) WithStatusCodeInterceptor(statusCode in
 
 func (requestIntent *proxiedRequestImpl) validateResponse(response *http.Response) (*http.Response, error) {
 	var err error
+	statusCodeInterceptors, genericInterceptors := requestIntent.interceptorsFor(response.StatusCode)
+	if len(statusCodeInterceptors) == 0 && len(genericInterceptors) == 0 {
+		// Leave the body untouched so that it can be streamed
+		return response, nil
+	}
 	responseBody := extractResponseBody(response)
-	if statusCodeInterceptors, isDefined := requestIntent.statusCodeInterceptors[response.StatusCode]; isDefined {
-		for _, interceptor := range statusCodeInterceptors {
-			err = interceptor(responseBody, response)
-			if err != nil {
-				return response, err
-			}
+	for _, interceptor := range statusCodeInterceptors {
+		err = interceptor(responseBody, response)
+		if err != nil {
+			return response, err
 		}
 	}
-	for _, handler := range requestIntent.genericInterceptors {
+	for _, handler := range genericInterceptors {
 		err = handler(responseBody, response)
 		if err != nil {
 			return response, err
@@ -52,13 +59,29 @@ func (requestIntent *proxiedRequestImpl) validateResponse(response *http.Respons
 	return response, err
 }
 
+// Returns a snapshot of the interceptors to run for the status code, so that
+// interceptors added while a response is being validated don't race with it
+func (requestIntent *proxiedRequestImpl) interceptorsFor(statusCode int) ([]errorHandler, []errorHandler) {
+	requestIntent.mutex.Lock()
+	defer requestIntent.mutex.Unlock()
+	statusCodeInterceptors := append([]errorHandler{}, requestIntent.statusCodeInterceptors[statusCode]...)
+	genericInterceptors := append([]errorHandler{}, requestIntent.genericInterceptors...)
+	return statusCodeInterceptors, genericInterceptors
+}
+
 func extractResponseBody(response *http.Response) map[string]interface{} {
 	var jsonErr error
 	var responseBody map[string]interface{}
 	var buf bytes.Buffer
-	teeReader := io.TeeReader(response.Body, &buf)
+	originalBody := response.Body
+	teeReader := io.TeeReader(originalBody, &buf)
 	jsonErr = json.NewDecoder(teeReader).Decode(&responseBody)
-	response.Body = io.NopCloser(&buf)
+	// The decoder stops reading at the end of the first JSON value or at the
+	// first syntax error, so the rest of the body is still in originalBody
+	response.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(&buf, originalBody), originalBody}
 	switch {
 	case jsonErr == nil:
 		responseBody[FORMAT_TYPE] = FORMAT_JSON
@@ -1,8 +1,10 @@
 package http_proxy_test
 
 import (
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
 	http_proxy "github.com/AndreaCostanzo1/http-proxy/http_proxy"
@@ -114,3 +116,32 @@ func TestJsonFormatKeyAndParsedBody(t *testing.T) {
 		}
 	})
 }
+
+func TestResponseBodyAfterParsing(t *testing.T) {
+	t.Run("Bodies that are not JSON are returned whole", func(t *testing.T) {
+		expectedBody := strings.Repeat("not json ", 1000)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(expectedBody))
+		}))
+		defer server.Close()
+
+		var parsedFormat interface{}
+		resp, err := http_proxy.NewRequest("GET", server.URL).
+			WithGenericInterceptor(func(parsedBody map[string]interface{}, response *http.Response) error {
+				parsedFormat = parsedBody[http_proxy.FORMAT_TYPE]
+				return nil
+			}).
+			Send()
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+
+		if parsedFormat != http_proxy.FORMAT_STRING {
+			t.Errorf("expected the interceptor to receive a %s body, got %v", http_proxy.FORMAT_STRING, parsedFormat)
+		}
+		if string(body) != expectedBody {
+			t.Errorf("expected a body of %d bytes, got %d", len(expectedBody), len(body))
+		}
+	})
+}
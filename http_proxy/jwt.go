@@ -0,0 +1,328 @@
+package http_proxy
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrJWTExpired     = errors.New("jwt token is expired")
+	ErrJWTNotYetValid = errors.New("jwt token is not valid yet")
+)
+
+type jwtAlgorithm string
+
+const (
+	JWT_HS256 jwtAlgorithm = "HS256"
+	JWT_RS256 jwtAlgorithm = "RS256"
+	JWT_ES256 jwtAlgorithm = "ES256"
+)
+
+// Claims carried by a JWT payload, as decoded from JSON
+type JWTClaims map[string]interface{}
+
+// Returns the expiration time stored in the "exp" claim, if any
+func (claims JWTClaims) ExpiresAt() (time.Time, bool) {
+	return claims.numericDate("exp")
+}
+
+// Returns the not-before time stored in the "nbf" claim, if any
+func (claims JWTClaims) NotBefore() (time.Time, bool) {
+	return claims.numericDate("nbf")
+}
+
+func (claims JWTClaims) numericDate(name string) (time.Time, bool) {
+	switch value := claims[name].(type) {
+	case float64:
+		return time.Unix(int64(value), 0), true
+	case json.Number:
+		seconds, err := value.Int64()
+		return time.Unix(seconds, 0), err == nil
+	default:
+		return time.Time{}, false
+	}
+}
+
+// Decodes the claims of a JWT without verifying its signature
+func ParseJWTClaims(token string) (JWTClaims, error) {
+	segments := strings.Split(token, ".")
+	if len(segments) != 3 {
+		return nil, fmt.Errorf("malformed jwt token: expected 3 segments, got %d", len(segments))
+	}
+	payload, decodeErr := base64.RawURLEncoding.DecodeString(segments[1])
+	if decodeErr != nil {
+		return nil, fmt.Errorf("malformed jwt payload: %w", decodeErr)
+	}
+	var claims JWTClaims
+	if unmarshalErr := json.Unmarshal(payload, &claims); unmarshalErr != nil {
+		return nil, fmt.Errorf("malformed jwt claims: %w", unmarshalErr)
+	}
+	return claims, nil
+}
+
+// Options used when a token is set with SetValidatedJWTAuthToken
+type JWTValidation struct {
+	// Tokens expiring within this window are considered already expired, while
+	// tokens becoming valid within it are accepted to tolerate clock skew
+	Leeway time.Duration
+	// Invoked with the expired token to obtain a fresh one. When nil
+	// expired tokens are refused with ErrJWTExpired
+	Refresh func(expiredToken string) (string, error)
+}
+
+type validatedJWT struct {
+	mutex      sync.Mutex
+	token      string
+	validation JWTValidation
+}
+
+func (validated *validatedJWT) Token() (string, error) {
+	validated.mutex.Lock()
+	defer validated.mutex.Unlock()
+	expired, checkErr := isJWTExpired(validated.token, validated.validation.Leeway)
+	if checkErr != nil || !expired {
+		return validated.token, checkErr
+	}
+	if validated.validation.Refresh == nil {
+		return "", ErrJWTExpired
+	}
+	refreshedToken, refreshErr := validated.validation.Refresh(validated.token)
+	if refreshErr != nil {
+		return "", fmt.Errorf("failed to refresh expired jwt token: %w", refreshErr)
+	}
+	if expired, checkErr = isJWTExpired(refreshedToken, validated.validation.Leeway); checkErr != nil {
+		return "", checkErr
+	} else if expired {
+		return "", fmt.Errorf("refreshed token: %w", ErrJWTExpired)
+	}
+	validated.token = refreshedToken
+	return refreshedToken, nil
+}
+
+func (validated *validatedJWT) cachedToken() (string, bool) {
+	validated.mutex.Lock()
+	defer validated.mutex.Unlock()
+	return validated.token, true
+}
+
+// Reports whether the token is expired. Tokens whose "nbf" claim is further
+// in the future than leeway are refused with ErrJWTNotYetValid
+func isJWTExpired(token string, leeway time.Duration) (bool, error) {
+	claims, parseErr := ParseJWTClaims(token)
+	if parseErr != nil {
+		return false, parseErr
+	}
+	now := time.Now()
+	if notBefore, hasNotBefore := claims.NotBefore(); hasNotBefore && now.Add(leeway).Before(notBefore) {
+		return false, fmt.Errorf("%w until %s", ErrJWTNotYetValid, notBefore.Format(time.RFC3339))
+	}
+	expiresAt, hasExpiration := claims.ExpiresAt()
+	return hasExpiration && !now.Add(leeway).Before(expiresAt), nil
+}
+
+// Mints short-lived JWTs signed with a HS256, RS256 or ES256 key.
+// Tokens are cached and re-minted when they get close to their expiry
+type JWTSigner struct {
+	algorithm   jwtAlgorithm
+	key         interface{}
+	keyID       string
+	ttl         time.Duration
+	renewBefore time.Duration
+	claims      JWTClaims
+	mutex       sync.Mutex
+	token       string
+	expiresAt   time.Time
+}
+
+// Creates a signer producing HS256 tokens valid for ttl
+func NewHS256Signer(secret []byte, ttl time.Duration) *JWTSigner {
+	return newJWTSigner(JWT_HS256, secret, ttl)
+}
+
+// Creates a signer producing RS256 tokens valid for ttl
+func NewRS256Signer(key *rsa.PrivateKey, ttl time.Duration) *JWTSigner {
+	return newJWTSigner(JWT_RS256, key, ttl)
+}
+
+// Creates a signer producing ES256 tokens valid for ttl. The key must use the P-256 curve
+func NewES256Signer(key *ecdsa.PrivateKey, ttl time.Duration) *JWTSigner {
+	return newJWTSigner(JWT_ES256, key, ttl)
+}
+
+func newJWTSigner(algorithm jwtAlgorithm, key interface{}, ttl time.Duration) *JWTSigner {
+	return &JWTSigner{
+		algorithm:   algorithm,
+		key:         key,
+		ttl:         ttl,
+		renewBefore: ttl / 10,
+		claims:      JWTClaims{},
+	}
+}
+
+// Adds a claim to every minted token. Registered time claims
+// ("iat", "exp") are always computed by the signer
+func (signer *JWTSigner) WithClaim(name string, value interface{}) *JWTSigner {
+	signer.mutex.Lock()
+	defer signer.mutex.Unlock()
+	signer.claims[name] = value
+	signer.token = ""
+	return signer
+}
+
+// Sets the "kid" header of minted tokens
+func (signer *JWTSigner) WithKeyID(keyID string) *JWTSigner {
+	signer.mutex.Lock()
+	defer signer.mutex.Unlock()
+	signer.keyID = keyID
+	signer.token = ""
+	return signer
+}
+
+// Sets how long before expiry a cached token is replaced by a new one.
+// It defaults to a tenth of the token ttl
+func (signer *JWTSigner) WithRenewBefore(renewBefore time.Duration) *JWTSigner {
+	signer.mutex.Lock()
+	defer signer.mutex.Unlock()
+	signer.renewBefore = renewBefore
+	return signer
+}
+
+// Returns the cached token, minting a new one if it is missing or about to expire
+func (signer *JWTSigner) Token() (string, error) {
+	signer.mutex.Lock()
+	defer signer.mutex.Unlock()
+	now := time.Now()
+	if signer.token != "" && now.Add(signer.renewBefore).Before(signer.expiresAt) {
+		return signer.token, nil
+	}
+	token, mintErr := signer.mint(now)
+	if mintErr != nil {
+		return "", mintErr
+	}
+	signer.token = token
+	signer.expiresAt = now.Add(signer.ttl)
+	return token, nil
+}
+
+func (signer *JWTSigner) cachedToken() (string, bool) {
+	signer.mutex.Lock()
+	defer signer.mutex.Unlock()
+	return signer.token, signer.token != ""
+}
+
+func (signer *JWTSigner) mint(now time.Time) (string, error) {
+	header := map[string]string{"alg": string(signer.algorithm), "typ": "JWT"}
+	if signer.keyID != "" {
+		header["kid"] = signer.keyID
+	}
+	tokenID := make([]byte, 16)
+	if _, randErr := rand.Read(tokenID); randErr != nil {
+		return "", randErr
+	}
+	claims := JWTClaims{"jti": hex.EncodeToString(tokenID)}
+	for name, value := range signer.claims {
+		claims[name] = value
+	}
+	claims["iat"] = now.Unix()
+	claims["exp"] = now.Add(signer.ttl).Unix()
+
+	encodedHeader, headerErr := encodeJWTSegment(header)
+	if headerErr != nil {
+		return "", headerErr
+	}
+	encodedClaims, claimsErr := encodeJWTSegment(claims)
+	if claimsErr != nil {
+		return "", claimsErr
+	}
+	signingInput := encodedHeader + "." + encodedClaims
+	signature, signErr := signer.sign([]byte(signingInput))
+	if signErr != nil {
+		return "", fmt.Errorf("failed to sign jwt token: %w", signErr)
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+func (signer *JWTSigner) sign(signingInput []byte) ([]byte, error) {
+	digest := sha256.Sum256(signingInput)
+	switch key := signer.key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, key)
+		mac.Write(signingInput)
+		return mac.Sum(nil), nil
+	case *rsa.PrivateKey:
+		return rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		if key.Curve.Params().BitSize != 256 {
+			return nil, fmt.Errorf("ES256 requires a P-256 key")
+		}
+		r, s, signErr := ecdsa.Sign(rand.Reader, key, digest[:])
+		if signErr != nil {
+			return nil, signErr
+		}
+		signature := make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+		return signature, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %T for %s", signer.key, signer.algorithm)
+	}
+}
+
+func encodeJWTSegment(segment any) (string, error) {
+	payload, marshalErr := json.Marshal(segment)
+	if marshalErr != nil {
+		return "", marshalErr
+	}
+	return base64.RawURLEncoding.EncodeToString(payload), nil
+}
+
+type jwtTokenSource interface {
+	Token() (string, error)
+	// Returns the token currently held, without refreshing or minting one
+	cachedToken() (string, bool)
+}
+
+func (requestIntent *proxiedRequestImpl) SetValidatedJWTAuthToken(token string, validation JWTValidation) ProxiedRequest {
+	requestIntent.mutex.Lock()
+	defer requestIntent.mutex.Unlock()
+	requestIntent.verifyUnderlyingRequestNotGenerated("SetValidatedJWTAuthToken")
+	if _, parseErr := ParseJWTClaims(token); parseErr != nil {
+		requestIntent.recordError("SetValidatedJWTAuthToken", parseErr)
+		return requestIntent
+	}
+	requestIntent.tokenSource = &validatedJWT{token: token, validation: validation}
+	return requestIntent
+}
+
+func (requestIntent *proxiedRequestImpl) WithJWTSigner(signer *JWTSigner) ProxiedRequest {
+	requestIntent.mutex.Lock()
+	defer requestIntent.mutex.Unlock()
+	requestIntent.verifyUnderlyingRequestNotGenerated("WithJWTSigner")
+	requestIntent.tokenSource = signer
+	return requestIntent
+}
+
+// Returns the value of the Authorization header with the token of the source,
+// or an empty string without a source. It may refresh or mint the token
+func bearerAuthorization(tokenSource jwtTokenSource) (string, error) {
+	if tokenSource == nil {
+		return "", nil
+	}
+	token, tokenErr := tokenSource.Token()
+	if tokenErr != nil {
+		return "", tokenErr
+	}
+	return fmt.Sprintf("Bearer %s", token), nil
+}
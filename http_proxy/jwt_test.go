@@ -0,0 +1,337 @@
+package http_proxy_test
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	http_proxy "github.com/AndreaCostanzo1/http-proxy/http_proxy"
+)
+
+func unsignedToken(claims map[string]interface{}) string {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","typ":"JWT"}`))
+	payload, _ := json.Marshal(claims)
+	return header + "." + base64.RawURLEncoding.EncodeToString(payload) + ".signature"
+}
+
+func bearerServer(tokens chan<- string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokens <- strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		w.WriteHeader(http.StatusOK)
+	}))
+}
+
+func TestSetValidatedJWTAuthToken(t *testing.T) {
+	t.Run("SetValidatedJWTAuthToken sends a valid token", func(t *testing.T) {
+		tokens := make(chan string, 1)
+		server := bearerServer(tokens)
+		defer server.Close()
+
+		token := unsignedToken(map[string]interface{}{"exp": time.Now().Add(time.Hour).Unix()})
+		req := http_proxy.NewRequest("GET", server.URL)
+		req.SetValidatedJWTAuthToken(token, http_proxy.JWTValidation{})
+		_, err := req.Send()
+
+		if err != nil {
+			t.Errorf("expected no error, got %v", err)
+		}
+		if received := <-tokens; received != token {
+			t.Errorf("expected token '%s', got '%s'", token, received)
+		}
+	})
+
+	t.Run("SetValidatedJWTAuthToken refuses expired tokens", func(t *testing.T) {
+		tokens := make(chan string, 1)
+		server := bearerServer(tokens)
+		defer server.Close()
+
+		token := unsignedToken(map[string]interface{}{"exp": time.Now().Add(time.Minute).Unix()})
+		req := http_proxy.NewRequest("GET", server.URL)
+		req.SetValidatedJWTAuthToken(token, http_proxy.JWTValidation{Leeway: time.Hour})
+		resp, err := req.Send()
+
+		if !errors.Is(err, http_proxy.ErrJWTExpired) {
+			t.Errorf("expected ErrJWTExpired, got %v", err)
+		}
+		if resp != nil {
+			t.Errorf("expected no response, got %v", resp)
+		}
+	})
+
+	t.Run("SetValidatedJWTAuthToken refreshes expired tokens", func(t *testing.T) {
+		tokens := make(chan string, 1)
+		server := bearerServer(tokens)
+		defer server.Close()
+
+		expiredToken := unsignedToken(map[string]interface{}{"exp": time.Now().Add(-time.Minute).Unix()})
+		freshToken := unsignedToken(map[string]interface{}{"exp": time.Now().Add(time.Hour).Unix()})
+		refreshedWith := ""
+		req := http_proxy.NewRequest("GET", server.URL)
+		req.SetValidatedJWTAuthToken(expiredToken, http_proxy.JWTValidation{
+			Refresh: func(expired string) (string, error) {
+				refreshedWith = expired
+				return freshToken, nil
+			},
+		})
+		_, err := req.Send()
+
+		if err != nil {
+			t.Errorf("expected no error, got %v", err)
+		}
+		if refreshedWith != expiredToken {
+			t.Errorf("expected refresh to receive the expired token")
+		}
+		if received := <-tokens; received != freshToken {
+			t.Errorf("expected refreshed token '%s', got '%s'", freshToken, received)
+		}
+	})
+
+	t.Run("SetValidatedJWTAuthToken fails only the send whose refresh fails", func(t *testing.T) {
+		tokens := make(chan string, 1)
+		server := bearerServer(tokens)
+		defer server.Close()
+
+		expiredToken := unsignedToken(map[string]interface{}{"exp": time.Now().Add(-time.Minute).Unix()})
+		freshToken := unsignedToken(map[string]interface{}{"exp": time.Now().Add(time.Hour).Unix()})
+		refreshErr := errors.New("transient")
+		req := http_proxy.NewRequest("GET", server.URL)
+		req.SetValidatedJWTAuthToken(expiredToken, http_proxy.JWTValidation{
+			Refresh: func(expired string) (string, error) {
+				if refreshErr != nil {
+					return "", refreshErr
+				}
+				return freshToken, nil
+			},
+		})
+		if _, err := req.Send(); !errors.Is(err, refreshErr) {
+			t.Fatalf("expected error %v, got %v", refreshErr, err)
+		}
+
+		refreshErr = nil
+		if _, err := req.Send(); err != nil {
+			t.Fatalf("expected no error once the refresh works, got %v", err)
+		}
+		if received := <-tokens; received != freshToken {
+			t.Errorf("expected refreshed token '%s', got '%s'", freshToken, received)
+		}
+	})
+
+	t.Run("SetValidatedJWTAuthToken keeps the body for the send after a failed refresh", func(t *testing.T) {
+		received := make(chan string, 1)
+		server := echoBodyServer(received)
+		defer server.Close()
+
+		bodies := map[string]io.Reader{
+			"one-shot body": &nonSeekableReader{strings.NewReader("test body")},
+			"seekable body": &seekOnlyReader{strings.NewReader("test body")},
+		}
+		for name, body := range bodies {
+			t.Run(name, func(t *testing.T) {
+				token := unsignedToken(map[string]interface{}{"exp": time.Now().Add(-time.Minute).Unix()})
+				refreshErr := errors.New("transient")
+				req := http_proxy.NewRequest("POST", server.URL).WithBodyBufferLimit(4).SetBody(body)
+				req.SetValidatedJWTAuthToken(token, http_proxy.JWTValidation{
+					Refresh: func(expired string) (string, error) {
+						if refreshErr != nil {
+							return "", refreshErr
+						}
+						return unsignedToken(map[string]interface{}{"exp": time.Now().Add(time.Hour).Unix()}), nil
+					},
+				})
+				if _, err := req.Send(); !errors.Is(err, refreshErr) {
+					t.Fatalf("expected error %v, got %v", refreshErr, err)
+				}
+
+				refreshErr = nil
+				if _, err := req.Send(); err != nil {
+					t.Fatalf("expected no error once the refresh works, got %v", err)
+				}
+				if sent := <-received; sent != "test body" {
+					t.Errorf("expected body to be 'test body', got '%s'", sent)
+				}
+			})
+		}
+	})
+
+	t.Run("SetValidatedJWTAuthToken refuses tokens not valid yet", func(t *testing.T) {
+		token := unsignedToken(map[string]interface{}{"nbf": time.Now().Add(time.Hour).Unix(), "exp": time.Now().Add(2 * time.Hour).Unix()})
+		req := http_proxy.NewRequest("GET", "http://localhost")
+		req.SetValidatedJWTAuthToken(token, http_proxy.JWTValidation{})
+		_, err := req.Send()
+
+		if !errors.Is(err, http_proxy.ErrJWTNotYetValid) {
+			t.Errorf("expected ErrJWTNotYetValid, got %v", err)
+		}
+	})
+
+	t.Run("SetValidatedJWTAuthToken accepts tokens becoming valid within the leeway", func(t *testing.T) {
+		tokens := make(chan string, 1)
+		server := bearerServer(tokens)
+		defer server.Close()
+		token := unsignedToken(map[string]interface{}{"nbf": time.Now().Add(5 * time.Second).Unix(), "exp": time.Now().Add(time.Hour).Unix()})
+
+		_, err := http_proxy.NewRequest("GET", server.URL).
+			SetValidatedJWTAuthToken(token, http_proxy.JWTValidation{Leeway: 30 * time.Second}).
+			Send()
+
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if sent := <-tokens; sent != token {
+			t.Errorf("expected token %s, got %s", token, sent)
+		}
+	})
+
+	t.Run("SetValidatedJWTAuthToken refreshes without holding the request", func(t *testing.T) {
+		tokens := make(chan string, 1)
+		server := bearerServer(tokens)
+		defer server.Close()
+		expiredToken := unsignedToken(map[string]interface{}{"exp": time.Now().Add(-time.Hour).Unix()})
+		freshToken := unsignedToken(map[string]interface{}{"exp": time.Now().Add(time.Hour).Unix()})
+
+		req := http_proxy.NewRequest("GET", server.URL)
+		req.SetValidatedJWTAuthToken(expiredToken, http_proxy.JWTValidation{Refresh: func(string) (string, error) {
+			configured := make(chan struct{})
+			go func() {
+				req.WithRoute("/refreshed")
+				close(configured)
+			}()
+			select {
+			case <-configured:
+			case <-time.After(time.Second):
+				t.Errorf("expected the request to be configurable during the refresh")
+			}
+			return freshToken, nil
+		}})
+		_, err := req.Send()
+
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if sent := <-tokens; sent != freshToken {
+			t.Errorf("expected token %s, got %s", freshToken, sent)
+		}
+	})
+
+	t.Run("SetValidatedJWTAuthToken with malformed token", func(t *testing.T) {
+		req := http_proxy.NewRequest("GET", "http://localhost")
+		req.SetValidatedJWTAuthToken("not-a-jwt", http_proxy.JWTValidation{})
+		_, err := req.Send()
+
+		if err == nil {
+			t.Errorf("expected an error due to malformed token, got none")
+		}
+	})
+}
+
+func TestWithJWTSigner(t *testing.T) {
+	signingInputAndSignature := func(token string) ([]byte, []byte) {
+		lastDot := strings.LastIndex(token, ".")
+		signature, _ := base64.RawURLEncoding.DecodeString(token[lastDot+1:])
+		return []byte(token[:lastDot]), signature
+	}
+
+	t.Run("WithJWTSigner mints HS256 tokens with custom claims", func(t *testing.T) {
+		secret := []byte("secret")
+		tokens := make(chan string, 1)
+		server := bearerServer(tokens)
+		defer server.Close()
+
+		signer := http_proxy.NewHS256Signer(secret, time.Minute).WithClaim("sub", "service").WithKeyID("key-1")
+		req := http_proxy.NewRequest("GET", server.URL)
+		req.WithJWTSigner(signer)
+		_, err := req.Send()
+		if err != nil {
+			t.Errorf("expected no error, got %v", err)
+		}
+
+		token := <-tokens
+		signingInput, signature := signingInputAndSignature(token)
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(signingInput)
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			t.Errorf("expected a valid HS256 signature")
+		}
+		claims, parseErr := http_proxy.ParseJWTClaims(token)
+		if parseErr != nil {
+			t.Fatalf("expected no error parsing claims, got %v", parseErr)
+		}
+		if claims["sub"] != "service" {
+			t.Errorf("expected sub claim 'service', got %v", claims["sub"])
+		}
+		if expiresAt, found := claims.ExpiresAt(); !found || time.Until(expiresAt) > time.Minute {
+			t.Errorf("expected exp claim within a minute, got %v", expiresAt)
+		}
+	})
+
+	t.Run("WithJWTSigner mints RS256 tokens", func(t *testing.T) {
+		key, _ := rsa.GenerateKey(rand.Reader, 2048)
+		signer := http_proxy.NewRS256Signer(key, time.Minute)
+		token, err := signer.Token()
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+
+		signingInput, signature := signingInputAndSignature(token)
+		digest := sha256.Sum256(signingInput)
+		if verifyErr := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], signature); verifyErr != nil {
+			t.Errorf("expected a valid RS256 signature, got %v", verifyErr)
+		}
+	})
+
+	t.Run("WithJWTSigner mints ES256 tokens", func(t *testing.T) {
+		key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		signer := http_proxy.NewES256Signer(key, time.Minute)
+		token, err := signer.Token()
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+
+		signingInput, signature := signingInputAndSignature(token)
+		digest := sha256.Sum256(signingInput)
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(&key.PublicKey, digest[:], r, s) {
+			t.Errorf("expected a valid ES256 signature")
+		}
+	})
+
+	t.Run("WithJWTSigner rejects keys on the wrong curve", func(t *testing.T) {
+		key, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+		_, err := http_proxy.NewES256Signer(key, time.Minute).Token()
+
+		if err == nil {
+			t.Errorf("expected an error due to wrong curve, got none")
+		}
+	})
+
+	t.Run("WithJWTSigner reuses tokens until they are about to expire", func(t *testing.T) {
+		cachingSigner := http_proxy.NewHS256Signer([]byte("secret"), time.Hour)
+		first, _ := cachingSigner.Token()
+		second, _ := cachingSigner.Token()
+		if first != second {
+			t.Errorf("expected cached token to be reused")
+		}
+
+		renewingSigner := http_proxy.NewHS256Signer([]byte("secret"), time.Minute).WithRenewBefore(time.Hour)
+		first, _ = renewingSigner.Token()
+		second, _ = renewingSigner.Token()
+		if first == second {
+			t.Errorf("expected token close to expiry to be re-minted, got '%s' twice", first)
+		}
+	})
+}
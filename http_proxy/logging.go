@@ -0,0 +1,197 @@
+package http_proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Levels of the events emitted by a RequestLogger for each outcome of a send
+type LogLevels struct {
+	// Emitted before the request is sent
+	Start slog.Level
+	// Response with a status code lower than 400
+	Success slog.Level
+	// Response with a 4xx status code
+	ClientError slog.Level
+	// Response with a 5xx status code
+	ServerError slog.Level
+	// No response, e.g. because of a timeout or a connection error
+	Failure slog.Level
+}
+
+// Emits a structured event when a send starts and when it finishes, with
+// the method, URL without query, route, attempt, status, duration and sizes.
+// Header and body logging are disabled unless enabled with WithHeaders and
+// WithBodies. It can be shared between requests
+type RequestLogger struct {
+	logger        *slog.Logger
+	levels        LogLevels
+	logHeaders    bool
+	redactHeaders []string
+	maxBodySize   int
+}
+
+// Creates a request logger writing to logger. Starts are logged at debug level,
+// successes at info, client errors at warn and server errors and failures at error
+func NewRequestLogger(logger *slog.Logger) *RequestLogger {
+	return &RequestLogger{
+		logger: logger,
+		levels: LogLevels{
+			Start:       slog.LevelDebug,
+			Success:     slog.LevelInfo,
+			ClientError: slog.LevelWarn,
+			ServerError: slog.LevelError,
+			Failure:     slog.LevelError,
+		},
+		redactHeaders: DefaultRedactedHeaders,
+	}
+}
+
+// Set the level of the events of each outcome
+func (requestLogger *RequestLogger) WithLevels(levels LogLevels) *RequestLogger {
+	requestLogger.levels = levels
+	return requestLogger
+}
+
+// Adds the request and response headers to the events. The values of
+// DefaultRedactedHeaders and of redactHeaders are replaced by REDACTED
+func (requestLogger *RequestLogger) WithHeaders(redactHeaders ...string) *RequestLogger {
+	requestLogger.logHeaders = true
+	requestLogger.redactHeaders = append(append([]string{}, DefaultRedactedHeaders...), redactHeaders...)
+	return requestLogger
+}
+
+// Adds the first maxSize bytes of the request and response bodies to the
+// events. Bodies are not redacted. The response body is read up to maxSize
+// bytes before Send returns, and handed to the caller unchanged
+func (requestLogger *RequestLogger) WithBodies(maxSize int) *RequestLogger {
+	requestLogger.maxBodySize = maxSize
+	return requestLogger
+}
+
+func (requestIntent *proxiedRequestImpl) WithLogger(logger *RequestLogger) ProxiedRequest {
+	requestIntent.mutex.Lock()
+	defer requestIntent.mutex.Unlock()
+	requestIntent.options.logger = logger
+	return requestIntent
+}
+
+func (requestIntent *proxiedRequestImpl) WithRoute(route string) ProxiedRequest {
+	requestIntent.mutex.Lock()
+	defer requestIntent.mutex.Unlock()
+	requestIntent.options.route = route
+	return requestIntent
+}
+
+// Logs the start of a send and returns the attributes shared by its events
+func (requestLogger *RequestLogger) start(ctx context.Context, request *http.Request, options sendOptions) []slog.Attr {
+	if requestLogger == nil || !requestLogger.logger.Enabled(ctx, max(requestLogger.levels.Start, requestLogger.levels.Success, requestLogger.levels.ClientError, requestLogger.levels.ServerError, requestLogger.levels.Failure)) {
+		return nil
+	}
+	attributes := []slog.Attr{
+		slog.String("method", request.Method),
+		slog.String("url", urlWithoutQuery(request.URL)),
+	}
+	if options.route != "" {
+		attributes = append(attributes, slog.String("route", options.route))
+	}
+	attributes = append(attributes, slog.Int("attempt", options.attempt))
+	startAttributes := append([]slog.Attr{}, attributes...)
+	if request.ContentLength > 0 {
+		startAttributes = append(startAttributes, slog.Int64("request_size", request.ContentLength))
+	}
+	if requestLogger.logHeaders {
+		startAttributes = append(startAttributes, headerGroup("request_headers", RedactHeader(request.Header, requestLogger.redactHeaders)))
+	}
+	// The body taken by the send is peeked instead of opening a new one with
+	// GetBody, which would run the body factory once more
+	if requestLogger.maxBodySize > 0 && request.Body != nil && request.Body != http.NoBody {
+		var loggedBody string
+		request.Body, loggedBody = requestLogger.peekBody(request.Body)
+		startAttributes = append(startAttributes, slog.String("request_body", loggedBody))
+	}
+	requestLogger.logger.LogAttrs(ctx, requestLogger.levels.Start, "request started", startAttributes...)
+	return attributes
+}
+
+// Logs the outcome of a send started at startTime
+func (requestLogger *RequestLogger) finish(ctx context.Context, attributes []slog.Attr, startTime time.Time, response *http.Response, err error) {
+	if attributes == nil {
+		return
+	}
+	attributes = append(attributes, slog.Duration("duration", time.Since(startTime)))
+	level, message := requestLogger.levels.Failure, "request failed"
+	if response != nil {
+		level, message = requestLogger.levels.Success, "request finished"
+		switch {
+		case response.StatusCode >= http.StatusInternalServerError:
+			level = requestLogger.levels.ServerError
+		case response.StatusCode >= http.StatusBadRequest:
+			level = requestLogger.levels.ClientError
+		}
+		attributes = append(attributes, slog.Int("status", response.StatusCode))
+		if response.ContentLength >= 0 {
+			attributes = append(attributes, slog.Int64("response_size", response.ContentLength))
+		}
+		if timings, isFound := TimingsFromResponse(response); isFound {
+			attributes = append(attributes, timingsGroup(timings))
+		}
+		if requestLogger.logHeaders {
+			attributes = append(attributes, headerGroup("response_headers", RedactHeader(response.Header, requestLogger.redactHeaders)))
+		}
+		if requestLogger.maxBodySize > 0 {
+			var loggedBody string
+			response.Body, loggedBody = requestLogger.peekBody(response.Body)
+			attributes = append(attributes, slog.String("response_body", loggedBody))
+		}
+	}
+	if err != nil {
+		attributes = append(attributes, slog.String("error", err.Error()))
+	}
+	requestLogger.logger.LogAttrs(ctx, level, message, attributes...)
+}
+
+// Reads the beginning of the body and returns a body putting it back in
+// front of the rest, along with the text to log
+func (requestLogger *RequestLogger) peekBody(body io.ReadCloser) (io.ReadCloser, string) {
+	prefix, _ := io.ReadAll(io.LimitReader(body, int64(requestLogger.maxBodySize)+1))
+	peekedBody := struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(prefix), body), body}
+	return peekedBody, requestLogger.truncatedBody(bytes.NewReader(prefix))
+}
+
+func (requestLogger *RequestLogger) truncatedBody(body io.Reader) string {
+	prefix, _ := io.ReadAll(io.LimitReader(body, int64(requestLogger.maxBodySize)+1))
+	if len(prefix) > requestLogger.maxBodySize {
+		return string(prefix[:requestLogger.maxBodySize]) + "...(truncated)"
+	}
+	return string(prefix)
+}
+
+func headerGroup(name string, header http.Header) slog.Attr {
+	attributes := make([]any, 0, len(header))
+	for key, values := range header {
+		if len(values) == 1 {
+			attributes = append(attributes, slog.String(key, values[0]))
+		} else {
+			attributes = append(attributes, slog.Any(key, values))
+		}
+	}
+	return slog.Group(name, attributes...)
+}
+
+// Returns the URL without query and credentials, which may contain secrets
+func urlWithoutQuery(requestURL *url.URL) string {
+	stripped := *requestURL
+	stripped.User = nil
+	stripped.RawQuery = ""
+	stripped.ForceQuery = false
+	return stripped.String()
+}
@@ -0,0 +1,183 @@
+package http_proxy_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	http_proxy "github.com/AndreaCostanzo1/http-proxy/http_proxy"
+)
+
+// Returns a logger writing JSON lines to buffer and a function decoding them
+func jsonLogger(level slog.Level) (*slog.Logger, func() []map[string]any) {
+	var buffer bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buffer, &slog.HandlerOptions{Level: level}))
+	return logger, func() []map[string]any {
+		events := []map[string]any{}
+		for _, line := range strings.Split(strings.TrimSpace(buffer.String()), "\n") {
+			event := map[string]any{}
+			if line != "" && json.Unmarshal([]byte(line), &event) == nil {
+				events = append(events, event)
+			}
+		}
+		return events
+	}
+}
+
+func TestWithLogger(t *testing.T) {
+	t.Run("Start and finish events describe the send", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"id":42}`))
+		}))
+		defer server.Close()
+		logger, events := jsonLogger(slog.LevelDebug)
+
+		req := http_proxy.NewRequest("POST", server.URL+"/users/42?token=secret").
+			WithLogger(http_proxy.NewRequestLogger(logger)).
+			WithRoute("/users/{id}").
+			SetJSONBody(map[string]string{"name": "Ada"})
+		req.Send()
+		req.Send()
+
+		logged := events()
+		if len(logged) != 4 {
+			t.Fatalf("expected 4 events, got %d: %v", len(logged), logged)
+		}
+		start, finish := logged[0], logged[3]
+		if start["msg"] != "request started" || start["level"] != "DEBUG" || start["request_size"] != 14.0 {
+			t.Errorf("expected a debug start event with the request size, got %v", start)
+		}
+		if finish["msg"] != "request finished" || finish["level"] != "INFO" {
+			t.Errorf("expected an info finish event, got %v", finish)
+		}
+		if finish["method"] != "POST" || finish["route"] != "/users/{id}" || finish["url"] != server.URL+"/users/42" {
+			t.Errorf("expected method, route and url without query, got %v", finish)
+		}
+		if finish["status"] != 200.0 || finish["response_size"] != 9.0 || finish["attempt"] != 2.0 {
+			t.Errorf("expected status, response size and second attempt, got %v", finish)
+		}
+		if _, hasDuration := finish["duration"]; !hasDuration {
+			t.Errorf("expected a duration, got %v", finish)
+		}
+	})
+
+	t.Run("Levels depend on the outcome", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/slow" {
+				time.Sleep(100 * time.Millisecond)
+			}
+			switch r.URL.Path {
+			case "/missing":
+				w.WriteHeader(http.StatusNotFound)
+			case "/broken":
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+		}))
+		defer server.Close()
+		logger, events := jsonLogger(slog.LevelInfo)
+		requestLogger := http_proxy.NewRequestLogger(logger).WithLevels(http_proxy.LogLevels{
+			Start:       slog.LevelDebug,
+			Success:     slog.LevelInfo,
+			ClientError: slog.LevelInfo,
+			ServerError: slog.LevelWarn,
+			Failure:     slog.LevelError,
+		})
+
+		for _, path := range []string{"/ok", "/missing", "/broken", "/slow"} {
+			http_proxy.NewRequest("GET", server.URL+path).WithLogger(requestLogger).WithTimeout(20 * time.Millisecond).Send()
+		}
+
+		expectedLevels := []string{"INFO", "INFO", "WARN", "ERROR"}
+		logged := events()
+		if len(logged) != len(expectedLevels) {
+			t.Fatalf("expected %d events, got %d: %v", len(expectedLevels), len(logged), logged)
+		}
+		for index, expected := range expectedLevels {
+			if logged[index]["level"] != expected {
+				t.Errorf("expected level %s for event %d, got %v", expected, index, logged[index])
+			}
+		}
+		if logged[3]["msg"] != "request failed" || !strings.Contains(logged[3]["error"].(string), "timed out") {
+			t.Errorf("expected a failure with the timeout error, got %v", logged[3])
+		}
+	})
+
+	t.Run("Headers are redacted and bodies truncated", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Set-Cookie", "session=secret")
+			w.Write([]byte(strings.Repeat("b", 100)))
+		}))
+		defer server.Close()
+		logger, events := jsonLogger(slog.LevelDebug)
+
+		_, body := sendAndRead(t, http_proxy.NewRequest("PUT", server.URL).
+			WithLogger(http_proxy.NewRequestLogger(logger).WithHeaders("X-Tenant-Secret").WithBodies(10)).
+			SetJWTAuthToken("secret").
+			SetHeader("X-Tenant-Secret", "secret").
+			SetHeader("X-Api-Key", "secret").
+			SetHeader("X-Visible", "visible").
+			SetBody(strings.NewReader(strings.Repeat("a", 20))))
+
+		logged := events()
+		if len(body) != 100 {
+			t.Errorf("expected the caller to read the whole body, got %d bytes", len(body))
+		}
+		encoded, _ := json.Marshal(logged)
+		if strings.Contains(string(encoded), "secret") {
+			t.Errorf("expected sensitive headers to be redacted, got %s", encoded)
+		}
+		requestHeaders, _ := logged[0]["request_headers"].(map[string]any)
+		if requestHeaders["X-Visible"] != "visible" || requestHeaders["Authorization"] != http_proxy.REDACTED {
+			t.Errorf("expected only sensitive headers to be redacted, got %v", requestHeaders)
+		}
+		if logged[0]["request_body"] != "aaaaaaaaaa...(truncated)" || logged[1]["response_body"] != "bbbbbbbbbb...(truncated)" {
+			t.Errorf("expected truncated bodies, got %v and %v", logged[0]["request_body"], logged[1]["response_body"])
+		}
+	})
+
+	t.Run("Request bodies are logged without running the body factory again", func(t *testing.T) {
+		var received string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			received = string(body)
+		}))
+		defer server.Close()
+		logger, events := jsonLogger(slog.LevelDebug)
+
+		factoryCalls := 0
+		sendAndRead(t, http_proxy.NewRequest("POST", server.URL).
+			WithLogger(http_proxy.NewRequestLogger(logger).WithBodies(10)).
+			SetBodyFactory(func() (io.Reader, error) {
+				factoryCalls++
+				return strings.NewReader(strings.Repeat("a", 20)), nil
+			}))
+
+		if factoryCalls != 1 {
+			t.Errorf("expected the body factory to run once, got %d", factoryCalls)
+		}
+		if received != strings.Repeat("a", 20) {
+			t.Errorf("expected the server to receive the whole body, got '%s'", received)
+		}
+		if logged := events(); logged[0]["request_body"] != "aaaaaaaaaa...(truncated)" {
+			t.Errorf("expected the truncated request body, got %v", logged[0]["request_body"])
+		}
+	})
+
+	t.Run("Nothing is logged above the enabled level", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		defer server.Close()
+		logger, events := jsonLogger(slog.LevelWarn)
+
+		http_proxy.NewRequest("GET", server.URL).WithLogger(http_proxy.NewRequestLogger(logger)).Send()
+
+		if logged := events(); len(logged) != 0 {
+			t.Errorf("expected no events, got %v", logged)
+		}
+	})
+}
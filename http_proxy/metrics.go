@@ -0,0 +1,248 @@
+package http_proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Namespace of the metrics unless configured otherwise
+const DEFAULT_METRICS_NAMESPACE = "http_client"
+
+// Content type of the Prometheus text exposition format
+const PROMETHEUS_CONTENT_TYPE = "text/plain; version=0.0.4; charset=utf-8"
+
+// Upper bounds, in seconds, of the latency histogram buckets unless configured otherwise
+var DefaultLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Upper bounds, in bytes, of the response size histogram buckets unless configured otherwise
+var DefaultSizeBuckets = []float64{100, 1000, 10_000, 100_000, 1_000_000, 10_000_000}
+
+// Collects request counters, in-flight gauges and latency and response size
+// histograms of the sends of the requests it is attached to. Series are
+// labeled by method, host, route template and status class, which is 2xx,
+// 3xx, 4xx, 5xx or error when no response is received. It can be shared
+// between requests and exposed as an http.Handler in the Prometheus text format
+type Metrics struct {
+	namespace      string
+	latencyBuckets []float64
+	sizeBuckets    []float64
+	mutex          sync.Mutex
+	requests       map[metricLabels]uint64
+	inFlight       map[metricLabels]int64
+	latencies      map[metricLabels]*histogram
+	sizes          map[metricLabels]*histogram
+}
+
+type metricLabels struct {
+	method      string
+	host        string
+	route       string
+	statusClass string
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// Creates a collector whose metric names start with namespace.
+// When namespace is empty DEFAULT_METRICS_NAMESPACE is used
+func NewMetrics(namespace string) *Metrics {
+	if namespace == "" {
+		namespace = DEFAULT_METRICS_NAMESPACE
+	}
+	return &Metrics{
+		namespace:      namespace,
+		latencyBuckets: DefaultLatencyBuckets,
+		sizeBuckets:    DefaultSizeBuckets,
+		requests:       map[metricLabels]uint64{},
+		inFlight:       map[metricLabels]int64{},
+		latencies:      map[metricLabels]*histogram{},
+		sizes:          map[metricLabels]*histogram{},
+	}
+}
+
+// Set the upper bounds, in seconds, of the latency histogram buckets.
+// It must be called before the metrics are collected
+func (metrics *Metrics) WithLatencyBuckets(buckets ...float64) *Metrics {
+	metrics.latencyBuckets = sortedBuckets(buckets)
+	return metrics
+}
+
+// Set the upper bounds, in bytes, of the response size histogram buckets.
+// It must be called before the metrics are collected
+func (metrics *Metrics) WithSizeBuckets(buckets ...float64) *Metrics {
+	metrics.sizeBuckets = sortedBuckets(buckets)
+	return metrics
+}
+
+func (requestIntent *proxiedRequestImpl) WithMetrics(metrics *Metrics) ProxiedRequest {
+	requestIntent.mutex.Lock()
+	defer requestIntent.mutex.Unlock()
+	requestIntent.options.metrics = metrics
+	return requestIntent
+}
+
+// Serves the collected metrics in the Prometheus text format
+func (metrics *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", PROMETHEUS_CONTENT_TYPE)
+	metrics.WriteTo(w)
+}
+
+// Writes the collected metrics in the Prometheus text format
+func (metrics *Metrics) WriteTo(writer io.Writer) (int64, error) {
+	var output bytes.Buffer
+	metrics.mutex.Lock()
+	writeFamily(&output, metrics.namespace+"_requests_total", "counter", "Requests sent, by status class of the response.", metrics.requests, func(labels metricLabels, value uint64) {
+		fmt.Fprintf(&output, "%s_requests_total%s %d\n", metrics.namespace, labels.format(true, ""), value)
+	})
+	writeFamily(&output, metrics.namespace+"_requests_in_flight", "gauge", "Requests waiting for the response headers.", metrics.inFlight, func(labels metricLabels, value int64) {
+		fmt.Fprintf(&output, "%s_requests_in_flight%s %d\n", metrics.namespace, labels.format(false, ""), value)
+	})
+	writeFamily(&output, metrics.namespace+"_request_duration_seconds", "histogram", "Time from the start of the send to the response headers.", metrics.latencies, func(labels metricLabels, value *histogram) {
+		value.write(&output, metrics.namespace+"_request_duration_seconds", labels, metrics.latencyBuckets)
+	})
+	writeFamily(&output, metrics.namespace+"_response_size_bytes", "histogram", "Size of the response bodies.", metrics.sizes, func(labels metricLabels, value *histogram) {
+		value.write(&output, metrics.namespace+"_response_size_bytes", labels, metrics.sizeBuckets)
+	})
+	metrics.mutex.Unlock()
+	written, writeErr := writer.Write(output.Bytes())
+	return int64(written), writeErr
+}
+
+// Records the start of a send and returns the function recording its outcome
+func (metrics *Metrics) start(request *http.Request, options sendOptions) func(response *http.Response) {
+	if metrics == nil {
+		return func(response *http.Response) {}
+	}
+	startTime := time.Now()
+	labels := metricLabels{method: request.Method, host: request.URL.Host, route: options.route}
+	metrics.mutex.Lock()
+	metrics.inFlight[labels]++
+	metrics.mutex.Unlock()
+
+	return func(response *http.Response) {
+		completedLabels := labels
+		completedLabels.statusClass = "error"
+		if response != nil {
+			completedLabels.statusClass = fmt.Sprintf("%dxx", response.StatusCode/100)
+		}
+		metrics.mutex.Lock()
+		defer metrics.mutex.Unlock()
+		metrics.inFlight[labels]--
+		metrics.requests[completedLabels]++
+		metrics.observe(metrics.latencies, completedLabels, metrics.latencyBuckets, time.Since(startTime).Seconds())
+		if response == nil {
+			return
+		}
+		if response.ContentLength >= 0 {
+			metrics.observe(metrics.sizes, completedLabels, metrics.sizeBuckets, float64(response.ContentLength))
+			return
+		}
+		response.Body = &countingBody{ReadCloser: response.Body, onDone: func(size int64) {
+			metrics.mutex.Lock()
+			defer metrics.mutex.Unlock()
+			metrics.observe(metrics.sizes, completedLabels, metrics.sizeBuckets, float64(size))
+		}}
+	}
+}
+
+func (metrics *Metrics) observe(histograms map[metricLabels]*histogram, labels metricLabels, buckets []float64, value float64) {
+	series, isFound := histograms[labels]
+	if !isFound {
+		series = &histogram{counts: make([]uint64, len(buckets))}
+		histograms[labels] = series
+	}
+	for index, bound := range buckets {
+		if value <= bound {
+			series.counts[index]++
+		}
+	}
+	series.sum += value
+	series.count++
+}
+
+func (series *histogram) write(output *bytes.Buffer, name string, labels metricLabels, buckets []float64) {
+	for index, bound := range buckets {
+		fmt.Fprintf(output, "%s_bucket%s %d\n", name, labels.format(true, formatFloat(bound)), series.counts[index])
+	}
+	fmt.Fprintf(output, "%s_bucket%s %d\n", name, labels.format(true, "+Inf"), series.count)
+	fmt.Fprintf(output, "%s_sum%s %s\n", name, labels.format(true, ""), formatFloat(series.sum))
+	fmt.Fprintf(output, "%s_count%s %d\n", name, labels.format(true, ""), series.count)
+}
+
+// Writes the header of a metric family followed by its series sorted by labels
+func writeFamily[T any](output *bytes.Buffer, name string, metricType string, help string, series map[metricLabels]T, writeSeries func(labels metricLabels, value T)) {
+	fmt.Fprintf(output, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+	labels := make([]metricLabels, 0, len(series))
+	for key := range series {
+		labels = append(labels, key)
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		return labels[i].format(true, "") < labels[j].format(true, "")
+	})
+	for _, key := range labels {
+		writeSeries(key, series[key])
+	}
+}
+
+func (labels metricLabels) format(withStatusClass bool, le string) string {
+	pairs := []string{
+		"method=" + quoteLabelValue(labels.method),
+		"host=" + quoteLabelValue(labels.host),
+		"route=" + quoteLabelValue(labels.route),
+	}
+	if withStatusClass {
+		pairs = append(pairs, "status_class="+quoteLabelValue(labels.statusClass))
+	}
+	if le != "" {
+		pairs = append(pairs, "le="+quoteLabelValue(le))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// Escapes backslashes, double quotes and line feeds as required by the text format
+func quoteLabelValue(value string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value) + `"`
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func sortedBuckets(buckets []float64) []float64 {
+	sorted := append([]float64{}, buckets...)
+	sort.Float64s(sorted)
+	return sorted
+}
+
+// Counts the bytes read from the body and reports them once, when the
+// body is read to the end or closed
+type countingBody struct {
+	io.ReadCloser
+	size   int64
+	once   sync.Once
+	onDone func(size int64)
+}
+
+func (body *countingBody) Read(p []byte) (int, error) {
+	n, err := body.ReadCloser.Read(p)
+	body.size += int64(n)
+	if err == io.EOF {
+		body.once.Do(func() { body.onDone(body.size) })
+	}
+	return n, err
+}
+
+func (body *countingBody) Close() error {
+	body.once.Do(func() { body.onDone(body.size) })
+	return body.ReadCloser.Close()
+}
@@ -0,0 +1,192 @@
+package http_proxy_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	http_proxy "github.com/AndreaCostanzo1/http-proxy/http_proxy"
+)
+
+// Returns the Prometheus text exposition of metrics, served by its handler
+func scrape(t *testing.T, metrics *http_proxy.Metrics) string {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	metrics.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	if contentType := recorder.Header().Get("Content-Type"); contentType != http_proxy.PROMETHEUS_CONTENT_TYPE {
+		t.Errorf("expected content type %q, got %q", http_proxy.PROMETHEUS_CONTENT_TYPE, contentType)
+	}
+	return recorder.Body.String()
+}
+
+func expectLines(t *testing.T, exposition string, lines ...string) {
+	t.Helper()
+	for _, line := range lines {
+		if !strings.Contains(exposition, line+"\n") {
+			t.Errorf("expected line %q, got:\n%s", line, exposition)
+		}
+	}
+}
+
+func TestWithMetrics(t *testing.T) {
+	t.Run("Sends are counted by status class", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/missing" {
+				w.WriteHeader(http.StatusNotFound)
+			}
+			w.Write([]byte("hello"))
+		}))
+		defer server.Close()
+		host := strings.TrimPrefix(server.URL, "http://")
+		metrics := http_proxy.NewMetrics("")
+
+		req := http_proxy.NewRequest("GET", server.URL+"/users/1").WithMetrics(metrics).WithRoute("/users/{id}")
+		sendAndRead(t, req)
+		sendAndRead(t, req)
+		http_proxy.NewRequest("GET", server.URL+"/missing").WithMetrics(metrics).Send()
+
+		labels := `method="GET",host="` + host + `",route="/users/{id}",status_class="2xx"`
+		expectLines(t, scrape(t, metrics),
+			"# TYPE http_client_requests_total counter",
+			`http_client_requests_total{`+labels+`} 2`,
+			`http_client_requests_total{method="GET",host="`+host+`",route="",status_class="4xx"} 1`,
+			"# TYPE http_client_requests_in_flight gauge",
+			`http_client_requests_in_flight{method="GET",host="`+host+`",route="/users/{id}"} 0`,
+			"# TYPE http_client_request_duration_seconds histogram",
+			`http_client_request_duration_seconds_bucket{`+labels+`,le="+Inf"} 2`,
+			`http_client_request_duration_seconds_count{`+labels+`} 2`,
+			"# TYPE http_client_response_size_bytes histogram",
+			`http_client_response_size_bytes_bucket{`+labels+`,le="100"} 2`,
+			`http_client_response_size_bytes_bucket{`+labels+`,le="1e+07"} 2`,
+			`http_client_response_size_bytes_sum{`+labels+`} 10`,
+		)
+	})
+
+	t.Run("Failed sends have the error status class", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		server.Close()
+		metrics := http_proxy.NewMetrics("api")
+
+		if _, err := http_proxy.NewRequest("DELETE", server.URL).WithMetrics(metrics).Send(); err == nil {
+			t.Fatalf("expected an error")
+		}
+
+		host := strings.TrimPrefix(server.URL, "http://")
+		expectLines(t, scrape(t, metrics),
+			`api_requests_total{method="DELETE",host="`+host+`",route="",status_class="error"} 1`,
+			`api_request_duration_seconds_count{method="DELETE",host="`+host+`",route="",status_class="error"} 1`,
+		)
+		if strings.Contains(scrape(t, metrics), "api_response_size_bytes_count") {
+			t.Errorf("expected no response size for a failed send")
+		}
+	})
+
+	t.Run("Bodies of unknown length are measured while read", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("chunk"))
+			w.(http.Flusher).Flush()
+			w.Write([]byte("chunk"))
+		}))
+		defer server.Close()
+		metrics := http_proxy.NewMetrics("").WithSizeBuckets(100, 5)
+
+		resp, err := http_proxy.NewRequest("GET", server.URL).WithMetrics(metrics).Send()
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if resp.ContentLength != -1 {
+			t.Fatalf("expected an unknown content length, got %d", resp.ContentLength)
+		}
+		if strings.Contains(scrape(t, metrics), "http_client_response_size_bytes_count") {
+			t.Errorf("expected no response size before the body is read")
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "chunkchunk" {
+			t.Errorf("expected body %q, got %q", "chunkchunk", body)
+		}
+
+		host := strings.TrimPrefix(server.URL, "http://")
+		labels := `method="GET",host="` + host + `",route="",status_class="2xx"`
+		expectLines(t, scrape(t, metrics),
+			`http_client_response_size_bytes_bucket{`+labels+`,le="5"} 0`,
+			`http_client_response_size_bytes_bucket{`+labels+`,le="100"} 1`,
+			`http_client_response_size_bytes_sum{`+labels+`} 10`,
+			`http_client_response_size_bytes_count{`+labels+`} 1`,
+		)
+	})
+
+	t.Run("Bodies parsed by interceptors are measured", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(strings.Repeat("not json ", 1000)))
+		}))
+		defer server.Close()
+		metrics := http_proxy.NewMetrics("").WithSizeBuckets(10000)
+
+		for i := 0; i < 3; i++ {
+			sendAndRead(t, http_proxy.NewRequest("GET", server.URL).
+				WithMetrics(metrics).
+				WithGenericInterceptor(func(parsedBody map[string]interface{}, response *http.Response) error {
+					return nil
+				}))
+		}
+
+		host := strings.TrimPrefix(server.URL, "http://")
+		labels := `method="GET",host="` + host + `",route="",status_class="2xx"`
+		expectLines(t, scrape(t, metrics),
+			`http_client_response_size_bytes_sum{`+labels+`} 27000`,
+			`http_client_response_size_bytes_count{`+labels+`} 3`,
+		)
+	})
+
+	t.Run("In-flight sends are reported until the response headers", func(t *testing.T) {
+		server := slowServer(200 * time.Millisecond)
+		defer server.Close()
+		metrics := http_proxy.NewMetrics("")
+		host := strings.TrimPrefix(server.URL, "http://")
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			http_proxy.NewRequest("GET", server.URL).WithMetrics(metrics).Send()
+		}()
+		time.Sleep(50 * time.Millisecond)
+		expectLines(t, scrape(t, metrics), `http_client_requests_in_flight{method="GET",host="`+host+`",route=""} 1`)
+		<-done
+		expectLines(t, scrape(t, metrics), `http_client_requests_in_flight{method="GET",host="`+host+`",route=""} 0`)
+	})
+
+	t.Run("Latency stops at the response headers", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"name": "item"}`))
+		}))
+		defer server.Close()
+		metrics := http_proxy.NewMetrics("")
+		host := strings.TrimPrefix(server.URL, "http://")
+
+		http_proxy.NewRequest("GET", server.URL).
+			WithMetrics(metrics).
+			WithGenericInterceptor(func(parsedBody map[string]interface{}, response *http.Response) error {
+				time.Sleep(300 * time.Millisecond)
+				return nil
+			}).
+			Send()
+
+		expectLines(t, scrape(t, metrics), `http_client_request_duration_seconds_bucket{method="GET",host="`+host+`",route="",status_class="2xx",le="0.25"} 1`)
+	})
+
+	t.Run("Label values are escaped", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		defer server.Close()
+		metrics := http_proxy.NewMetrics("")
+
+		http_proxy.NewRequest("GET", server.URL).WithMetrics(metrics).WithRoute("/a\"b\\c\nd").Send()
+
+		if exposition := scrape(t, metrics); !strings.Contains(exposition, `route="/a\"b\\c\nd"`) {
+			t.Errorf("expected an escaped route label, got:\n%s", exposition)
+		}
+	})
+}
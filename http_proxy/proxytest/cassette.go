@@ -0,0 +1,338 @@
+package proxytest
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"unicode/utf8"
+
+	http_proxy "github.com/AndreaCostanzo1/http-proxy/http_proxy"
+)
+
+var ErrInteractionNotFound = errors.New("no recorded interaction matches the request")
+
+// Value replacing redacted headers and JSON fields
+const REDACTED = http_proxy.REDACTED
+
+type CassetteMode int
+
+const (
+	// Replays the cassette when its file exists and records a new one otherwise
+	CASSETTE_AUTO CassetteMode = iota
+	// Sends every request to the network and records it, replacing the file
+	CASSETTE_RECORD
+	// Serves every request from the file, never reaching the network
+	CASSETTE_REPLAY
+)
+
+// Headers redacted when the cassette options don't list any
+var DefaultRedactedHeaders = http_proxy.DefaultRedactedHeaders
+
+// Decides whether a request can be answered by a recorded interaction
+type MatchRule func(request *http.Request, body []byte, recorded RecordedRequest) bool
+
+// Rewrites a request or response body before it is written to disk
+type BodyRedactor func(body []byte) []byte
+
+type CassetteOptions struct {
+	Mode CassetteMode
+	// Transport used to reach the network while recording. It defaults to http.DefaultTransport
+	Transport http.RoundTripper
+	// Rules a recorded interaction must satisfy to be replayed.
+	// They default to MatchMethod and MatchURL
+	MatchRules []MatchRule
+	// Request and response headers whose values are replaced by REDACTED.
+	// They default to DefaultRedactedHeaders
+	RedactHeaders []string
+	// Applied in order to the request and response bodies
+	RedactBody []BodyRedactor
+}
+
+// A request/response pair stored in a cassette
+type Interaction struct {
+	Request  RecordedRequest  `json:"request"`
+	Response RecordedResponse `json:"response"`
+}
+
+type RecordedRequest struct {
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Header http.Header `json:"header,omitempty"`
+	RecordedBody
+}
+
+type RecordedResponse struct {
+	StatusCode int         `json:"status_code"`
+	Header     http.Header `json:"header,omitempty"`
+	RecordedBody
+}
+
+// A body stored as text, or base64 encoded when it isn't valid UTF-8
+type RecordedBody struct {
+	Body         string `json:"body,omitempty"`
+	BodyEncoding string `json:"body_encoding,omitempty"`
+}
+
+// Returns the decoded body
+func (recorded RecordedBody) Bytes() []byte {
+	if recorded.BodyEncoding == "base64" {
+		body, _ := base64.StdEncoding.DecodeString(recorded.Body)
+		return body
+	}
+	return []byte(recorded.Body)
+}
+
+func newRecordedBody(body []byte) RecordedBody {
+	if utf8.Valid(body) {
+		return RecordedBody{Body: string(body)}
+	}
+	return RecordedBody{Body: base64.StdEncoding.EncodeToString(body), BodyEncoding: "base64"}
+}
+
+// An http.RoundTripper recording the interactions with the network to a
+// JSON file and replaying them later. It is safe for concurrent use
+type Cassette struct {
+	path         string
+	options      CassetteOptions
+	isRecording  bool
+	mutex        sync.Mutex
+	interactions []Interaction
+	replayed     []bool
+}
+
+// Opens the cassette stored at path. In replay mode the file is loaded
+// immediately, in record mode it is replaced on the first request
+func NewCassette(path string, options CassetteOptions) (*Cassette, error) {
+	if options.Transport == nil {
+		options.Transport = http.DefaultTransport
+	}
+	if options.MatchRules == nil {
+		options.MatchRules = []MatchRule{MatchMethod, MatchURL}
+	}
+	if options.RedactHeaders == nil {
+		options.RedactHeaders = DefaultRedactedHeaders
+	}
+	cassette := &Cassette{path: path, options: options}
+	payload, readErr := os.ReadFile(path)
+	switch {
+	case options.Mode == CASSETTE_RECORD || (options.Mode == CASSETTE_AUTO && errors.Is(readErr, os.ErrNotExist)):
+		cassette.isRecording = true
+	case readErr != nil:
+		return nil, readErr
+	default:
+		if unmarshalErr := json.Unmarshal(payload, &cassette.interactions); unmarshalErr != nil {
+			return nil, fmt.Errorf("invalid cassette %s: %w", path, unmarshalErr)
+		}
+		cassette.replayed = make([]bool, len(cassette.interactions))
+	}
+	return cassette, nil
+}
+
+// Returns a client sending its requests through the cassette, to be
+// injected with ProxiedRequest.WithHTTPClient
+func (cassette *Cassette) Client() *http.Client {
+	return &http.Client{Transport: cassette}
+}
+
+// Reports whether the cassette sends requests to the network
+func (cassette *Cassette) IsRecording() bool {
+	return cassette.isRecording
+}
+
+// Returns a copy of the recorded interactions
+func (cassette *Cassette) Interactions() []Interaction {
+	cassette.mutex.Lock()
+	defer cassette.mutex.Unlock()
+	return append([]Interaction{}, cassette.interactions...)
+}
+
+func (cassette *Cassette) RoundTrip(request *http.Request) (*http.Response, error) {
+	if cassette.isRecording {
+		return cassette.record(request)
+	}
+	return cassette.replay(request)
+}
+
+// Sends the request and appends the redacted interaction to the file
+// before handing the response to the caller
+func (cassette *Cassette) record(request *http.Request) (*http.Response, error) {
+	requestBody := readBody(request)
+	response, err := cassette.options.Transport.RoundTrip(request)
+	if err != nil {
+		return nil, err
+	}
+	responseBody, readErr := io.ReadAll(response.Body)
+	response.Body.Close()
+	if readErr != nil {
+		return nil, readErr
+	}
+	response.Body = io.NopCloser(bytes.NewReader(responseBody))
+
+	interaction := Interaction{
+		Request: RecordedRequest{
+			Method:       request.Method,
+			URL:          request.URL.String(),
+			Header:       http_proxy.RedactHeader(request.Header, cassette.options.RedactHeaders),
+			RecordedBody: newRecordedBody(cassette.redactBody(requestBody)),
+		},
+		Response: RecordedResponse{
+			StatusCode:   response.StatusCode,
+			Header:       http_proxy.RedactHeader(response.Header, cassette.options.RedactHeaders),
+			RecordedBody: newRecordedBody(cassette.redactBody(responseBody)),
+		},
+	}
+	cassette.mutex.Lock()
+	defer cassette.mutex.Unlock()
+	cassette.interactions = append(cassette.interactions, interaction)
+	if saveErr := cassette.save(); saveErr != nil {
+		return nil, saveErr
+	}
+	return response, nil
+}
+
+// Answers with the first interaction matching the request that was not
+// already replayed. Each interaction is replayed once, so repeated requests
+// receive the responses in the order they were recorded
+func (cassette *Cassette) replay(request *http.Request) (*http.Response, error) {
+	body := readBody(request)
+	cassette.mutex.Lock()
+	defer cassette.mutex.Unlock()
+	for index, interaction := range cassette.interactions {
+		if cassette.replayed[index] || !cassette.matches(request, body, interaction.Request) {
+			continue
+		}
+		cassette.replayed[index] = true
+		response := NewResponse(request, interaction.Response.StatusCode, "")
+		responseBody := interaction.Response.Bytes()
+		response.Body = io.NopCloser(bytes.NewReader(responseBody))
+		response.ContentLength = int64(len(responseBody))
+		for name, values := range interaction.Response.Header {
+			response.Header[name] = append([]string{}, values...)
+		}
+		return response, nil
+	}
+	return nil, fmt.Errorf("%w: %s %s in %s", ErrInteractionNotFound, request.Method, request.URL, cassette.path)
+}
+
+func (cassette *Cassette) matches(request *http.Request, body []byte, recorded RecordedRequest) bool {
+	for _, rule := range cassette.options.MatchRules {
+		if !rule(request, body, recorded) {
+			return false
+		}
+	}
+	return true
+}
+
+func (cassette *Cassette) redactBody(body []byte) []byte {
+	for _, redactor := range cassette.options.RedactBody {
+		body = redactor(body)
+	}
+	return body
+}
+
+func (cassette *Cassette) save() error {
+	payload, marshalErr := json.MarshalIndent(cassette.interactions, "", "  ")
+	if marshalErr != nil {
+		return marshalErr
+	}
+	if mkdirErr := os.MkdirAll(filepath.Dir(cassette.path), 0o755); mkdirErr != nil {
+		return mkdirErr
+	}
+	temporaryFile, createErr := os.CreateTemp(filepath.Dir(cassette.path), "cassette-*.tmp")
+	if createErr != nil {
+		return createErr
+	}
+	_, writeErr := temporaryFile.Write(payload)
+	closeErr := temporaryFile.Close()
+	if err := errors.Join(writeErr, closeErr); err != nil {
+		os.Remove(temporaryFile.Name())
+		return err
+	}
+	return os.Rename(temporaryFile.Name(), cassette.path)
+}
+
+// Matches interactions recorded with the same method
+func MatchMethod(request *http.Request, body []byte, recorded RecordedRequest) bool {
+	return request.Method == recorded.Method
+}
+
+// Matches interactions recorded with the same URL, query included
+func MatchURL(request *http.Request, body []byte, recorded RecordedRequest) bool {
+	return request.URL.String() == recorded.URL
+}
+
+// Matches interactions recorded with the same URL path, ignoring host and query
+func MatchPath(request *http.Request, body []byte, recorded RecordedRequest) bool {
+	recordedURL, parseErr := url.Parse(recorded.URL)
+	return parseErr == nil && request.URL.Path == recordedURL.Path
+}
+
+// Matches interactions recorded with the same body. Bodies are compared
+// as JSON values when both are valid JSON
+func MatchBody(request *http.Request, body []byte, recorded RecordedRequest) bool {
+	recordedBody := recorded.Bytes()
+	if bytes.Equal(body, recordedBody) {
+		return true
+	}
+	actual, expected, decodeErr := decodeBoth(body, json.RawMessage(recordedBody))
+	return decodeErr == nil && reflect.DeepEqual(actual, expected)
+}
+
+// Matches interactions recorded with the same values of the headers
+func MatchHeaders(names ...string) MatchRule {
+	return func(request *http.Request, body []byte, recorded RecordedRequest) bool {
+		for _, name := range names {
+			if fmt.Sprint(request.Header.Values(name)) != fmt.Sprint(recorded.Header.Values(name)) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// Replaces with REDACTED the values of the JSON object fields with the
+// provided names, at any depth. Bodies that are not JSON are left unchanged
+func RedactJSONFields(names ...string) BodyRedactor {
+	redactedNames := map[string]bool{}
+	for _, name := range names {
+		redactedNames[name] = true
+	}
+	return func(body []byte) []byte {
+		var value any
+		if json.Unmarshal(body, &value) != nil {
+			return body
+		}
+		redacted, marshalErr := json.Marshal(redactJSONValue(value, redactedNames))
+		if marshalErr != nil {
+			return body
+		}
+		return redacted
+	}
+}
+
+func redactJSONValue(value any, names map[string]bool) any {
+	switch typed := value.(type) {
+	case map[string]any:
+		for key, field := range typed {
+			if names[key] {
+				typed[key] = REDACTED
+			} else {
+				typed[key] = redactJSONValue(field, names)
+			}
+		}
+	case []any:
+		for index, item := range typed {
+			typed[index] = redactJSONValue(item, names)
+		}
+	}
+	return value
+}
@@ -0,0 +1,157 @@
+package proxytest_test
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	http_proxy "github.com/AndreaCostanzo1/http-proxy/http_proxy"
+	"github.com/AndreaCostanzo1/http-proxy/http_proxy/proxytest"
+)
+
+func TestCassette(t *testing.T) {
+	t.Run("Recorded interactions are replayed without the network", func(t *testing.T) {
+		calls := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			body, _ := io.ReadAll(r.Body)
+			w.Header().Set("X-Call", r.URL.Path)
+			w.Write([]byte("echo " + string(body)))
+		}))
+		path := filepath.Join(t.TempDir(), "cassettes", "echo.json")
+
+		recorder, err := proxytest.NewCassette(path, proxytest.CassetteOptions{})
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if !recorder.IsRecording() {
+			t.Fatalf("expected a missing cassette to be recorded")
+		}
+		for _, payload := range []string{"first", "second"} {
+			http_proxy.NewRequest("POST", server.URL+"/echo").
+				WithHTTPClient(recorder.Client()).
+				SetBody(strings.NewReader(payload)).
+				Send()
+		}
+		server.Close()
+
+		player, err := proxytest.NewCassette(path, proxytest.CassetteOptions{})
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if player.IsRecording() {
+			t.Fatalf("expected an existing cassette to be replayed")
+		}
+		for _, payload := range []string{"first", "second"} {
+			resp, err := http_proxy.NewRequest("POST", server.URL+"/echo").WithHTTPClient(player.Client()).Send()
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			if string(body) != "echo "+payload {
+				t.Errorf("expected body 'echo %s', got '%s'", payload, body)
+			}
+			if value := resp.Header.Get("X-Call"); value != "/echo" {
+				t.Errorf("expected header X-Call '/echo', got '%s'", value)
+			}
+		}
+		if calls != 2 {
+			t.Errorf("expected 2 calls to the server, got %d", calls)
+		}
+		_, err = http_proxy.NewRequest("POST", server.URL+"/echo").WithHTTPClient(player.Client()).Send()
+		if !errors.Is(err, proxytest.ErrInteractionNotFound) {
+			t.Errorf("expected ErrInteractionNotFound once the interactions are used, got %v", err)
+		}
+	})
+
+	t.Run("Secrets are redacted before writing to disk", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Set-Cookie", "session=secret-session")
+			w.Write([]byte(`{"access_token":"secret-token","user":{"password":"secret-password","name":"Ada"}}`))
+		}))
+		defer server.Close()
+		path := filepath.Join(t.TempDir(), "login.json")
+
+		cassette, _ := proxytest.NewCassette(path, proxytest.CassetteOptions{
+			Mode:       proxytest.CASSETTE_RECORD,
+			RedactBody: []proxytest.BodyRedactor{proxytest.RedactJSONFields("access_token", "password")},
+		})
+		resp, err := http_proxy.NewRequest("POST", server.URL+"/login").
+			WithHTTPClient(cassette.Client()).
+			SetJWTAuthToken("secret-jwt").
+			SetJSONBody(map[string]string{"password": "secret-password"}).
+			Send()
+
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		if !strings.Contains(string(body), "secret-token") {
+			t.Errorf("expected the caller to receive the original body, got '%s'", body)
+		}
+		content, _ := os.ReadFile(path)
+		if strings.Contains(string(content), "secret") {
+			t.Errorf("expected secrets to be redacted, got %s", content)
+		}
+		if !strings.Contains(string(content), "Ada") || !strings.Contains(string(content), proxytest.REDACTED) {
+			t.Errorf("expected only the secrets to be redacted, got %s", content)
+		}
+	})
+
+	t.Run("Match rules select the replayed interaction", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "search.json")
+		os.WriteFile(path, []byte(`[
+			{"request": {"method": "POST", "url": "http://recorded.test/search?page=1", "body": "{\"query\": \"a\"}"}, "response": {"status_code": 200, "body": "result a"}},
+			{"request": {"method": "POST", "url": "http://recorded.test/search?page=2", "body": "{\"query\": \"b\"}"}, "response": {"status_code": 200, "body": "result b"}}
+		]`), 0o600)
+
+		cassette, _ := proxytest.NewCassette(path, proxytest.CassetteOptions{
+			Mode:       proxytest.CASSETTE_REPLAY,
+			MatchRules: []proxytest.MatchRule{proxytest.MatchMethod, proxytest.MatchPath, proxytest.MatchBody},
+		})
+		resp, err := http_proxy.NewRequest("POST", "http://other.test/search").
+			WithHTTPClient(cassette.Client()).
+			SetJSONBody(map[string]string{"query": "b"}).
+			Send()
+
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		if string(body) != "result b" {
+			t.Errorf("expected body 'result b', got '%s'", body)
+		}
+	})
+
+	t.Run("Replay mode requires the cassette file", func(t *testing.T) {
+		_, err := proxytest.NewCassette(filepath.Join(t.TempDir(), "missing.json"), proxytest.CassetteOptions{Mode: proxytest.CASSETTE_REPLAY})
+
+		if !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("expected os.ErrNotExist, got %v", err)
+		}
+	})
+
+	t.Run("Binary bodies survive the round trip", func(t *testing.T) {
+		payload := []byte{0xff, 0x00, 0xfe}
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write(payload)
+		}))
+		path := filepath.Join(t.TempDir(), "binary.json")
+		recorder, _ := proxytest.NewCassette(path, proxytest.CassetteOptions{})
+		http_proxy.NewRequest("GET", server.URL).WithHTTPClient(recorder.Client()).Send()
+		server.Close()
+
+		player, _ := proxytest.NewCassette(path, proxytest.CassetteOptions{})
+		resp, _ := http_proxy.NewRequest("GET", server.URL).WithHTTPClient(player.Client()).Send()
+		body, _ := io.ReadAll(resp.Body)
+
+		if string(body) != string(payload) {
+			t.Errorf("expected body %v, got %v", payload, body)
+		}
+	})
+}
@@ -0,0 +1,146 @@
+package proxytest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// Checks whether a request satisfies a condition. Describe is used in the
+// report produced when no expectation matches a request
+type Matcher interface {
+	Match(request *http.Request, body []byte) bool
+	Describe() string
+}
+
+type matcherFunc struct {
+	description string
+	match       func(request *http.Request, body []byte) bool
+}
+
+func (matcher matcherFunc) Match(request *http.Request, body []byte) bool {
+	return matcher.match(request, body)
+}
+
+func (matcher matcherFunc) Describe() string {
+	return matcher.description
+}
+
+// Creates a matcher from a function
+func MatchFunc(description string, match func(request *http.Request, body []byte) bool) Matcher {
+	return matcherFunc{description: description, match: match}
+}
+
+// Matches requests with the method
+func Method(method string) Matcher {
+	return MatchFunc("method "+method, func(request *http.Request, body []byte) bool {
+		return strings.EqualFold(request.Method, method)
+	})
+}
+
+// Matches requests with the URL path
+func Path(path string) Matcher {
+	return MatchFunc("path "+path, func(request *http.Request, body []byte) bool {
+		return request.URL.Path == path
+	})
+}
+
+// Matches requests whose query parameter has the value
+func Query(key string, value string) Matcher {
+	return MatchFunc(fmt.Sprintf("query %s=%s", key, value), func(request *http.Request, body []byte) bool {
+		for _, actual := range request.URL.Query()[key] {
+			if actual == value {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// Matches requests whose header has the value
+func Header(key string, value string) Matcher {
+	return MatchFunc(fmt.Sprintf("header %s: %s", key, value), func(request *http.Request, body []byte) bool {
+		for _, actual := range request.Header.Values(key) {
+			if actual == value {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// Matches requests whose JSON body is equal to expected once both are decoded
+func JSONBody(expected any) Matcher {
+	return MatchFunc("JSON body "+encodeForDescription(expected), func(request *http.Request, body []byte) bool {
+		actual, expectedValue, decodeErr := decodeBoth(body, expected)
+		return decodeErr == nil && reflect.DeepEqual(actual, expectedValue)
+	})
+}
+
+// Matches requests whose JSON body contains expected: objects must contain
+// the expected keys with matching values, other values must be equal
+func PartialJSONBody(expected any) Matcher {
+	return MatchFunc("JSON body containing "+encodeForDescription(expected), func(request *http.Request, body []byte) bool {
+		actual, expectedValue, decodeErr := decodeBoth(body, expected)
+		return decodeErr == nil && containsJSON(actual, expectedValue)
+	})
+}
+
+// Matches requests whose body is exactly expected
+func Body(expected string) Matcher {
+	return MatchFunc(fmt.Sprintf("body %q", expected), func(request *http.Request, body []byte) bool {
+		return string(body) == expected
+	})
+}
+
+func decodeBoth(body []byte, expected any) (any, any, error) {
+	var actual any
+	if decodeErr := json.Unmarshal(body, &actual); decodeErr != nil {
+		return nil, nil, decodeErr
+	}
+	var expectedValue any
+	if decodeErr := json.Unmarshal([]byte(encodeForDescription(expected)), &expectedValue); decodeErr != nil {
+		return nil, nil, decodeErr
+	}
+	return actual, expectedValue, nil
+}
+
+func containsJSON(actual any, expected any) bool {
+	expectedObject, isObject := expected.(map[string]any)
+	if !isObject {
+		return reflect.DeepEqual(actual, expected)
+	}
+	actualObject, isObject := actual.(map[string]any)
+	if !isObject {
+		return false
+	}
+	for key, expectedValue := range expectedObject {
+		actualValue, isFound := actualObject[key]
+		if !isFound || !containsJSON(actualValue, expectedValue) {
+			return false
+		}
+	}
+	return true
+}
+
+func encodeForDescription(value any) string {
+	if raw, isString := value.(string); isString && json.Valid([]byte(raw)) {
+		return raw
+	}
+	payload, _ := json.Marshal(value)
+	return string(payload)
+}
+
+func readBody(request *http.Request) []byte {
+	if request.Body == nil {
+		return nil
+	}
+	body, _ := io.ReadAll(request.Body)
+	request.Body.Close()
+	request.Body = io.NopCloser(bytes.NewReader(body))
+	return body
+}
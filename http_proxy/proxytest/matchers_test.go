@@ -0,0 +1,43 @@
+package proxytest_test
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/AndreaCostanzo1/http-proxy/http_proxy/proxytest"
+)
+
+func TestMatchers(t *testing.T) {
+	request, _ := http.NewRequest("PUT", "http://api.test/items/1?expand=owner&expand=tags", nil)
+	request.Header.Set("Content-Type", "application/json")
+	body := []byte(`{"name":"item","tags":["a","b"],"owner":{"id":1,"name":"Ada"}}`)
+
+	testCases := []struct {
+		name     string
+		matcher  proxytest.Matcher
+		expected bool
+	}{
+		{"Method ignores case", proxytest.Method("put"), true},
+		{"Method mismatch", proxytest.Method("GET"), false},
+		{"Path", proxytest.Path("/items/1"), true},
+		{"Query with repeated values", proxytest.Query("expand", "tags"), true},
+		{"Query mismatch", proxytest.Query("expand", "items"), false},
+		{"Header", proxytest.Header("Content-Type", "application/json"), true},
+		{"Body", proxytest.Body(string(body)), true},
+		{"JSON body ignores formatting", proxytest.JSONBody(map[string]any{"owner": map[string]any{"name": "Ada", "id": 1}, "tags": []string{"a", "b"}, "name": "item"}), true},
+		{"JSON body requires all fields", proxytest.JSONBody(map[string]any{"name": "item"}), false},
+		{"Partial JSON body", proxytest.PartialJSONBody(map[string]any{"owner": map[string]any{"id": 1}}), true},
+		{"Partial JSON body mismatch", proxytest.PartialJSONBody(map[string]any{"owner": map[string]any{"id": 2}}), false},
+		{"Partial JSON body on arrays", proxytest.PartialJSONBody(map[string]any{"tags": []string{"a"}}), false},
+		{"Custom matcher", proxytest.MatchFunc("has id", func(r *http.Request, b []byte) bool { return strings.HasSuffix(r.URL.Path, "/1") }), true},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			if actual := testCase.matcher.Match(request, body); actual != testCase.expected {
+				t.Errorf("expected %s to return %v, got %v", testCase.matcher.Describe(), testCase.expected, actual)
+			}
+		})
+	}
+}
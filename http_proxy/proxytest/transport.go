@@ -0,0 +1,250 @@
+package proxytest
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var ErrUnexpectedRequest = errors.New("unexpected request")
+
+// The subset of testing.TB used to report failed assertions
+type TestingT interface {
+	Helper()
+	Errorf(format string, args ...any)
+}
+
+// Produces the response to a matched request
+type Responder = func(request *http.Request) (*http.Response, error)
+
+// An http.RoundTripper answering requests with canned responses instead of
+// reaching the network. It is safe for concurrent use
+type MockTransport struct {
+	mutex        sync.Mutex
+	expectations []*Expectation
+	unexpected   []string
+}
+
+// Creates a transport without expectations: every request is unexpected
+func NewMockTransport() *MockTransport {
+	return &MockTransport{}
+}
+
+// Returns a client sending its requests through the transport, to be
+// injected with ProxiedRequest.WithHTTPClient
+func (mock *MockTransport) Client() *http.Client {
+	return &http.Client{Transport: mock}
+}
+
+// Registers an expectation for requests satisfying all the matchers.
+// Expectations are evaluated in registration order
+func (mock *MockTransport) On(matchers ...Matcher) *Expectation {
+	mock.mutex.Lock()
+	defer mock.mutex.Unlock()
+	expectation := &Expectation{mock: mock, matchers: matchers, times: -1}
+	mock.expectations = append(mock.expectations, expectation)
+	return expectation
+}
+
+func (mock *MockTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	body := readBody(request)
+	mock.mutex.Lock()
+	for _, expectation := range mock.expectations {
+		if responder, isMatched := expectation.take(request, body); isMatched {
+			mock.mutex.Unlock()
+			return responder(request)
+		}
+	}
+	report := mock.describeMismatch(request, body)
+	mock.unexpected = append(mock.unexpected, report)
+	mock.mutex.Unlock()
+	return nil, fmt.Errorf("%w: %s", ErrUnexpectedRequest, report)
+}
+
+// Reports through t the unexpected requests and the expectations that were
+// not called the expected number of times. It returns true if there are none
+func (mock *MockTransport) AssertExpectations(t TestingT) bool {
+	t.Helper()
+	mock.mutex.Lock()
+	defer mock.mutex.Unlock()
+	isSatisfied := true
+	for _, report := range mock.unexpected {
+		t.Errorf("%s", report)
+		isSatisfied = false
+	}
+	for _, expectation := range mock.expectations {
+		if expectation.times >= 0 && expectation.calls != expectation.times {
+			t.Errorf("expected %d calls matching %s, got %d", expectation.times, expectation.describe(), expectation.calls)
+			isSatisfied = false
+		} else if expectation.times < 0 && expectation.calls == 0 {
+			t.Errorf("expected at least one call matching %s, got none", expectation.describe())
+			isSatisfied = false
+		}
+	}
+	return isSatisfied
+}
+
+// Describes the request and how it differs from the closest expectation
+func (mock *MockTransport) describeMismatch(request *http.Request, body []byte) string {
+	var report strings.Builder
+	fmt.Fprintf(&report, "unexpected request %s %s", request.Method, request.URL)
+	headerNames := make([]string, 0, len(request.Header))
+	for name := range request.Header {
+		headerNames = append(headerNames, name)
+	}
+	sort.Strings(headerNames)
+	for _, name := range headerNames {
+		fmt.Fprintf(&report, "\n    %s: %s", name, strings.Join(request.Header[name], ", "))
+	}
+	if len(body) > 0 {
+		fmt.Fprintf(&report, "\n    body: %s", body)
+	}
+
+	var closest *Expectation
+	closestScore := -1
+	for _, expectation := range mock.expectations {
+		if score := expectation.score(request, body); score > closestScore {
+			closest, closestScore = expectation, score
+		}
+	}
+	if closest == nil {
+		report.WriteString("\nno expectations registered")
+		return report.String()
+	}
+	report.WriteString("\nclosest expectation:")
+	for _, matcher := range closest.matchers {
+		mark := "-"
+		if matcher.Match(request, body) {
+			mark = "+"
+		}
+		fmt.Fprintf(&report, "\n  %s %s", mark, matcher.Describe())
+	}
+	if closest.isExhausted() {
+		fmt.Fprintf(&report, "\n  already called %d times", closest.calls)
+	}
+	return report.String()
+}
+
+// The canned behavior for the requests matching a set of matchers
+type Expectation struct {
+	mock       *MockTransport
+	matchers   []Matcher
+	responders []Responder
+	times      int
+	calls      int
+}
+
+// Adds a response to the sequence returned by the expectation. Each call
+// consumes the next response, the last one is repeated once the others are used
+func (expectation *Expectation) Respond(statusCode int, body string) *Expectation {
+	return expectation.RespondWithHeaders(statusCode, nil, body)
+}
+
+// Adds a response with headers to the sequence returned by the expectation
+func (expectation *Expectation) RespondWithHeaders(statusCode int, headers map[string]string, body string) *Expectation {
+	return expectation.RespondWith(func(request *http.Request) (*http.Response, error) {
+		response := NewResponse(request, statusCode, body)
+		for name, value := range headers {
+			response.Header.Set(name, value)
+		}
+		return response, nil
+	})
+}
+
+// Adds a JSON response to the sequence returned by the expectation
+func (expectation *Expectation) RespondJSON(statusCode int, body any) *Expectation {
+	payload, _ := json.Marshal(body)
+	return expectation.RespondWithHeaders(statusCode, map[string]string{"Content-Type": "application/json"}, string(payload))
+}
+
+// Adds a transport error to the sequence returned by the expectation
+func (expectation *Expectation) RespondError(err error) *Expectation {
+	return expectation.RespondWith(func(request *http.Request) (*http.Response, error) {
+		return nil, err
+	})
+}
+
+// Adds a custom responder to the sequence returned by the expectation
+func (expectation *Expectation) RespondWith(responder Responder) *Expectation {
+	expectation.responders = append(expectation.responders, responder)
+	return expectation
+}
+
+// Limits the expectation to n calls and makes AssertExpectations verify
+// that it was called exactly n times
+func (expectation *Expectation) Times(n int) *Expectation {
+	expectation.times = n
+	return expectation
+}
+
+// Shorthand for Times(1)
+func (expectation *Expectation) Once() *Expectation {
+	return expectation.Times(1)
+}
+
+// Returns how many requests matched the expectation. It can be called
+// while requests are being sent
+func (expectation *Expectation) Calls() int {
+	expectation.mock.mutex.Lock()
+	defer expectation.mock.mutex.Unlock()
+	return expectation.calls
+}
+
+func (expectation *Expectation) take(request *http.Request, body []byte) (Responder, bool) {
+	if expectation.isExhausted() || expectation.score(request, body) != len(expectation.matchers) {
+		return nil, false
+	}
+	expectation.calls++
+	if len(expectation.responders) == 0 {
+		return func(request *http.Request) (*http.Response, error) {
+			return NewResponse(request, http.StatusOK, ""), nil
+		}, true
+	}
+	return expectation.responders[min(expectation.calls, len(expectation.responders))-1], true
+}
+
+func (expectation *Expectation) isExhausted() bool {
+	return expectation.times >= 0 && expectation.calls >= expectation.times
+}
+
+func (expectation *Expectation) score(request *http.Request, body []byte) int {
+	score := 0
+	for _, matcher := range expectation.matchers {
+		if matcher.Match(request, body) {
+			score++
+		}
+	}
+	return score
+}
+
+func (expectation *Expectation) describe() string {
+	descriptions := []string{}
+	for _, matcher := range expectation.matchers {
+		descriptions = append(descriptions, matcher.Describe())
+	}
+	if len(descriptions) == 0 {
+		return "any request"
+	}
+	return "[" + strings.Join(descriptions, ", ") + "]"
+}
+
+// Builds a response to the request with the status code and body
+func NewResponse(request *http.Request, statusCode int, body string) *http.Response {
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", statusCode, http.StatusText(statusCode)),
+		StatusCode:    statusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{},
+		Body:          io.NopCloser(bytes.NewBufferString(body)),
+		ContentLength: int64(len(body)),
+		Request:       request,
+	}
+}
@@ -0,0 +1,158 @@
+package proxytest_test
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	http_proxy "github.com/AndreaCostanzo1/http-proxy/http_proxy"
+	"github.com/AndreaCostanzo1/http-proxy/http_proxy/proxytest"
+)
+
+type recordingT struct {
+	errors []string
+}
+
+func (t *recordingT) Helper() {}
+
+func (t *recordingT) Errorf(format string, args ...any) {
+	t.errors = append(t.errors, fmt.Sprintf(format, args...))
+}
+
+func TestMockTransport(t *testing.T) {
+	t.Run("Matched requests receive the canned response", func(t *testing.T) {
+		mock := proxytest.NewMockTransport()
+		mock.On(proxytest.Method("POST"), proxytest.Path("/users"), proxytest.JSONBody(map[string]any{"name": "Ada"})).
+			RespondWithHeaders(http.StatusCreated, map[string]string{"Location": "/users/1"}, "created").
+			Once()
+
+		resp, err := http_proxy.NewRequest("POST", "http://api.test/users").
+			WithHTTPClient(mock.Client()).
+			SetJSONBody(map[string]any{"name": "Ada"}).
+			Send()
+
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusCreated || string(body) != "created" {
+			t.Errorf("expected 201 'created', got %d '%s'", resp.StatusCode, body)
+		}
+		if value := resp.Header.Get("Location"); value != "/users/1" {
+			t.Errorf("expected Location '/users/1', got '%s'", value)
+		}
+		mock.AssertExpectations(t)
+	})
+
+	t.Run("Responses are returned in sequence and the last one repeats", func(t *testing.T) {
+		mock := proxytest.NewMockTransport()
+		mock.On(proxytest.Method("GET")).
+			Respond(http.StatusServiceUnavailable, "").
+			RespondJSON(http.StatusOK, map[string]string{"status": "ok"})
+		request := http_proxy.NewRequest("GET", "http://api.test/health").WithHTTPClient(mock.Client())
+
+		statusCodes := []int{}
+		for range 3 {
+			resp, _ := request.Send()
+			statusCodes = append(statusCodes, resp.StatusCode)
+		}
+
+		if fmt.Sprint(statusCodes) != "[503 200 200]" {
+			t.Errorf("expected status codes [503 200 200], got %v", statusCodes)
+		}
+	})
+
+	t.Run("Times limits the matched calls", func(t *testing.T) {
+		mock := proxytest.NewMockTransport()
+		limited := mock.On(proxytest.Path("/limited")).Respond(http.StatusOK, "").Times(2)
+		request := http_proxy.NewRequest("GET", "http://api.test/limited").WithHTTPClient(mock.Client())
+
+		request.Send()
+		request.Send()
+		_, err := request.Send()
+
+		if !errors.Is(err, proxytest.ErrUnexpectedRequest) {
+			t.Errorf("expected ErrUnexpectedRequest, got %v", err)
+		}
+		if limited.Calls() != 2 {
+			t.Errorf("expected 2 calls, got %d", limited.Calls())
+		}
+	})
+
+	t.Run("Unexpected requests report the closest expectation", func(t *testing.T) {
+		mock := proxytest.NewMockTransport()
+		mock.On(proxytest.Method("GET"), proxytest.Path("/users"))
+		mock.On(proxytest.Method("POST"), proxytest.Path("/orders"), proxytest.Header("X-Tenant", "acme"))
+
+		_, err := http_proxy.NewRequest("POST", "http://api.test/orders").
+			WithHTTPClient(mock.Client()).
+			SetHeader("X-Tenant", "other").
+			Send()
+
+		if err == nil {
+			t.Fatalf("expected an error, got none")
+		}
+		for _, expected := range []string{"unexpected request POST http://api.test/orders", "X-Tenant: other", "+ method POST", "+ path /orders", "- header X-Tenant: acme"} {
+			if !strings.Contains(err.Error(), expected) {
+				t.Errorf("expected error to contain '%s', got '%s'", expected, err.Error())
+			}
+		}
+	})
+
+	t.Run("AssertExpectations reports unmet and unexpected calls", func(t *testing.T) {
+		mock := proxytest.NewMockTransport()
+		mock.On(proxytest.Path("/twice")).Times(2)
+		mock.On(proxytest.Path("/never"))
+		request := http_proxy.NewRequest("GET", "http://api.test/twice").WithHTTPClient(mock.Client())
+		request.Send()
+		http_proxy.NewRequest("GET", "http://api.test/other").WithHTTPClient(mock.Client()).Send()
+
+		recorder := &recordingT{}
+		isSatisfied := mock.AssertExpectations(recorder)
+
+		if isSatisfied {
+			t.Errorf("expected expectations not to be satisfied")
+		}
+		if len(recorder.errors) != 3 {
+			t.Errorf("expected 3 reported errors, got %d: %v", len(recorder.errors), recorder.errors)
+		}
+	})
+
+	t.Run("RespondError returns a transport error", func(t *testing.T) {
+		mock := proxytest.NewMockTransport()
+		failure := errors.New("connection reset")
+		mock.On().RespondError(failure)
+
+		_, err := http_proxy.NewRequest("GET", "http://api.test").WithHTTPClient(mock.Client()).Send()
+
+		if !errors.Is(err, failure) {
+			t.Errorf("expected the transport error, got %v", err)
+		}
+	})
+
+	t.Run("Calls can be read while requests are sent", func(t *testing.T) {
+		mock := proxytest.NewMockTransport()
+		expectation := mock.On(proxytest.Method("GET")).Respond(http.StatusOK, "ok")
+
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if resp, err := http_proxy.NewRequest("GET", "http://api.test").WithHTTPClient(mock.Client()).Send(); err == nil {
+					resp.Body.Close()
+				}
+				expectation.Calls()
+			}()
+		}
+		wg.Wait()
+
+		if calls := expectation.Calls(); calls != 10 {
+			t.Errorf("expected 10 calls, got %d", calls)
+		}
+	})
+}
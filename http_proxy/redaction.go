@@ -0,0 +1,58 @@
+package http_proxy
+
+import (
+	"net/http"
+	"net/url"
+)
+
+// Value replacing redacted headers, query parameters and body fields
+const REDACTED = "[REDACTED]"
+
+// Headers carrying credentials, redacted unless other headers are listed
+var DefaultRedactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", "X-Api-Key", "Api-Key", "X-Auth-Token"}
+
+// Returns a copy of header where the values of the named headers are replaced by REDACTED
+func RedactHeader(header http.Header, names []string) http.Header {
+	redacted := header.Clone()
+	for _, name := range names {
+		if values := redacted.Values(name); len(values) > 0 {
+			redacted.Del(name)
+			for range values {
+				redacted.Add(name, REDACTED)
+			}
+		}
+	}
+	return redacted
+}
+
+// Returns the URL with the password and the values of the named query
+// parameters replaced by REDACTED
+func redactURL(requestURL *url.URL, queryNames []string) string {
+	redacted := *requestURL
+	if _, hasPassword := redacted.User.Password(); hasPassword {
+		redacted.User = url.UserPassword(redacted.User.Username(), REDACTED)
+	}
+	query := redacted.Query()
+	isRedacted := false
+	for _, name := range queryNames {
+		if values, isFound := query[name]; isFound {
+			for index := range values {
+				values[index] = REDACTED
+			}
+			isRedacted = true
+		}
+	}
+	if isRedacted {
+		redacted.RawQuery = query.Encode()
+	}
+	return redacted.String()
+}
+
+func containsHeader(names []string, name string) bool {
+	for _, candidate := range names {
+		if http.CanonicalHeaderKey(candidate) == http.CanonicalHeaderKey(name) {
+			return true
+		}
+	}
+	return false
+}
@@ -2,17 +2,31 @@ package http_proxy
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"sync"
+	"time"
 )
 
+// A builder for an HTTP request that can be sent any number of times.
+// All methods are safe for concurrent use: setters are serialized with
+// the sends, and each send works on its own copy of the underlying request.
+// Setting a value while another goroutine sends the request makes it
+// unpredictable whether that send observes the change, so configure a
+// request or a RequestTemplate before sharing it between goroutines
 type ProxiedRequest interface {
 	// Adds the key-value pair to the header.
 	// It appends to any existing values associated with key
 	AddHeader(key string, value string) ProxiedRequest
-	// Applies the body to request replacing the older one if present
+	// Applies the body to request replacing the older one if present.
+	// Seekable readers are rewound on each send, other readers are buffered
+	// in memory up to the body buffer limit so that the body can be replayed
 	SetBody(body io.Reader) ProxiedRequest
+	// Applies a body produced by the factory, replacing the older one if present.
+	// The factory is invoked every time the body needs to be sent
+	SetBodyFactory(factory func() (io.Reader, error)) ProxiedRequest
 	// Set the key-value pair to the header.
 	// It replaces any existing values associated with key
 	SetHeader(key string, value string) ProxiedRequest
@@ -25,55 +39,145 @@ type ProxiedRequest interface {
 	// It allows to set comma separated values for the provided keys
 	// It replaces any existing values associated with the keys
 	SetMultiValueHeaders(headers map[string][]string) ProxiedRequest
+	// Set the maximum number of bytes buffered to replay a non-seekable body.
+	// Bigger bodies can be sent only once
+	WithBodyBufferLimit(limit int64) ProxiedRequest
+	// Set the Authorization header to the provided bearer token.
+	// The token is treated as an opaque string
+	SetJWTAuthToken(token string) ProxiedRequest
+	// Set the provided JWT as bearer token. Before each send its claims are
+	// inspected and, if it is expired, it is refreshed or the send fails
+	SetValidatedJWTAuthToken(token string, validation JWTValidation) ProxiedRequest
+	// Uses the signer to mint the bearer token of the request. A new token
+	// is minted whenever the cached one is about to expire
+	WithJWTSigner(signer *JWTSigner) ProxiedRequest
 	// Adds an interceptor that is executed over the response
 	WithGenericInterceptor(handlers ...errorHandler) ProxiedRequest
 	// Adds an interceptor that is executed when the response status code
 	// matches the provided value
 	WithStatusCodeInterceptor(statusCode int, handlers ...errorHandler) ProxiedRequest
+	// Creates an independent copy of the request that can be modified even if
+	// the underlying request of the original has already been generated
+	Clone() ProxiedRequest
 	// Generates the underlying request without sending it. After this the request
 	// can't be modified or it will return an error
 	UnderlyingRequest() (*http.Request, error)
+	// Renders the request as a shell-escaped curl command. The values of the
+	// headers listed in redactHeaders are replaced by REDACTED. The body is
+	// read without being consumed, so the request can still be sent. JWTs are
+	// rendered as currently held, without being refreshed or minted, so the
+	// Authorization header is missing until a JWTSigner has minted a token
+	ToCurl(redactHeaders ...string) (string, error)
 	// Set the context of the request
 	WithContext(ctx context.Context) ProxiedRequest
-	// Generates the underlying request if not already generated and sends it
+	// Set the client used to send the request. It defaults to http.DefaultClient
+	WithHTTPClient(client *http.Client) ProxiedRequest
+	// Bounds the total duration of each send, redirects included
+	WithTimeout(timeout time.Duration) ProxiedRequest
+	// Set the connect, TLS handshake, response header and total timeouts of each send
+	WithTimeouts(timeouts Timeouts) ProxiedRequest
+	// Bounds each send by a deadline shared with other sends
+	WithBudget(budget *Budget) ProxiedRequest
+	// Fires duplicate requests when a response is slow and keeps the first
+	// successful one. Interceptors run only on the winning response
+	WithHedging(policy HedgingPolicy) ProxiedRequest
+	// Serves GET requests from the cache when a fresh response is stored
+	// and stores cacheable responses received from the network
+	WithCache(cache *ResponseCache) ProxiedRequest
+	// Shares a single upstream call between identical GET and HEAD requests
+	// in flight at the same time in the group
+	WithDeduplication(group *DedupGroup) ProxiedRequest
+	// Records the exchanges of the request with the server in the recorder
+	WithHARRecorder(recorder *HARRecorder) ProxiedRequest
+	// Logs the start and the outcome of each send with the logger
+	WithLogger(logger *RequestLogger) ProxiedRequest
+	// Set the route template, e.g. /users/{id}, reported by logs, traces and metrics
+	// in place of the full path, which may have too many distinct values
+	WithRoute(route string) ProxiedRequest
+	// Reports a span for each send to the tracer. Trace context and baggage
+	// carried by the context are propagated also without a tracer
+	WithTracer(tracer Tracer) ProxiedRequest
+	// Collects counters, gauges and histograms of the sends in metrics
+	WithMetrics(metrics *Metrics) ProxiedRequest
+	// Captures the DNS, connect, TLS, time to first byte and body read durations
+	// of each send, available from the response with TimingsFromResponse
+	WithTimings() ProxiedRequest
+	// Sends the request to a target of the balancer when its host is the
+	// service name of the balancer
+	WithBalancer(balancer *Balancer) ProxiedRequest
+	// Generates the underlying request if not already generated and sends it.
+	// It can be called multiple times as long as the body can be replayed
 	Send() (*http.Response, error)
+	// Starts sending the request in the background and returns a handle to
+	// wait for the response or cancel the send
+	SendAsync() *Future
 }
 
 type proxiedRequestImpl struct {
+	mutex                  *sync.Mutex
 	method                 string
 	url                    string
 	body                   io.Reader
+	bodyFactory            bodyFactory
+	bodyBufferLimit        int64
+	replayableBody         *replayableBody
+	attempts               int
 	context                context.Context
 	headers                map[string][]string
-	requestError           error
+	requestErrors          []error
 	underlyingRequest      *http.Request
 	statusCodeInterceptors map[int][]errorHandler
 	genericInterceptors    []errorHandler
+	tokenSource            jwtTokenSource
+	options                sendOptions
 }
 
+// Creates a request for the method and absolute url. Invalid values are
+// reported when the request is generated or sent
 func NewRequest(method string, url string) *proxiedRequestImpl {
-	return &proxiedRequestImpl{
+	requestIntent := &proxiedRequestImpl{
+		mutex:                  &sync.Mutex{},
 		method:                 method,
 		headers:                map[string][]string{},
 		url:                    url,
 		body:                   http.NoBody,
+		bodyBufferLimit:        DEFAULT_BODY_BUFFER_LIMIT,
 		genericInterceptors:    []errorHandler{},
 		statusCodeInterceptors: map[int][]errorHandler{},
 	}
+	if methodErr := validateMethod(method); methodErr != nil {
+		requestIntent.recordError("NewRequest", methodErr)
+	}
+	if urlErr := validateURL(url); urlErr != nil {
+		requestIntent.recordError("NewRequest", urlErr)
+	}
+	return requestIntent
 }
 
 func (requestIntent *proxiedRequestImpl) UnderlyingRequest() (*http.Request, error) {
-	if requestIntent.requestError != nil {
-		return nil, requestIntent.requestError
+	requestIntent.mutex.Lock()
+	defer requestIntent.mutex.Unlock()
+	return requestIntent.generateUnderlyingRequest()
+}
+
+func (requestIntent *proxiedRequestImpl) generateUnderlyingRequest() (*http.Request, error) {
+	if buildErr := requestIntent.buildError(); buildErr != nil {
+		return nil, buildErr
 	}
 	if requestIntent.underlyingRequest != nil {
 		return requestIntent.underlyingRequest, nil
 	}
-	newRequest, createRequestErr := http.NewRequest(requestIntent.method, requestIntent.url, requestIntent.body)
+	newRequest, createRequestErr := http.NewRequest(requestIntent.method, requestIntent.url, nil)
 	requestIntent.underlyingRequest = newRequest
-	requestIntent.requestError = createRequestErr
-	if createRequestErr == nil {
+	if createRequestErr != nil {
+		requestIntent.recordError("UnderlyingRequest", createRequestErr)
+	} else {
 		for headerKey, headerValues := range requestIntent.headers {
+			// net/http ignores the Host header of outgoing requests and sends Request.Host
+			if http.CanonicalHeaderKey(headerKey) == "Host" && len(headerValues) > 0 {
+				requestIntent.underlyingRequest.Host = headerValues[0]
+				continue
+			}
 			for _, value := range headerValues {
 				requestIntent.underlyingRequest.Header.Add(headerKey, value)
 			}
@@ -81,29 +185,144 @@ func (requestIntent *proxiedRequestImpl) UnderlyingRequest() (*http.Request, err
 		if requestIntent.context != nil {
 			requestIntent.underlyingRequest = requestIntent.underlyingRequest.WithContext(requestIntent.context)
 		}
+		// The token is resolved by each send instead, so that a failed refresh
+		// only fails that send
+		if bodyErr := requestIntent.applyBody(requestIntent.underlyingRequest); bodyErr != nil {
+			requestIntent.recordError("UnderlyingRequest", bodyErr)
+		}
+	}
+	if buildErr := requestIntent.buildError(); buildErr != nil {
+		return nil, buildErr
 	}
-	return newRequest, createRequestErr
+	return requestIntent.underlyingRequest, nil
 }
 
 func (requestIntent *proxiedRequestImpl) Send() (*http.Response, error) {
-	if requestIntent.underlyingRequest == nil {
-		requestIntent.UnderlyingRequest()
+	outgoingRequest, options, prepareErr := requestIntent.prepareOutgoingRequest()
+	if prepareErr != nil {
+		return nil, prepareErr
 	}
+	return requestIntent.send(outgoingRequest, options)
+}
 
-	if requestIntent.requestError != nil {
-		return nil, requestIntent.requestError
+// Sends the request aborting it also when parent is done before the
+// response is received. Once the send returns the response body is
+// no longer bound to parent
+func (requestIntent *proxiedRequestImpl) sendWithParent(parent context.Context) (*http.Response, error) {
+	outgoingRequest, options, prepareErr := requestIntent.prepareOutgoingRequest()
+	if prepareErr != nil {
+		return nil, prepareErr
+	}
+	ctx, cancel := context.WithCancelCause(outgoingRequest.Context())
+	stop := context.AfterFunc(parent, func() { cancel(context.Cause(parent)) })
+	response, err := requestIntent.send(outgoingRequest.WithContext(ctx), options)
+	if !stop() && response != nil && parent.Err() != nil {
+		response.Body.Close()
+		return nil, context.Cause(parent)
+	}
+	if response == nil {
+		cancel(nil)
+		if cause := context.Cause(parent); cause != nil && !errors.Is(err, cause) {
+			err = fmt.Errorf("%w: %w", cause, err)
+		}
+		return nil, err
 	}
+	response.Body = &cancelOnCloseBody{ReadCloser: response.Body, cancel: func() { cancel(nil) }}
+	return response, err
+}
 
-	var response *http.Response
-	var err error
-	if response, err = http.DefaultClient.Do(requestIntent.underlyingRequest); err == nil {
-		response, err = requestIntent.validateResponse(response)
+func (requestIntent *proxiedRequestImpl) send(outgoingRequest *http.Request, options sendOptions) (*http.Response, error) {
+	callerCtx := outgoingRequest.Context()
+	startTime := time.Now()
+	spanCtx, endSpan := options.startSpan(callerCtx, outgoingRequest)
+	logAttributes := options.logger.start(spanCtx, outgoingRequest, options)
+	finishMetrics := options.metrics.start(outgoingRequest, options)
+	ctx, cancel := options.deadlineContext(options.balancer.sendContext(spanCtx))
+	sentRequest := outgoingRequest.WithContext(options.timingsContext(ctx, startTime))
+	response, err := options.do(sentRequest, &cancel)
+	if err != nil {
+		cancel()
+		err = timeoutError(callerCtx, ctx, err)
+		options.logger.finish(spanCtx, logAttributes, startTime, nil, err)
+		finishMetrics(nil)
+		endSpan(nil, err)
+		return nil, err
 	}
+	// The latency stops at the response headers, before interceptors read the body
+	finishMetrics(response)
+	attachTimings(sentRequest.Context(), sentRequest, response)
+	response, err = requestIntent.validateResponse(response)
+	err = timeoutError(callerCtx, ctx, err)
+	options.logger.finish(spanCtx, logAttributes, startTime, response, err)
+	endSpan(response, err)
+	response.Body = &cancelOnCloseBody{ReadCloser: response.Body, cancel: cancel}
 	return response, err
 }
 
-func (requestIntent *proxiedRequestImpl) verifyUnderlyingRequestNotGenerated() {
-	if requestIntent.underlyingRequest != nil {
-		requestIntent.requestError = fmt.Errorf("tried to modify request proxy after generating the underlying request")
+// Creates a copy of the underlying request for a single send. The first send
+// uses the body of the underlying request, the following ones replay it
+func (requestIntent *proxiedRequestImpl) prepareOutgoingRequest() (*http.Request, sendOptions, error) {
+	requestIntent.mutex.Lock()
+	options := requestIntent.options
+	underlyingRequest, generateErr := requestIntent.generateUnderlyingRequest()
+	tokenSource := requestIntent.tokenSource
+	requestIntent.mutex.Unlock()
+	if generateErr != nil {
+		return nil, options, generateErr
+	}
+	// The token is resolved without holding the mutex, as a refresh may take a
+	// network round trip, and before taking the body, so that a failed refresh
+	// leaves the body available to the next send
+	authorization, authErr := bearerAuthorization(tokenSource)
+	if authErr != nil {
+		return nil, options, authErr
+	}
+
+	requestIntent.mutex.Lock()
+	defer requestIntent.mutex.Unlock()
+	options = requestIntent.options
+	// The context set after the underlying request was generated applies too
+	ctx := underlyingRequest.Context()
+	if requestIntent.context != nil {
+		ctx = requestIntent.context
+	}
+	outgoingRequest := underlyingRequest.Clone(ctx)
+	if authorization != "" {
+		outgoingRequest.Header.Set("Authorization", authorization)
+	}
+	if requestIntent.attempts > 0 {
+		if underlyingRequest.GetBody == nil {
+			return nil, options, ErrBodyNotReplayable
+		}
+		body, bodyErr := underlyingRequest.GetBody()
+		if bodyErr != nil {
+			return nil, options, bodyErr
+		}
+		outgoingRequest.Body = body
+	}
+	requestIntent.attempts++
+	options.attempt = requestIntent.attempts
+	return outgoingRequest, options, nil
+}
+
+func (requestIntent *proxiedRequestImpl) applyBody(request *http.Request) error {
+	body, bodyErr := requestIntent.resolveBody()
+	if bodyErr != nil {
+		return bodyErr
+	}
+	return body.applyTo(request)
+}
+
+// Turns the configured body into a replayable one. The result is cached
+// so that clones of the request share it instead of consuming the reader
+func (requestIntent *proxiedRequestImpl) resolveBody() (*replayableBody, error) {
+	if requestIntent.replayableBody != nil {
+		return requestIntent.replayableBody, nil
+	}
+	body, bodyErr := newReplayableBody(requestIntent.body, requestIntent.bodyFactory, requestIntent.bodyBufferLimit)
+	if bodyErr != nil {
+		return nil, bodyErr
 	}
+	requestIntent.replayableBody = body
+	return body, nil
 }
@@ -0,0 +1,281 @@
+package http_proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Headers meaningful only for a single connection, which are not forwarded
+var hopByHopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// An http.Handler forwarding incoming requests to an upstream. Each incoming
+// request is sent as a copy of the upstream request, so the headers,
+// authorization, interceptors and send options of the upstream request apply
+// to every forwarded request. Bodies are streamed in both directions
+type ReverseProxy struct {
+	template     *RequestTemplate
+	errorHandler func(w http.ResponseWriter, r *http.Request, err error)
+}
+
+// Creates a reverse proxy forwarding to upstream. The path and query of the
+// incoming requests are appended to the URL of upstream, its method and body
+// are ignored. Headers set on upstream replace the incoming ones with the same
+// name. Interceptors can transform the upstream response in place, or reject
+// it by returning an error, responses with interceptors are parsed before
+// being forwarded. Redirects are returned to the caller, not followed
+func NewReverseProxy(upstream ProxiedRequest) *ReverseProxy {
+	base := upstream.Clone().(*proxiedRequestImpl)
+	client := http.Client{}
+	if base.options.httpClient != nil {
+		client = *base.options.httpClient
+	}
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	base.options.httpClient = &client
+	return &ReverseProxy{template: &RequestTemplate{base: base}, errorHandler: defaultProxyErrorHandler}
+}
+
+// Set the function writing the response when the upstream can't be reached
+// or an interceptor rejects its response. By default a 504 Gateway Timeout is
+// written for timeouts and a 502 Bad Gateway for the other errors
+func (proxy *ReverseProxy) WithErrorHandler(handler func(w http.ResponseWriter, r *http.Request, err error)) *ReverseProxy {
+	proxy.errorHandler = handler
+	return proxy
+}
+
+func (proxy *ReverseProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	response, err := proxy.forward(r)
+	if err != nil {
+		if response != nil {
+			response.Body.Close()
+		}
+		proxy.errorHandler(w, r, err)
+		return
+	}
+	defer response.Body.Close()
+	writeResponse(w, response)
+}
+
+// Sends a copy of the upstream request carrying the incoming one
+func (proxy *ReverseProxy) forward(r *http.Request) (*http.Response, error) {
+	forwarded := proxy.template.base.Clone().(*proxiedRequestImpl)
+	forwarded.method = r.Method
+	forwarded.url = upstreamURL(forwarded.url, r.URL)
+	return sendIncoming(forwarded, r)
+}
+
+// Sends forwarded with the headers, trace context and body of the incoming
+// request. Headers already set on forwarded take precedence
+func sendIncoming(forwarded *proxiedRequestImpl, r *http.Request) (*http.Response, error) {
+	ctx := r.Context()
+	header := r.Header.Clone()
+	removeHopByHopHeaders(header)
+	// Trailers are end-to-end, so the upstream must know the caller accepts them
+	if acceptsTrailers(r.Header) {
+		header.Set("Te", "trailers")
+	}
+	if spanContext, parseErr := ParseTraceparent(header.Get(TRACEPARENT_HEADER)); parseErr == nil {
+		// The incoming trace context becomes the parent of the forwarded send
+		spanContext.TraceState = header.Get(TRACESTATE_HEADER)
+		ctx = ContextWithSpanContext(ctx, spanContext)
+		header.Del(TRACEPARENT_HEADER)
+		header.Del(TRACESTATE_HEADER)
+	}
+	setForwardedHeaders(header, r)
+	for key := range forwarded.headers {
+		header.Del(key)
+	}
+	for key, values := range header {
+		forwarded.headers[key] = append(forwarded.headers[key], values...)
+	}
+	forwarded.context = ctx
+	forwarded.body = r.Body
+	forwarded.bodyFactory = nil
+	forwarded.replayableBody = incomingBody(r)
+	return forwarded.Send()
+}
+
+// Streams the incoming body once, keeping its length when known
+func incomingBody(r *http.Request) *replayableBody {
+	if r.Body == nil || r.Body == http.NoBody || r.ContentLength == 0 {
+		return emptyBody()
+	}
+	body := oneShotBody(r.Body)
+	body.contentLength = r.ContentLength
+	return body
+}
+
+// Appends the path and query of the incoming URL to the upstream URL
+func upstreamURL(upstream string, incoming *url.URL) string {
+	base, parseErr := url.Parse(upstream)
+	if parseErr != nil {
+		return upstream
+	}
+	query := base.RawQuery
+	if incoming.RawQuery != "" {
+		if query != "" {
+			query += "&"
+		}
+		query += incoming.RawQuery
+	}
+	path := base.EscapedPath()
+	if incomingPath := incoming.EscapedPath(); incomingPath != "" {
+		path = strings.TrimSuffix(path, "/") + "/" + strings.TrimPrefix(incomingPath, "/")
+	}
+	base.Path, base.RawPath, base.RawQuery, base.ForceQuery = "", "", "", false
+	joined := base.String() + path
+	if query != "" {
+		joined += "?" + query
+	}
+	return joined
+}
+
+// Removes the hop-by-hop headers, including the ones listed in Connection
+func removeHopByHopHeaders(header http.Header) {
+	for _, connectionHeaders := range header.Values("Connection") {
+		for _, name := range strings.Split(connectionHeaders, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		header.Del(name)
+	}
+}
+
+// Reports whether the TE header lists trailers
+func acceptsTrailers(header http.Header) bool {
+	for _, te := range header.Values("Te") {
+		for _, coding := range strings.Split(te, ",") {
+			name, _, _ := strings.Cut(coding, ";")
+			if strings.EqualFold(strings.TrimSpace(name), "trailers") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Appends the client address to X-Forwarded-For and Forwarded and sets the
+// original host and protocol in X-Forwarded-Host and X-Forwarded-Proto
+func setForwardedHeaders(header http.Header, r *http.Request) {
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+	clientIP, _, splitErr := net.SplitHostPort(r.RemoteAddr)
+	if splitErr != nil {
+		clientIP = r.RemoteAddr
+	}
+	if clientIP != "" {
+		forwardedFor := clientIP
+		if previous := header.Values("X-Forwarded-For"); len(previous) > 0 {
+			forwardedFor = strings.Join(previous, ", ") + ", " + clientIP
+		}
+		header.Set("X-Forwarded-For", forwardedFor)
+	}
+	header.Set("X-Forwarded-Host", r.Host)
+	header.Set("X-Forwarded-Proto", proto)
+
+	element := fmt.Sprintf("host=%s;proto=%s", quoteForwardedValue(r.Host), proto)
+	if clientIP != "" {
+		nodeIP := clientIP
+		if strings.Contains(nodeIP, ":") {
+			nodeIP = "[" + nodeIP + "]"
+		}
+		element = "for=" + quoteForwardedValue(nodeIP) + ";" + element
+	}
+	if previous := header.Values("Forwarded"); len(previous) > 0 {
+		element = strings.Join(previous, ", ") + ", " + element
+	}
+	header.Set("Forwarded", element)
+}
+
+// Quotes the values of the Forwarded header that are not tokens, as defined by RFC 7239
+func quoteForwardedValue(value string) string {
+	if value != "" && strings.IndexFunc(value, isNotTokenRune) == -1 {
+		return value
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`
+}
+
+// Copies the upstream response, flushing each chunk of bodies of unknown
+// length so that streamed responses reach the caller as they are produced
+func writeResponse(w http.ResponseWriter, response *http.Response) {
+	header := w.Header()
+	for key, values := range response.Header {
+		header[key] = append([]string{}, values...)
+	}
+	removeHopByHopHeaders(header)
+	// The cache status describes the internal cache, not the response
+	header.Del(CACHE_STATUS_HEADER)
+	// Interceptors replacing the body are expected to update ContentLength
+	if response.ContentLength > 0 || response.ContentLength == 0 && header.Get("Content-Length") != "" {
+		header.Set("Content-Length", fmt.Sprint(response.ContentLength))
+	} else {
+		header.Del("Content-Length")
+	}
+	trailerNames := make([]string, 0, len(response.Trailer))
+	for name := range response.Trailer {
+		trailerNames = append(trailerNames, name)
+	}
+	if len(trailerNames) > 0 {
+		header.Set("Trailer", strings.Join(trailerNames, ", "))
+	}
+	w.WriteHeader(response.StatusCode)
+
+	if copyErr := copyBody(w, response.Body, response.ContentLength < 0); copyErr != nil {
+		// Abort the response so that the caller doesn't mistake it for a complete one
+		panic(http.ErrAbortHandler)
+	}
+	for name, values := range response.Trailer {
+		for _, value := range values {
+			header.Add(name, value)
+		}
+	}
+}
+
+func copyBody(w http.ResponseWriter, body io.Reader, flush bool) error {
+	controller := http.NewResponseController(w)
+	buffer := make([]byte, 32<<10)
+	for {
+		n, readErr := body.Read(buffer)
+		if n > 0 {
+			if _, writeErr := w.Write(buffer[:n]); writeErr != nil {
+				return writeErr
+			}
+			if flush {
+				controller.Flush()
+			}
+		}
+		if readErr == io.EOF {
+			return nil
+		}
+		if readErr != nil {
+			return readErr
+		}
+	}
+}
+
+func defaultProxyErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	status := http.StatusBadGateway
+	if errors.Is(err, ErrTimeout) {
+		status = http.StatusGatewayTimeout
+	}
+	http.Error(w, http.StatusText(status), status)
+}
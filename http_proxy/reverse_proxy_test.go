@@ -0,0 +1,363 @@
+package http_proxy_test
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	http_proxy "github.com/AndreaCostanzo1/http-proxy/http_proxy"
+)
+
+// Starts a server proxying to the upstream request
+func proxyServer(upstream http_proxy.ProxiedRequest) *httptest.Server {
+	return httptest.NewServer(http_proxy.NewReverseProxy(upstream))
+}
+
+func TestReverseProxy(t *testing.T) {
+	t.Run("Requests are forwarded to the upstream", func(t *testing.T) {
+		var received *http.Request
+		var receivedBody string
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			received = r
+			body, _ := io.ReadAll(r.Body)
+			receivedBody = string(body)
+			w.Header().Set("X-Upstream", "yes")
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte("created"))
+		}))
+		defer upstream.Close()
+		proxy := proxyServer(http_proxy.NewRequest("GET", upstream.URL+"/api?version=2"))
+		defer proxy.Close()
+
+		req, _ := http.NewRequest("POST", proxy.URL+"/users/42?expand=true", strings.NewReader("payload"))
+		req.Header.Set("X-Custom", "value")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusCreated || string(body) != "created" || resp.Header.Get("X-Upstream") != "yes" {
+			t.Errorf("expected the upstream response, got %d %q %v", resp.StatusCode, body, resp.Header)
+		}
+		if received.Method != "POST" || received.URL.Path != "/api/users/42" || received.URL.RawQuery != "version=2&expand=true" {
+			t.Errorf("expected POST /api/users/42?version=2&expand=true, got %s %s", received.Method, received.URL)
+		}
+		if receivedBody != "payload" || received.ContentLength != 7 {
+			t.Errorf("expected body %q of length 7, got %q of length %d", "payload", receivedBody, received.ContentLength)
+		}
+		if received.Header.Get("X-Custom") != "value" {
+			t.Errorf("expected the incoming headers, got %v", received.Header)
+		}
+	})
+
+	t.Run("Forwarding headers are set and hop-by-hop headers are removed", func(t *testing.T) {
+		var received http.Header
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			received = r.Header
+			w.Header().Set("Connection", "X-Upstream-Hop")
+			w.Header().Set("X-Upstream-Hop", "secret")
+		}))
+		defer upstream.Close()
+		proxy := proxyServer(http_proxy.NewRequest("GET", upstream.URL))
+		defer proxy.Close()
+
+		req, _ := http.NewRequest("GET", proxy.URL, nil)
+		req.Header.Set("X-Forwarded-For", "203.0.113.7")
+		req.Header.Set("Connection", "X-Hop")
+		req.Header.Set("X-Hop", "secret")
+		req.Header.Set("Proxy-Authorization", "Basic c2VjcmV0")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		resp.Body.Close()
+
+		proxyHost := strings.TrimPrefix(proxy.URL, "http://")
+		expected := map[string]string{
+			"X-Forwarded-For":   "203.0.113.7, 127.0.0.1",
+			"X-Forwarded-Host":  proxyHost,
+			"X-Forwarded-Proto": "http",
+			"Forwarded":         `for=127.0.0.1;host="` + proxyHost + `";proto=http`,
+		}
+		for name, value := range expected {
+			if received.Get(name) != value {
+				t.Errorf("expected %s %q, got %q", name, value, received.Get(name))
+			}
+		}
+		for _, name := range []string{"X-Hop", "Proxy-Authorization"} {
+			if received.Get(name) != "" {
+				t.Errorf("expected %s to be removed, got %q", name, received.Get(name))
+			}
+		}
+		if resp.Header.Get("X-Upstream-Hop") != "" {
+			t.Errorf("expected the upstream hop-by-hop header to be removed, got %v", resp.Header)
+		}
+	})
+
+	t.Run("Headers of the upstream request replace the incoming ones", func(t *testing.T) {
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(r.Header.Get("Authorization") + "|" + r.Header.Get("Accept")))
+		}))
+		defer upstream.Close()
+		proxy := proxyServer(http_proxy.NewRequest("GET", upstream.URL).SetJWTAuthToken("upstream-token"))
+		defer proxy.Close()
+
+		req, _ := http.NewRequest("GET", proxy.URL, nil)
+		req.Header.Set("Authorization", "Bearer caller-token")
+		req.Header.Set("Accept", "text/plain")
+		resp, _ := http.DefaultClient.Do(req)
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if string(body) != "Bearer upstream-token|text/plain" {
+			t.Errorf("expected the upstream authorization and the incoming accept, got %q", body)
+		}
+	})
+
+	t.Run("Request bodies are streamed to the upstream", func(t *testing.T) {
+		firstChunk := make(chan string, 1)
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			buffer := make([]byte, 5)
+			io.ReadFull(r.Body, buffer)
+			firstChunk <- string(buffer)
+			io.Copy(io.Discard, r.Body)
+		}))
+		defer upstream.Close()
+		proxy := proxyServer(http_proxy.NewRequest("GET", upstream.URL))
+		defer proxy.Close()
+
+		bodyReader, bodyWriter := io.Pipe()
+		done := make(chan error, 1)
+		go func() {
+			resp, err := http.Post(proxy.URL, "text/plain", bodyReader)
+			if err == nil {
+				resp.Body.Close()
+			}
+			done <- err
+		}()
+		bodyWriter.Write([]byte("first"))
+
+		select {
+		case chunk := <-firstChunk:
+			if chunk != "first" {
+				t.Errorf("expected chunk %q, got %q", "first", chunk)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected the first chunk to reach the upstream before the body ends")
+		}
+		bodyWriter.Write([]byte("second"))
+		bodyWriter.Close()
+		if err := <-done; err != nil {
+			t.Errorf("expected no error, got %v", err)
+		}
+	})
+
+	t.Run("Response bodies are streamed to the caller", func(t *testing.T) {
+		release := make(chan struct{})
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("first"))
+			w.(http.Flusher).Flush()
+			<-release
+			w.Write([]byte("second"))
+		}))
+		defer upstream.Close()
+		proxy := proxyServer(http_proxy.NewRequest("GET", upstream.URL))
+		defer proxy.Close()
+		defer close(release)
+
+		resp, err := http.Get(proxy.URL)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		defer resp.Body.Close()
+		chunk := make([]byte, 5)
+		read := make(chan error, 1)
+		go func() {
+			_, readErr := io.ReadFull(resp.Body, chunk)
+			read <- readErr
+		}()
+		select {
+		case readErr := <-read:
+			if readErr != nil || string(chunk) != "first" {
+				t.Errorf("expected chunk %q, got %q and %v", "first", chunk, readErr)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected the first chunk to reach the caller before the body ends")
+		}
+	})
+
+	t.Run("Interceptors transform or reject upstream responses", func(t *testing.T) {
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/broken" {
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+			w.Write([]byte(`{"internal":"details"}`))
+		}))
+		defer upstream.Close()
+		errRejected := errors.New("upstream failed")
+		upstreamRequest := http_proxy.NewRequest("GET", upstream.URL).
+			WithStatusCodeInterceptor(http.StatusInternalServerError, func(parsedBody map[string]interface{}, response *http.Response) error {
+				return errRejected
+			}).
+			WithGenericInterceptor(func(parsedBody map[string]interface{}, response *http.Response) error {
+				response.Header.Set("X-Fields", "internal")
+				return nil
+			})
+		handler := http_proxy.NewReverseProxy(upstreamRequest).
+			WithErrorHandler(func(w http.ResponseWriter, r *http.Request, err error) {
+				if !errors.Is(err, errRejected) {
+					t.Errorf("expected error %v, got %v", errRejected, err)
+				}
+				w.WriteHeader(http.StatusServiceUnavailable)
+			})
+		proxy := httptest.NewServer(handler)
+		defer proxy.Close()
+
+		resp, _ := http.Get(proxy.URL + "/ok")
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.Header.Get("X-Fields") != "internal" || string(body) != `{"internal":"details"}` {
+			t.Errorf("expected the transformed response, got %v %q", resp.Header, body)
+		}
+
+		resp, _ = http.Get(proxy.URL + "/broken")
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("expected status %d, got %d", http.StatusServiceUnavailable, resp.StatusCode)
+		}
+	})
+
+	t.Run("Interceptors leave the whole body to the caller", func(t *testing.T) {
+		bodies := map[string]string{
+			"/text": strings.Repeat("not json ", 5000),
+			"/json": `{"padding":"` + strings.Repeat("a", 241) + `"}` + "\n",
+		}
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(bodies[r.URL.Path]))
+		}))
+		defer upstream.Close()
+		upstreamRequest := http_proxy.NewRequest("GET", upstream.URL).
+			WithGenericInterceptor(func(parsedBody map[string]interface{}, response *http.Response) error {
+				return nil
+			})
+		proxy := proxyServer(upstreamRequest)
+		defer proxy.Close()
+
+		for path, expectedBody := range bodies {
+			resp, err := http.Get(proxy.URL + path)
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			body, readErr := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if readErr != nil || string(body) != expectedBody {
+				t.Errorf("expected the %d bytes of %s, got %d bytes and %v", len(expectedBody), path, len(body), readErr)
+			}
+		}
+	})
+
+	t.Run("Failures are reported as gateway errors", func(t *testing.T) {
+		unreachable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		unreachable.Close()
+		slow := slowServer(time.Second)
+		defer slow.Close()
+		unreachableProxy := proxyServer(http_proxy.NewRequest("GET", unreachable.URL))
+		defer unreachableProxy.Close()
+		slowProxy := proxyServer(http_proxy.NewRequest("GET", slow.URL).WithTimeout(50 * time.Millisecond))
+		defer slowProxy.Close()
+
+		for proxyURL, expected := range map[string]int{unreachableProxy.URL: http.StatusBadGateway, slowProxy.URL: http.StatusGatewayTimeout} {
+			resp, err := http.Get(proxyURL)
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != expected {
+				t.Errorf("expected status %d, got %d", expected, resp.StatusCode)
+			}
+		}
+	})
+
+	t.Run("Redirects and trailers are passed to the caller", func(t *testing.T) {
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/old" {
+				http.Redirect(w, r, "/new", http.StatusFound)
+				return
+			}
+			w.Header().Set("Trailer", "X-Checksum")
+			w.Write([]byte("content"))
+			w.Header().Set("X-Checksum", "abc")
+		}))
+		defer upstream.Close()
+		proxy := proxyServer(http_proxy.NewRequest("GET", upstream.URL))
+		defer proxy.Close()
+		client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+
+		resp, _ := client.Get(proxy.URL + "/old")
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != "/new" {
+			t.Errorf("expected the redirect, got %d %v", resp.StatusCode, resp.Header)
+		}
+
+		resp, _ = client.Get(proxy.URL + "/content")
+		io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.Trailer.Get("X-Checksum") != "abc" {
+			t.Errorf("expected trailer %q, got %v", "abc", resp.Trailer)
+		}
+	})
+
+	t.Run("TE trailers is forwarded and the cache status is not", func(t *testing.T) {
+		var receivedTE []string
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			receivedTE = r.Header.Values("Te")
+			w.Header().Set("Cache-Control", "max-age=60")
+		}))
+		defer upstream.Close()
+		cache := http_proxy.NewResponseCache(http_proxy.NewMemoryCacheStorage(1 << 20))
+		proxy := proxyServer(http_proxy.NewRequest("GET", upstream.URL).WithCache(cache))
+		defer proxy.Close()
+
+		req, _ := http.NewRequest("GET", proxy.URL, nil)
+		req.Header.Set("Te", "trailers, deflate;q=0.5")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		resp.Body.Close()
+
+		if len(receivedTE) != 1 || receivedTE[0] != "trailers" {
+			t.Errorf("expected TE %q, got %v", "trailers", receivedTE)
+		}
+		if status := resp.Header.Get(http_proxy.CACHE_STATUS_HEADER); status != "" {
+			t.Errorf("expected no cache status header, got %q", status)
+		}
+	})
+
+	t.Run("Incoming trace context is the parent of the forwarded send", func(t *testing.T) {
+		upstream := traceHeadersServer()
+		defer upstream.Close()
+		tracer := &recordingTracer{}
+		proxy := proxyServer(http_proxy.NewRequest("GET", upstream.URL).WithTracer(tracer))
+		defer proxy.Close()
+
+		incoming := "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+		req, _ := http.NewRequest("GET", proxy.URL, nil)
+		req.Header.Set("Traceparent", incoming)
+		resp, _ := http.DefaultClient.Do(req)
+		resp.Body.Close()
+
+		if len(tracer.spans) != 1 || tracer.spans[0].parent.Traceparent() != incoming {
+			t.Fatalf("expected a span child of %s, got %v", incoming, tracer.spans)
+		}
+		if forwarded := resp.Header.Get("X-Echo-Traceparent"); forwarded != tracer.spans[0].context.Traceparent() {
+			t.Errorf("expected traceparent %s, got %s", tracer.spans[0].context.Traceparent(), forwarded)
+		}
+	})
+}
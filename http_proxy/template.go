@@ -0,0 +1,71 @@
+package http_proxy
+
+import (
+	"fmt"
+	"net/url"
+	"sync"
+)
+
+// A base request from which many concrete requests are derived.
+// Derived requests inherit a copy of the headers, body, context,
+// authorization and interceptors of the base request
+type RequestTemplate struct {
+	base *proxiedRequestImpl
+}
+
+// Creates a template from a snapshot of the provided request. Later changes
+// to the request are not reflected in the template
+func NewTemplate(base ProxiedRequest) *RequestTemplate {
+	return &RequestTemplate{base: base.Clone().(*proxiedRequestImpl)}
+}
+
+// Derives a new request identical to the base one
+func (template *RequestTemplate) Derive() ProxiedRequest {
+	return template.base.Clone()
+}
+
+// Derives a new request with the provided method, resolving path
+// against the URL of the base request
+func (template *RequestTemplate) DerivePath(method string, path string) ProxiedRequest {
+	derived := template.base.Clone().(*proxiedRequestImpl)
+	derived.method = method
+	if methodErr := validateMethod(method); methodErr != nil {
+		derived.recordError("DerivePath", methodErr)
+	}
+	baseURL, parseErr := url.Parse(template.base.url)
+	if parseErr == nil {
+		var reference *url.URL
+		if reference, parseErr = url.Parse(path); parseErr == nil {
+			derived.url = baseURL.ResolveReference(reference).String()
+		}
+	}
+	if parseErr != nil {
+		derived.recordError("DerivePath", fmt.Errorf("%w: %w", ErrInvalidURL, parseErr))
+	}
+	return derived
+}
+
+func (requestIntent *proxiedRequestImpl) Clone() ProxiedRequest {
+	requestIntent.mutex.Lock()
+	defer requestIntent.mutex.Unlock()
+	clone := *requestIntent
+	clone.mutex = &sync.Mutex{}
+	clone.headers = map[string][]string{}
+	for key, values := range requestIntent.headers {
+		clone.headers[key] = append([]string{}, values...)
+	}
+	clone.statusCodeInterceptors = map[int][]errorHandler{}
+	for statusCode, handlers := range requestIntent.statusCodeInterceptors {
+		clone.statusCodeInterceptors[statusCode] = append([]errorHandler{}, handlers...)
+	}
+	clone.requestErrors = append([]error{}, requestIntent.requestErrors...)
+	clone.genericInterceptors = append([]errorHandler{}, requestIntent.genericInterceptors...)
+	if body, bodyErr := requestIntent.resolveBody(); bodyErr == nil {
+		clone.replayableBody = body
+	} else {
+		clone.recordError("Clone", bodyErr)
+	}
+	clone.underlyingRequest = nil
+	clone.attempts = 0
+	return &clone
+}
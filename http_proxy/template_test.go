@@ -0,0 +1,133 @@
+package http_proxy_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	http_proxy "github.com/AndreaCostanzo1/http-proxy/http_proxy"
+)
+
+func TestClone(t *testing.T) {
+	t.Run("Clone copies headers, body, context and interceptors", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			w.Header().Set("X-Echo-Header", r.Header.Get("X-Custom-Header"))
+			w.Header().Set("X-Echo-Body", string(body))
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer server.Close()
+
+		interceptorCalls := 0
+		ctx := context.WithValue(context.Background(), "key", "value")
+		original := http_proxy.NewRequest("POST", server.URL).
+			SetHeader("X-Custom-Header", "original").
+			SetBody(strings.NewReader("test body")).
+			WithContext(ctx).
+			WithGenericInterceptor(func(body map[string]interface{}, response *http.Response) error {
+				interceptorCalls++
+				return nil
+			})
+		clone := original.Clone().SetHeader("X-Custom-Header", "clone")
+
+		originalResp, originalErr := original.Send()
+		cloneResp, cloneErr := clone.Send()
+
+		if originalErr != nil || cloneErr != nil {
+			t.Fatalf("expected no errors, got %v and %v", originalErr, cloneErr)
+		}
+		if value := originalResp.Header.Get("X-Echo-Header"); value != "original" {
+			t.Errorf("expected original header to be unchanged, got '%s'", value)
+		}
+		if value := cloneResp.Header.Get("X-Echo-Header"); value != "clone" {
+			t.Errorf("expected clone header 'clone', got '%s'", value)
+		}
+		if body := cloneResp.Header.Get("X-Echo-Body"); body != "test body" {
+			t.Errorf("expected clone body 'test body', got '%s'", body)
+		}
+		if cloneResp.Request.Context().Value("key") != "value" {
+			t.Errorf("expected clone to keep the context")
+		}
+		if interceptorCalls != 2 {
+			t.Errorf("expected interceptor to be called twice, got %d", interceptorCalls)
+		}
+	})
+
+	t.Run("Clone can be modified after the underlying request was generated", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if value := r.Header.Get("X-Custom-Header"); value != "value" {
+				t.Errorf("expected header value 'value', got '%s'", value)
+			}
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer server.Close()
+
+		original := http_proxy.NewRequest("GET", server.URL)
+		original.UnderlyingRequest()
+		resp, err := original.Clone().SetHeader("X-Custom-Header", "value").Send()
+
+		if err != nil {
+			t.Errorf("expected no error, got %v", err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("expected status code 200, got %d", resp.StatusCode)
+		}
+	})
+}
+
+func TestRequestTemplate(t *testing.T) {
+	t.Run("DerivePath resolves paths against the base URL", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Echo-Path", r.URL.Path)
+			w.Header().Set("X-Echo-Method", r.Method)
+			w.Header().Set("X-Echo-Header", r.Header.Get("Authorization"))
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer server.Close()
+
+		base := http_proxy.NewRequest("GET", server.URL+"/api/").SetJWTAuthToken("token")
+		base.UnderlyingRequest()
+		template := http_proxy.NewTemplate(base)
+
+		for _, path := range []string{"users", "orders"} {
+			resp, err := template.DerivePath("DELETE", path).Send()
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if value := resp.Header.Get("X-Echo-Path"); value != "/api/"+path {
+				t.Errorf("expected path '/api/%s', got '%s'", path, value)
+			}
+			if value := resp.Header.Get("X-Echo-Method"); value != "DELETE" {
+				t.Errorf("expected method 'DELETE', got '%s'", value)
+			}
+			if value := resp.Header.Get("X-Echo-Header"); value != "Bearer token" {
+				t.Errorf("expected Authorization header 'Bearer token', got '%s'", value)
+			}
+		}
+	})
+
+	t.Run("Derive creates independent requests", func(t *testing.T) {
+		template := http_proxy.NewTemplate(http_proxy.NewRequest("GET", "http://localhost").SetHeader("X-Custom-Header", "base"))
+		first, _ := template.Derive().SetHeader("X-Custom-Header", "first").UnderlyingRequest()
+		second, _ := template.Derive().UnderlyingRequest()
+
+		if value := first.Header.Get("X-Custom-Header"); value != "first" {
+			t.Errorf("expected header value 'first', got '%s'", value)
+		}
+		if value := second.Header.Get("X-Custom-Header"); value != "base" {
+			t.Errorf("expected header value 'base', got '%s'", value)
+		}
+	})
+
+	t.Run("DerivePath with invalid path", func(t *testing.T) {
+		template := http_proxy.NewTemplate(http_proxy.NewRequest("GET", "http://localhost"))
+		_, err := template.DerivePath("GET", "%zz").Send()
+
+		if err == nil {
+			t.Errorf("expected an error due to invalid path, got none")
+		}
+	})
+}
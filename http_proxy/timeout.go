@@ -0,0 +1,130 @@
+package http_proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// Returned, wrapped, when a send exceeds one of its timeouts. Cancellations
+// of the context set with WithContext are reported as context.Canceled instead
+var ErrTimeout = errors.New("request timed out")
+
+var ErrBudgetExhausted = fmt.Errorf("%w: time budget exhausted", ErrTimeout)
+
+// Limits applied to each send of a request. Zero values disable the limit.
+// Connect, TLSHandshake and ResponseHeader are applied only when the client
+// transport is an *http.Transport
+type Timeouts struct {
+	// Maximum time to establish the TCP connection, or to wait for one when
+	// the transport limits the connections per host
+	Connect time.Duration
+	// Maximum time to complete the TLS handshake
+	TLSHandshake time.Duration
+	// Maximum time to wait for the response headers after the request is written
+	ResponseHeader time.Duration
+	// Maximum time for the whole send, redirects and response validation included
+	Total time.Duration
+}
+
+func (timeouts Timeouts) hasTransportTimeouts() bool {
+	return timeouts.Connect > 0 || timeouts.TLSHandshake > 0 || timeouts.ResponseHeader > 0
+}
+
+// A deadline shared by multiple sends, e.g. the attempts of a retry loop
+// or the requests needed to complete a single operation
+type Budget struct {
+	deadline time.Time
+}
+
+// Creates a budget expiring after total has elapsed
+func NewBudget(total time.Duration) *Budget {
+	return &Budget{deadline: time.Now().Add(total)}
+}
+
+// Returns the time left before the budget expires
+func (budget *Budget) Remaining() time.Duration {
+	return time.Until(budget.deadline)
+}
+
+// Reports whether the budget has expired
+func (budget *Budget) Exhausted() bool {
+	return budget.Remaining() <= 0
+}
+
+func (requestIntent *proxiedRequestImpl) WithTimeout(timeout time.Duration) ProxiedRequest {
+	requestIntent.mutex.Lock()
+	defer requestIntent.mutex.Unlock()
+	requestIntent.options.timeouts.Total = timeout
+	return requestIntent
+}
+
+func (requestIntent *proxiedRequestImpl) WithTimeouts(timeouts Timeouts) ProxiedRequest {
+	requestIntent.mutex.Lock()
+	defer requestIntent.mutex.Unlock()
+	requestIntent.options.timeouts = timeouts
+	return requestIntent
+}
+
+func (requestIntent *proxiedRequestImpl) WithBudget(budget *Budget) ProxiedRequest {
+	requestIntent.mutex.Lock()
+	defer requestIntent.mutex.Unlock()
+	requestIntent.options.budget = budget
+	return requestIntent
+}
+
+// Derives the context of a send, bounded by the total timeout and the budget
+// and carrying the transport timeouts
+func (options sendOptions) deadlineContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if options.timeouts.hasTransportTimeouts() {
+		ctx = context.WithValue(ctx, transportTimeoutsKey{}, options.timeouts)
+	}
+	cancels := []context.CancelFunc{}
+	if options.timeouts.Total > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, options.timeouts.Total,
+			fmt.Errorf("%w after %s: %w", ErrTimeout, options.timeouts.Total, context.DeadlineExceeded))
+		cancels = append(cancels, cancel)
+	}
+	if options.budget != nil {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadlineCause(ctx, options.budget.deadline,
+			fmt.Errorf("%w: %w", ErrBudgetExhausted, context.DeadlineExceeded))
+		cancels = append(cancels, cancel)
+	}
+	return ctx, func() {
+		for _, cancel := range cancels {
+			cancel()
+		}
+	}
+}
+
+// Wraps errors caused by an expired timeout so that they match ErrTimeout.
+// Transport timeouts match it only if the caller context is still alive
+func timeoutError(callerCtx context.Context, ctx context.Context, err error) error {
+	if err == nil || errors.Is(err, ErrTimeout) {
+		return err
+	}
+	if cause := context.Cause(ctx); cause != nil && errors.Is(cause, ErrTimeout) {
+		return fmt.Errorf("%w: %w", cause, err)
+	}
+	var netErr net.Error
+	if callerCtx.Err() == nil && errors.As(err, &netErr) && netErr.Timeout() {
+		return fmt.Errorf("%w: %w", ErrTimeout, err)
+	}
+	return err
+}
+
+// Releases the resources of the send context once the response body is closed
+type cancelOnCloseBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (body *cancelOnCloseBody) Close() error {
+	defer body.cancel()
+	return body.ReadCloser.Close()
+}
@@ -0,0 +1,249 @@
+package http_proxy_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	http_proxy "github.com/AndreaCostanzo1/http-proxy/http_proxy"
+)
+
+func slowServer(delay time.Duration) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+}
+
+func TestWithTimeout(t *testing.T) {
+	t.Run("WithTimeout fails slow sends with ErrTimeout", func(t *testing.T) {
+		server := slowServer(time.Second)
+		defer server.Close()
+
+		resp, err := http_proxy.NewRequest("GET", server.URL).WithTimeout(50 * time.Millisecond).Send()
+
+		if !errors.Is(err, http_proxy.ErrTimeout) {
+			t.Errorf("expected ErrTimeout, got %v", err)
+		}
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expected error to wrap context.DeadlineExceeded, got %v", err)
+		}
+		if resp != nil {
+			t.Errorf("expected no response, got %v", resp)
+		}
+	})
+
+	t.Run("WithTimeout doesn't affect fast sends", func(t *testing.T) {
+		server := slowServer(0)
+		defer server.Close()
+
+		resp, err := http_proxy.NewRequest("GET", server.URL).WithTimeout(time.Second).Send()
+
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("expected status code 200, got %d", resp.StatusCode)
+		}
+		resp.Body.Close()
+	})
+
+	t.Run("Caller cancellation is not reported as a timeout", func(t *testing.T) {
+		server := slowServer(time.Second)
+		defer server.Close()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(50*time.Millisecond, cancel)
+		_, err := http_proxy.NewRequest("GET", server.URL).WithContext(ctx).WithTimeout(time.Second).Send()
+
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("expected context.Canceled, got %v", err)
+		}
+		if errors.Is(err, http_proxy.ErrTimeout) {
+			t.Errorf("expected cancellation not to match ErrTimeout, got %v", err)
+		}
+	})
+}
+
+func TestWithTimeouts(t *testing.T) {
+	t.Run("ResponseHeader timeout fails slow responses with ErrTimeout", func(t *testing.T) {
+		server := slowServer(time.Second)
+		defer server.Close()
+
+		_, err := http_proxy.NewRequest("GET", server.URL).
+			WithTimeouts(http_proxy.Timeouts{ResponseHeader: 50 * time.Millisecond, Connect: time.Second}).
+			Send()
+
+		if !errors.Is(err, http_proxy.ErrTimeout) {
+			t.Errorf("expected ErrTimeout, got %v", err)
+		}
+	})
+
+	t.Run("Transport timeouts are applied to the custom client transport", func(t *testing.T) {
+		server := slowServer(time.Second)
+		defer server.Close()
+
+		client := &http.Client{Transport: &http.Transport{}}
+		start := time.Now()
+		_, err := http_proxy.NewRequest("GET", server.URL).
+			WithHTTPClient(client).
+			WithTimeouts(http_proxy.Timeouts{ResponseHeader: 50 * time.Millisecond}).
+			Send()
+
+		if !errors.Is(err, http_proxy.ErrTimeout) {
+			t.Errorf("expected ErrTimeout, got %v", err)
+		}
+		if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+			t.Errorf("expected send to time out early, took %s", elapsed)
+		}
+	})
+	t.Run("Connect timeout wraps the dialer of the custom client transport", func(t *testing.T) {
+		var dials atomic.Int32
+		client := &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network string, address string) (net.Conn, error) {
+				dials.Add(1)
+				<-ctx.Done()
+				return nil, ctx.Err()
+			},
+		}}
+		start := time.Now()
+		_, err := http_proxy.NewRequest("GET", "http://example.com").
+			WithHTTPClient(client).
+			WithTimeouts(http_proxy.Timeouts{Connect: 50 * time.Millisecond}).
+			Send()
+
+		if !errors.Is(err, http_proxy.ErrTimeout) {
+			t.Errorf("expected ErrTimeout, got %v", err)
+		}
+		if dials.Load() != 1 {
+			t.Errorf("expected the custom dialer to be called once, got %d", dials.Load())
+		}
+		if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+			t.Errorf("expected send to time out early, took %s", elapsed)
+		}
+	})
+
+	t.Run("TLS handshake timeout fails stalled handshakes with ErrTimeout", func(t *testing.T) {
+		listener, _ := net.Listen("tcp", "127.0.0.1:0")
+		defer listener.Close()
+		go func() {
+			for {
+				connection, acceptErr := listener.Accept()
+				if acceptErr != nil {
+					return
+				}
+				defer connection.Close()
+			}
+		}()
+
+		start := time.Now()
+		_, err := http_proxy.NewRequest("GET", "https://"+listener.Addr().String()).
+			WithTimeouts(http_proxy.Timeouts{TLSHandshake: 50 * time.Millisecond}).
+			Send()
+
+		if !errors.Is(err, http_proxy.ErrTimeout) {
+			t.Errorf("expected ErrTimeout, got %v", err)
+		}
+		if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+			t.Errorf("expected send to time out early, took %s", elapsed)
+		}
+	})
+
+	t.Run("Sends with different timeouts share the connections", func(t *testing.T) {
+		server := slowServer(0)
+		defer server.Close()
+
+		client := &http.Client{Transport: &http.Transport{}}
+		reused := false
+		for i := 1; i <= 2; i++ {
+			trace := &httptrace.ClientTrace{GotConn: func(info httptrace.GotConnInfo) { reused = info.Reused }}
+			resp, err := http_proxy.NewRequest("GET", server.URL).
+				WithHTTPClient(client).
+				WithContext(httptrace.WithClientTrace(context.Background(), trace)).
+				WithTimeouts(http_proxy.Timeouts{ResponseHeader: time.Duration(i) * time.Second}).
+				Send()
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			io.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+
+		if !reused {
+			t.Errorf("expected the second send to reuse the connection of the first")
+		}
+	})
+
+	t.Run("Transports used with timeouts can be garbage collected", func(t *testing.T) {
+		server := slowServer(0)
+		defer server.Close()
+
+		collected := make(chan struct{})
+		func() {
+			// The transport references itself, so the finalizer is set on an
+			// object that only its dialer references
+			marker := new(int)
+			runtime.SetFinalizer(marker, func(*int) { close(collected) })
+			transport := &http.Transport{DialContext: func(ctx context.Context, network string, address string) (net.Conn, error) {
+				*marker++
+				return (&net.Dialer{}).DialContext(ctx, network, address)
+			}}
+			resp, err := http_proxy.NewRequest("GET", server.URL).
+				WithHTTPClient(&http.Client{Transport: transport}).
+				WithTimeouts(http_proxy.Timeouts{Connect: time.Second, ResponseHeader: time.Second}).
+				Send()
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			io.ReadAll(resp.Body)
+			resp.Body.Close()
+			transport.CloseIdleConnections()
+		}()
+
+		for i := 0; i < 50; i++ {
+			runtime.GC()
+			select {
+			case <-collected:
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+		t.Errorf("expected the transport to be garbage collected")
+	})
+}
+
+func TestWithBudget(t *testing.T) {
+	t.Run("Budget is shared across sends", func(t *testing.T) {
+		server := slowServer(100 * time.Millisecond)
+		defer server.Close()
+
+		budget := http_proxy.NewBudget(150 * time.Millisecond)
+		req := http_proxy.NewRequest("GET", server.URL).WithBudget(budget)
+		_, firstErr := req.Send()
+		_, secondErr := req.Send()
+
+		if firstErr != nil {
+			t.Errorf("expected first send to succeed, got %v", firstErr)
+		}
+		if !errors.Is(secondErr, http_proxy.ErrBudgetExhausted) {
+			t.Errorf("expected ErrBudgetExhausted, got %v", secondErr)
+		}
+		if !errors.Is(secondErr, http_proxy.ErrTimeout) {
+			t.Errorf("expected budget exhaustion to match ErrTimeout, got %v", secondErr)
+		}
+		if !budget.Exhausted() {
+			t.Errorf("expected budget to be exhausted, remaining %s", budget.Remaining())
+		}
+	})
+}
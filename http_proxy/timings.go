@@ -0,0 +1,167 @@
+package http_proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"log/slog"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// Durations of the phases of a send, captured when the request has WithTimings.
+// Phases that didn't happen, like the connection setup on a reused
+// connection, are zero
+type Timings struct {
+	// Resolution of the host name
+	DNSLookup time.Duration
+	// Establishment of the TCP connection
+	Connect time.Duration
+	// TLS handshake on the established connection
+	TLSHandshake time.Duration
+	// From the start of the send to the first byte of the response
+	TimeToFirstByte time.Duration
+	// From the first byte of the response to the end of the body. It is zero
+	// until the body is read to the end or closed
+	BodyRead time.Duration
+	// Whether the connection was taken from the pool of idle connections
+	ConnectionReused bool
+	// How long the reused connection was idle in the pool
+	ConnectionIdleTime time.Duration
+	// Address of the server the request was sent to
+	RemoteAddress string
+}
+
+type timingsKey struct{}
+
+func (requestIntent *proxiedRequestImpl) WithTimings() ProxiedRequest {
+	requestIntent.mutex.Lock()
+	defer requestIntent.mutex.Unlock()
+	requestIntent.options.captureTimings = true
+	return requestIntent
+}
+
+// Returns the timings of the send that produced the response, if the
+// request has WithTimings. It is available to interceptors and loggers
+func TimingsFromResponse(response *http.Response) (Timings, bool) {
+	if response == nil || response.Request == nil {
+		return Timings{}, false
+	}
+	capture, isFound := response.Request.Context().Value(timingsKey{}).(*timingsCapture)
+	if !isFound {
+		return Timings{}, false
+	}
+	return capture.timings(), true
+}
+
+// Instants of the phases of a send, set by the hooks of an httptrace.ClientTrace.
+// When the send is hedged the attempts share it, and the first instant of each
+// phase is kept
+type timingsCapture struct {
+	mutex             sync.Mutex
+	start             time.Time
+	dnsStart          time.Time
+	dnsDone           time.Time
+	connectStart      time.Time
+	connectDone       time.Time
+	tlsStart          time.Time
+	tlsDone           time.Time
+	firstByte         time.Time
+	end               time.Time
+	connectionReused  bool
+	connectionIdle    time.Duration
+	remoteAddress     string
+	hasConnectionInfo bool
+}
+
+// Returns a context capturing the timings of the send when they are enabled
+func (options sendOptions) timingsContext(ctx context.Context, startTime time.Time) context.Context {
+	if !options.captureTimings {
+		return ctx
+	}
+	capture := &timingsCapture{start: startTime}
+	return httptrace.WithClientTrace(context.WithValue(ctx, timingsKey{}, capture), capture.trace())
+}
+
+func (capture *timingsCapture) trace() *httptrace.ClientTrace {
+	set := func(instant *time.Time) {
+		capture.mutex.Lock()
+		defer capture.mutex.Unlock()
+		if instant.IsZero() {
+			*instant = time.Now()
+		}
+	}
+	return &httptrace.ClientTrace{
+		DNSStart:             func(httptrace.DNSStartInfo) { set(&capture.dnsStart) },
+		DNSDone:              func(httptrace.DNSDoneInfo) { set(&capture.dnsDone) },
+		ConnectStart:         func(string, string) { set(&capture.connectStart) },
+		ConnectDone:          func(string, string, error) { set(&capture.connectDone) },
+		TLSHandshakeStart:    func() { set(&capture.tlsStart) },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { set(&capture.tlsDone) },
+		GotFirstResponseByte: func() { set(&capture.firstByte) },
+		GotConn: func(info httptrace.GotConnInfo) {
+			capture.mutex.Lock()
+			defer capture.mutex.Unlock()
+			if !capture.hasConnectionInfo {
+				capture.hasConnectionInfo = true
+				capture.connectionReused = info.Reused
+				capture.connectionIdle = info.IdleTime
+				capture.remoteAddress = info.Conn.RemoteAddr().String()
+			}
+		},
+	}
+}
+
+func (capture *timingsCapture) finish() {
+	capture.mutex.Lock()
+	defer capture.mutex.Unlock()
+	if capture.end.IsZero() {
+		capture.end = time.Now()
+	}
+}
+
+func (capture *timingsCapture) timings() Timings {
+	capture.mutex.Lock()
+	defer capture.mutex.Unlock()
+	return Timings{
+		DNSLookup:          elapsed(capture.dnsStart, capture.dnsDone),
+		Connect:            elapsed(capture.connectStart, capture.connectDone),
+		TLSHandshake:       elapsed(capture.tlsStart, capture.tlsDone),
+		TimeToFirstByte:    elapsed(capture.start, capture.firstByte),
+		BodyRead:           elapsed(capture.firstByte, capture.end),
+		ConnectionReused:   capture.connectionReused,
+		ConnectionIdleTime: capture.connectionIdle,
+		RemoteAddress:      capture.remoteAddress,
+	}
+}
+
+// Attaches the timings captured in ctx to the response and measures the
+// reading of its body
+func attachTimings(ctx context.Context, sentRequest *http.Request, response *http.Response) {
+	capture, isFound := ctx.Value(timingsKey{}).(*timingsCapture)
+	if !isFound {
+		return
+	}
+	if response.Request == nil || response.Request.Context().Value(timingsKey{}) != capture {
+		response.Request = sentRequest
+	}
+	response.Body = &countingBody{ReadCloser: response.Body, onDone: func(int64) { capture.finish() }}
+}
+
+func elapsed(start time.Time, end time.Time) time.Duration {
+	if start.IsZero() || end.IsZero() || end.Before(start) {
+		return 0
+	}
+	return end.Sub(start)
+}
+
+func timingsGroup(timings Timings) slog.Attr {
+	return slog.Group("timings",
+		slog.Duration("dns", timings.DNSLookup),
+		slog.Duration("connect", timings.Connect),
+		slog.Duration("tls", timings.TLSHandshake),
+		slog.Duration("ttfb", timings.TimeToFirstByte),
+		slog.Bool("connection_reused", timings.ConnectionReused),
+	)
+}
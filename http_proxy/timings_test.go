@@ -0,0 +1,153 @@
+package http_proxy_test
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	http_proxy "github.com/AndreaCostanzo1/http-proxy/http_proxy"
+)
+
+func TestWithTimings(t *testing.T) {
+	t.Run("New connections report the connection setup", func(t *testing.T) {
+		server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(50 * time.Millisecond)
+			w.Write([]byte("ok"))
+		}))
+		defer server.Close()
+		// A host name makes the send resolve it, the test certificate is for example.com
+		localhostURL := strings.Replace(server.URL, "127.0.0.1", "localhost", 1)
+		client := server.Client()
+		client.Transport.(*http.Transport).TLSClientConfig.ServerName = "example.com"
+
+		req := http_proxy.NewRequest("GET", localhostURL).WithHTTPClient(client).WithTimings()
+		resp, _ := sendAndRead(t, req)
+
+		timings, isFound := http_proxy.TimingsFromResponse(resp)
+		if !isFound {
+			t.Fatalf("expected timings on the response")
+		}
+		if timings.ConnectionReused {
+			t.Errorf("expected a new connection")
+		}
+		if timings.DNSLookup <= 0 || timings.Connect <= 0 || timings.TLSHandshake <= 0 {
+			t.Errorf("expected dns, connect and tls durations, got %+v", timings)
+		}
+		if timings.TimeToFirstByte < 50*time.Millisecond {
+			t.Errorf("expected a time to first byte of at least 50ms, got %s", timings.TimeToFirstByte)
+		}
+		if timings.RemoteAddress != server.Listener.Addr().String() {
+			t.Errorf("expected remote address %s, got %s", server.Listener.Addr(), timings.RemoteAddress)
+		}
+	})
+
+	t.Run("Reused connections skip the connection setup", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("ok"))
+		}))
+		defer server.Close()
+
+		req := http_proxy.NewRequest("GET", server.URL).WithHTTPClient(server.Client()).WithTimings()
+		sendAndRead(t, req)
+		resp, _ := sendAndRead(t, req)
+
+		timings, _ := http_proxy.TimingsFromResponse(resp)
+		if !timings.ConnectionReused {
+			t.Errorf("expected a reused connection")
+		}
+		if timings.DNSLookup != 0 || timings.Connect != 0 || timings.TLSHandshake != 0 {
+			t.Errorf("expected no connection setup, got %+v", timings)
+		}
+	})
+
+	t.Run("Body read is measured once the body is consumed", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("first"))
+			w.(http.Flusher).Flush()
+			time.Sleep(50 * time.Millisecond)
+			w.Write([]byte("second"))
+		}))
+		defer server.Close()
+
+		resp, err := http_proxy.NewRequest("GET", server.URL).WithTimings().Send()
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if timings, _ := http_proxy.TimingsFromResponse(resp); timings.BodyRead != 0 {
+			t.Errorf("expected no body read duration before reading, got %s", timings.BodyRead)
+		}
+		io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if timings, _ := http_proxy.TimingsFromResponse(resp); timings.BodyRead < 50*time.Millisecond {
+			t.Errorf("expected a body read duration of at least 50ms, got %s", timings.BodyRead)
+		}
+	})
+
+	t.Run("Body read is measured when interceptors parse the body", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("first"))
+			w.(http.Flusher).Flush()
+			time.Sleep(50 * time.Millisecond)
+			w.Write([]byte("second"))
+		}))
+		defer server.Close()
+
+		resp, body := sendAndRead(t, http_proxy.NewRequest("GET", server.URL).
+			WithTimings().
+			WithGenericInterceptor(func(parsedBody map[string]interface{}, response *http.Response) error {
+				return nil
+			}))
+
+		if body != "firstsecond" {
+			t.Errorf("expected body %q, got %q", "firstsecond", body)
+		}
+		if timings, _ := http_proxy.TimingsFromResponse(resp); timings.BodyRead < 50*time.Millisecond {
+			t.Errorf("expected a body read duration of at least 50ms, got %s", timings.BodyRead)
+		}
+	})
+
+	t.Run("Timings are available to interceptors and loggers", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"ok":true}`))
+		}))
+		defer server.Close()
+		logger, events := jsonLogger(slog.LevelInfo)
+
+		interceptorSawTimings := false
+		req := http_proxy.NewRequest("GET", server.URL).
+			WithTimings().
+			WithLogger(http_proxy.NewRequestLogger(logger)).
+			WithGenericInterceptor(func(parsedBody map[string]interface{}, response *http.Response) error {
+				_, interceptorSawTimings = http_proxy.TimingsFromResponse(response)
+				return nil
+			})
+		sendAndRead(t, req)
+
+		if !interceptorSawTimings {
+			t.Errorf("expected the interceptor to see the timings")
+		}
+		logged := events()
+		timings, isMap := logged[len(logged)-1]["timings"].(map[string]any)
+		if !isMap || timings["connection_reused"] != false || timings["ttfb"] == nil {
+			t.Errorf("expected timings in the finish event, got %v", logged)
+		}
+	})
+
+	t.Run("Timings are not captured unless enabled", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		defer server.Close()
+
+		resp, _ := sendAndRead(t, http_proxy.NewRequest("GET", server.URL))
+
+		if _, isFound := http_proxy.TimingsFromResponse(resp); isFound {
+			t.Errorf("expected no timings")
+		}
+		if _, isFound := http_proxy.TimingsFromResponse(nil); isFound {
+			t.Errorf("expected no timings for a nil response")
+		}
+	})
+}
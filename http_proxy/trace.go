@@ -0,0 +1,205 @@
+package http_proxy
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+var ErrInvalidTraceparent = errors.New("invalid traceparent")
+
+const (
+	TRACEPARENT_HEADER = "Traceparent"
+	TRACESTATE_HEADER  = "Tracestate"
+	BAGGAGE_HEADER     = "Baggage"
+)
+
+// Attribute names passed to a Tracer, following the OpenTelemetry semantic conventions
+const (
+	ATTRIBUTE_HTTP_METHOD = "http.request.method"
+	ATTRIBUTE_URL         = "url.full"
+	ATTRIBUTE_SERVER      = "server.address"
+	ATTRIBUTE_ROUTE       = "url.template"
+	ATTRIBUTE_STATUS_CODE = "http.response.status_code"
+	ATTRIBUTE_ERROR_TYPE  = "error.type"
+)
+
+// The identity of a span as propagated by the W3C Trace Context headers
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	// Trace flags, the lowest bit reports whether the trace is sampled
+	Flags byte
+	// Vendor specific data carried by the tracestate header
+	TraceState string
+}
+
+// Reports whether both the trace and span IDs are set
+func (spanContext SpanContext) IsValid() bool {
+	return spanContext.TraceID != [16]byte{} && spanContext.SpanID != [8]byte{}
+}
+
+// Returns the value of the traceparent header identifying the span
+func (spanContext SpanContext) Traceparent() string {
+	return fmt.Sprintf("00-%s-%s-%02x", hex.EncodeToString(spanContext.TraceID[:]), hex.EncodeToString(spanContext.SpanID[:]), spanContext.Flags)
+}
+
+// Parses the value of a traceparent header
+func ParseTraceparent(traceparent string) (SpanContext, error) {
+	traceparent = strings.TrimSpace(traceparent)
+	parts := strings.Split(traceparent, "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return SpanContext{}, fmt.Errorf("%w %q", ErrInvalidTraceparent, traceparent)
+	}
+	var spanContext SpanContext
+	traceID, traceErr := hex.DecodeString(parts[1])
+	spanID, spanErr := hex.DecodeString(parts[2])
+	flags, flagsErr := hex.DecodeString(parts[3])
+	if traceErr != nil || spanErr != nil || flagsErr != nil || len(traceID) != 16 || len(spanID) != 8 || len(flags) != 1 || strings.ToLower(traceparent) != traceparent {
+		return SpanContext{}, fmt.Errorf("%w %q", ErrInvalidTraceparent, traceparent)
+	}
+	copy(spanContext.TraceID[:], traceID)
+	copy(spanContext.SpanID[:], spanID)
+	spanContext.Flags = flags[0]
+	if !spanContext.IsValid() {
+		return SpanContext{}, fmt.Errorf("%w %q: zero trace or span id", ErrInvalidTraceparent, traceparent)
+	}
+	return spanContext, nil
+}
+
+type spanContextKey struct{}
+
+type baggageKey struct{}
+
+// Returns a copy of ctx carrying the span context. Requests sent with this
+// context propagate it in the traceparent and tracestate headers
+func ContextWithSpanContext(ctx context.Context, spanContext SpanContext) context.Context {
+	return context.WithValue(ctx, spanContextKey{}, spanContext)
+}
+
+// Returns the span context carried by ctx, if any
+func SpanContextFromContext(ctx context.Context) (SpanContext, bool) {
+	spanContext, isFound := ctx.Value(spanContextKey{}).(SpanContext)
+	return spanContext, isFound && spanContext.IsValid()
+}
+
+// Returns a copy of ctx carrying the baggage members of ctx merged with the
+// provided ones. Requests sent with this context propagate it in the baggage header
+func ContextWithBaggage(ctx context.Context, members map[string]string) context.Context {
+	merged := BaggageFromContext(ctx)
+	for key, value := range members {
+		merged[key] = value
+	}
+	return context.WithValue(ctx, baggageKey{}, merged)
+}
+
+// Returns a copy of the baggage members carried by ctx
+func BaggageFromContext(ctx context.Context) map[string]string {
+	members := map[string]string{}
+	if parent, isFound := ctx.Value(baggageKey{}).(map[string]string); isFound {
+		for key, value := range parent {
+			members[key] = value
+		}
+	}
+	return members
+}
+
+// Bridges the spans of the sends to a tracing backend
+type Tracer interface {
+	// Starts a client span as child of the span carried by ctx, if any. The
+	// returned context must carry the span context of the new span, set with
+	// ContextWithSpanContext, so that it is propagated to the server
+	StartSpan(ctx context.Context, name string, attributes map[string]any) (context.Context, Span)
+}
+
+// A span started by a Tracer
+type Span interface {
+	// Adds attributes to the span
+	SetAttributes(attributes map[string]any)
+	// Ends the span, reporting the error that made the send fail, if any
+	End(err error)
+}
+
+func (requestIntent *proxiedRequestImpl) WithTracer(tracer Tracer) ProxiedRequest {
+	requestIntent.mutex.Lock()
+	defer requestIntent.mutex.Unlock()
+	requestIntent.options.tracer = tracer
+	return requestIntent
+}
+
+// Starts the span of the send when a tracer is set and injects the trace
+// context headers, unless they were set explicitly. It returns the context
+// of the send and the function ending the span
+func (options sendOptions) startSpan(ctx context.Context, request *http.Request) (context.Context, func(response *http.Response, err error)) {
+	endSpan := func(response *http.Response, err error) {}
+	if options.tracer != nil {
+		attributes := map[string]any{
+			ATTRIBUTE_HTTP_METHOD: request.Method,
+			ATTRIBUTE_URL:         urlWithoutQuery(request.URL),
+			ATTRIBUTE_SERVER:      request.URL.Hostname(),
+		}
+		if options.route != "" {
+			attributes[ATTRIBUTE_ROUTE] = options.route
+		}
+		var span Span
+		ctx, span = options.tracer.StartSpan(ctx, "HTTP "+request.Method, attributes)
+		endSpan = func(response *http.Response, err error) {
+			if response != nil {
+				span.SetAttributes(map[string]any{ATTRIBUTE_STATUS_CODE: response.StatusCode})
+				if err == nil && response.StatusCode >= http.StatusInternalServerError {
+					span.SetAttributes(map[string]any{ATTRIBUTE_ERROR_TYPE: fmt.Sprint(response.StatusCode)})
+				}
+			}
+			if err != nil {
+				span.SetAttributes(map[string]any{ATTRIBUTE_ERROR_TYPE: errorType(err)})
+			}
+			span.End(err)
+		}
+	}
+	injectTraceContext(ctx, request.Header)
+	return ctx, endSpan
+}
+
+func injectTraceContext(ctx context.Context, header http.Header) {
+	if spanContext, isFound := SpanContextFromContext(ctx); isFound && header.Get(TRACEPARENT_HEADER) == "" {
+		header.Set(TRACEPARENT_HEADER, spanContext.Traceparent())
+		if spanContext.TraceState != "" {
+			header.Set(TRACESTATE_HEADER, spanContext.TraceState)
+		}
+	}
+	if members := BaggageFromContext(ctx); len(members) > 0 && header.Get(BAGGAGE_HEADER) == "" {
+		header.Set(BAGGAGE_HEADER, encodeBaggage(members))
+	}
+}
+
+// Encodes the members as defined by the W3C Baggage specification,
+// percent-encoding the values
+func encodeBaggage(members map[string]string) string {
+	keys := make([]string, 0, len(members))
+	for key := range members {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	encoded := make([]string, 0, len(keys))
+	for _, key := range keys {
+		encoded = append(encoded, key+"="+url.PathEscape(members[key]))
+	}
+	return strings.Join(encoded, ",")
+}
+
+// Returns a low cardinality description of the error
+func errorType(err error) string {
+	switch {
+	case errors.Is(err, ErrTimeout), errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	default:
+		return fmt.Sprintf("%T", err)
+	}
+}
@@ -0,0 +1,208 @@
+package http_proxy_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	http_proxy "github.com/AndreaCostanzo1/http-proxy/http_proxy"
+)
+
+type recordedSpan struct {
+	name       string
+	parent     http_proxy.SpanContext
+	context    http_proxy.SpanContext
+	attributes map[string]any
+	err        error
+	ended      bool
+}
+
+func (span *recordedSpan) SetAttributes(attributes map[string]any) {
+	for key, value := range attributes {
+		span.attributes[key] = value
+	}
+}
+
+func (span *recordedSpan) End(err error) {
+	span.err = err
+	span.ended = true
+}
+
+// A tracer keeping the started spans, whose IDs are derived from a counter
+type recordingTracer struct {
+	mutex sync.Mutex
+	spans []*recordedSpan
+}
+
+func (tracer *recordingTracer) StartSpan(ctx context.Context, name string, attributes map[string]any) (context.Context, http_proxy.Span) {
+	tracer.mutex.Lock()
+	defer tracer.mutex.Unlock()
+	parent, _ := http_proxy.SpanContextFromContext(ctx)
+	spanContext := http_proxy.SpanContext{TraceID: parent.TraceID, Flags: parent.Flags, TraceState: parent.TraceState}
+	spanContext.SpanID[7] = byte(len(tracer.spans) + 1)
+	if spanContext.TraceID == [16]byte{} {
+		spanContext.TraceID[15] = 1
+	}
+	span := &recordedSpan{name: name, parent: parent, context: spanContext, attributes: attributes}
+	tracer.spans = append(tracer.spans, span)
+	return http_proxy.ContextWithSpanContext(ctx, spanContext), span
+}
+
+func traceHeadersServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, name := range []string{"Traceparent", "Tracestate", "Baggage"} {
+			w.Header().Set("X-Echo-"+name, r.Header.Get(name))
+		}
+		if r.URL.Path == "/broken" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+}
+
+func TestTraceContextPropagation(t *testing.T) {
+	parent, _ := http_proxy.ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	parent.TraceState = "vendor=value"
+
+	t.Run("Headers are derived from the context", func(t *testing.T) {
+		server := traceHeadersServer()
+		defer server.Close()
+		ctx := http_proxy.ContextWithSpanContext(context.Background(), parent)
+		ctx = http_proxy.ContextWithBaggage(ctx, map[string]string{"tenant": "acme"})
+		ctx = http_proxy.ContextWithBaggage(ctx, map[string]string{"user": "Ada Lovelace"})
+
+		resp, _ := sendAndRead(t, http_proxy.NewRequest("GET", server.URL).WithContext(ctx))
+
+		if value := resp.Header.Get("X-Echo-Traceparent"); value != "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01" {
+			t.Errorf("expected the parent traceparent, got '%s'", value)
+		}
+		if value := resp.Header.Get("X-Echo-Tracestate"); value != "vendor=value" {
+			t.Errorf("expected tracestate 'vendor=value', got '%s'", value)
+		}
+		if value := resp.Header.Get("X-Echo-Baggage"); value != "tenant=acme,user=Ada%20Lovelace" {
+			t.Errorf("expected baggage 'tenant=acme,user=Ada%%20Lovelace', got '%s'", value)
+		}
+	})
+
+	t.Run("Explicit headers are not replaced", func(t *testing.T) {
+		server := traceHeadersServer()
+		defer server.Close()
+
+		resp, _ := sendAndRead(t, http_proxy.NewRequest("GET", server.URL).
+			WithContext(http_proxy.ContextWithSpanContext(context.Background(), parent)).
+			SetHeader("traceparent", "00-11111111111111111111111111111111-2222222222222222-00"))
+
+		if value := resp.Header.Get("X-Echo-Traceparent"); value != "00-11111111111111111111111111111111-2222222222222222-00" {
+			t.Errorf("expected the explicit traceparent, got '%s'", value)
+		}
+	})
+
+	t.Run("Nothing is injected without a span context", func(t *testing.T) {
+		server := traceHeadersServer()
+		defer server.Close()
+
+		resp, _ := sendAndRead(t, http_proxy.NewRequest("GET", server.URL))
+
+		if value := resp.Header.Get("X-Echo-Traceparent"); value != "" {
+			t.Errorf("expected no traceparent, got '%s'", value)
+		}
+	})
+}
+
+func TestWithTracer(t *testing.T) {
+	parent, _ := http_proxy.ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+	t.Run("Each send is a child span propagated to the server", func(t *testing.T) {
+		server := traceHeadersServer()
+		defer server.Close()
+		tracer := &recordingTracer{}
+
+		resp, _ := sendAndRead(t, http_proxy.NewRequest("GET", server.URL+"/users/1?secret=1").
+			WithContext(http_proxy.ContextWithSpanContext(context.Background(), parent)).
+			WithRoute("/users/{id}").
+			WithTracer(tracer))
+
+		if len(tracer.spans) != 1 {
+			t.Fatalf("expected 1 span, got %d", len(tracer.spans))
+		}
+		span := tracer.spans[0]
+		if span.name != "HTTP GET" || span.parent != parent || !span.ended || span.err != nil {
+			t.Errorf("expected an ended child span of the parent, got %+v", span)
+		}
+		if value := resp.Header.Get("X-Echo-Traceparent"); value != span.context.Traceparent() {
+			t.Errorf("expected traceparent of the child span %s, got '%s'", span.context.Traceparent(), value)
+		}
+		expectedAttributes := map[string]any{
+			http_proxy.ATTRIBUTE_HTTP_METHOD: "GET",
+			http_proxy.ATTRIBUTE_URL:         server.URL + "/users/1",
+			http_proxy.ATTRIBUTE_ROUTE:       "/users/{id}",
+			http_proxy.ATTRIBUTE_STATUS_CODE: 200,
+		}
+		for key, expected := range expectedAttributes {
+			if span.attributes[key] != expected {
+				t.Errorf("expected attribute %s = %v, got %v", key, expected, span.attributes[key])
+			}
+		}
+	})
+
+	t.Run("Failures are reported on the span", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(100 * time.Millisecond)
+		}))
+		defer server.Close()
+		tracer := &recordingTracer{}
+
+		_, err := http_proxy.NewRequest("GET", server.URL).WithTracer(tracer).WithTimeout(10 * time.Millisecond).Send()
+
+		span := tracer.spans[0]
+		if !errors.Is(span.err, http_proxy.ErrTimeout) || err == nil {
+			t.Errorf("expected the span to end with the timeout, got %v", span.err)
+		}
+		if span.attributes[http_proxy.ATTRIBUTE_ERROR_TYPE] != "timeout" {
+			t.Errorf("expected error type 'timeout', got %v", span.attributes[http_proxy.ATTRIBUTE_ERROR_TYPE])
+		}
+	})
+
+	t.Run("Server errors are reported on the span", func(t *testing.T) {
+		server := traceHeadersServer()
+		defer server.Close()
+		tracer := &recordingTracer{}
+
+		sendAndRead(t, http_proxy.NewRequest("GET", server.URL+"/broken").WithTracer(tracer))
+
+		if value := tracer.spans[0].attributes[http_proxy.ATTRIBUTE_ERROR_TYPE]; value != "500" {
+			t.Errorf("expected error type '500', got %v", value)
+		}
+	})
+}
+
+func TestParseTraceparent(t *testing.T) {
+	invalidValues := []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e47-00f067aa0ba902b7-01",
+	}
+	for _, value := range invalidValues {
+		t.Run("Invalid "+value, func(t *testing.T) {
+			if _, err := http_proxy.ParseTraceparent(value); !errors.Is(err, http_proxy.ErrInvalidTraceparent) {
+				t.Errorf("expected ErrInvalidTraceparent, got %v", err)
+			}
+		})
+	}
+
+	t.Run("Future versions may have more fields", func(t *testing.T) {
+		spanContext, err := http_proxy.ParseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra")
+
+		if err != nil || spanContext.Flags != 1 {
+			t.Errorf("expected a sampled span context, got %+v and %v", spanContext, err)
+		}
+	})
+}
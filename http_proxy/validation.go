@@ -0,0 +1,74 @@
+package http_proxy
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+var (
+	ErrRequestAlreadyGenerated = errors.New("tried to modify request proxy after generating the underlying request")
+	ErrInvalidMethod           = errors.New("invalid method")
+	ErrInvalidURL              = errors.New("invalid url")
+	ErrInvalidHeader           = errors.New("invalid header")
+)
+
+// Records an error produced while building the request. All the recorded
+// errors are returned together when the request is generated or sent
+func (requestIntent *proxiedRequestImpl) recordError(call string, err error) {
+	requestIntent.requestErrors = append(requestIntent.requestErrors, fmt.Errorf("%s: %w", call, err))
+}
+
+func (requestIntent *proxiedRequestImpl) buildError() error {
+	return errors.Join(requestIntent.requestErrors...)
+}
+
+func (requestIntent *proxiedRequestImpl) verifyUnderlyingRequestNotGenerated(call string) {
+	if requestIntent.underlyingRequest != nil {
+		requestIntent.recordError(call, ErrRequestAlreadyGenerated)
+	}
+}
+
+func validateMethod(method string) error {
+	if method == "" || strings.IndexFunc(method, isNotTokenRune) != -1 {
+		return fmt.Errorf("%w %q", ErrInvalidMethod, method)
+	}
+	return nil
+}
+
+func validateURL(rawURL string) error {
+	parsedURL, parseErr := url.Parse(rawURL)
+	if parseErr != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidURL, parseErr)
+	}
+	if parsedURL.Scheme == "" || parsedURL.Host == "" {
+		return fmt.Errorf("%w %q: scheme and host are required", ErrInvalidURL, rawURL)
+	}
+	return nil
+}
+
+func validateHeader(key string, values ...string) error {
+	if key == "" || strings.IndexFunc(key, isNotTokenRune) != -1 {
+		return fmt.Errorf("%w name %q", ErrInvalidHeader, key)
+	}
+	for _, value := range values {
+		if strings.IndexFunc(value, isForbiddenHeaderValueRune) != -1 {
+			return fmt.Errorf("%w value %q for %q", ErrInvalidHeader, value, key)
+		}
+	}
+	return nil
+}
+
+// Reports whether the rune is not a tchar as defined by RFC 9110
+func isNotTokenRune(r rune) bool {
+	if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+		return false
+	}
+	return !strings.ContainsRune("!#$%&'*+-.^_`|~", r)
+}
+
+// Reports whether the rune is a control character other than horizontal tab
+func isForbiddenHeaderValueRune(r rune) bool {
+	return r != '\t' && (r < ' ' || r == 0x7f)
+}
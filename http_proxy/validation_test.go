@@ -0,0 +1,102 @@
+package http_proxy_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	http_proxy "github.com/AndreaCostanzo1/http-proxy/http_proxy"
+)
+
+func TestRequestErrorsAggregation(t *testing.T) {
+	t.Run("Failed SetJSONBody is not cleared by a later successful one", func(t *testing.T) {
+		req := http_proxy.NewRequest("POST", "http://localhost")
+		req.SetJSONBody(map[string]interface{}{"key": make(chan int)})
+		req.SetJSONBody(map[string]string{"key": "value"})
+		_, err := req.UnderlyingRequest()
+
+		if err == nil || !strings.Contains(err.Error(), "SetJSONBody") {
+			t.Errorf("expected SetJSONBody error, got %v", err)
+		}
+	})
+
+	t.Run("All builder errors are reported with the call that produced them", func(t *testing.T) {
+		req := http_proxy.NewRequest("GET", "http://localhost")
+		req.SetHeader("Invalid Header", "value")
+		req.SetJSONBody(map[string]interface{}{"key": make(chan int)})
+		req.UnderlyingRequest()
+		req.AddHeader("X-Custom-Header", "value")
+		resp, err := req.Send()
+
+		if resp != nil {
+			t.Errorf("expected no response, got %v", resp)
+		}
+		if !errors.Is(err, http_proxy.ErrInvalidHeader) {
+			t.Errorf("expected ErrInvalidHeader, got %v", err)
+		}
+		for _, call := range []string{"SetHeader", "SetJSONBody"} {
+			if err == nil || !strings.Contains(err.Error(), call) {
+				t.Errorf("expected error produced by %s, got %v", call, err)
+			}
+		}
+	})
+
+	t.Run("Modifying a generated request is reported", func(t *testing.T) {
+		req := http_proxy.NewRequest("GET", "http://localhost")
+		req.UnderlyingRequest()
+		req.SetHeader("X-Custom-Header", "value")
+		req.SetBody(strings.NewReader("test body"))
+		_, err := req.UnderlyingRequest()
+
+		if !errors.Is(err, http_proxy.ErrRequestAlreadyGenerated) {
+			t.Errorf("expected ErrRequestAlreadyGenerated, got %v", err)
+		}
+		for _, call := range []string{"SetHeader", "SetBody"} {
+			if err == nil || !strings.Contains(err.Error(), call) {
+				t.Errorf("expected error produced by %s, got %v", call, err)
+			}
+		}
+	})
+}
+
+func TestRequestValidation(t *testing.T) {
+	cases := []struct {
+		name          string
+		build         func() http_proxy.ProxiedRequest
+		expectedError error
+	}{
+		{"empty method", func() http_proxy.ProxiedRequest { return http_proxy.NewRequest("", "http://localhost") }, http_proxy.ErrInvalidMethod},
+		{"method with spaces", func() http_proxy.ProxiedRequest { return http_proxy.NewRequest("GE T", "http://localhost") }, http_proxy.ErrInvalidMethod},
+		{"relative url", func() http_proxy.ProxiedRequest { return http_proxy.NewRequest("GET", "/path") }, http_proxy.ErrInvalidURL},
+		{"malformed url", func() http_proxy.ProxiedRequest { return http_proxy.NewRequest("GET", "http://local host:port") }, http_proxy.ErrInvalidURL},
+		{"header value with newline", func() http_proxy.ProxiedRequest {
+			return http_proxy.NewRequest("GET", "http://localhost").SetHeader("X-Custom-Header", "value\r\nX-Injected: true")
+		}, http_proxy.ErrInvalidHeader},
+		{"empty header name", func() http_proxy.ProxiedRequest {
+			return http_proxy.NewRequest("GET", "http://localhost").AddHeader("", "value")
+		}, http_proxy.ErrInvalidHeader},
+		{"invalid header in SetHeaders", func() http_proxy.ProxiedRequest {
+			return http_proxy.NewRequest("GET", "http://localhost").SetHeaders(map[string]string{"X:Header": "value"})
+		}, http_proxy.ErrInvalidHeader},
+		{"invalid value in SetMultiValueHeaders", func() http_proxy.ProxiedRequest {
+			return http_proxy.NewRequest("GET", "http://localhost").SetMultiValueHeaders(map[string][]string{"X-Header": {"ok", "not\x00ok"}})
+		}, http_proxy.ErrInvalidHeader},
+	}
+	for _, testCase := range cases {
+		t.Run("Validation rejects "+testCase.name, func(t *testing.T) {
+			_, err := testCase.build().UnderlyingRequest()
+
+			if !errors.Is(err, testCase.expectedError) {
+				t.Errorf("expected %v, got %v", testCase.expectedError, err)
+			}
+		})
+	}
+
+	t.Run("Validation accepts tabs in header values", func(t *testing.T) {
+		_, err := http_proxy.NewRequest("GET", "http://localhost").SetHeader("X-Custom-Header", "a\tb").UnderlyingRequest()
+
+		if err != nil {
+			t.Errorf("expected no error, got %v", err)
+		}
+	})
+}